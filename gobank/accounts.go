@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// accountSorts compares two accounts on each field the list can be sorted by.
+// Ties are broken on ID, so every sort is a total order and a cursor always
+// lands in the same place.
+var accountSorts = map[string]func(a, b *Account) int{
+	"id": func(a, b *Account) int { return 0 },
+	"name": func(a, b *Account) int {
+		return strings.Compare(sortName(a), sortName(b))
+	},
+	"status": func(a, b *Account) int {
+		return strings.Compare(string(a.Status), string(b.Status))
+	},
+	"balance": func(a, b *Account) int {
+		return compareInt64(a.Balance, b.Balance)
+	},
+	"createdAt": func(a, b *Account) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	},
+}
+
+func sortName(a *Account) string {
+	return strings.ToLower(a.LastName + " " + a.FirstName)
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// AccountQuery filters, sorts and pages the account list. Zero values don't
+// filter.
+type AccountQuery struct {
+	// Owner limits the list to one principal's accounts.
+	Owner      string
+	CustomerID int
+	// NamePrefix matches the start of the first name, last name or full name,
+	// ignoring case.
+	NamePrefix    string
+	Status        []AccountStatus
+	MinBalance    *int64
+	MaxBalance    *int64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          string
+	Desc          bool
+	Limit         int
+	// After is the cursor of the last account on the previous page.
+	After        *AccountCursor
+	IncludeTotal bool
+}
+
+func (q *AccountQuery) matches(a *Account) bool {
+	if q.Owner != "" && a.Owner != q.Owner {
+		return false
+	}
+	if q.CustomerID != 0 && a.CustomerID != q.CustomerID {
+		return false
+	}
+	if q.NamePrefix != "" {
+		prefix := strings.ToLower(q.NamePrefix)
+		first, last := strings.ToLower(a.FirstName), strings.ToLower(a.LastName)
+		if !strings.HasPrefix(first, prefix) && !strings.HasPrefix(last, prefix) && !strings.HasPrefix(first+" "+last, prefix) {
+			return false
+		}
+	}
+	if len(q.Status) > 0 {
+		found := false
+		for _, s := range q.Status {
+			found = found || a.Status == s
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.MinBalance != nil && a.Balance < *q.MinBalance {
+		return false
+	}
+	if q.MaxBalance != nil && a.Balance > *q.MaxBalance {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !a.CreatedAt.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !a.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// compare orders two accounts by the query's sort.
+func (q *AccountQuery) compare(a, b *Account) int {
+	c := accountSorts[q.Sort](a, b)
+	if c == 0 {
+		c = compareInt64(int64(a.ID), int64(b.ID))
+	}
+	if q.Desc {
+		c = -c
+	}
+	return c
+}
+
+// AccountCursor marks a position in a sorted list: the sort key and ID of the
+// last account returned. The next page starts after it, wherever new
+// accounts have been inserted in the meantime.
+type AccountCursor struct {
+	Sort      string        `json:"s"`
+	Desc      bool          `json:"d,omitempty"`
+	ID        int           `json:"id"`
+	FirstName string        `json:"f,omitempty"`
+	LastName  string        `json:"l,omitempty"`
+	Status    AccountStatus `json:"st,omitempty"`
+	Balance   int64         `json:"b,omitempty"`
+	CreatedAt time.Time     `json:"c"`
+}
+
+func newAccountCursor(q *AccountQuery, a *Account) *AccountCursor {
+	return &AccountCursor{
+		Sort:      q.Sort,
+		Desc:      q.Desc,
+		ID:        a.ID,
+		FirstName: a.FirstName,
+		LastName:  a.LastName,
+		Status:    a.Status,
+		Balance:   a.Balance,
+		CreatedAt: a.CreatedAt,
+	}
+}
+
+// account returns a stand-in account that sorts where the cursor points.
+func (c *AccountCursor) account() *Account {
+	return &Account{
+		ID:        c.ID,
+		FirstName: c.FirstName,
+		LastName:  c.LastName,
+		Status:    c.Status,
+		Balance:   c.Balance,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+func (c *AccountCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAccountCursor(s string) (*AccountCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor given %s", s)
+	}
+	c := new(AccountCursor)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor given %s", s)
+	}
+	return c, nil
+}
+
+type AccountPage struct {
+	Accounts []*Account `json:"accounts"`
+	// NextCursor fetches the next page. It is empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+	// Total counts every account matching the filters, when asked for.
+	Total *int `json:"total,omitempty"`
+}
+
+// parseAccountQuery reads the list parameters from the query string.
+func parseAccountQuery(r *http.Request) (*AccountQuery, error) {
+	params := r.URL.Query()
+	q := &AccountQuery{
+		NamePrefix: params.Get("name"),
+		Sort:       "id",
+		Limit:      defaultPageSize,
+	}
+	if v := params.Get("status"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			status := AccountStatus(s)
+			if _, ok := accountTransitions[status]; !ok {
+				return nil, fmt.Errorf("unknown status %s", s)
+			}
+			q.Status = append(q.Status, status)
+		}
+	}
+	for name, dst := range map[string]**int64{"minBalance": &q.MinBalance, "maxBalance": &q.MaxBalance} {
+		if v := params.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s given %s", name, v)
+			}
+			*dst = &n
+		}
+	}
+	for name, dst := range map[string]*time.Time{"createdAfter": &q.CreatedAfter, "createdBefore": &q.CreatedBefore} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s given %s", name, v)
+			}
+			*dst = t
+		}
+	}
+	if v := params.Get("sort"); v != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(v, "-"), strings.HasPrefix(v, "-")
+		if _, ok := accountSorts[q.Sort]; !ok {
+			return nil, fmt.Errorf("cannot sort on %s", q.Sort)
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = n
+	}
+	if v := params.Get("cursor"); v != "" {
+		c, err := decodeAccountCursor(v)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != q.Sort || c.Desc != q.Desc {
+			return nil, fmt.Errorf("cursor is for a different sort")
+		}
+		q.After = c
+	}
+	q.IncludeTotal = params.Get("total") == "true"
+	return q, nil
+}
+
+// handleListAccounts lists accounts. Roles that may only read their own
+// accounts only see those.
+func (s *APIServer) handleListAccounts(w http.ResponseWriter, r *http.Request) error {
+	q, err := parseAccountQuery(r)
+	if err != nil {
+		return err
+	}
+	p := principalFrom(r)
+	if rolePermissions[p.Role][PermReadAccount] != scopeAny {
+		q.Owner = p.Subject
+	} else {
+		q.Owner = r.URL.Query().Get("owner")
+	}
+	page, err := s.storage(r).ListAccounts(q)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// AccountPatch is the set of changes in a JSON Merge Patch (RFC 7396) of an
+// account. Only the fields below can be changed; a nil field is left alone.
+// Names belong to the customer and are changed there.
+type AccountPatch struct {
+	// Product is set to the empty string when the patch clears it.
+	Product *string
+}
+
+func (p *AccountPatch) apply(a *Account) {
+	if p.Product != nil {
+		a.Product = *p.Product
+	}
+}
+
+// parseAccountPatch reads a merge patch, rejecting fields that can't be
+// changed this way.
+func parseAccountPatch(r io.Reader) (*AccountPatch, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&fields); err != nil {
+		return nil, err
+	}
+	p := &AccountPatch{}
+	for name, raw := range fields {
+		switch name {
+		case "product":
+		case "firstName", "lastName":
+			return nil, fmt.Errorf("field %s is changed on the account's customer", name)
+		default:
+			return nil, fmt.Errorf("field %s cannot be changed", name)
+		}
+		v := ""
+		if string(raw) != "null" {
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+		p.Product = &v
+	}
+	return p, nil
+}
+
+func accountETag(a *Account) string {
+	return fmt.Sprintf("\"%d\"", a.Version)
+}
+
+// ifMatchVersion reads the version to change a resource at from the If-Match
+// header, which is required on requests that change an account or customer
+// through its resource. "*" matches any current version and gives zero. A
+// list naming more than one version is matched against the version current
+// returns. Weak tags never match: If-Match compares strongly.
+func ifMatchVersion(r *http.Request, current func() (int, error)) (int, error) {
+	v := r.Header.Get("If-Match")
+	if v == "" {
+		return 0, httpError{Status: http.StatusPreconditionRequired, Msg: "If-Match header is required"}
+	}
+	failed := httpError{Status: http.StatusPreconditionFailed, Msg: fmt.Sprintf("If-Match %s does not match", v)}
+	if strings.TrimSpace(v) == "*" {
+		return 0, nil
+	}
+	var versions []int
+	for _, tag := range strings.Split(v, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			return 0, failed
+		}
+		// The ETag of a compressed or non-JSON body has the representation
+		// after the version; see representationETag.
+		tag, _, _ = strings.Cut(tag[1:len(tag)-1], "-")
+		version, err := strconv.Atoi(tag)
+		if err != nil || version < 1 {
+			return 0, failed
+		}
+		if !slices.Contains(versions, version) {
+			versions = append(versions, version)
+		}
+	}
+	switch len(versions) {
+	case 0:
+		return 0, failed
+	case 1:
+		return versions[0], nil
+	}
+	version, err := current()
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(versions, version) {
+		return 0, failed
+	}
+	// The store still checks nothing changed it since.
+	return version, nil
+}
+
+// accountVersion returns a func giving the account's current version, for
+// ifMatchVersion.
+func (s *APIServer) accountVersion(r *http.Request, id int) func() (int, error) {
+	return func() (int, error) {
+		acc, err := s.storage(r).GetAccountByID(id)
+		if err != nil {
+			return 0, err
+		}
+		return acc.Version, nil
+	}
+}
+
+func (s *APIServer) handlePatchAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	ifVersion, err := ifMatchVersion(r, s.accountVersion(r, id))
+	if err != nil {
+		return err
+	}
+	patch, err := parseAccountPatch(r.Body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if p := patch.Product; p != nil && *p != "" {
+		if _, ok := s.products[*p]; !ok {
+			return fmt.Errorf("unknown product %s", *p)
+		}
+	}
+
+	change, err := s.storage(r).PatchAccount(id, patch, ifVersion)
+	if errors.Is(err, ErrVersionConflict) {
+		return httpError{Status: http.StatusPreconditionFailed, Msg: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	s.recordAudit(r, "account.update", id, change.Before, change.After)
+	w.Header().Set("ETag", accountETag(change.After))
+	return WriteJSON(w, http.StatusOK, change.After)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listAccounts(t *testing.T, server *APIServer, p Principal, query string) *AccountPage {
+	t.Helper()
+	token, err := createJWT(p, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/accounts?"+query, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /accounts?%s: %d %s", query, rec.Code, rec.Body)
+	}
+	page := new(AccountPage)
+	if err := json.NewDecoder(rec.Body).Decode(page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func accountIDs(page *AccountPage) []int {
+	ids := []int{}
+	for _, a := range page.Accounts {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newListFixture(t *testing.T) (*MemoryStore, *APIServer) {
+	t.Helper()
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	for i, a := range []Account{
+		{FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Balance: 500, Status: StatusActive},
+		{FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Balance: 50, Status: StatusFrozen},
+		{FirstName: "Grace", LastName: "Hopper", Owner: "bob", Balance: 900, Status: StatusActive},
+		{FirstName: "Adele", LastName: "Goldberg", Owner: "carol", Balance: 0, Status: StatusClosed},
+		{FirstName: "Barbara", LastName: "Liskov", Owner: "dave", Balance: 300, Status: StatusActive},
+	} {
+		a.ID = i + 1
+		a.CreatedAt = day.AddDate(0, 0, i)
+		store.CreateAccount(&a)
+	}
+	return store, NewAPIServer("", store, NewAuditLog())
+}
+
+func TestListAccountsFiltersAndSorts(t *testing.T) {
+	_, server := newListFixture(t)
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 2, 3, 4, 5}},
+		{"name=ad", []int{1, 2, 4}},
+		{"name=grace%20h", []int{3}},
+		{"status=active,frozen", []int{1, 2, 3, 5}},
+		{"minBalance=100&maxBalance=600", []int{1, 5}},
+		{"createdAfter=2026-01-02T00:00:00Z&createdBefore=2026-01-05T00:00:00Z", []int{3, 4}},
+		{"sort=-balance", []int{3, 1, 5, 2, 4}},
+		{"sort=name", []int{4, 3, 5, 1, 2}},
+		{"sort=status&status=active,closed", []int{1, 3, 5, 4}},
+		{"owner=alice&sort=-createdAt", []int{2, 1}},
+	}
+	for _, tt := range tests {
+		if got := accountIDs(listAccounts(t, server, admin, tt.query)); !sameIDs(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	customer := Principal{Subject: "alice", Role: RoleCustomer}
+	if got := accountIDs(listAccounts(t, server, customer, "owner=bob")); !sameIDs(got, []int{1, 2}) {
+		t.Errorf("customer saw %v, want only their own accounts", got)
+	}
+}
+
+func TestListAccountsKeysetPagination(t *testing.T) {
+	store, server := newListFixture(t)
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+
+	page := listAccounts(t, server, admin, "sort=-balance&limit=2&total=true")
+	if got := accountIDs(page); !sameIDs(got, []int{3, 1}) || page.Total == nil || *page.Total != 5 {
+		t.Fatalf("first page %v total %v", got, page.Total)
+	}
+
+	// Accounts inserted before the cursor don't shift the pages after it.
+	store.CreateAccount(&Account{ID: 6, FirstName: "Rich", Balance: 10_000, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 7, FirstName: "Mid", Balance: 400, Status: StatusActive})
+
+	page = listAccounts(t, server, admin, "sort=-balance&limit=2&cursor="+page.NextCursor)
+	if got := accountIDs(page); !sameIDs(got, []int{7, 5}) {
+		t.Fatalf("second page %v, want [7 5]", got)
+	}
+	page = listAccounts(t, server, admin, "sort=-balance&limit=2&cursor="+page.NextCursor)
+	if got := accountIDs(page); !sameIDs(got, []int{2, 4}) || page.NextCursor != "" {
+		t.Fatalf("last page %v cursor %q", got, page.NextCursor)
+	}
+}
+
+func TestPatchAccountNeedsCurrentETag(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Byron", Owner: "alice", Product: "savings", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	token, err := createJWT(Principal{Subject: "alice", Role: RoleCustomer}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, ifMatch, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/account/1", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		server.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("GET", "", "")
+	etag := rec.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("ETag %s, want \"1\"", etag)
+	}
+	if rec := do("PATCH", "", `{"product":null}`); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("PATCH without If-Match: %d", rec.Code)
+	}
+	if rec := do("PATCH", etag, `{"balance":100}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("PATCH of balance: %d", rec.Code)
+	}
+	// Names are the customer's, and only change there.
+	if rec := do("PATCH", etag, `{"lastName":"Lovelace"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("PATCH of lastName: %d", rec.Code)
+	}
+
+	rec = do("PATCH", etag, `{"product":null}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("PATCH: %d ETag %s: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	acc, _ := store.GetAccountByID(1)
+	if acc.Product != "" || acc.LastName != "Byron" {
+		t.Fatalf("patched account is %s %s with product %q", acc.FirstName, acc.LastName, acc.Product)
+	}
+
+	// The old ETag is stale now, and so is the new one once money moves.
+	if rec := do("PATCH", etag, `{"product":null}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with a stale ETag: %d", rec.Code)
+	}
+	// If-Match compares strongly, takes a list and takes "*" for any version.
+	if rec := do("PATCH", `W/"2"`, `{"product":null}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with a weak ETag: %d", rec.Code)
+	}
+	if rec := do("PATCH", `"1", "2-gzip"`, `{"product":null}`); rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"3"` {
+		t.Fatalf("PATCH with a list naming the current ETag: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("PATCH", `"1", "2"`, `{"product":null}`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with a list of stale ETags: %d", rec.Code)
+	}
+	if rec := do("PATCH", `*`, `{"product":null}`); rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"4"` {
+		t.Fatalf("PATCH with If-Match *: %d %s", rec.Code, rec.Body)
+	}
+	store.mu.Lock()
+	store.accounts[1].Balance = 10
+	store.mu.Unlock()
+	if _, _, err := store.Transfer(1, 2, 10); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do("DELETE", `"4"`, ""); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with a stale ETag: %d", rec.Code)
+	}
+	if rec := do("DELETE", `"5"`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAccountStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from   AccountStatus
+		route  string
+		to     AccountStatus
+		status int
+	}{
+		{StatusActive, "freeze", StatusFrozen, http.StatusOK},
+		{StatusActive, "unfreeze", StatusActive, http.StatusBadRequest},
+		{StatusActive, "close", StatusClosed, http.StatusOK},
+		{StatusActive, "reopen", StatusActive, http.StatusBadRequest},
+		{StatusFrozen, "freeze", StatusFrozen, http.StatusBadRequest},
+		{StatusFrozen, "unfreeze", StatusActive, http.StatusOK},
+		{StatusFrozen, "close", StatusClosed, http.StatusOK},
+		{StatusFrozen, "reopen", StatusFrozen, http.StatusBadRequest},
+		{StatusClosed, "freeze", StatusClosed, http.StatusBadRequest},
+		{StatusClosed, "unfreeze", StatusClosed, http.StatusBadRequest},
+		{StatusClosed, "close", StatusClosed, http.StatusBadRequest},
+		{StatusClosed, "reopen", StatusActive, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" "+tt.route, func(t *testing.T) {
+			store := NewMemoryStore()
+			store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: tt.from})
+			server := NewAPIServer("", store, NewAuditLog())
+			rec := customerRequest(t, server, *e2ePrincipals["admin"], "POST", "/account/1/"+tt.route, "")
+			if rec.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if acc, _ := store.GetAccountByID(1); acc.Status != tt.to {
+				t.Fatalf("account is %s, want %s", acc.Status, tt.to)
+			}
+		})
+	}
+}
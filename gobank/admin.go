@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminSessionCookie holds the ID of a dashboard session. It is only
+// honoured under /admin, so a page elsewhere can't use it to call the API.
+const adminSessionCookie = "gobank_admin"
+
+// adminLoginCookie holds the form token of the sign-in page, so another site
+// can't sign a browser in as someone else.
+const adminLoginCookie = "gobank_admin_login"
+
+// adminSessionTTL is how long a dashboard session lasts.
+const adminSessionTTL = 8 * time.Hour
+
+//go:embed admin
+var adminFiles embed.FS
+
+// adminPages are the dashboard's pages by name, each parsed with the layout.
+var adminPages = parseAdminPages()
+
+func parseAdminPages() map[string]*template.Template {
+	funcs := template.FuncMap{
+		"amount": formatAmount,
+		"date": func(t time.Time) string {
+			return t.UTC().Format("2006-01-02 15:04")
+		},
+	}
+	names, err := fs.Glob(adminFiles, "admin/templates/*.html")
+	if err != nil {
+		panic(err)
+	}
+	pages := map[string]*template.Template{}
+	for _, name := range names {
+		if path.Base(name) == "layout.html" {
+			continue
+		}
+		t := template.New("layout.html").Funcs(funcs)
+		pages[strings.TrimSuffix(path.Base(name), ".html")] = template.Must(t.ParseFS(adminFiles, "admin/templates/layout.html", name))
+	}
+	return pages
+}
+
+func isAdminPath(p string) bool {
+	return p == "/admin" || strings.HasPrefix(p, "/admin/")
+}
+
+// adminSession is a signed-in dashboard user. Sessions are kept by the
+// server, so signing out ends one for good, and each has a random token its
+// forms must carry.
+type adminSession struct {
+	principal Principal
+	csrf      string
+	expires   time.Time
+}
+
+// adminSessions are the dashboard's sessions by ID.
+type adminSessions struct {
+	mu   sync.Mutex
+	byID map[string]*adminSession
+}
+
+func newAdminSessions() *adminSessions {
+	return &adminSessions{byID: map[string]*adminSession{}}
+}
+
+// randomToken returns 32 random bytes, hex encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// start begins a session for p and returns its ID.
+func (ss *adminSessions) start(p Principal, now time.Time) (string, *adminSession) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for id, sess := range ss.byID {
+		if !now.Before(sess.expires) {
+			delete(ss.byID, id)
+		}
+	}
+	id := randomToken()
+	sess := &adminSession{principal: p, csrf: randomToken(), expires: now.Add(adminSessionTTL)}
+	ss.byID[id] = sess
+	return id, sess
+}
+
+// get returns the session with id, or nil if there is none or it has
+// expired.
+func (ss *adminSessions) get(id string, now time.Time) *adminSession {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	sess, ok := ss.byID[id]
+	if !ok {
+		return nil
+	}
+	if !now.Before(sess.expires) {
+		delete(ss.byID, id)
+		return nil
+	}
+	return sess
+}
+
+func (ss *adminSessions) end(id string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.byID, id)
+}
+
+// session returns the dashboard session of a request, or nil.
+func (s *APIServer) session(r *http.Request) *adminSession {
+	if !isAdminPath(r.URL.Path) {
+		return nil
+	}
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return nil
+	}
+	return s.sessions.get(c.Value, s.clock.Now())
+}
+
+// sessionPrincipal authenticates a dashboard request by its session cookie.
+// A missing or expired session leaves the request anonymous, so the
+// dashboard can send it to sign in.
+func (s *APIServer) sessionPrincipal(r *http.Request) *Principal {
+	sess := s.session(r)
+	if sess == nil {
+		return nil
+	}
+	p := sess.principal
+	return &p
+}
+
+// adminCookie is a cookie for the dashboard. It is Secure when the request
+// came over TLS or the server is told its callers always use HTTPS, as they
+// do behind a proxy that terminates TLS.
+func (s *APIServer) adminCookie(r *http.Request, name, value, path string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.secureCookies || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// formToken is the token the forms on a page must carry. Signed-in users
+// get their session's. Users signed in by client certificate are given a
+// session for it, and anonymous users, who can only sign in, the token in
+// their sign-in cookie.
+func (s *APIServer) formToken(w http.ResponseWriter, r *http.Request) string {
+	if sess := s.session(r); sess != nil {
+		return sess.csrf
+	}
+	if p := principalFrom(r); p != nil {
+		id, sess := s.sessions.start(*p, s.clock.Now())
+		http.SetCookie(w, s.adminCookie(r, adminSessionCookie, id, "/admin", int(adminSessionTTL/time.Second)))
+		return sess.csrf
+	}
+	if c, err := r.Cookie(adminLoginCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := randomToken()
+	http.SetCookie(w, s.adminCookie(r, adminLoginCookie, token, "/admin/login", 0))
+	return token
+}
+
+// adminView is what every dashboard page is rendered with.
+type adminView struct {
+	Principal *Principal
+	Tenant    *Tenant
+	CSRF      string
+	// Page is the page's own data.
+	Page any
+}
+
+// Can reports whether the signed-in principal has perm, for pages to decide
+// which actions to offer.
+func (v adminView) Can(perm string) bool {
+	if v.Principal == nil {
+		return false
+	}
+	_, ok := rolePermissions[v.Principal.Role][Permission(perm)]
+	return ok
+}
+
+// renderAdmin renders a dashboard page. It is rendered in full before
+// anything is written, so a template error still gets a proper status.
+func (s *APIServer) renderAdmin(w http.ResponseWriter, r *http.Request, status int, page string, data any) {
+	v := adminView{Principal: principalFrom(r), Tenant: s.tenant(r), Page: data}
+	v.CSRF = s.formToken(w, r)
+	var buf bytes.Buffer
+	if err := adminPages[page].Execute(&buf, v); err != nil {
+		log.Printf("rendering admin page %s: %v", page, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// adminPage is the dashboard's makeHTTPHandleFunc. Anonymous callers are sent
+// to sign in, everyone else needs PermUseDashboard, and forms must carry the
+// session's CSRF token. Errors are rendered as a page.
+func (s *APIServer) adminPage(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := checkPermission(r, PermUseDashboard)
+		if err == nil && r.Method == "POST" {
+			err = s.checkCSRF(r)
+		}
+		if err == nil {
+			err = f(w, r)
+		}
+		if err == nil {
+			return
+		}
+		status := http.StatusBadRequest
+		var herr httpError
+		if errors.As(err, &herr) {
+			status = herr.Status
+		}
+		if status == http.StatusUnauthorized {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+		s.renderAdmin(w, r, status, "error", err.Error())
+	}
+}
+
+// checkCSRF checks that a form carries the token of the session it was
+// posted in. Callers signed in without a session have never been shown a
+// form, so theirs can't be genuine.
+func (s *APIServer) checkCSRF(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	sess := s.session(r)
+	if sess == nil || !hmac.Equal([]byte(r.PostForm.Get("csrf")), []byte(sess.csrf)) {
+		return denied(r, http.StatusForbidden, "form token is missing or out of date")
+	}
+	return nil
+}
+
+// adminRoutes adds the dashboard to router. Its pages check permissions
+// like the API does, so support staff can look but only admins can change
+// anything.
+func (s *APIServer) adminRoutes(router *mux.Router) {
+	static, err := fs.Sub(adminFiles, "admin")
+	if err != nil {
+		panic(err)
+	}
+	router.PathPrefix("/admin/static/").Handler(http.StripPrefix("/admin/", http.FileServer(http.FS(static))))
+
+	router.HandleFunc("/admin/login", s.handleAdminLogin)
+	router.HandleFunc("/admin/logout", s.adminPage(s.authorize(routePermissions{
+		"POST": PermUseDashboard,
+	}, s.handleAdminLogout)))
+	router.Handle("/admin", http.RedirectHandler("/admin/accounts", http.StatusSeeOther))
+	router.Handle("/admin/", http.RedirectHandler("/admin/accounts", http.StatusSeeOther))
+	router.HandleFunc("/admin/accounts", s.adminPage(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleAdminAccounts)))
+	router.HandleFunc("/admin/accounts/{id}", s.adminPage(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleAdminAccount)))
+	router.HandleFunc("/admin/accounts/{id}/freeze", s.adminPage(s.authorize(routePermissions{
+		"POST": PermFreezeAccount,
+	}, s.handleAdminAccountStatus(StatusActive, StatusFrozen))))
+	router.HandleFunc("/admin/accounts/{id}/unfreeze", s.adminPage(s.authorize(routePermissions{
+		"POST": PermFreezeAccount,
+	}, s.handleAdminAccountStatus(StatusFrozen, StatusActive))))
+	router.HandleFunc("/admin/reviews", s.adminPage(s.authorize(routePermissions{
+		"GET": PermReadReviews,
+	}, s.handleAdminReviews)))
+	router.HandleFunc("/admin/reviews/{reviewId}/approve", s.adminPage(s.authorize(routePermissions{
+		"POST": PermResolveReviews,
+	}, s.handleAdminResolveReview(ReviewApproved))))
+	router.HandleFunc("/admin/reviews/{reviewId}/reject", s.adminPage(s.authorize(routePermissions{
+		"POST": PermResolveReviews,
+	}, s.handleAdminResolveReview(ReviewRejected))))
+}
+
+// handleAdminLogin signs a user in to the dashboard with a token, such as
+// one from `gobank token`, and starts a session for them. Users with a client
+// certificate are signed in already.
+func (s *APIServer) handleAdminLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		if principalFrom(r) != nil {
+			http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+			return
+		}
+		s.renderAdmin(w, r, http.StatusOK, "login", "")
+		return
+	}
+	c, err := r.Cookie(adminLoginCookie)
+	if err != nil || c.Value == "" || !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(c.Value)) {
+		denied(r, http.StatusForbidden, "sign-in form token is missing or out of date")
+		s.renderAdmin(w, r, http.StatusForbidden, "login", "The sign-in form has expired. Please try again.")
+		return
+	}
+	token := strings.TrimSpace(r.PostFormValue("token"))
+	p, err := validateJWT(token)
+	if err != nil {
+		s.renderAdmin(w, r, http.StatusUnauthorized, "login", "That token is not valid.")
+		return
+	}
+	tenant := p.Tenant
+	if tenant == "" {
+		tenant = defaultTenantID
+	}
+	if _, ok := rolePermissions[p.Role][PermUseDashboard]; !ok || tenant != s.tenant(r).ID {
+		denied(r, http.StatusForbidden, fmt.Sprintf("dashboard sign-in by %s role=%s tenant=%s", p.Subject, p.Role, tenant))
+		s.renderAdmin(w, r, http.StatusForbidden, "login", "That token can't be used for the dashboard of this bank.")
+		return
+	}
+	// Any session the browser had is replaced, so one planted before sign-in
+	// can't be carried into it.
+	if old, err := r.Cookie(adminSessionCookie); err == nil {
+		s.sessions.end(old.Value)
+	}
+	id, _ := s.sessions.start(*p, s.clock.Now())
+	http.SetCookie(w, s.adminCookie(r, adminSessionCookie, id, "/admin", int(adminSessionTTL/time.Second)))
+	http.SetCookie(w, s.adminCookie(r, adminLoginCookie, "", "/admin/login", -1))
+	http.Redirect(w, r, "/admin/accounts", http.StatusSeeOther)
+}
+
+func (s *APIServer) handleAdminLogout(w http.ResponseWriter, r *http.Request) error {
+	if c, err := r.Cookie(adminSessionCookie); err == nil {
+		s.sessions.end(c.Value)
+	}
+	http.SetCookie(w, s.adminCookie(r, adminSessionCookie, "", "/admin", -1))
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	return nil
+}
+
+// adminAccounts is the data of the account search page.
+type adminAccounts struct {
+	Name     string
+	Status   string
+	Statuses []AccountStatus
+	*AccountPage
+}
+
+func (s *APIServer) handleAdminAccounts(w http.ResponseWriter, r *http.Request) error {
+	q, err := parseAccountQuery(r)
+	if err != nil {
+		return err
+	}
+	page, err := s.storage(r).ListAccounts(q)
+	if err != nil {
+		return err
+	}
+	params := r.URL.Query()
+	s.renderAdmin(w, r, http.StatusOK, "accounts", adminAccounts{
+		Name:        params.Get("name"),
+		Status:      params.Get("status"),
+		Statuses:    []AccountStatus{StatusActive, StatusFrozen, StatusClosed},
+		AccountPage: page,
+	})
+	return nil
+}
+
+// adminAccount is the data of an account's page. History is newest first.
+type adminAccount struct {
+	Account *Account
+	History []StatementLine
+	Holds   []*Hold
+}
+
+func (s *APIServer) handleAdminAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	account, err := s.storage(r).GetAccountByID(id)
+	if err != nil {
+		return httpError{Status: http.StatusNotFound, Msg: err.Error()}
+	}
+	txs, err := s.storage(r).GetTransactions(id)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.After(txs[j].CreatedAt) })
+	// Walk back from the current balance to give each line the balance it
+	// left the account with.
+	history := make([]StatementLine, len(txs))
+	balance := account.Balance
+	for i, tx := range txs {
+		history[i] = statementLine(tx, id)
+		history[i].Balance = balance
+		balance -= history[i].Amount
+	}
+	holds, err := s.storage(r).GetHolds(id)
+	if err != nil {
+		return err
+	}
+	s.renderAdmin(w, r, http.StatusOK, "account", adminAccount{Account: account, History: history, Holds: holds})
+	return nil
+}
+
+func (s *APIServer) handleAdminAccountStatus(from, to AccountStatus) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
+		if _, err := s.changeAccountStatus(r, id, from, to, 0); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/admin/accounts/"+strconv.Itoa(id), http.StatusSeeOther)
+		return nil
+	}
+}
+
+func (s *APIServer) handleAdminReviews(w http.ResponseWriter, r *http.Request) error {
+	decisions, err := s.storage(r).GetRiskDecisions(ReviewPending)
+	if err != nil {
+		return err
+	}
+	s.renderAdmin(w, r, http.StatusOK, "reviews", decisions)
+	return nil
+}
+
+func (s *APIServer) handleAdminResolveReview(status ReviewStatus) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		idStr := mux.Vars(r)["reviewId"]
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("invalid review id given %s", idStr)
+		}
+		if _, err := s.resolveRiskReview(r, id, status); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/admin/reviews", http.StatusSeeOther)
+		return nil
+	}
+}
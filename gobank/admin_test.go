@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest makes a dashboard request with the session cookie, posting
+// form if it isn't nil.
+func adminRequest(t *testing.T, server *APIServer, session *http.Cookie, method, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if session != nil {
+		req.AddCookie(session)
+	}
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// adminSignIn posts token to the sign-in form, as a browser that has just
+// loaded it would.
+func adminSignIn(t *testing.T, server *APIServer, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	var form *http.Cookie
+	for _, c := range adminRequest(t, server, nil, "GET", "/admin/login", nil).Result().Cookies() {
+		if c.Name == adminLoginCookie {
+			form = c
+		}
+	}
+	if form == nil {
+		t.Fatal("no sign-in cookie")
+	}
+	return adminRequest(t, server, form, "POST", "/admin/login", url.Values{"token": {token}, "csrf": {form.Value}})
+}
+
+// adminLogin signs p in to the dashboard and returns the session cookie.
+func adminLogin(t *testing.T, server *APIServer, p Principal) *http.Cookie {
+	t.Helper()
+	token, err := createJWT(p, time.Minute)
+	must(t, err)
+	rec := adminSignIn(t, server, token)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("login as %s: %d %s", p.Subject, rec.Code, rec.Body)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == adminSessionCookie {
+			if !c.HttpOnly || c.SameSite != http.SameSiteStrictMode || c.Value == token {
+				t.Errorf("session cookie %+v", c)
+			}
+			return c
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+// adminCSRF is the form token of the session in cookie.
+func adminCSRF(t *testing.T, server *APIServer, session *http.Cookie) string {
+	t.Helper()
+	sess := server.sessions.get(session.Value, server.clock.Now())
+	if sess == nil {
+		t.Fatal("no session")
+	}
+	return sess.csrf
+}
+
+func TestAdminDashboard(t *testing.T) {
+	server, store := newE2EServer(t)
+
+	rec := adminRequest(t, server, nil, "GET", "/admin/accounts", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin/login" {
+		t.Fatalf("anonymous: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != adminCSP {
+		t.Errorf("csp %q", csp)
+	}
+	if rec := adminRequest(t, server, nil, "GET", "/admin/static/admin.css", nil); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/css") {
+		t.Fatalf("stylesheet: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	customer, err := createJWT(Principal{Subject: "alice", Role: RoleCustomer}, time.Minute)
+	must(t, err)
+	if rec := adminSignIn(t, server, customer); rec.Code != http.StatusForbidden {
+		t.Fatalf("customer login: %d", rec.Code)
+	}
+	// The session is only good for the dashboard.
+	support := adminLogin(t, server, Principal{Subject: "sam", Role: RoleSupport})
+	if rec := adminRequest(t, server, support, "GET", "/accounts", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("API with a session: %d", rec.Code)
+	}
+
+	rec = adminRequest(t, server, support, "GET", "/admin/accounts?name=grace", nil)
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, "Hopper") || strings.Contains(body, "Lovelace") {
+		t.Fatalf("search: %d %s", rec.Code, body)
+	}
+	rec = adminRequest(t, server, support, "GET", "/admin/accounts/1", nil)
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, "Transfer to 2") || !strings.Contains(body, "card") {
+		t.Fatalf("account: %d %s", rec.Code, body)
+	}
+	if strings.Contains(rec.Body.String(), "Freeze account") {
+		t.Error("support is offered to freeze")
+	}
+	if rec := adminRequest(t, server, support, "POST", "/admin/accounts/1/freeze", url.Values{"csrf": {adminCSRF(t, server, support)}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("support freeze: %d", rec.Code)
+	}
+
+	admin := adminLogin(t, server, Principal{Subject: "root", Role: RoleAdmin})
+	csrf := adminCSRF(t, server, admin)
+	if rec := adminRequest(t, server, admin, "POST", "/admin/accounts/1/freeze", url.Values{}); rec.Code != http.StatusForbidden {
+		t.Fatalf("freeze without a form token: %d", rec.Code)
+	}
+	rec = adminRequest(t, server, admin, "POST", "/admin/accounts/1/freeze", url.Values{"csrf": {csrf}})
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("freeze: %d %s", rec.Code, rec.Body)
+	}
+	if acc, _ := store.GetAccountByID(1); acc.Status != StatusFrozen {
+		t.Fatalf("account 1 is %s", acc.Status)
+	}
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	if entries := tenant.audit.Query(AuditQuery{AccountID: 1}); len(entries) != 1 || entries[0].Action != "account.frozen" || entries[0].Actor != "root" {
+		t.Fatalf("audit %+v", entries)
+	}
+	must(t, store.RecordRiskDecision(&RiskDecision{FromAccount: 2, ToAccount: 1, Amount: 5, Outcome: RiskHold, CreatedAt: e2eNow, Review: ReviewPending}))
+
+	rec = adminRequest(t, server, admin, "GET", "/admin/reviews", nil)
+	if body := rec.Body.String(); rec.Code != http.StatusOK || !strings.Contains(body, "first transfer to 2 is over 10") || !strings.Contains(body, "/admin/reviews/1/approve") {
+		t.Fatalf("reviews: %d %s", rec.Code, body)
+	}
+	if rec := adminRequest(t, server, admin, "POST", "/admin/reviews/2/reject", url.Values{"csrf": {csrf}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("reject: %d %s", rec.Code, rec.Body)
+	}
+	if d, _ := store.GetRiskDecision(2); d.Review != ReviewRejected || d.ReviewedBy != "root" {
+		t.Fatalf("review %+v", d)
+	}
+	if entries := tenant.audit.Query(AuditQuery{Action: "review.rejected"}); len(entries) != 1 || entries[0].AccountID != 2 || entries[0].Actor != "root" {
+		t.Fatalf("rejection audit %+v", entries)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	server, _ := newE2EServer(t)
+	token, err := createJWT(Principal{Subject: "root", Role: RoleAdmin}, time.Minute)
+	must(t, err)
+	// Another site can't post the sign-in form.
+	if rec := adminRequest(t, server, nil, "POST", "/admin/login", url.Values{"token": {token}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("sign-in without a form token: %d", rec.Code)
+	}
+
+	// Each session has a token of its own.
+	first := adminLogin(t, server, Principal{Subject: "root", Role: RoleAdmin})
+	second := adminLogin(t, server, Principal{Subject: "root", Role: RoleAdmin})
+	if adminCSRF(t, server, first) == adminCSRF(t, server, second) {
+		t.Fatal("sessions share a form token")
+	}
+	if rec := adminRequest(t, server, second, "POST", "/admin/accounts/1/freeze", url.Values{"csrf": {adminCSRF(t, server, first)}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("freeze with another session's token: %d", rec.Code)
+	}
+
+	// Signing out ends the session, not just the cookie.
+	if rec := adminRequest(t, server, first, "POST", "/admin/logout", url.Values{"csrf": {adminCSRF(t, server, first)}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("logout: %d %s", rec.Code, rec.Body)
+	}
+	if rec := adminRequest(t, server, first, "GET", "/admin/accounts", nil); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin/login" {
+		t.Fatalf("signed-out session: %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := adminRequest(t, server, second, "GET", "/admin/accounts", nil); rec.Code != http.StatusOK {
+		t.Fatalf("other session after logout: %d", rec.Code)
+	}
+
+	if second.Secure {
+		t.Error("session cookie is Secure over plain HTTP")
+	}
+	server.secureCookies = true
+	if c := adminLogin(t, server, Principal{Subject: "root", Role: RoleAdmin}); !c.Secure {
+		t.Error("session cookie isn't Secure with secureCookies set")
+	}
+}
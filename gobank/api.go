@@ -1,18 +1,68 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cshorten/gobank/hook"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// WriteJSON writes v with the given status. Behind withNegotiation it
+// answers in the format and compression the client asked for; elsewhere it
+// writes plain JSON.
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	media, encoding, pretty := mediaJSON, "", false
+	if nw, ok := w.(*negotiatedWriter); ok {
+		media, encoding, pretty = nw.media, nw.encoding, nw.pretty
+		w.Header().Add("Vary", "Accept, Accept-Encoding")
+	}
+	body, err := encodeBody(media, pretty, v)
+	if err != nil {
+		return err
+	}
+	if encoding != "" && len(body) >= compressMinSize {
+		if body, err = compress(encoding, body); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Encoding", encoding)
+	} else {
+		encoding = ""
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", representationETag(etag, media, encoding))
+	}
+	w.Header().Set("Content-Type", media)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json")
-	return json.NewEncoder(w).Encode(v)
+	_, err = w.Write(body)
+	return err
+}
+
+// representationETag tells the formats and compressions of a resource apart
+// in its strong ETag, so a cache never takes one for another: "3" becomes
+// "3-cbor-gzip" for a compressed CBOR body. ifMatchVersion reads any of
+// them.
+func representationETag(etag, media, encoding string) string {
+	if !strings.HasPrefix(etag, "\"") {
+		return etag
+	}
+	suffix := ""
+	if media != mediaJSON {
+		suffix += "-" + strings.TrimPrefix(media, "application/")
+	}
+	if encoding != "" {
+		suffix += "-" + encoding
+	}
+	return strings.TrimSuffix(etag, "\"") + suffix + "\""
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
@@ -21,27 +71,105 @@ type ApiError struct {
 	Error string
 }
 
+// httpError is returned by handlers that need a status other than 400.
+type httpError struct {
+	Status int
+	Msg    string
+}
+
+func (e httpError) Error() string {
+	return e.Msg
+}
+
+// errMethodNotAllowed is returned for a method the route doesn't serve.
+func errMethodNotAllowed(r *http.Request) error {
+	return httpError{Status: http.StatusMethodNotAllowed, Msg: fmt.Sprintf("method not allowed %s", r.Method)}
+}
+
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			status := http.StatusBadRequest
+			var herr httpError
+			if errors.As(err, &herr) {
+				status = herr.Status
+			} else if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			WriteJSON(w, status, ApiError{Error: err.Error()})
 		}
 	}
 }
 
 type APIServer struct {
 	listenAddr string
+	// tenants hold each bank's store, audit log and risk engine. Handlers
+	// reach them only through the tenant of the request.
+	tenants  *Tenants
+	clock    Clock
+	products map[string]*InterestProduct
+	cors     CORSConfig
+	// tls serves HTTPS when set.
+	tls *tls.Config
+	// clientPrincipals are the principals client certificates authenticate
+	// as, by common name.
+	clientPrincipals map[string]Principal
+	// tracer, if set, traces each request.
+	tracer trace.Tracer
+	// payeeCoolingOff is how long a new payee waits before it can be paid.
+	payeeCoolingOff time.Duration
+	// hooks run around account and transfer operations.
+	hooks *hook.Registry
+	// nameChecks limits how often each principal checks payee names.
+	nameChecks *rateLimiter
+	// sessions are the dashboard's signed-in users.
+	sessions *adminSessions
+	// secureCookies marks dashboard cookies Secure even on plain HTTP, for
+	// servers behind a proxy that terminates TLS.
+	secureCookies bool
 }
 
-func NewAPIServer(listenAddr string) *APIServer {
+// NewAPIServer serves a single bank, the default tenant, from store and
+// audit. Use NewMultiTenantAPIServer to host several.
+func NewAPIServer(listenAddr string, store Storage, audit *AuditLog) *APIServer {
+	tenants, _ := NewTenants(NewTenant(TenantConfig{ID: defaultTenantID}, store, audit, realClock{}))
+	return NewMultiTenantAPIServer(listenAddr, tenants)
+}
+
+func NewMultiTenantAPIServer(listenAddr string, tenants *Tenants) *APIServer {
 	// returns a pointer to our API server
-	return &APIServer{
-		listenAddr: listenAddr,
+	s := &APIServer{
+		listenAddr:      listenAddr,
+		tenants:         tenants,
+		clock:           realClock{},
+		products:        make(map[string]*InterestProduct),
+		cors:            defaultCORS,
+		payeeCoolingOff: defaultPayeeCoolingOff,
+		nameChecks:      newRateLimiter(nameCheckBurst, nameCheckInterval),
+		sessions:        newAdminSessions(),
 	}
+	s.useHooks(hook.NewRegistry(defaultHookTimeout))
+	return s
 }
 
 func (s *APIServer) Run() {
+	router := s.routes()
+
+	log.Println("JSON API server running on port: ", s.listenAddr)
+
+	if s.tls != nil {
+		server := &http.Server{Addr: s.listenAddr, Handler: router, TLSConfig: s.tls}
+		// The certificate comes from TLSConfig, so no files are given here.
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	http.ListenAndServe(s.listenAddr, router)
+}
+
+func (s *APIServer) routes() http.Handler {
 	router := mux.NewRouter()
+	router.NotFoundHandler = notFound
+	router.MethodNotAllowedHandler = methodNotAllowed
+	router.Use(s.withTracing, withSecurityHeaders, s.withCORS, withNegotiation, withRequestID, s.withJWTAuth, s.withTenant)
 
 	/*
 		// HandleFunc registers a new route with a matcher for the URL path.
@@ -51,43 +179,386 @@ func (s *APIServer) Run() {
 			return r.NewRoute().Path(path).HandlerFunc(f)
 		}
 	*/
-	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleAccount))
+	router.HandleFunc("/account", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermCreateAccount,
+	}, s.handleAccount)))
 
-	router.HandleFunc("/account/{id}", makeHTTPHandleFunc((s.handleGetAccount)))
+	router.HandleFunc("/accounts", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleListAccounts)))
 
-	log.Println("JSON API server running on port: ", s.listenAddr)
+	router.HandleFunc("/account/{id}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":    PermReadAccount,
+		"PATCH":  PermUpdateAccount,
+		"DELETE": PermCloseAccount,
+	}, s.handleAccountByID)))
+	router.HandleFunc("/account/{id}/freeze", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermFreezeAccount,
+	}, s.handleFreezeAccount)))
+	router.HandleFunc("/account/{id}/unfreeze", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermFreezeAccount,
+	}, s.handleUnfreezeAccount)))
+	router.HandleFunc("/account/{id}/close", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermCloseAccount,
+	}, s.handleCloseAccount)))
+	router.HandleFunc("/account/{id}/reopen", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermReopenAccount,
+	}, s.handleReopenAccount)))
+	router.HandleFunc("/account/{id}/transactions", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleGetTransactions)))
+	router.HandleFunc("/account/{id}/statements/{period}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleGetStatement)))
+	router.HandleFunc("/account/{id}/events", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleAccountEvents)))
+	router.HandleFunc("/account/{id}/export", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermExportAccount,
+	}, s.handleExportAccount)))
+	router.HandleFunc("/account/{id}/erase", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermEraseAccount,
+	}, s.handleEraseAccount)))
+	router.HandleFunc("/account/{id}/schedules", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermReadAccount,
+		"POST": PermTransfer,
+	}, s.handleSchedules)))
+	router.HandleFunc("/account/{id}/schedules/{scheduleId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":    PermReadAccount,
+		"DELETE": PermTransfer,
+	}, s.handleScheduleByID)))
+	router.HandleFunc("/account/{id}/holds", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermReadAccount,
+		"POST": PermTransfer,
+	}, s.handleHolds)))
+	router.HandleFunc("/account/{id}/holds/{holdId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAccount,
+	}, s.handleHoldByID)))
+	router.HandleFunc("/account/{id}/holds/{holdId}/capture", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermTransfer,
+	}, s.handleCaptureHold)))
+	router.HandleFunc("/account/{id}/holds/{holdId}/release", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermTransfer,
+	}, s.handleReleaseHold)))
+	router.HandleFunc("/customers", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermReadCustomer,
+		"POST": PermCreateCustomer,
+	}, s.handleCustomers)))
+	router.HandleFunc("/customers/{customerId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":   PermReadCustomer,
+		"PATCH": PermUpdateCustomer,
+	}, s.handleCustomerByID)))
+	router.HandleFunc("/customers/{customerId}/accounts", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermReadAccount,
+		"POST": PermCreateAccount,
+	}, s.handleCustomerAccounts)))
+	router.HandleFunc("/customers/{customerId}/payees", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermReadCustomer,
+		"POST": PermManagePayees,
+	}, s.handlePayees)))
+	router.HandleFunc("/customers/{customerId}/payees/{payeeId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":    PermReadCustomer,
+		"DELETE": PermManagePayees,
+	}, s.handlePayeeByID)))
+	router.HandleFunc("/confirm-payee", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermManagePayees,
+	}, s.handleConfirmPayee)))
+	router.HandleFunc("/transfer", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermTransfer,
+	}, s.handleTransfer)))
+	router.HandleFunc("/batches", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermTransfer,
+	}, s.handleBatches)))
+	router.HandleFunc("/batches/{batchId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermTransfer,
+	}, s.handleGetBatch)))
+	router.HandleFunc("/audit", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadAudit,
+	}, s.handleGetAudit)))
+	router.HandleFunc("/debug/vars", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadMetrics,
+	}, s.handleMetrics)))
+	router.HandleFunc("/reviews", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermReadReviews,
+	}, s.handleGetReviews)))
+	router.HandleFunc("/reviews/{reviewId}/approve", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermResolveReviews,
+	}, s.handleApproveReview)))
+	router.HandleFunc("/reviews/{reviewId}/reject", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"POST": PermResolveReviews,
+	}, s.handleRejectReview)))
+	router.HandleFunc("/webhooks", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":  PermManageWebhooks,
+		"POST": PermManageWebhooks,
+	}, s.handleWebhooks)))
+	router.HandleFunc("/webhooks/{webhookId}", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET":    PermManageWebhooks,
+		"DELETE": PermManageWebhooks,
+	}, s.handleWebhookByID)))
+	router.HandleFunc("/webhooks/{webhookId}/deliveries", makeHTTPHandleFunc(s.authorize(routePermissions{
+		"GET": PermManageWebhooks,
+	}, s.handleWebhookDeliveries)))
+	s.adminRoutes(router)
 
-	http.ListenAndServe(s.listenAddr, router)
+	return router
 }
 
 func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "POST" {
+		return s.handleCreateAccount(w, r)
+	}
+	return errMethodNotAllowed(r)
+}
+
+func (s *APIServer) handleAccountByID(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "GET" {
 		return s.handleGetAccount(w, r)
 	}
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
+	if r.Method == "PATCH" {
+		return s.handlePatchAccount(w, r)
 	}
 	if r.Method == "DELETE" {
 		return s.handleDeleteAccount(w, r)
 	}
-	return fmt.Errorf("method not allowed %s", r.Method)
+	return errMethodNotAllowed(r)
 }
 
 func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
-	//vars := mux.Vars(r)["id"]
-	// db.get(id)
-	account := NewAccount("Anthony", "GG")
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	var account *Account
+	if cache := s.tenant(r).cache; cache != nil {
+		account, err = cache.Get(id)
+	} else {
+		account, err = s.storage(r).GetAccountByID(id)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", accountETag(account))
 	return WriteJSON(w, http.StatusOK, account)
 }
 
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	return nil
+	req := new(CreateAccountRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	owner := principalFrom(r).Subject
+	if req.Owner != "" && rolePermissions[principalFrom(r).Role][PermCreateAccount] == scopeAny {
+		owner = req.Owner
+	}
+	account := NewAccount(req.FirstName, req.LastName, owner)
+	account.Product = req.Product
+	account.Currency = req.Currency
+	if err := s.createAccount(r, account); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, account)
 }
 
+// handleDeleteAccount closes the account rather than removing it, so its
+// transactions stay on the ledger.
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	return nil
+	return s.setAccountStatus(w, r, "", StatusClosed)
+}
+
+func (s *APIServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, StatusActive, StatusFrozen)
+}
+
+// Unfreezing and reopening both make an account active, so each only
+// applies to accounts in the status it undoes.
+func (s *APIServer) handleUnfreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, StatusFrozen, StatusActive)
+}
+
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, "", StatusClosed)
+}
+
+func (s *APIServer) handleReopenAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, StatusClosed, StatusActive)
+}
+
+// setAccountStatus moves an account to status to. If from is given, the
+// account has to be in it; otherwise any status the move is allowed from
+// will do.
+func (s *APIServer) setAccountStatus(w http.ResponseWriter, r *http.Request, from, to AccountStatus) error {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		return errMethodNotAllowed(r)
+	}
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	// DELETE is a plain HTTP update of the resource, so it carries the
+	// version the client last saw.
+	ifVersion := 0
+	if r.Method == "DELETE" {
+		if ifVersion, err = ifMatchVersion(r, s.accountVersion(r, id)); err != nil {
+			return err
+		}
+	}
+	account, err := s.changeAccountStatus(r, id, from, to, ifVersion)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// changeAccountStatus moves an account to status to, auditing the change and
+// running the hooks for closing it.
+func (s *APIServer) changeAccountStatus(r *http.Request, id int, from, to AccountStatus, ifVersion int) (*Account, error) {
+	var e *hook.Event
+	if to == StatusClosed {
+		account, err := s.storage(r).GetAccountByID(id)
+		if err != nil {
+			return nil, err
+		}
+		e = newHookEvent(r, hook.DeleteAccount)
+		e.Account = hookAccount(account)
+		if err := s.runBeforeHooks(r, e); err != nil {
+			return nil, err
+		}
+	}
+	change, err := s.storage(r).SetAccountStatus(id, from, to, ifVersion)
+	if errors.Is(err, ErrVersionConflict) {
+		return nil, httpError{Status: http.StatusPreconditionFailed, Msg: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit(r, "account."+string(to), id, change.Before, change.After)
+	if e != nil {
+		e.Account = hookAccount(change.After)
+		s.runAfterHooks(r, e)
+	}
+	return change.After, nil
+}
+
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return errMethodNotAllowed(r)
+	}
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	txs, err := s.storage(r).GetTransactions(id)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, txs)
 }
 
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	return nil
+	if r.Method != "POST" {
+		return errMethodNotAllowed(r)
+	}
+	req := new(TransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if err := s.authorizeAccount(r, PermTransfer, req.FromAccount); err != nil {
+		return err
+	}
+	if err := s.tenant(r).checkAmount(req.Amount); err != nil {
+		return err
+	}
+	if req.ToAccountNumber != 0 {
+		if req.ToAccount != 0 {
+			return fmt.Errorf("give either toAccount or toAccountNumber")
+		}
+		to, err := s.payeeAccount(r, req.FromAccount, req.ToAccountNumber)
+		if err != nil {
+			return err
+		}
+		req.ToAccount = to
+	} else if err := s.checkPayee(r, req.FromAccount, req.ToAccount); err != nil {
+		return err
+	}
+	var changes Changes
+	d, tx, err := s.tenant(r).risk.Guard(r.Context(), principalFrom(r).Subject, req.FromAccount, req.ToAccount, req.Amount, "api", func() (tx *Transaction, err error) {
+		tx, changes, err = s.storage(r).Transfer(req.FromAccount, req.ToAccount, req.Amount)
+		return tx, err
+	})
+	if err != nil {
+		return hookStatus(err)
+	}
+	switch d.Outcome {
+	case RiskHold:
+		return WriteJSON(w, http.StatusAccepted, d)
+	case RiskDeny:
+		return httpError{Status: http.StatusUnprocessableEntity, Msg: "transfer denied: " + strings.Join(d.Reasons, "; ")}
+	}
+	s.recordAudit(r, "transfer.debit", req.FromAccount, changes.before(req.FromAccount), changes.after(req.FromAccount))
+	s.recordAudit(r, "transfer.credit", req.ToAccount, changes.before(req.ToAccount), changes.after(req.ToAccount))
+	return WriteJSON(w, http.StatusOK, tx)
+}
+
+func (s *APIServer) handleGetAudit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return errMethodNotAllowed(r)
+	}
+	params := r.URL.Query()
+	q := AuditQuery{
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+	}
+	if v := params.Get("account"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid account given %s", v)
+		}
+		q.AccountID = id
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return fmt.Errorf("invalid %s given %s", name, v)
+			}
+			*t = parsed
+		}
+	}
+	return WriteJSON(w, http.StatusOK, s.tenant(r).audit.Query(q))
+}
+
+// recordAudit appends an entry for a change that has already been applied, so
+// a failure is logged rather than returned to the caller.
+func (s *APIServer) recordAudit(r *http.Request, action string, accountID int, before, after *Account) {
+	s.appendAudit(r, &AuditEntry{Action: action, AccountID: accountID, Before: before, After: after})
+}
+
+// recordCustomerAudit audits a change to a customer rather than to any one
+// of their accounts. The entry names the customer as its subject.
+func (s *APIServer) recordCustomerAudit(r *http.Request, action string, customerID int) {
+	s.appendAudit(r, &AuditEntry{Action: action, Subject: customerSubject(customerID)})
+}
+
+func (s *APIServer) appendAudit(r *http.Request, e *AuditEntry) {
+	e.Actor = "anonymous"
+	if p := principalFrom(r); p != nil {
+		e.Actor = p.Subject
+	}
+	e.RequestID = requestIDFrom(r)
+	e.SourceIP = sourceIP(r)
+	if err := s.tenant(r).audit.Append(e); err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+func getID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return id, fmt.Errorf("invalid id given %s", idStr)
+	}
+	return id, nil
 }
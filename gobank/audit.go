@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single change to an account. Entries are chained by
+// hash: each one includes the hash of the entry before it, so editing or
+// dropping an entry breaks every hash after it.
+//
+// The hash is taken over the entry's JSON exactly as it was stored, with the
+// hash itself left empty, rather than over the entry marshalled again. Adding
+// fields to accounts or entries then leaves old entries verifying as they did.
+//
+// Names in the snapshots are stored encrypted under the data key of Subject,
+// so erasing the subject makes them unreadable without breaking the chain.
+type AuditEntry struct {
+	Seq       int       `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	AccountID int       `json:"accountId"`
+	Subject   string    `json:"subject,omitempty"`
+	Before    *Account  `json:"before,omitempty"`
+	After     *Account  `json:"after,omitempty"`
+	RequestID string    `json:"requestId"`
+	SourceIP  string    `json:"sourceIp"`
+	PrevHash  string    `json:"prevHash"`
+	// Hash must stay the last field: it is filled in on the stored JSON.
+	Hash string `json:"hash"`
+
+	// raw is the entry's JSON as stored.
+	raw []byte
+}
+
+// emptyHash is how the hash field of an entry's JSON ends before it is hashed.
+var emptyHash = []byte(`"hash":""}`)
+
+// seal marshals the entry, hashes the JSON and fills the hash in on it.
+func (e *AuditEntry) seal() error {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(b, emptyHash) {
+		return fmt.Errorf("audit entry %d doesn't end with its hash", e.Seq)
+	}
+	sum := sha256.Sum256(b)
+	e.Hash = hex.EncodeToString(sum[:])
+	e.raw = append(b[:len(b)-len(emptyHash)], fmt.Sprintf(`"hash":%q}`, e.Hash)...)
+	return nil
+}
+
+// storedHash hashes the entry's JSON as stored, with its hash taken out.
+func (e *AuditEntry) storedHash() (string, error) {
+	field := []byte(fmt.Sprintf(`"hash":%q`, e.Hash))
+	i := bytes.LastIndex(e.raw, field)
+	if i < 0 {
+		return "", fmt.Errorf("audit entry %d has no hash", e.Seq)
+	}
+	b := make([]byte, 0, len(e.raw))
+	b = append(append(append(b, e.raw[:i]...), `"hash":""`...), e.raw[i+len(field):]...)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type AuditQuery struct {
+	AccountID int
+	Actor     string
+	Action    string
+	Since     time.Time
+	Until     time.Time
+}
+
+func (q AuditQuery) matches(e *AuditEntry) bool {
+	if q.AccountID != 0 && e.AccountID != q.AccountID {
+		return false
+	}
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action {
+		return false
+	}
+	if !q.Since.IsZero() && e.Timestamp.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Timestamp.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only, hash-chained log of audit entries. When backed
+// by a file, entries are written as JSON lines.
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []*AuditEntry
+	w       io.Writer
+	// keys holds the data keys names are encrypted under. A log without
+	// keys keeps no names at all.
+	keys subjectKeys
+}
+
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// OpenAuditLog loads the entries already in path and appends new ones to it.
+// It refuses to open a log whose chain doesn't verify.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	entries, err := readAuditFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyAuditChain(entries); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{entries: entries, w: f}, nil
+}
+
+func (l *AuditLog) Append(e *AuditEntry) error {
+	if err := l.protect(e); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = len(l.entries) + 1
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	if n := len(l.entries); n > 0 {
+		e.PrevHash = l.entries[n-1].Hash
+	}
+	if err := e.seal(); err != nil {
+		return err
+	}
+
+	if l.w != nil {
+		if _, err := l.w.Write(append(e.raw, '\n')); err != nil {
+			return err
+		}
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+// Query returns the matching entries with their names readable, as far as
+// their subjects' data keys still exist.
+func (l *AuditLog) Query(q AuditQuery) []*AuditEntry {
+	l.mu.Lock()
+	var matched []*AuditEntry
+	for _, e := range l.entries {
+		if q.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	l.mu.Unlock()
+
+	entries := []*AuditEntry{}
+	for _, e := range matched {
+		entries = append(entries, l.reveal(e))
+	}
+	return entries
+}
+
+// protect replaces the names in the entry's snapshots with their encryption
+// under the subject's data key. Snapshots of erased accounts only carry
+// pseudonyms and are left as they are.
+func (l *AuditLog) protect(e *AuditEntry) error {
+	var key []byte
+	for _, acc := range []**Account{&e.Before, &e.After} {
+		if *acc == nil || (*acc).ErasedAt != nil {
+			continue
+		}
+		c := **acc
+		*acc = &c
+		if l.keys == nil {
+			c.FirstName, c.LastName = "", ""
+			continue
+		}
+		if key == nil {
+			e.Subject = subjectOf(&c)
+			var err error
+			if key, err = dataKey(l.keys, e.Subject, true); err != nil {
+				return fmt.Errorf("audit entry for account %d: %w", e.AccountID, err)
+			}
+		}
+		for _, name := range []*string{&c.FirstName, &c.LastName} {
+			sealed, err := seal(key, []byte(*name))
+			if err != nil {
+				return err
+			}
+			*name = base64.StdEncoding.EncodeToString(sealed)
+		}
+	}
+	return nil
+}
+
+// reveal returns a copy of the entry with its names decrypted. Names whose
+// data key is gone are left empty.
+func (l *AuditLog) reveal(e *AuditEntry) *AuditEntry {
+	if e.Subject == "" {
+		return e
+	}
+	var key []byte
+	if l.keys != nil {
+		key, _ = dataKey(l.keys, e.Subject, false)
+	}
+	c := *e
+	for _, acc := range []**Account{&c.Before, &c.After} {
+		if *acc == nil || (*acc).ErasedAt != nil {
+			continue
+		}
+		a := **acc
+		*acc = &a
+		for _, name := range []*string{&a.FirstName, &a.LastName} {
+			*name = openName(key, *name)
+		}
+	}
+	return &c
+}
+
+func openName(key []byte, stored string) string {
+	if key == nil {
+		return ""
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return ""
+	}
+	name, err := unseal(key, sealed)
+	if err != nil {
+		return ""
+	}
+	return string(name)
+}
+
+func readAuditFile(path string) ([]*AuditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		e := new(AuditEntry)
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("audit entry %d: %w", len(entries)+1, err)
+		}
+		e.raw = append([]byte(nil), sc.Bytes()...)
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// verifyAuditChain walks the chain from the start and reports the first entry
+// whose sequence, link or hash doesn't match.
+func verifyAuditChain(entries []*AuditEntry) error {
+	prev := ""
+	for i, e := range entries {
+		if e.Seq != i+1 {
+			return fmt.Errorf("audit entry %d has sequence %d", i+1, e.Seq)
+		}
+		if e.PrevHash != prev {
+			return fmt.Errorf("audit entry %d does not link to the previous entry", e.Seq)
+		}
+		hash, err := e.storedHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("audit entry %d has been modified", e.Seq)
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// runVerifyAudit implements `gobank verify-audit [file]`.
+func runVerifyAudit(args []string) {
+	path := "audit.log"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	entries, err := readAuditFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := verifyAuditChain(entries); err != nil {
+		log.Fatalf("audit chain is broken: %v", err)
+	}
+	fmt.Printf("audit chain ok: %d entries\n", len(entries))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// oldAuditLine is an entry as written before accounts had a version, an
+// available balance or a currency, hashed the way it was then.
+func oldAuditLine() string {
+	line := `{"seq":1,"timestamp":"2024-05-01T09:00:00Z","actor":"alice","action":"account.create","accountId":7,` +
+		`"after":{"id":7,"firstName":"Ada","lastName":"Lovelace","owner":"alice","number":4242,"balance":0,"status":"active","createdAt":"2024-05-01T09:00:00Z"},` +
+		`"requestId":"r1","sourceIp":"10.0.0.1","prevHash":"","hash":""}`
+	sum := sha256.Sum256([]byte(line))
+	return strings.Replace(line, `"hash":""`, `"hash":"`+hex.EncodeToString(sum[:])+`"`, 1)
+}
+
+func TestAuditChainSurvivesNewFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	must(t, os.WriteFile(path, []byte(oldAuditLine()+"\n"), 0o600))
+
+	log, err := OpenAuditLog(path)
+	must(t, err)
+	must(t, log.Append(&AuditEntry{Actor: "root", Action: "account.frozen", AccountID: 7,
+		After: &Account{ID: 7, FirstName: "Ada", Currency: "GBP", Version: 2, Status: StatusFrozen}}))
+
+	entries, err := readAuditFile(path)
+	must(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("read %d entries", len(entries))
+	}
+	must(t, verifyAuditChain(entries))
+	if _, err := OpenAuditLog(path); err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	must(t, err)
+	tampered := strings.Replace(string(b), `"actor":"alice"`, `"actor":"mallory"`, 1)
+	must(t, os.WriteFile(path, []byte(tampered), 0o600))
+	if _, err := OpenAuditLog(path); err == nil || !strings.Contains(err.Error(), "entry 1 has been modified") {
+		t.Fatalf("opened a tampered log: %v", err)
+	}
+}
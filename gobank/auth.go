@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+type ctxKey int
+
+const (
+	principalKey ctxKey = iota
+	requestIDKey
+	spanKey
+	tenantKey
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string `json:"sub"`
+	Role    Role   `json:"role"`
+	// Tenant is the bank the principal belongs to. Empty means the default
+	// tenant.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type principalClaims struct {
+	Role   Role   `json:"role"`
+	Tenant string `json:"tenant,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// devJWTSecret signs tokens in development when JWT_SECRET isn't set. It is
+// public, so a token signed with it proves nothing.
+const devJWTSecret = "gobank-dev-secret"
+
+// jwtKey is the key tokens are signed with, set by configureJWTSecret.
+var jwtKey []byte
+
+// configureJWTSecret reads the token signing key from JWT_SECRET. Without
+// it, only dev mode may fall back to the public development key.
+func configureJWTSecret(dev bool) error {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		if !dev {
+			return errors.New("JWT_SECRET is not set; set it, or pass -dev to sign tokens with the public development key")
+		}
+		log.Println("auth: JWT_SECRET is not set; signing tokens with the public development key")
+		secret = devJWTSecret
+	}
+	jwtKey = []byte(secret)
+	return nil
+}
+
+func jwtSecret() []byte {
+	if jwtKey == nil {
+		panic("auth: the JWT secret has not been configured")
+	}
+	return jwtKey
+}
+
+func createJWT(p Principal, ttl time.Duration) (string, error) {
+	claims := principalClaims{
+		Role:   p.Role,
+		Tenant: p.Tenant,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   p.Subject,
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret())
+}
+
+func validateJWT(tokenString string) (*Principal, error) {
+	claims := new(principalClaims)
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+		return jwtSecret(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if !claims.Role.Valid() {
+		return nil, fmt.Errorf("unknown role %s", claims.Role)
+	}
+	return &Principal{Subject: claims.Subject, Role: claims.Role, Tenant: claims.Tenant}, nil
+}
+
+// withJWTAuth attaches the principal from a bearer token to the request
+// context. Requests without a token are authenticated by their dashboard
+// session or client certificate if they have one, or pass through
+// unauthenticated; requests with an invalid token are rejected.
+func (s *APIServer) withJWTAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			p := s.sessionPrincipal(r)
+			if p == nil {
+				p = s.certPrincipal(r)
+			}
+			if p != nil {
+				r = r.WithContext(context.WithValue(r.Context(), principalKey, p))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		tokenString, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "invalid authorization header"})
+			return
+		}
+		p, err := validateJWT(tokenString)
+		if err != nil {
+			WriteJSON(w, http.StatusUnauthorized, ApiError{Error: "invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// withRequestID tags every request with an ID, reusing X-Request-ID when the
+// caller sends one.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func principalFrom(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// runToken implements `gobank token`, which prints a signed token for local
+// testing.
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	sub := fs.String("sub", "", "subject the token is issued to")
+	role := fs.String("role", "customer", "role of the subject")
+	ttl := fs.Duration("ttl", 24*time.Hour, "token lifetime")
+	tenant := fs.String("tenant", "", "bank the subject belongs to; empty for the default one")
+	dev := fs.Bool("dev", false, "sign with the public development key if JWT_SECRET isn't set")
+	fs.Parse(args)
+
+	if *sub == "" {
+		log.Fatal("token: -sub is required")
+	}
+	if !Role(*role).Valid() {
+		log.Fatalf("token: unknown role %s", *role)
+	}
+	if err := configureJWTSecret(*dev); err != nil {
+		log.Fatal("token: ", err)
+	}
+	token, err := createJWT(Principal{Subject: *sub, Role: Role(*role), Tenant: *tenant}, *ttl)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxBatchItems caps the number of transfers in one batch.
+const maxBatchItems = 5000
+
+type BatchMode string
+
+const (
+	// BatchAllOrNothing posts every transfer or none of them.
+	BatchAllOrNothing BatchMode = "all-or-nothing"
+	// BatchBestEffort posts each transfer on its own and reports the ones
+	// that failed.
+	BatchBestEffort BatchMode = "best-effort"
+)
+
+type BatchStatus string
+
+const (
+	BatchPending   BatchStatus = "pending"
+	BatchRunning   BatchStatus = "running"
+	BatchCompleted BatchStatus = "completed"
+	// BatchPartial is a best-effort batch where some transfers failed.
+	BatchPartial BatchStatus = "partial"
+	BatchFailed  BatchStatus = "failed"
+)
+
+type BatchItemStatus string
+
+const (
+	ItemPending   BatchItemStatus = "pending"
+	ItemSucceeded BatchItemStatus = "succeeded"
+	ItemFailed    BatchItemStatus = "failed"
+	// ItemHeld is a transfer the risk rules sent for review.
+	ItemHeld BatchItemStatus = "held"
+	// ItemSkipped is a transfer in an all-or-nothing batch that wasn't posted
+	// because another one failed.
+	ItemSkipped BatchItemStatus = "skipped"
+)
+
+type BatchItem struct {
+	FromAccount   int             `json:"fromAccount"`
+	ToAccount     int             `json:"toAccount"`
+	Amount        int64           `json:"amount"`
+	Reference     string          `json:"reference,omitempty"`
+	Status        BatchItemStatus `json:"status"`
+	Error         string          `json:"error,omitempty"`
+	TransactionID int             `json:"transactionId,omitempty"`
+	// PayeeID is the saved payee the transfer pays, if it needed one. It is
+	// checked again when the transfer is made.
+	PayeeID int `json:"payeeId,omitempty"`
+}
+
+// Batch is a set of transfers submitted together. It is posted in the
+// background; clients poll it for progress and per-item results.
+type Batch struct {
+	ID          int          `json:"id"`
+	Owner       string       `json:"owner"`
+	Mode        BatchMode    `json:"mode"`
+	Status      BatchStatus  `json:"status"`
+	Items       []*BatchItem `json:"items"`
+	Succeeded   int          `json:"succeeded"`
+	Failed      int          `json:"failed"`
+	RequestID   string       `json:"requestId,omitempty"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty"`
+	// Traceparent is the trace context of the request that made the batch.
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+type CreateBatchRequest struct {
+	Mode      BatchMode     `json:"mode"`
+	Transfers []*BatchEntry `json:"transfers"`
+}
+
+type BatchEntry struct {
+	FromAccount int    `json:"fromAccount"`
+	ToAccount   int    `json:"toAccount"`
+	Amount      int64  `json:"amount"`
+	Reference   string `json:"reference,omitempty"`
+}
+
+func (b *Batch) clone() *Batch {
+	c := *b
+	c.Items = make([]*BatchItem, len(b.Items))
+	for i, item := range b.Items {
+		it := *item
+		c.Items[i] = &it
+	}
+	return &c
+}
+
+// finish works out the batch's status once every item has a result.
+func (b *Batch) finish(now time.Time) {
+	b.Succeeded, b.Failed = 0, 0
+	for _, item := range b.Items {
+		switch item.Status {
+		case ItemSucceeded:
+			b.Succeeded++
+		case ItemPending:
+			if b.Mode == BatchAllOrNothing {
+				item.Status = ItemSkipped
+			}
+		default:
+			b.Failed++
+		}
+	}
+	switch {
+	case b.Failed == 0:
+		b.Status = BatchCompleted
+	case b.Succeeded == 0:
+		b.Status = BatchFailed
+	default:
+		b.Status = BatchPartial
+	}
+	b.CompletedAt = &now
+}
+
+// parseBatchCSV reads transfers from CSV with a header row naming the
+// fromAccount, toAccount and amount columns, and optionally reference.
+func parseBatchCSV(r io.Reader) ([]*BatchEntry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading csv header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"fromAccount", "toAccount", "amount"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("csv is missing the %s column", name)
+		}
+	}
+
+	entries := []*BatchEntry{}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		e := &BatchEntry{Reference: field("reference")}
+		if e.FromAccount, err = strconv.Atoi(field("fromAccount")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid fromAccount %q", line, field("fromAccount"))
+		}
+		if e.ToAccount, err = strconv.Atoi(field("toAccount")); err != nil {
+			return nil, fmt.Errorf("line %d: invalid toAccount %q", line, field("toAccount"))
+		}
+		if e.Amount, err = strconv.ParseInt(field("amount"), 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid amount %q", line, field("amount"))
+		}
+		entries = append(entries, e)
+	}
+}
+
+// BatchProcessor posts pending batches. Best-effort batches go through the
+// risk rules one transfer at a time, and a restart picks up where it left off.
+// All-or-nothing batches are checked against the rules as a whole and posted
+// in one step.
+type BatchProcessor struct {
+	store    Storage
+	audit    *AuditLog
+	risk     *RiskEngine
+	clock    Clock
+	interval time.Duration
+	// tracer, if set, traces each batch, linked to the request that made
+	// it.
+	tracer trace.Tracer
+}
+
+func NewBatchProcessor(store Storage, audit *AuditLog, risk *RiskEngine, clock Clock) *BatchProcessor {
+	return &BatchProcessor{
+		store:    store,
+		audit:    audit,
+		risk:     risk,
+		clock:    clock,
+		interval: time.Second,
+	}
+}
+
+func (p *BatchProcessor) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		p.RunDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *BatchProcessor) RunDue() {
+	batches, err := p.store.PendingBatches()
+	if err != nil {
+		log.Println("batches:", err)
+		return
+	}
+	for _, b := range batches {
+		if err := p.process(b); err != nil {
+			log.Printf("batches: batch %d: %v", b.ID, err)
+		}
+	}
+}
+
+func (p *BatchProcessor) process(b *Batch) (err error) {
+	ctx, span := startWork(p.tracer, "batch.process", trace.SpanKindInternal, b.Traceparent)
+	span.SetAttributes(attribute.Int("gobank.batch.id", b.ID), attribute.String("gobank.batch.mode", string(b.Mode)))
+	defer endSpan(span, &err)
+
+	changes := Changes{}
+	if b.Mode == BatchAllOrNothing {
+		err = p.processAll(ctx, b, changes)
+	} else {
+		err = p.processEach(ctx, b, changes)
+	}
+	if err != nil {
+		return err
+	}
+	b, err = traced(ctx, p.store).FinishBatch(b.ID, p.clock.Now())
+	if err != nil {
+		return err
+	}
+	if b.Succeeded > 0 {
+		p.recordAudit(b, changes)
+	}
+	return nil
+}
+
+// processAll and processEach merge the accounts they change into changes.
+func (p *BatchProcessor) processAll(ctx context.Context, b *Batch, changes Changes) error {
+	store := traced(ctx, p.store)
+	// Payees may have been removed since the batch was submitted.
+	for i, item := range b.Items {
+		if item.Status != ItemPending {
+			continue
+		}
+		if err := checkSavedPayee(store, item.PayeeID, item.ToAccount); err != nil {
+			return store.RecordBatchItemResult(b.ID, i, ItemFailed, err.Error())
+		}
+	}
+	exec := func() ([]int, error) {
+		c, err := store.ExecuteBatch(b.ID, p.clock.Now())
+		if err != nil {
+			return nil, err
+		}
+		changes.Merge(c)
+		done, err := store.GetBatch(b.ID)
+		if err != nil {
+			return nil, err
+		}
+		txIDs := make([]int, len(done.Items))
+		for i, item := range done.Items {
+			txIDs[i] = item.TransactionID
+		}
+		return txIDs, nil
+	}
+	if p.risk == nil {
+		_, err := exec()
+		return err
+	}
+	decisions, err := p.risk.GuardAll(ctx, b.Owner, b.Items, fmt.Sprintf("batch:%d", b.ID), exec)
+	var refused *BatchItemError
+	if errors.As(err, &refused) {
+		return store.RecordBatchItemResult(b.ID, refused.Index, ItemFailed, refused.Err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	for i, d := range decisions {
+		if d == nil || d.Outcome == RiskAllow {
+			continue
+		}
+		msg := fmt.Sprintf("rejected by risk rules (decision %d): %s", d.ID, strings.Join(d.Reasons, "; "))
+		if err := store.RecordBatchItemResult(b.ID, i, ItemFailed, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *BatchProcessor) processEach(ctx context.Context, b *Batch, changes Changes) error {
+	store := traced(ctx, p.store)
+	source := fmt.Sprintf("batch:%d", b.ID)
+	for i, item := range b.Items {
+		if item.Status != ItemPending {
+			continue
+		}
+		exec := func() (*Transaction, error) {
+			tx, c, err := store.ExecuteBatchItem(b.ID, i, p.clock.Now())
+			changes.Merge(c)
+			return tx, err
+		}
+		status, msg := ItemSucceeded, ""
+		if err := checkSavedPayee(store, item.PayeeID, item.ToAccount); err != nil {
+			status, msg = ItemFailed, err.Error()
+		} else if p.risk == nil {
+			_, err := exec()
+			if err != nil {
+				status, msg = ItemFailed, err.Error()
+			}
+		} else {
+			d, _, err := p.risk.Guard(ctx, b.Owner, item.FromAccount, item.ToAccount, item.Amount, source, exec)
+			switch {
+			case err != nil:
+				status, msg = ItemFailed, err.Error()
+			case d.Outcome == RiskHold:
+				status, msg = ItemHeld, fmt.Sprintf("held for review (decision %d): %s", d.ID, strings.Join(d.Reasons, "; "))
+			case d.Outcome == RiskDeny:
+				status, msg = ItemFailed, "denied by risk rules: "+strings.Join(d.Reasons, "; ")
+			}
+		}
+		if status == ItemSucceeded {
+			continue
+		}
+		if err := store.RecordBatchItemResult(b.ID, i, status, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordAudit writes one entry per account the batch changed, on behalf of
+// whoever submitted it.
+func (p *BatchProcessor) recordAudit(b *Batch, changes Changes) {
+	if p.audit == nil {
+		return
+	}
+	seen := map[int]bool{}
+	for _, item := range b.Items {
+		for _, id := range []int{item.FromAccount, item.ToAccount} {
+			ch, ok := changes[id]
+			if seen[id] || !ok || ch.Before.Balance == ch.After.Balance {
+				continue
+			}
+			seen[id] = true
+			err := p.audit.Append(&AuditEntry{
+				Actor:     b.Owner,
+				Action:    "batch.transfer",
+				AccountID: id,
+				Before:    ch.Before,
+				After:     ch.After,
+				RequestID: b.RequestID,
+			})
+			if err != nil {
+				log.Println("audit:", err)
+			}
+		}
+	}
+}
+
+// handleBatches accepts a batch as JSON, or as CSV with the mode in the query
+// string. Every transfer is checked before the batch is accepted, so a batch
+// with any invalid transfer is rejected as a whole.
+func (s *APIServer) handleBatches(w http.ResponseWriter, r *http.Request) error {
+	req := new(CreateBatchRequest)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		entries, err := parseBatchCSV(r.Body)
+		if err != nil {
+			return err
+		}
+		req.Mode = BatchMode(r.URL.Query().Get("mode"))
+		req.Transfers = entries
+	} else if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if req.Mode == "" {
+		req.Mode = BatchAllOrNothing
+	}
+	if req.Mode != BatchAllOrNothing && req.Mode != BatchBestEffort {
+		return fmt.Errorf("unknown batch mode %s", req.Mode)
+	}
+	if len(req.Transfers) == 0 {
+		return fmt.Errorf("batch has no transfers")
+	}
+	if len(req.Transfers) > maxBatchItems {
+		return fmt.Errorf("batch has %d transfers, the most allowed is %d", len(req.Transfers), maxBatchItems)
+	}
+
+	b := &Batch{
+		Owner:     principalFrom(r).Subject,
+		Mode:      req.Mode,
+		Status:    BatchPending,
+		RequestID: requestIDFrom(r),
+		CreatedAt: s.clock.Now(),
+	}
+	var problems []string
+	for i, e := range req.Transfers {
+		payeeID, err := s.validateBatchEntry(r, e)
+		if err != nil {
+			// Touching an account the caller doesn't own fails the request
+			// outright, as a single transfer would.
+			var herr httpError
+			if errors.As(err, &herr) {
+				return err
+			}
+			problems = append(problems, fmt.Sprintf("transfer %d: %v", i, err))
+		}
+		b.Items = append(b.Items, &BatchItem{
+			FromAccount: e.FromAccount,
+			ToAccount:   e.ToAccount,
+			Amount:      e.Amount,
+			Reference:   e.Reference,
+			Status:      ItemPending,
+			PayeeID:     payeeID,
+		})
+	}
+	if len(problems) > 0 {
+		return httpError{Status: http.StatusUnprocessableEntity, Msg: "invalid batch: " + strings.Join(problems, "; ")}
+	}
+
+	if err := s.storage(r).CreateBatch(b); err != nil {
+		return err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/batches/%d", b.ID))
+	return WriteJSON(w, http.StatusAccepted, b)
+}
+
+// validateBatchEntry checks a transfer in a batch and returns the ID of the
+// saved payee it pays, if it needs one.
+func (s *APIServer) validateBatchEntry(r *http.Request, e *BatchEntry) (int, error) {
+	if e.Amount <= 0 {
+		return 0, fmt.Errorf("amount must be positive")
+	}
+	if err := s.tenant(r).checkAmount(e.Amount); err != nil {
+		return 0, err
+	}
+	if e.FromAccount == e.ToAccount {
+		return 0, fmt.Errorf("cannot transfer to the same account")
+	}
+	if err := s.authorizeAccount(r, PermTransfer, e.FromAccount); err != nil {
+		return 0, err
+	}
+	payee, err := s.payeeFor(r, e.FromAccount, e.ToAccount)
+	if err != nil {
+		return 0, err
+	}
+	from, err := s.storage(r).GetAccountByID(e.FromAccount)
+	if err != nil {
+		return 0, err
+	}
+	to, err := s.storage(r).GetAccountByID(e.ToAccount)
+	if err != nil {
+		return 0, err
+	}
+	if err := sameCurrency(from, to); err != nil {
+		return 0, err
+	}
+	if payee == nil {
+		return 0, nil
+	}
+	return payee.ID, nil
+}
+
+func (s *APIServer) handleGetBatch(w http.ResponseWriter, r *http.Request) error {
+	idStr := mux.Vars(r)["batchId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return fmt.Errorf("invalid batch id given %s", idStr)
+	}
+	b, err := s.storage(r).GetBatch(id)
+	p := principalFrom(r)
+	if err != nil || (b.Owner != p.Subject && rolePermissions[p.Role][PermTransfer] != scopeAny) {
+		return fmt.Errorf("batch %d %w", id, ErrNotFound)
+	}
+	return WriteJSON(w, http.StatusOK, b)
+}
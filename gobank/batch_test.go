@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBatchFixture(t *testing.T) (*MemoryStore, *APIServer, *BatchProcessor) {
+	t.Helper()
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "payroll", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "alice", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 3, Owner: "bob", Status: StatusActive})
+	savePayee(t, store, 1, 2)
+	savePayee(t, store, 1, 3)
+	server := NewAPIServer("", store, NewAuditLog())
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	return store, server, NewBatchProcessor(store, tenant.audit, tenant.risk, realClock{})
+}
+
+func submitBatch(t *testing.T, server *APIServer, path, contentType, body string) (*httptest.ResponseRecorder, *Batch) {
+	t.Helper()
+	token, err := createJWT(Principal{Subject: "payroll", Role: RoleCustomer}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		return rec, nil
+	}
+	b := new(Batch)
+	if err := json.NewDecoder(rec.Body).Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	return rec, b
+}
+
+func TestAllOrNothingBatch(t *testing.T) {
+	store, server, processor := newBatchFixture(t)
+
+	_, b := submitBatch(t, server, "/batches", "application/json", `{"mode":"all-or-nothing","transfers":[
+		{"fromAccount":1,"toAccount":2,"amount":60},
+		{"fromAccount":1,"toAccount":3,"amount":60}
+	]}`)
+	processor.RunDue()
+	b, _ = store.GetBatch(b.ID)
+	if b.Status != BatchFailed || b.Items[1].Status != ItemFailed || b.Items[0].Status != ItemSkipped {
+		t.Fatalf("unexpected batch after overdraft: %+v %+v %+v", b, b.Items[0], b.Items[1])
+	}
+	if got := balanceOf(t, store, 1); got != 100 {
+		t.Fatalf("failed batch moved money, balance %d", got)
+	}
+
+	_, b = submitBatch(t, server, "/batches", "application/json", `{"transfers":[
+		{"fromAccount":1,"toAccount":2,"amount":60},
+		{"fromAccount":1,"toAccount":3,"amount":40}
+	]}`)
+	processor.RunDue()
+	b, _ = store.GetBatch(b.ID)
+	if b.Status != BatchCompleted || b.Succeeded != 2 {
+		t.Fatalf("unexpected batch: %+v", b)
+	}
+	if got := balanceOf(t, store, 1); got != 0 {
+		t.Fatalf("balance %d after batch, want 0", got)
+	}
+}
+
+func TestBestEffortCSVBatch(t *testing.T) {
+	store, server, processor := newBatchFixture(t)
+
+	_, b := submitBatch(t, server, "/batches?mode=best-effort", "text/csv; charset=utf-8",
+		"fromAccount,toAccount,amount,reference\n1,2,60,jan\n1,3,60,jan\n1,3,40,jan\n")
+	if b == nil || b.Mode != BatchBestEffort || b.Items[0].Reference != "jan" {
+		t.Fatalf("unexpected batch from csv: %+v", b)
+	}
+
+	processor.RunDue()
+	b, _ = store.GetBatch(b.ID)
+	if b.Status != BatchPartial || b.Succeeded != 2 || b.Failed != 1 {
+		t.Fatalf("unexpected batch: %+v", b)
+	}
+	if b.Items[1].Status != ItemFailed || !strings.Contains(b.Items[1].Error, "insufficient funds") {
+		t.Fatalf("unexpected result for the overdraft: %+v", b.Items[1])
+	}
+	if got := balanceOf(t, store, 3); got != 40 {
+		t.Fatalf("balance %d, want 40", got)
+	}
+}
+
+func TestInvalidBatchIsRejectedUpFront(t *testing.T) {
+	store, server, _ := newBatchFixture(t)
+
+	rec, _ := submitBatch(t, server, "/batches", "application/json", `{"transfers":[
+		{"fromAccount":1,"toAccount":2,"amount":10},
+		{"fromAccount":1,"toAccount":9,"amount":10},
+		{"fromAccount":1,"toAccount":2,"amount":0}
+	]}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want 422: %s", rec.Code, rec.Body)
+	}
+	for _, want := range []string{"transfer 1", "transfer 2"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("response doesn't report %s: %s", want, rec.Body)
+		}
+	}
+	if pending, _ := store.PendingBatches(); len(pending) != 0 {
+		t.Fatalf("invalid batch was stored: %+v", pending)
+	}
+}
+
+func TestBatchStopsPayingRemovedPayee(t *testing.T) {
+	for _, mode := range []BatchMode{BatchAllOrNothing, BatchBestEffort} {
+		store, server, processor := newBatchFixture(t)
+		_, b := submitBatch(t, server, "/batches?mode="+string(mode), "application/json", `{"transfers":[
+			{"fromAccount":1,"toAccount":2,"amount":10},
+			{"fromAccount":1,"toAccount":3,"amount":10}
+		]}`)
+		if b == nil || b.Items[1].PayeeID == 0 {
+			t.Fatalf("%s: batch %+v doesn't name its payees", mode, b)
+		}
+		must(t, store.DeletePayee(b.Items[1].PayeeID))
+
+		processor.RunDue()
+		b, _ = store.GetBatch(b.ID)
+		if b.Items[1].Status != ItemFailed || !strings.Contains(b.Items[1].Error, "has been removed") {
+			t.Fatalf("%s: unexpected result for the removed payee: %+v", mode, b.Items[1])
+		}
+		if got := balanceOf(t, store, 3); got != 0 {
+			t.Fatalf("%s: removed payee was paid %d", mode, got)
+		}
+	}
+}
+
+func TestBatchAcrossCurrenciesIsRefused(t *testing.T) {
+	store, server, processor := newBatchFixture(t)
+	store.CreateAccount(&Account{ID: 4, Owner: "carol", Currency: "EUR", Status: StatusActive})
+	savePayee(t, store, 1, 4)
+
+	body := `{"transfers":[
+		{"fromAccount":1,"toAccount":2,"amount":10},
+		{"fromAccount":1,"toAccount":4,"amount":10}
+	]}`
+	if rec, _ := submitBatch(t, server, "/batches", "application/json", body); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "transfer 1") {
+		t.Fatalf("got %d, want 422 for transfer 1: %s", rec.Code, rec.Body)
+	}
+
+	// A batch that got in some other way is failed as a whole before any
+	// of it is posted.
+	b := &Batch{Mode: BatchAllOrNothing, Status: BatchPending, Items: []*BatchItem{
+		{FromAccount: 1, ToAccount: 2, Amount: 10, Status: ItemPending},
+		{FromAccount: 1, ToAccount: 4, Amount: 10, Status: ItemPending},
+	}}
+	must(t, store.CreateBatch(b))
+	processor.RunDue()
+	b, _ = store.GetBatch(b.ID)
+	if b.Status != BatchFailed || !strings.Contains(b.Items[1].Error, "EUR") {
+		t.Fatalf("unexpected batch: %+v %+v", b, b.Items[1])
+	}
+	if got := balanceOf(t, store, 1); got != 100 {
+		t.Fatalf("balance %d after a failed batch, want 100", got)
+	}
+}
+
+func TestAllOrNothingBatchUndoesTransfersWhenOneFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, Owner: "payroll", Balance: 100, Status: StatusActive}))
+	must(t, store.CreateAccount(&Account{ID: 2, Owner: "alice", Status: StatusActive}))
+	processor := NewBatchProcessor(store, NewAuditLog(), NewRiskEngine(store, realClock{}), realClock{})
+
+	// The check lets a transfer to the same account through, but posting
+	// it fails after the first transfer has been made.
+	b := &Batch{Mode: BatchAllOrNothing, Status: BatchPending, Items: []*BatchItem{
+		{FromAccount: 1, ToAccount: 2, Amount: 10, Status: ItemPending},
+		{FromAccount: 1, ToAccount: 1, Amount: 10, Status: ItemPending},
+	}}
+	must(t, store.CreateBatch(b))
+	processor.RunDue()
+
+	reopened, err := OpenMemoryStore(path)
+	must(t, err)
+	for _, s := range []*MemoryStore{store, reopened} {
+		b, _ := s.GetBatch(b.ID)
+		if b.Status != BatchFailed || b.Items[1].Status != ItemFailed || b.Items[0].TransactionID != 0 {
+			t.Fatalf("unexpected batch: %+v %+v %+v", b, b.Items[0], b.Items[1])
+		}
+		if got := balanceOf(t, s, 1); got != 100 {
+			t.Fatalf("balance %d after a failed batch, want 100", got)
+		}
+		if txs, _ := s.GetTransactions(1); len(txs) != 0 {
+			t.Fatalf("%d transactions after a failed batch", len(txs))
+		}
+	}
+}
+
+func TestBatchRiskCountsEarlierTransfers(t *testing.T) {
+	for _, mode := range []BatchMode{BatchAllOrNothing, BatchBestEffort} {
+		t.Run(string(mode), func(t *testing.T) {
+			store, server, processor := newBatchFixture(t)
+			rules := new(RiskRules)
+			if err := json.Unmarshal([]byte(`{"dailyLimit": {"amount": 50, "action": "deny"}}`), rules); err != nil {
+				t.Fatal(err)
+			}
+			processor.risk.SetRules(rules)
+
+			_, b := submitBatch(t, server, "/batches", "application/json", `{"mode":"`+string(mode)+`","transfers":[
+				{"fromAccount":1,"toAccount":2,"amount":30},
+				{"fromAccount":1,"toAccount":3,"amount":30}
+			]}`)
+			processor.RunDue()
+			b, _ = store.GetBatch(b.ID)
+			if b.Items[1].Status != ItemFailed || !strings.Contains(b.Items[1].Error, "daily limit") {
+				t.Fatalf("second transfer passed the limit with the first: %+v", b.Items[1])
+			}
+			decisions := []*RiskDecision{}
+			for id := 1; ; id++ {
+				d, err := store.GetRiskDecision(id)
+				if err != nil {
+					break
+				}
+				decisions = append(decisions, d)
+			}
+			if len(decisions) != 2 || decisions[0].Outcome != RiskAllow || decisions[1].Outcome != RiskDeny || decisions[1].Source != fmt.Sprintf("batch:%d", b.ID) {
+				t.Fatalf("decisions recorded: %+v", decisions)
+			}
+		})
+	}
+}
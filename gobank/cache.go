@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheBackend stores values by key for a while, as memcached does. Values
+// are opaque bytes so a backend can live out of process.
+type CacheBackend interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// LRUCache is an in-process CacheBackend holding up to a fixed number of
+// entries, evicting the least recently used first.
+type LRUCache struct {
+	mu       sync.Mutex
+	capacity int
+	clock    Clock
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRUCache(capacity int, clock Clock) *LRUCache {
+	return &LRUCache{capacity: capacity, clock: clock, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.clock.Now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.clock.Now().Add(ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value = &lruEntry{key, value, expires}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, expires})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// flight is a load in progress that other callers can wait on.
+type flight struct {
+	done chan struct{}
+	acc  *Account
+	err  error
+	// stale is set, under the cache's lock, when the account changes while
+	// the load is under way, so the old account isn't put back.
+	stale bool
+}
+
+// AccountCache reads accounts through a CacheBackend. Concurrent misses for
+// the same account share one store read, and every change to an account
+// drops it from the cache.
+type AccountCache struct {
+	store   Storage
+	backend CacheBackend
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	flights map[int]*flight
+
+	stats *expvar.Map
+}
+
+func NewAccountCache(store Storage, backend CacheBackend, ttl time.Duration) *AccountCache {
+	c := &AccountCache{
+		store:   store,
+		backend: backend,
+		ttl:     ttl,
+		flights: map[int]*flight{},
+		stats:   new(expvar.Map).Init(),
+	}
+	store.OnAccountChange(c.Invalidate)
+	return c
+}
+
+func cacheKey(id int) string {
+	return "account:" + strconv.Itoa(id)
+}
+
+// Get returns the account from the cache, or from the store on a miss.
+func (c *AccountCache) Get(id int) (*Account, error) {
+	if b, ok := c.backend.Get(cacheKey(id)); ok {
+		acc := new(Account)
+		if err := json.Unmarshal(b, acc); err == nil {
+			c.stats.Add("hits", 1)
+			return acc, nil
+		}
+	}
+	c.stats.Add("misses", 1)
+
+	c.mu.Lock()
+	f, ok := c.flights[id]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		c.flights[id] = f
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-f.done
+	} else {
+		c.load(id, f)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	acc := *f.acc
+	return &acc, nil
+}
+
+// load reads the account for a flight and caches it, unless it was
+// invalidated while the read was under way.
+func (c *AccountCache) load(id int, f *flight) {
+	c.stats.Add("loads", 1)
+	f.acc, f.err = c.store.GetAccountByID(id)
+
+	c.mu.Lock()
+	if c.flights[id] == f {
+		delete(c.flights, id)
+	}
+	if !f.stale && f.err == nil {
+		if b, err := json.Marshal(f.acc); err == nil {
+			c.backend.Set(cacheKey(id), b, c.ttl)
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// Invalidate drops the account from the cache. Callers that arrive after it
+// start a fresh read rather than joining one that may have read the old
+// account. Only loads under way are tracked, so nothing is kept for accounts
+// that have been invalidated or evicted.
+func (c *AccountCache) Invalidate(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[id]; ok {
+		f.stale = true
+		delete(c.flights, id)
+	}
+	c.backend.Delete(cacheKey(id))
+	c.stats.Add("invalidations", 1)
+}
+
+// Stats are the cache's counters: hits, misses, loads (store reads after
+// misses were collapsed) and invalidations.
+func (c *AccountCache) Stats() *expvar.Map {
+	return c.stats
+}
+
+// handleMetrics serves the counters of the request's tenant. They aren't
+// published through expvar, which is process-wide and would show every
+// tenant's numbers to any tenant's admin.
+func (s *APIServer) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	vars := map[string]json.RawMessage{}
+	if cache := s.tenant(r).cache; cache != nil {
+		vars["accountCache"] = json.RawMessage(cache.Stats().String())
+	}
+	return WriteJSON(w, http.StatusOK, vars)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsAndExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewLRUCache(2, clock)
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	c.Get("a")
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("recently used entry evicted")
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, ok := c.Get("c"); ok || c.Len() != 1 {
+		t.Errorf("expired entry served, %d left", c.Len())
+	}
+}
+
+// countingStore counts account reads and can hold them until released.
+type countingStore struct {
+	*MemoryStore
+	reads atomic.Int64
+	gate  chan struct{}
+}
+
+func (s *countingStore) GetAccountByID(id int) (*Account, error) {
+	s.reads.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return s.MemoryStore.GetAccountByID(id)
+}
+
+func TestAccountCacheReadsThroughAndInvalidates(t *testing.T) {
+	mem := NewMemoryStore()
+	mem.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive})
+	mem.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	store := &countingStore{MemoryStore: mem}
+	cache := NewAccountCache(store, NewLRUCache(10, realClock{}), time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if acc, err := cache.Get(1); err != nil || acc.Balance != 100 {
+			t.Fatalf("get: %+v %v", acc, err)
+		}
+	}
+	if n := store.reads.Load(); n != 1 {
+		t.Fatalf("%d store reads for three gets", n)
+	}
+
+	if _, _, err := mem.Transfer(1, 2, 30); err != nil {
+		t.Fatal(err)
+	}
+	acc, err := cache.Get(1)
+	if err != nil || acc.Balance != 70 || acc.Version != 2 {
+		t.Fatalf("stale account after a transfer: %+v %v", acc, err)
+	}
+	if _, err := cache.Get(9); err == nil {
+		t.Fatal("missing account found")
+	}
+	stats := cache.Stats()
+	for k, want := range map[string]string{"hits": "2", "misses": "3", "loads": "3", "invalidations": "2"} {
+		if got := stats.Get(k); got == nil || got.String() != want {
+			t.Errorf("%s = %v, want %s", k, got, want)
+		}
+	}
+}
+
+func TestAccountCacheCollapsesConcurrentMisses(t *testing.T) {
+	mem := NewMemoryStore()
+	mem.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store := &countingStore{MemoryStore: mem, gate: make(chan struct{})}
+	cache := NewAccountCache(store, NewLRUCache(10, realClock{}), time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Get(1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Let the readers pile up behind the first one before it finishes.
+	for cache.Stats().Get("misses") == nil || cache.Stats().Get("misses").String() != "20" {
+		time.Sleep(time.Millisecond)
+	}
+	close(store.gate)
+	wg.Wait()
+	if n := store.reads.Load(); n != 1 {
+		t.Fatalf("%d store reads for 20 concurrent misses", n)
+	}
+}
+
+func TestAccountCacheDropsLoadsRacingAWrite(t *testing.T) {
+	mem := NewMemoryStore()
+	mem.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store := &countingStore{MemoryStore: mem, gate: make(chan struct{})}
+	cache := NewAccountCache(store, NewLRUCache(10, realClock{}), time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Get(1)
+	}()
+	for store.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The account changes after the read started; whatever it read mustn't
+	// be cached.
+	if _, err := mem.SetAccountStatus(1, "", StatusFrozen, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(store.gate)
+	<-done
+
+	store.gate = nil
+	if acc, err := cache.Get(1); err != nil || acc.Status != StatusFrozen {
+		t.Fatalf("got %+v %v after the change", acc, err)
+	}
+}
+
+func TestCacheStatsArePerTenant(t *testing.T) {
+	server, storeA, _ := newTenantServer(t)
+	tenantA, _ := server.tenants.Get("a")
+	tenantA.cache = NewAccountCache(storeA, NewLRUCache(10, realClock{}), time.Minute)
+	tenantA.cache.Get(1)
+
+	metrics := func(tenant string) map[string]json.RawMessage {
+		p := Principal{Subject: "root", Role: RoleAdmin, Tenant: tenant}
+		res := customerRequest(t, server, p, "GET", "http://"+tenant+".bank.test/debug/vars", "")
+		vars := map[string]json.RawMessage{}
+		if err := json.Unmarshal(res.Body.Bytes(), &vars); err != nil {
+			t.Fatalf("%d %s", res.Code, res.Body)
+		}
+		return vars
+	}
+	if _, ok := metrics("a")["accountCache"]; !ok {
+		t.Fatal("a's admin can't see a's cache")
+	}
+	if vars := metrics("b"); len(vars) != 0 {
+		t.Fatalf("b's admin sees %v", vars)
+	}
+}
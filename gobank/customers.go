@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type KYCStatus string
+
+const (
+	KYCPending  KYCStatus = "pending"
+	KYCVerified KYCStatus = "verified"
+	KYCRejected KYCStatus = "rejected"
+)
+
+func (k KYCStatus) Valid() bool {
+	return k == KYCPending || k == KYCVerified || k == KYCRejected
+}
+
+// Customer is the person behind one or more accounts. Each principal is at
+// most one customer. The customer is where names are kept: accounts carry a
+// copy, which is brought up to date when the customer's names change.
+type Customer struct {
+	ID        int       `json:"id"`
+	Owner     string    `json:"owner"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Email     string    `json:"email,omitempty"`
+	Phone     string    `json:"phone,omitempty"`
+	KYCStatus KYCStatus `json:"kycStatus"`
+	// Version goes up by one with every change to the customer.
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// ErasedAt is set once the customer's personal data has been erased.
+	ErasedAt *time.Time `json:"erasedAt,omitempty"`
+}
+
+type CreateCustomerRequest struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email,omitempty"`
+	Phone     string `json:"phone,omitempty"`
+	// Owner is only honoured for roles that may create customers for anyone;
+	// everyone else becomes the customer they create.
+	Owner string `json:"owner,omitempty"`
+}
+
+type OpenAccountRequest struct {
+	Product  string `json:"product,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+func NewCustomer(req *CreateCustomerRequest, owner string, now time.Time) (*Customer, error) {
+	if req.FirstName == "" || req.LastName == "" {
+		return nil, fmt.Errorf("firstName and lastName are required")
+	}
+	if err := validateEmail(req.Email); err != nil {
+		return nil, err
+	}
+	return &Customer{
+		Owner:     owner,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		KYCStatus: KYCPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if a, err := mail.ParseAddress(email); err != nil || a.Address != email {
+		return fmt.Errorf("invalid email %s", email)
+	}
+	return nil
+}
+
+// CustomerPatch is the set of changes in a JSON Merge Patch of a customer. A
+// nil field is left alone.
+type CustomerPatch struct {
+	FirstName *string
+	LastName  *string
+	// Email and Phone are set to the empty string when the patch clears them.
+	Email     *string
+	Phone     *string
+	KYCStatus *KYCStatus
+}
+
+func (p *CustomerPatch) apply(c *Customer) {
+	if p.FirstName != nil {
+		c.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		c.LastName = *p.LastName
+	}
+	if p.Email != nil {
+		c.Email = *p.Email
+	}
+	if p.Phone != nil {
+		c.Phone = *p.Phone
+	}
+	if p.KYCStatus != nil {
+		c.KYCStatus = *p.KYCStatus
+	}
+}
+
+// renames reports whether the patch changes the names copied onto accounts.
+func (p *CustomerPatch) renames() bool {
+	return p.FirstName != nil || p.LastName != nil
+}
+
+// parseCustomerPatch reads a merge patch, rejecting fields that can't be
+// changed this way.
+func parseCustomerPatch(r io.Reader) (*CustomerPatch, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r).Decode(&fields); err != nil {
+		return nil, err
+	}
+	p := &CustomerPatch{}
+	for name, raw := range fields {
+		var dst **string
+		switch name {
+		case "firstName":
+			dst = &p.FirstName
+		case "lastName":
+			dst = &p.LastName
+		case "email":
+			dst = &p.Email
+		case "phone":
+			dst = &p.Phone
+		case "kycStatus":
+		default:
+			return nil, fmt.Errorf("field %s cannot be changed", name)
+		}
+		v := ""
+		if string(raw) == "null" {
+			if name != "email" && name != "phone" {
+				return nil, fmt.Errorf("field %s cannot be removed", name)
+			}
+		} else if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		if name == "kycStatus" {
+			status := KYCStatus(v)
+			if !status.Valid() {
+				return nil, fmt.Errorf("unknown kyc status %s", v)
+			}
+			p.KYCStatus = &status
+			continue
+		}
+		if (name == "firstName" || name == "lastName") && v == "" {
+			return nil, fmt.Errorf("field %s cannot be empty", name)
+		}
+		*dst = &v
+	}
+	if p.Email != nil {
+		if err := validateEmail(*p.Email); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func customerETag(c *Customer) string {
+	return fmt.Sprintf("\"%d\"", c.Version)
+}
+
+func (s *APIServer) handleCustomers(w http.ResponseWriter, r *http.Request) error {
+	p := principalFrom(r)
+	if r.Method == "GET" {
+		owner := p.Subject
+		if rolePermissions[p.Role][PermReadCustomer] == scopeAny {
+			owner = r.URL.Query().Get("owner")
+		}
+		customers, err := s.storage(r).GetCustomers(owner)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, customers)
+	}
+
+	req := new(CreateCustomerRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	owner := p.Subject
+	if req.Owner != "" && rolePermissions[p.Role][PermCreateCustomer] == scopeAny {
+		owner = req.Owner
+	}
+	customer, err := NewCustomer(req, owner, s.clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if err := s.storage(r).CreateCustomer(customer); err != nil {
+		return err
+	}
+	s.recordCustomerAudit(r, "customer.create", customer.ID)
+	w.Header().Set("ETag", customerETag(customer))
+	return WriteJSON(w, http.StatusCreated, customer)
+}
+
+func (s *APIServer) handleCustomerByID(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		customer, err := s.customerFor(r, PermReadCustomer)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("ETag", customerETag(customer))
+		return WriteJSON(w, http.StatusOK, customer)
+	}
+
+	customer, err := s.customerFor(r, PermUpdateCustomer)
+	if err != nil {
+		return err
+	}
+	ifVersion, err := ifMatchVersion(r, func() (int, error) { return customer.Version, nil })
+	if err != nil {
+		return err
+	}
+	patch, err := parseCustomerPatch(r.Body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	// Only those who verify customers may change how far they got.
+	if patch.KYCStatus != nil {
+		if err := checkPermission(r, PermVerifyCustomer); err != nil {
+			return err
+		}
+	}
+
+	customer, changes, err := s.storage(r).PatchCustomer(customer.ID, patch, ifVersion, s.clock.Now().UTC())
+	if errors.Is(err, ErrVersionConflict) {
+		return httpError{Status: http.StatusPreconditionFailed, Msg: err.Error()}
+	}
+	if err != nil {
+		return err
+	}
+	s.recordCustomerAudit(r, "customer.update", customer.ID)
+	// Identity checks decide whether the customer may move money, so the
+	// outcome gets an entry of its own.
+	if patch.KYCStatus != nil {
+		s.recordCustomerAudit(r, "customer.kyc."+string(*patch.KYCStatus), customer.ID)
+	}
+	for _, id := range changes.ids() {
+		s.recordAudit(r, "account.update", id, changes.before(id), changes.after(id))
+	}
+	w.Header().Set("ETag", customerETag(customer))
+	return WriteJSON(w, http.StatusOK, customer)
+}
+
+// handleCustomerAccounts lists a customer's accounts, or opens another one
+// for them in their name.
+func (s *APIServer) handleCustomerAccounts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		customer, err := s.customerFor(r, PermReadAccount)
+		if err != nil {
+			return err
+		}
+		q, err := parseAccountQuery(r)
+		if err != nil {
+			return err
+		}
+		q.CustomerID = customer.ID
+		page, err := s.storage(r).ListAccounts(q)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, page)
+	}
+
+	customer, err := s.customerFor(r, PermCreateAccount)
+	if err != nil {
+		return err
+	}
+	req := new(OpenAccountRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && err != io.EOF {
+		return err
+	}
+	defer r.Body.Close()
+	account := NewAccount(customer.FirstName, customer.LastName, customer.Owner)
+	account.CustomerID = customer.ID
+	account.Product = req.Product
+	account.Currency = req.Currency
+	if err := s.createAccount(r, account); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, account)
+}
+
+// customerFor loads the customer named in the path, checking that the caller
+// may use perm on them.
+func (s *APIServer) customerFor(r *http.Request, perm Permission) (*Customer, error) {
+	idStr := mux.Vars(r)["customerId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer id given %s", idStr)
+	}
+	if err := checkPermission(r, perm); err != nil {
+		return nil, err
+	}
+	customer, err := s.storage(r).GetCustomer(id)
+	p := principalFrom(r)
+	if rolePermissions[p.Role][perm] == scopeAny {
+		return customer, err
+	}
+	if err != nil || customer.Owner != p.Subject {
+		return nil, denied(r, http.StatusForbidden, fmt.Sprintf("customer %d is not %s", id, p.Subject))
+	}
+	return customer, nil
+}
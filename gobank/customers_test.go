@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func customerRequest(t *testing.T, server *APIServer, p Principal, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := createJWT(p, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCustomerAccounts(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewAPIServer("", store, NewAuditLog())
+	products, err := indexInterestProducts(defaultInterestProducts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.products = products
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+
+	rec := customerRequest(t, server, alice, "POST", "/customers", `{"firstName":"Ada","lastName":"Byron","email":"ada@example.com"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	var customer Customer
+	json.Unmarshal(rec.Body.Bytes(), &customer)
+	if customer.Owner != "alice" || customer.KYCStatus != KYCPending {
+		t.Fatalf("created %+v", customer)
+	}
+	if rec := customerRequest(t, server, alice, "POST", "/customers", `{"firstName":"Ada","lastName":"Byron"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("second customer for alice: %d %s", rec.Code, rec.Body)
+	}
+
+	for _, product := range []string{"checking", "savings"} {
+		rec := customerRequest(t, server, alice, "POST", "/customers/1/accounts", `{"product":"`+product+`"}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("open %s: %d %s", product, rec.Code, rec.Body)
+		}
+	}
+	rec = customerRequest(t, server, alice, "GET", "/customers/1/accounts", "")
+	var page AccountPage
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	if len(page.Accounts) != 2 {
+		t.Fatalf("listed %d accounts, want 2", len(page.Accounts))
+	}
+	for _, acc := range page.Accounts {
+		if acc.CustomerID != 1 || acc.Owner != "alice" || acc.LastName != "Byron" {
+			t.Errorf("account %+v", acc)
+		}
+	}
+
+	carol := Principal{Subject: "carol", Role: RoleCustomer}
+	if rec := customerRequest(t, server, carol, "GET", "/customers/1", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("carol read alice: %d", rec.Code)
+	}
+	if rec := customerRequest(t, server, carol, "POST", "/customers/1/accounts", `{}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("carol opened an account for alice: %d", rec.Code)
+	}
+	if rec := customerRequest(t, server, alice, "PATCH", "/customers/1", `{"kycStatus":"verified"}`, "If-Match", `"1"`); rec.Code != http.StatusForbidden {
+		t.Fatalf("alice verified herself: %d %s", rec.Code, rec.Body)
+	}
+	rec = customerRequest(t, server, admin, "PATCH", "/customers/1", `{"kycStatus":"verified"}`, "If-Match", `"1"`)
+	json.Unmarshal(rec.Body.Bytes(), &customer)
+	if rec.Code != http.StatusOK || customer.KYCStatus != KYCVerified || rec.Header().Get("ETag") != `"2"` {
+		t.Fatalf("verify: %d %s", rec.Code, rec.Body)
+	}
+	if rec := customerRequest(t, server, alice, "PATCH", "/customers/1", `{"lastName":"Lovelace"}`, "If-Match", `"1"`); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("stale patch: %d", rec.Code)
+	}
+	if rec := customerRequest(t, server, alice, "PATCH", "/customers/1", `{"lastName":"Lovelace"}`, "If-Match", `"2"`); rec.Code != http.StatusOK {
+		t.Fatalf("rename: %d %s", rec.Code, rec.Body)
+	}
+	for _, acc := range page.Accounts {
+		got, _ := store.GetAccountByID(acc.ID)
+		if got.LastName != "Lovelace" || got.Version != acc.Version+1 {
+			t.Errorf("account %d after rename: %+v", acc.ID, got)
+		}
+	}
+
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	var actions []string
+	for _, e := range tenant.audit.Query(AuditQuery{}) {
+		if strings.HasPrefix(e.Action, "customer.") && e.Subject != customerSubject(1) {
+			t.Errorf("%s entry has subject %q", e.Action, e.Subject)
+		}
+		if e.Action == "account.update" && (e.Before == nil || e.After == nil || e.After.Version != e.Before.Version+1) {
+			t.Errorf("rename entry %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	want := "customer.create account.create account.create customer.update customer.kyc.verified customer.update account.update account.update"
+	if got := strings.Join(actions, " "); got != want {
+		t.Fatalf("audited %s, want %s", got, want)
+	}
+}
+
+func TestCustomerMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	legacy := `{"accounts": {
+		"1": {"id": 1, "firstName": "Ada", "lastName": "Byron", "owner": "alice", "createdAt": "2024-01-01T00:00:00Z"},
+		"2": {"id": 2, "firstName": "A", "lastName": "Lovelace", "owner": "alice", "createdAt": "2025-01-01T00:00:00Z"},
+		"3": {"id": 3, "firstName": "Bob", "lastName": "B", "owner": "bob", "createdAt": "2024-06-01T00:00:00Z"},
+		"4": {"id": 4, "createdAt": "2024-06-01T00:00:00Z"}
+	}}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenMemoryStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		customers, _ := store.GetCustomers("")
+		if len(customers) != 2 {
+			t.Fatalf("open %d: %d customers, want 2", i, len(customers))
+		}
+		alice, _ := store.GetCustomers("alice")
+		if len(alice) != 1 || alice[0].LastName != "Byron" || alice[0].KYCStatus != KYCPending {
+			t.Fatalf("open %d: alice is %+v", i, alice)
+		}
+		for id, want := range map[int]int{1: alice[0].ID, 2: alice[0].ID, 4: 0} {
+			if acc, _ := store.GetAccountByID(id); acc.CustomerID != want {
+				t.Errorf("open %d: account %d has customer %d, want %d", i, id, acc.CustomerID, want)
+			}
+		}
+		if bob, _ := store.GetAccountByID(3); bob.CustomerID == alice[0].ID || bob.CustomerID == 0 {
+			t.Errorf("open %d: bob's account has customer %d", i, bob.CustomerID)
+		}
+		// Accounts carry their customer's names, not the ones they were
+		// opened with.
+		if acc, _ := store.GetAccountByID(2); acc.FirstName != "Ada" || acc.LastName != "Byron" {
+			t.Errorf("open %d: account 2 is in the name of %s %s", i, acc.FirstName, acc.LastName)
+		}
+	}
+}
+
+func TestRejectedCustomerCannotMoveMoney(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Byron", Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, FirstName: "Bob", Owner: "bob", Balance: 100, Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+
+	// The admin opens alice's second account under her customer's names.
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+	rec := customerRequest(t, server, admin, "POST", "/account", `{"firstName":"Someone","lastName":"Else","owner":"alice"}`)
+	var opened Account
+	json.Unmarshal(rec.Body.Bytes(), &opened)
+	if rec.Code != http.StatusCreated || opened.FirstName != "Ada" || opened.LastName != "Byron" {
+		t.Fatalf("open: %d %s", rec.Code, rec.Body)
+	}
+
+	rejected := KYCRejected
+	if _, _, err := store.PatchCustomer(opened.CustomerID, &CustomerPatch{KYCStatus: &rejected}, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := customerRequest(t, server, alice, "POST", "/customers/1/accounts", `{}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "identity checks") {
+		t.Errorf("rejected customer opened an account: %d %s", rec.Code, rec.Body)
+	}
+	if rec := customerRequest(t, server, alice, "POST", "/transfer", `{"fromAccount":1,"toAccount":`+strconv.Itoa(opened.ID)+`,"amount":10}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "identity checks") {
+		t.Errorf("rejected customer made a transfer: %d %s", rec.Code, rec.Body)
+	}
+	if _, _, err := store.Transfer(1, 2, 10); !errors.Is(err, ErrCustomerRejected) {
+		t.Errorf("transfer from a rejected customer: %v", err)
+	}
+	h, _ := NewHold(1, &PlaceHoldRequest{ToAccount: 2, Amount: 10}, time.Now())
+	if _, err := store.PlaceHold(h); !errors.Is(err, ErrCustomerRejected) {
+		t.Errorf("hold for a rejected customer: %v", err)
+	}
+	// Money can still come in.
+	if _, _, err := store.Transfer(2, 1, 10); err != nil {
+		t.Errorf("transfer to a rejected customer: %v", err)
+	}
+}
+
+func TestOwnAccountTransferSkipsNewPayee(t *testing.T) {
+	store, engine := newRiskFixture(t, `{"newPayee": {"amount": 50}}`)
+	store.CreateAccount(&Account{ID: 4, Owner: "alice", Balance: 1000, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 5, Owner: "alice", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 6, Owner: "bob", Status: StatusActive})
+
+	if d := guardTransfer(t, store, engine, 4, 5, 200); d.Outcome != RiskAllow {
+		t.Fatalf("own accounts: %s %v", d.Outcome, d.Reasons)
+	}
+	if d := guardTransfer(t, store, engine, 4, 6, 200); d.Outcome != RiskHold {
+		t.Fatalf("another customer: %s, want a hold", d.Outcome)
+	}
+}
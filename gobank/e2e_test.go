@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// e2eNow is the server clock in the end-to-end tests.
+var e2eNow = time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+
+var e2ePrincipals = map[string]*Principal{
+	"anonymous": nil,
+	"alice":     {Subject: "alice", Role: RoleCustomer},
+	"carol":     {Subject: "carol", Role: RoleCustomer},
+	"support":   {Subject: "sam", Role: RoleSupport},
+	"admin":     {Subject: "root", Role: RoleAdmin},
+}
+
+// newE2EServer boots the router against a seeded in-memory store. Account 1
+// belongs to alice and has a transfer, a schedule, a hold and a held review
+// against it; account 2 belongs to bob; account 3 is alice's and frozen.
+func newE2EServer(t *testing.T) (*APIServer, *MemoryStore) {
+	t.Helper()
+	store := NewMemoryStore()
+	for _, acc := range []*Account{
+		{ID: 1, FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Number: 111, Balance: 1000, Status: StatusActive},
+		{ID: 2, FirstName: "Grace", LastName: "Hopper", Owner: "bob", Number: 222, Balance: 500, Status: StatusActive},
+		{ID: 3, FirstName: "Ada", LastName: "Savings", Owner: "alice", Number: 333, Status: StatusFrozen},
+	} {
+		acc.CreatedAt = e2eNow.AddDate(0, -1, 0)
+		must(t, store.CreateAccount(acc))
+	}
+	savePayee(t, store, 1, 2)
+
+	store.mu.Lock()
+	_, err := store.transfer(1, 2, 100, e2eNow.Add(-time.Hour))
+	store.mu.Unlock()
+	must(t, err)
+
+	st, err := NewScheduledTransfer(1, &ScheduleTransferRequest{
+		ToAccount: 2, Amount: 10, Frequency: FrequencyMonthly, StartAt: e2eNow.AddDate(0, 0, 1),
+	}, e2eNow)
+	must(t, err)
+	must(t, store.CreateScheduledTransfer(st))
+
+	h, err := NewHold(1, &PlaceHoldRequest{ToAccount: 2, Amount: 50, Description: "card"}, e2eNow)
+	must(t, err)
+	_, err = store.PlaceHold(h)
+	must(t, err)
+
+	must(t, store.CreateWebhook(&Webhook{
+		Owner: "alice", URL: "https://hooks.example.com/gobank", Events: []string{EventAccountCreated},
+		Secret: "s3cret", CreatedAt: e2eNow,
+	}))
+	must(t, store.RecordRiskDecision(&RiskDecision{
+		FromAccount: 1, ToAccount: 2, Amount: 20, Source: "api", Outcome: RiskHold,
+		Reasons: []string{"first transfer to 2 is over 10"}, CreatedAt: e2eNow, Review: ReviewPending,
+	}))
+	must(t, store.CreateBatch(&Batch{
+		Owner: "alice", Mode: BatchBestEffort, Status: BatchPending, CreatedAt: e2eNow,
+		Items: []*BatchItem{{FromAccount: 1, ToAccount: 2, Amount: 5, Status: ItemPending}},
+	}))
+
+	server := NewAPIServer("", store, NewAuditLog())
+	server.clock = &fakeClock{now: e2eNow}
+	server.products, err = indexInterestProducts(defaultInterestProducts)
+	must(t, err)
+	return server, store
+}
+
+func TestMain(m *testing.M) {
+	// Tests sign and check their tokens, and protect personal data, with the
+	// development keys.
+	jwtKey = []byte(devJWTSecret)
+	configurePIIKey(true)
+	os.Exit(m.Run())
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func e2eRequest(t *testing.T, as, method, path, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if p := e2ePrincipals[as]; p != nil {
+		token, err := createJWT(*p, time.Minute)
+		must(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// normalizeJSON replaces the parts of a response that change from run to run
+// (generated IDs and secrets, and the fields named in volatile, such as times
+// the store takes from the wall clock) and indents it.
+func normalizeJSON(t *testing.T, body []byte, volatile ...string) []byte {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, body)
+	}
+	keys := map[string]bool{"secret": true, "requestId": true, "hash": true, "prevHash": true, "eventId": true}
+	for _, k := range volatile {
+		keys[k] = true
+	}
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, val := range v {
+				if keys[k] {
+					v[k] = "<" + k + ">"
+				} else {
+					v[k] = walk(val)
+				}
+			}
+		case []any:
+			for i := range v {
+				v[i] = walk(v[i])
+			}
+		}
+		return v
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	must(t, enc.Encode(walk(v)))
+	return out.Bytes()
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *updateGolden {
+		must(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		must(t, os.WriteFile(path, got, 0o644))
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response differs from %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestRoutesEndToEnd(t *testing.T) {
+	tests := []struct {
+		name     string
+		as       string
+		method   string
+		path     string
+		body     string
+		header   map[string]string
+		status   int
+		golden   string
+		volatile []string
+	}{
+		{name: "create account", as: "alice", method: "POST", path: "/account", body: `{"firstName":"Alan","lastName":"Turing","product":"savings"}`, status: 201, golden: "create_account.json", volatile: []string{"id", "number", "createdAt"}},
+		{name: "create account bad json", as: "alice", method: "POST", path: "/account", body: `{`, status: 400, golden: "create_account_bad_json.json"},
+		{name: "create account unknown product", as: "alice", method: "POST", path: "/account", body: `{"firstName":"A","product":"gold"}`, status: 400, golden: "create_account_unknown_product.json"},
+		{name: "create account anonymous", as: "anonymous", method: "POST", path: "/account", body: `{}`, status: 401, golden: "unauthenticated.json"},
+		{name: "create account support", as: "support", method: "POST", path: "/account", body: `{}`, status: 403, golden: "create_account_support.json"},
+		{name: "method not allowed", as: "admin", method: "PUT", path: "/account/1", status: 405, golden: "method_not_allowed.json"},
+
+		{name: "list accounts", as: "admin", method: "GET", path: "/accounts?sort=-balance&total=true", status: 200, golden: "list_accounts.json"},
+		{name: "list own accounts", as: "alice", method: "GET", path: "/accounts?limit=1", status: 200, golden: "list_accounts_own.json"},
+		{name: "list accounts bad sort", as: "admin", method: "GET", path: "/accounts?sort=owner", status: 400, golden: "list_accounts_bad_sort.json"},
+		{name: "list accounts bad cursor", as: "admin", method: "GET", path: "/accounts?cursor=nope", status: 400, golden: "list_accounts_bad_cursor.json"},
+
+		{name: "get account", as: "alice", method: "GET", path: "/account/1", status: 200, golden: "get_account.json"},
+		{name: "get account not owned", as: "carol", method: "GET", path: "/account/1", status: 403, golden: "get_account_not_owned.json"},
+		{name: "get account bad id", as: "admin", method: "GET", path: "/account/abc", status: 400, golden: "get_account_bad_id.json"},
+		{name: "get account missing", as: "admin", method: "GET", path: "/account/99", status: 404, golden: "get_account_missing.json"},
+		{name: "patch account", as: "alice", method: "PATCH", path: "/account/1", body: `{"product":null}`, header: map[string]string{"If-Match": `"3"`}, status: 200, golden: "patch_account.json"},
+		{name: "patch account names", as: "alice", method: "PATCH", path: "/account/1", body: `{"lastName":"King"}`, header: map[string]string{"If-Match": `"4"`}, status: 400, golden: "patch_account_names.json"},
+		{name: "patch account without if-match", as: "alice", method: "PATCH", path: "/account/1", body: `{"product":null}`, status: 428, golden: "patch_account_no_if_match.json"},
+		{name: "patch account stale", as: "alice", method: "PATCH", path: "/account/1", body: `{"product":null}`, header: map[string]string{"If-Match": `"1"`}, status: 412, golden: "patch_account_stale.json"},
+		{name: "patch account read-only field", as: "alice", method: "PATCH", path: "/account/1", body: `{"balance":1}`, header: map[string]string{"If-Match": `"3"`}, status: 400, golden: "patch_account_read_only.json"},
+		{name: "delete account with balance", as: "alice", method: "DELETE", path: "/account/1", header: map[string]string{"If-Match": `"3"`}, status: 400, golden: "delete_account_balance.json"},
+		{name: "freeze account", as: "admin", method: "POST", path: "/account/2/freeze", status: 200, golden: "freeze_account.json"},
+		{name: "freeze account as customer", as: "alice", method: "POST", path: "/account/1/freeze", status: 403, golden: "freeze_account_customer.json"},
+		{name: "unfreeze account", as: "admin", method: "POST", path: "/account/3/unfreeze", status: 200, golden: "unfreeze_account.json"},
+		{name: "close account", as: "alice", method: "POST", path: "/account/3/close", status: 200, golden: "close_account.json", volatile: []string{"closedAt"}},
+		{name: "reopen active account", as: "admin", method: "POST", path: "/account/1/reopen", status: 400, golden: "reopen_active_account.json"},
+
+		{name: "transactions", as: "alice", method: "GET", path: "/account/1/transactions", status: 200, golden: "transactions.json"},
+		{name: "statement", as: "alice", method: "GET", path: "/account/1/statements/2026-03", status: 200, golden: "statement.json"},
+		{name: "statement csv", as: "alice", method: "GET", path: "/account/1/statements/2026-03?format=csv", status: 200, golden: "statement.csv"},
+		{name: "statement text", as: "alice", method: "GET", path: "/account/1/statements/2026-03", header: map[string]string{"Accept": "text/plain"}, status: 200, golden: "statement.txt"},
+		{name: "statement bad period", as: "alice", method: "GET", path: "/account/1/statements/2026-13", status: 400, golden: "statement_bad_period.json"},
+
+		{name: "list schedules", as: "alice", method: "GET", path: "/account/1/schedules", status: 200, golden: "list_schedules.json"},
+		{name: "create schedule", as: "alice", method: "POST", path: "/account/1/schedules", body: `{"toAccount":2,"amount":25,"frequency":"weekly","startAt":"2026-03-20T09:00:00Z"}`, status: 201, golden: "create_schedule.json"},
+		{name: "create schedule in the past", as: "alice", method: "POST", path: "/account/1/schedules", body: `{"toAccount":2,"amount":25,"startAt":"2026-01-01T09:00:00Z"}`, status: 400, golden: "create_schedule_past.json"},
+		{name: "get schedule", as: "support", method: "GET", path: "/account/1/schedules/1", status: 200, golden: "get_schedule.json"},
+		{name: "get schedule on another account", as: "admin", method: "GET", path: "/account/2/schedules/1", status: 404, golden: "get_schedule_wrong_account.json"},
+		{name: "cancel schedule", as: "alice", method: "DELETE", path: "/account/1/schedules/1", status: 200, golden: "cancel_schedule.json"},
+
+		{name: "list holds", as: "alice", method: "GET", path: "/account/1/holds", status: 200, golden: "list_holds.json"},
+		{name: "place hold", as: "alice", method: "POST", path: "/account/1/holds", body: `{"toAccount":2,"amount":30,"description":"hotel","expiresAt":"2026-03-20T00:00:00Z"}`, status: 201, golden: "place_hold.json"},
+		{name: "place hold over available", as: "alice", method: "POST", path: "/account/1/holds", body: `{"toAccount":2,"amount":900}`, status: 400, golden: "place_hold_over_available.json"},
+		{name: "get hold", as: "alice", method: "GET", path: "/account/1/holds/1", status: 200, golden: "get_hold.json"},
+		{name: "capture hold", as: "alice", method: "POST", path: "/account/1/holds/1/capture", body: `{"amount":20}`, status: 200, golden: "capture_hold.json"},
+		{name: "capture hold too much", as: "alice", method: "POST", path: "/account/1/holds/1/capture", body: `{"amount":60}`, status: 400, golden: "capture_hold_too_much.json"},
+		{name: "release hold", as: "admin", method: "POST", path: "/account/1/holds/1/release", status: 200, golden: "release_hold.json"},
+
+		{name: "transfer", as: "alice", method: "POST", path: "/transfer", body: `{"fromAccount":1,"toAccount":2,"amount":5}`, status: 200, golden: "transfer.json", volatile: []string{"createdAt"}},
+		{name: "transfer insufficient funds", as: "alice", method: "POST", path: "/transfer", body: `{"fromAccount":1,"toAccount":2,"amount":900}`, status: 400, golden: "transfer_insufficient_funds.json"},
+		{name: "transfer to same account", as: "alice", method: "POST", path: "/transfer", body: `{"fromAccount":1,"toAccount":1,"amount":5}`, status: 400, golden: "transfer_same_account.json"},
+		{name: "transfer from frozen account", as: "alice", method: "POST", path: "/transfer", body: `{"fromAccount":3,"toAccount":2,"amount":5}`, status: 400, golden: "transfer_frozen.json"},
+		{name: "transfer not owned", as: "carol", method: "POST", path: "/transfer", body: `{"fromAccount":1,"toAccount":2,"amount":5}`, status: 403, golden: "transfer_not_owned.json"},
+
+		{name: "create batch", as: "alice", method: "POST", path: "/batches", body: `{"mode":"best-effort","transfers":[{"fromAccount":1,"toAccount":2,"amount":5,"reference":"r1"}]}`, status: 202, golden: "create_batch.json", volatile: []string{"id"}},
+		{name: "create invalid batch", as: "alice", method: "POST", path: "/batches", body: `{"transfers":[{"fromAccount":1,"toAccount":1,"amount":5}]}`, status: 422, golden: "create_batch_invalid.json"},
+		{name: "get batch", as: "alice", method: "GET", path: "/batches/1", status: 200, golden: "get_batch.json"},
+		{name: "get batch of someone else", as: "carol", method: "GET", path: "/batches/1", status: 404, golden: "get_batch_not_owned.json"},
+
+		{name: "audit", as: "admin", method: "GET", path: "/audit?account=1", status: 200, golden: "audit.json"},
+		{name: "audit bad since", as: "admin", method: "GET", path: "/audit?since=yesterday", status: 400, golden: "audit_bad_since.json"},
+		{name: "audit as customer", as: "alice", method: "GET", path: "/audit", status: 403, golden: "audit_customer.json"},
+
+		{name: "list reviews", as: "support", method: "GET", path: "/reviews", status: 200, golden: "list_reviews.json"},
+		{name: "approve review", as: "admin", method: "POST", path: "/reviews/1/approve", status: 200, golden: "approve_review.json"},
+		{name: "reject review", as: "admin", method: "POST", path: "/reviews/1/reject", status: 200, golden: "reject_review.json"},
+		{name: "approve missing review", as: "admin", method: "POST", path: "/reviews/9/approve", status: 404, golden: "approve_missing_review.json"},
+		{name: "approve review as support", as: "support", method: "POST", path: "/reviews/1/approve", status: 403, golden: "approve_review_support.json"},
+
+		{name: "list webhooks", as: "alice", method: "GET", path: "/webhooks", status: 200, golden: "list_webhooks.json"},
+		{name: "create webhook", as: "alice", method: "POST", path: "/webhooks", body: `{"url":"https://example.com/in","events":["transfer.completed"]}`, status: 201, golden: "create_webhook.json"},
+		{name: "create webhook bad url", as: "alice", method: "POST", path: "/webhooks", body: `{"url":"ftp://example.com","events":["transfer.completed"]}`, status: 400, golden: "create_webhook_bad_url.json"},
+		{name: "create webhook for all accounts", as: "alice", method: "POST", path: "/webhooks", body: `{"url":"https://example.com/in","events":["transfer.completed"],"allAccounts":true}`, status: 403, golden: "create_webhook_all_accounts.json"},
+		{name: "get webhook", as: "alice", method: "GET", path: "/webhooks/1", status: 200, golden: "get_webhook.json"},
+		{name: "get webhook of someone else", as: "carol", method: "GET", path: "/webhooks/1", status: 404, golden: "get_webhook_not_owned.json"},
+		{name: "delete webhook", as: "alice", method: "DELETE", path: "/webhooks/1", status: 200, golden: "delete_webhook.json"},
+		{name: "webhook deliveries", as: "alice", method: "GET", path: "/webhooks/1/deliveries", status: 200, golden: "webhook_deliveries.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newE2EServer(t)
+			ts := httptest.NewServer(server.routes())
+			defer ts.Close()
+
+			req := e2eRequest(t, tt.as, tt.method, ts.URL+tt.path, tt.body)
+			req.RequestURI = ""
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			must(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			must(t, err)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if strings.HasSuffix(tt.golden, ".json") {
+				body = normalizeJSON(t, body, tt.volatile...)
+			}
+			checkGolden(t, tt.golden, body)
+		})
+	}
+}
+
+func TestAccountEventsStream(t *testing.T) {
+	server, _ := newE2EServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := e2eRequest(t, "alice", "GET", "/account/1/events", "").WithContext(ctx)
+	req.Header.Set("Last-Event-ID", "0")
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	for _, want := range []string{"event: account.created", "event: transfer.completed", "event: hold.placed"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("stream is missing %q:\n%s", want, rec.Body)
+		}
+	}
+	if strings.Contains(rec.Body.String(), `"owners"`) {
+		t.Errorf("stream leaks account owners:\n%s", rec.Body)
+	}
+}
+
+// TestConcurrentTransfersConserveMoney fires thousands of transfers at the
+// server in parallel and checks no money is made or lost.
+func TestConcurrentTransfersConserveMoney(t *testing.T) {
+	const (
+		accounts  = 20
+		balance   = 1000
+		transfers = 4000
+		workers   = 64
+	)
+	store := NewMemoryStore()
+	for id := 1; id <= accounts; id++ {
+		must(t, store.CreateAccount(&Account{ID: id, Owner: "root", Balance: balance, Status: StatusActive}))
+	}
+	audit := NewAuditLog()
+	server := NewAPIServer("", store, audit)
+	ts := httptest.NewServer(server.routes())
+	defer ts.Close()
+	token, err := createJWT(*e2ePrincipals["admin"], time.Minute)
+	must(t, err)
+
+	jobs := make(chan TransferRequest)
+	var mu sync.Mutex
+	codes := map[int]int{}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				body, _ := json.Marshal(job)
+				req, _ := http.NewRequest("POST", ts.URL+"/transfer", bytes.NewReader(body))
+				req.Header.Set("Authorization", "Bearer "+token)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				mu.Lock()
+				codes[resp.StatusCode]++
+				mu.Unlock()
+			}
+		}()
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < transfers; i++ {
+		from := rng.Intn(accounts) + 1
+		to := rng.Intn(accounts-1) + 1
+		if to >= from {
+			to++
+		}
+		jobs <- TransferRequest{FromAccount: from, ToAccount: to, Amount: int64(rng.Intn(200) + 1)}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if codes[http.StatusOK]+codes[http.StatusBadRequest] != transfers {
+		t.Fatalf("unexpected responses: %v", codes)
+	}
+	all, err := store.GetAccounts()
+	must(t, err)
+	var total int64
+	for _, acc := range all {
+		if acc.Balance < 0 {
+			t.Errorf("account %d is overdrawn: %d", acc.ID, acc.Balance)
+		}
+		total += acc.Balance
+	}
+	if total != accounts*balance {
+		t.Fatalf("money not conserved: total %d, want %d", total, accounts*balance)
+	}
+	posted := 0
+	for id := 1; id <= accounts; id++ {
+		txs, err := store.GetTransactions(id)
+		must(t, err)
+		for _, tx := range txs {
+			if tx.FromAccount == id {
+				posted++
+			}
+		}
+	}
+	if posted != codes[http.StatusOK] {
+		t.Fatalf("%d transfers posted but %d succeeded", posted, codes[http.StatusOK])
+	}
+	// Each entry must show the account either side of its own transfer and
+	// nobody else's.
+	for _, e := range audit.Query(AuditQuery{}) {
+		if e.Before == nil || e.After == nil || e.After.Version != e.Before.Version+1 {
+			t.Fatalf("entry %d doesn't bracket one transfer: before %+v, after %+v", e.Seq, e.Before, e.After)
+		}
+	}
+	t.Logf("responses: %v", codes)
+}
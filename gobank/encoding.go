@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// compressMinSize is the smallest response body worth compressing. Below it
+// the compression headers cost about as much as they save.
+const compressMinSize = 1024
+
+// Media types WriteJSON can answer with.
+const (
+	mediaJSON    = "application/json"
+	mediaCBOR    = "application/cbor"
+	mediaMsgPack = "application/msgpack"
+)
+
+// mediaAliases maps the names clients ask for to the types above.
+var mediaAliases = map[string]string{
+	"application/json":          mediaJSON,
+	"application/cbor":          mediaCBOR,
+	"application/msgpack":       mediaMsgPack,
+	"application/x-msgpack":     mediaMsgPack,
+	"application/vnd.msgpack":   mediaMsgPack,
+	"application/x-messagepack": mediaMsgPack,
+}
+
+// negotiatedWriter carries what the client asked for to WriteJSON, which
+// only sees the ResponseWriter.
+type negotiatedWriter struct {
+	http.ResponseWriter
+	media    string
+	encoding string
+	pretty   bool
+}
+
+// Flush lets streaming handlers flush through the wrapper.
+func (w *negotiatedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withNegotiation picks the response format and compression from the
+// request's Accept and Accept-Encoding headers and the pretty query flag.
+func withNegotiation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ?pretty and ?pretty=true both turn it on.
+		query := r.URL.Query()
+		pretty := query.Has("pretty") && query.Get("pretty") != "false"
+		next.ServeHTTP(&negotiatedWriter{
+			ResponseWriter: w,
+			media:          negotiateMedia(r.Header.Get("Accept")),
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding")),
+			pretty:         pretty,
+		}, r)
+	})
+}
+
+// acceptEntry is one entry of an Accept or Accept-Encoding header.
+type acceptEntry struct {
+	value string
+	q     float64
+}
+
+// parseAccept reads a header of comma-separated values with optional q
+// parameters, most preferred first. Entries with q=0 are kept, last, since
+// they refuse what they name.
+func parseAccept(header string) []acceptEntry {
+	var entries []acceptEntry
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		entries = append(entries, acceptEntry{value, q})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	return entries
+}
+
+// negotiateMedia returns the most preferred media type we can produce.
+// Clients that ask only for types we don't have get JSON rather than a 406.
+func negotiateMedia(accept string) string {
+	for _, e := range parseAccept(accept) {
+		if e.q <= 0 {
+			break
+		}
+		if media, ok := mediaAliases[e.value]; ok {
+			return media
+		}
+		if e.value == "*/*" || e.value == "application/*" {
+			return mediaJSON
+		}
+	}
+	return mediaJSON
+}
+
+// negotiateEncoding returns gzip, deflate or the empty string for none. "*"
+// stands for any coding the header doesn't name, so "gzip;q=0, *" can't be
+// answered with gzip.
+func negotiateEncoding(accept string) string {
+	entries := parseAccept(accept)
+	named := map[string]bool{}
+	for _, e := range entries {
+		named[e.value] = true
+	}
+	for _, e := range entries {
+		if e.q <= 0 {
+			break
+		}
+		switch e.value {
+		case "gzip", "deflate":
+			return e.value
+		case "*":
+			for _, coding := range []string{"gzip", "deflate"} {
+				if !named[coding] {
+					return coding
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// encodeBody renders v as the given media type.
+func encodeBody(media string, pretty bool, v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	switch media {
+	case mediaCBOR, mediaMsgPack:
+		// Going through JSON keeps the field names, omitempty and custom
+		// marshalers the same in every format.
+		tree, err := decodeOrdered(b)
+		if err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		if media == mediaCBOR {
+			writeCBOR(buf, tree)
+		} else {
+			writeMsgPack(buf, tree)
+		}
+		return buf.Bytes(), nil
+	}
+	if pretty {
+		buf := new(bytes.Buffer)
+		if err := json.Indent(buf, b, "", "  "); err != nil {
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+	return append(b, '\n'), nil
+}
+
+// compress encodes body with gzip or deflate (the zlib format, as HTTP
+// means by it).
+func compress(encoding string, body []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var zw io.WriteCloser
+	switch encoding {
+	case "gzip":
+		zw = gzip.NewWriter(buf)
+	case "deflate":
+		zw = zlib.NewWriter(buf)
+	default:
+		return nil, fmt.Errorf("unknown content encoding %s", encoding)
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orderedObject is a JSON object with its keys in their original order, so
+// binary encodings come out in the same order as the JSON would.
+type orderedObject []orderedField
+
+type orderedField struct {
+	key   string
+	value any
+}
+
+// decodeOrdered parses JSON into nil, bool, string, json.Number, []any and
+// orderedObject values.
+func decodeOrdered(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return decodeOrderedValue(dec)
+}
+
+func decodeOrderedValue(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedField{key.(string), value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			value, err := decodeOrderedValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+// writeCBOR encodes a decoded JSON value as CBOR (RFC 8949).
+func writeCBOR(buf *bytes.Buffer, v any) {
+	head := func(major byte, n uint64) {
+		switch {
+		case n < 24:
+			buf.WriteByte(major<<5 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(major<<5 | 24)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(major<<5 | 25)
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+		case n <= math.MaxUint32:
+			buf.WriteByte(major<<5 | 26)
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+		default:
+			buf.WriteByte(major<<5 | 27)
+			buf.Write(binary.BigEndian.AppendUint64(nil, n))
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n >= 0 {
+				head(0, uint64(n))
+			} else {
+				head(1, uint64(-1-n))
+			}
+			return
+		}
+		f, _ := v.Float64()
+		buf.WriteByte(0xfb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case string:
+		head(3, uint64(len(v)))
+		buf.WriteString(v)
+	case []any:
+		head(4, uint64(len(v)))
+		for _, e := range v {
+			writeCBOR(buf, e)
+		}
+	case orderedObject:
+		head(5, uint64(len(v)))
+		for _, f := range v {
+			writeCBOR(buf, f.key)
+			writeCBOR(buf, f.value)
+		}
+	}
+}
+
+// writeMsgPack encodes a decoded JSON value as MessagePack.
+func writeMsgPack(buf *bytes.Buffer, v any) {
+	// sized writes the smallest of the 8, 16 and 32 bit forms of a length.
+	sized := func(n int, b8, b16, b32 byte) {
+		switch {
+		case b8 != 0 && n <= math.MaxUint8:
+			buf.WriteByte(b8)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(b16)
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+		default:
+			buf.WriteByte(b32)
+			buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		n, err := v.Int64()
+		switch {
+		case err != nil:
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+		case n >= 0 && n < 128:
+			buf.WriteByte(byte(n))
+		case n < 0 && n >= -32:
+			buf.WriteByte(byte(int8(n)))
+		case n >= 0:
+			buf.WriteByte(0xcf)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+		default:
+			buf.WriteByte(0xd3)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+		}
+	case string:
+		if len(v) < 32 {
+			buf.WriteByte(0xa0 | byte(len(v)))
+		} else {
+			sized(len(v), 0xd9, 0xda, 0xdb)
+		}
+		buf.WriteString(v)
+	case []any:
+		if len(v) < 16 {
+			buf.WriteByte(0x90 | byte(len(v)))
+		} else {
+			sized(len(v), 0, 0xdc, 0xdd)
+		}
+		for _, e := range v {
+			writeMsgPack(buf, e)
+		}
+	case orderedObject:
+		if len(v) < 16 {
+			buf.WriteByte(0x80 | byte(len(v)))
+		} else {
+			sized(len(v), 0, 0xde, 0xdf)
+		}
+		for _, f := range v {
+			writeMsgPack(buf, f.key)
+			writeMsgPack(buf, f.value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteJSONSetsContentType(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if err := WriteJSON(rec, http.StatusCreated, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Body.String() != "{\"id\":1}\n" {
+		t.Fatalf("body %q", rec.Body)
+	}
+}
+
+func TestBinaryEncodings(t *testing.T) {
+	v := struct {
+		A int    `json:"a"`
+		B []any  `json:"b"`
+		C string `json:"c,omitempty"`
+		D int64  `json:"d"`
+		E string `json:"e"`
+	}{A: 1, B: []any{true, nil, -5, 1.5}, D: -1000, E: strings.Repeat("x", 40)}
+
+	tests := []struct {
+		media string
+		want  []byte
+	}{
+		{mediaCBOR, append([]byte{
+			0xa4,
+			0x61, 'a', 0x01,
+			0x61, 'b', 0x84, 0xf5, 0xf6, 0x24, 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+			0x61, 'd', 0x39, 0x03, 0xe7,
+			0x61, 'e', 0x78, 40,
+		}, strings.Repeat("x", 40)...)},
+		{mediaMsgPack, append([]byte{
+			0x84,
+			0xa1, 'a', 0x01,
+			0xa1, 'b', 0x94, 0xc3, 0xc0, 0xfb, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+			0xa1, 'd', 0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfc, 0x18,
+			0xa1, 'e', 0xd9, 40,
+		}, strings.Repeat("x", 40)...)},
+	}
+	for _, tt := range tests {
+		got, err := encodeBody(tt.media, false, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s:\n got % x\nwant % x", tt.media, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiation(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 1; i <= 20; i++ {
+		store.CreateAccount(&Account{ID: i, FirstName: "Ada", LastName: "Lovelace", Status: StatusActive})
+	}
+	server := NewAPIServer("", store, NewAuditLog())
+	token, err := createJWT(Principal{Subject: "root", Role: RoleAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path, accept, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Accept-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		server.routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, rec.Code, rec.Body)
+		}
+		return rec
+	}
+	plain := get("/accounts", "", "").Body.Bytes()
+
+	tests := []struct {
+		accept, encoding     string
+		wantType, wantEncode string
+	}{
+		{"", "", "application/json", ""},
+		{"text/html, */*;q=0.1", "br", "application/json", ""},
+		{"application/json;q=0.5, application/cbor", "", "application/cbor", ""},
+		{"application/x-msgpack", "identity", "application/msgpack", ""},
+		{"", "gzip;q=0.5, deflate", "application/json", "deflate"},
+		{"", "deflate;q=0, gzip", "application/json", "gzip"},
+		{"", "*", "application/json", "gzip"},
+		{"", "gzip;q=0, *", "application/json", "deflate"},
+		{"", "gzip;q=0, deflate;q=0, *", "application/json", ""},
+	}
+	for _, tt := range tests {
+		rec := get("/accounts", tt.accept, tt.encoding)
+		if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+			t.Errorf("Accept %q: Content-Type %q, want %q", tt.accept, got, tt.wantType)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncode {
+			t.Errorf("Accept-Encoding %q: Content-Encoding %q, want %q", tt.encoding, got, tt.wantEncode)
+		}
+		if tt.wantType != "application/json" {
+			continue
+		}
+		var body io.Reader = rec.Body
+		switch tt.wantEncode {
+		case "gzip":
+			if body, err = gzip.NewReader(body); err != nil {
+				t.Fatal(err)
+			}
+		case "deflate":
+			if body, err = zlib.NewReader(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, _ := io.ReadAll(body); !bytes.Equal(got, plain) {
+			t.Errorf("Accept-Encoding %q: body differs once decoded", tt.encoding)
+		}
+	}
+
+	// Small bodies aren't worth compressing.
+	if rec := get("/account/1", "", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("compressed a %d byte body", rec.Body.Len())
+	}
+
+	// Each representation has an ETag of its own, and any of them can be
+	// sent back in If-Match.
+	jsonTag, cborTag := get("/account/1", "", "").Header().Get("ETag"), get("/account/1", "application/cbor", "").Header().Get("ETag")
+	if jsonTag == cborTag {
+		t.Errorf("JSON and CBOR share ETag %s", jsonTag)
+	}
+	if got := representationETag(jsonTag, mediaJSON, "gzip"); got == jsonTag {
+		t.Errorf("compressed body has ETag %s", got)
+	}
+	for _, tag := range []string{jsonTag, cborTag, representationETag(cborTag, mediaCBOR, "gzip")} {
+		req := httptest.NewRequest("PATCH", "/account/1", nil)
+		req.Header.Set("If-Match", tag)
+		if v, err := ifMatchVersion(req, nil); err != nil || v != 1 {
+			t.Errorf("If-Match %s: version %d %v", tag, v, err)
+		}
+	}
+
+	pretty := get("/account/1?pretty", "", "").Body.Bytes()
+	if !bytes.Contains(pretty, []byte("\n  \"id\": 1,")) {
+		t.Errorf("not pretty printed: %s", pretty)
+	}
+	var a, b Account
+	json.Unmarshal(pretty, &a)
+	json.Unmarshal(get("/account/1", "", "").Body.Bytes(), &b)
+	if a != b {
+		t.Errorf("pretty printed account differs: %+v", a)
+	}
+}
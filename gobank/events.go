@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventAccountCreated   = "account.created"
+	EventAccountUpdated   = "account.updated"
+	EventAccountFrozen    = "account.frozen"
+	EventAccountActivated = "account.activated"
+	EventAccountClosed    = "account.closed"
+	EventAccountErased    = "account.erased"
+	EventTransferComplete = "transfer.completed"
+	EventInterestPosted   = "interest.posted"
+	EventHoldPlaced       = "hold.placed"
+	EventHoldCaptured     = "hold.captured"
+	EventHoldReleased     = "hold.released"
+	EventHoldExpired      = "hold.expired"
+)
+
+var eventTypes = map[string]bool{
+	EventAccountCreated:   true,
+	EventAccountUpdated:   true,
+	EventAccountFrozen:    true,
+	EventAccountActivated: true,
+	EventAccountClosed:    true,
+	EventAccountErased:    true,
+	EventTransferComplete: true,
+	EventInterestPosted:   true,
+	EventHoldPlaced:       true,
+	EventHoldCaptured:     true,
+	EventHoldReleased:     true,
+	EventHoldExpired:      true,
+}
+
+// statusEvents maps the status an account moves to onto the event it raises.
+var statusEvents = map[AccountStatus]string{
+	StatusActive: EventAccountActivated,
+	StatusFrozen: EventAccountFrozen,
+	StatusClosed: EventAccountClosed,
+}
+
+// Event is a domain event: something that happened to one or more accounts.
+// The store writes events in the same step as the change they describe, and
+// Seq orders them. Owners are the principals the accounts belong to.
+type Event struct {
+	Seq        int             `json:"seq"`
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	AccountIDs []int           `json:"accountIds"`
+	Owners     []string        `json:"owners,omitempty"`
+	Data       json.RawMessage `json:"data"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	// Tenant is the bank the event happened at, set on events relayed to
+	// sinks shared by several banks.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func newEvent(typ string, data any, now time.Time, accounts ...*Account) (*Event, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		ID:        "evt_" + randomHex(12),
+		Type:      typ,
+		Data:      b,
+		CreatedAt: now,
+	}
+	for _, acc := range accounts {
+		e.AccountIDs = append(e.AccountIDs, acc.ID)
+		e.Owners = append(e.Owners, acc.Owner)
+	}
+	return e, nil
+}
+
+func (e *Event) concerns(accountID int) bool {
+	for _, id := range e.AccountIDs {
+		if id == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+// EventSink is somewhere the relay publishes events to.
+type EventSink interface {
+	Name() string
+	Publish(ctx context.Context, e *Event) error
+}
+
+// WriterSink writes each event as a line of JSON.
+type WriterSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func NewStdoutSink() *WriterSink {
+	return &WriterSink{name: "stdout", w: os.Stdout}
+}
+
+func NewFileSink(path string) (*WriterSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterSink{name: "file:" + path, w: f}, nil
+}
+
+func (s *WriterSink) Name() string {
+	return s.name
+}
+
+func (s *WriterSink) Publish(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// Publisher is the part of a NATS connection the bus sink needs. A *nats.Conn
+// satisfies it, as does InProcessBus.
+type Publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// BusSink publishes each event on the subject <prefix>.<event type>.
+type BusSink struct {
+	name   string
+	pub    Publisher
+	prefix string
+}
+
+func NewBusSink(name string, pub Publisher, prefix string) *BusSink {
+	return &BusSink{name: name, pub: pub, prefix: prefix}
+}
+
+func (s *BusSink) Name() string {
+	return s.name
+}
+
+func (s *BusSink) Publish(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.pub.Publish(s.prefix+"."+e.Type, b)
+}
+
+// InProcessBus stands in for NATS when there is no server to talk to. It
+// supports NATS subject wildcards: * matches one token and > the rest.
+type InProcessBus struct {
+	mu   sync.Mutex
+	subs map[string][]func(subject string, data []byte)
+}
+
+func NewInProcessBus() *InProcessBus {
+	return &InProcessBus{subs: make(map[string][]func(string, []byte))}
+}
+
+func (b *InProcessBus) Subscribe(subject string, handler func(subject string, data []byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[subject] = append(b.subs[subject], handler)
+}
+
+func (b *InProcessBus) Publish(subject string, data []byte) error {
+	b.mu.Lock()
+	var handlers []func(string, []byte)
+	for pattern, hs := range b.subs {
+		if subjectMatches(pattern, subject) {
+			handlers = append(handlers, hs...)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(subject, data)
+	}
+	return nil
+}
+
+func subjectMatches(pattern, subject string) bool {
+	pt, st := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, p := range pt {
+		if p == ">" {
+			return len(st) > i
+		}
+		if i >= len(st) || (p != "*" && p != st[i]) {
+			return false
+		}
+	}
+	return len(pt) == len(st)
+}
+
+// EventBroker fans events out to live subscribers, such as the server-sent
+// events endpoint. Subscribers that fall behind are dropped rather than
+// holding up the relay.
+type EventBroker struct {
+	mu   sync.Mutex
+	subs map[chan *Event]int
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subs: make(map[chan *Event]int)}
+}
+
+func (b *EventBroker) Name() string {
+	return "broker"
+}
+
+// Subscribe returns a channel of events concerning accountID. The channel is
+// closed when cancel is called or the subscriber falls behind.
+func (b *EventBroker) Subscribe(accountID int) (<-chan *Event, func()) {
+	ch := make(chan *Event, 64)
+	b.mu.Lock()
+	b.subs[ch] = accountID
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *EventBroker) Publish(ctx context.Context, e *Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch, accountID := range b.subs {
+		if !e.concerns(accountID) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// EventRelay publishes stored events to each sink in order. Every sink has its
+// own cursor in the store, so a sink that is down only holds up itself, and
+// picks up where it left off after a restart.
+type EventRelay struct {
+	store    Storage
+	sinks    []EventSink
+	interval time.Duration
+	batch    int
+}
+
+func NewEventRelay(store Storage, sinks ...EventSink) *EventRelay {
+	return &EventRelay{
+		store:    store,
+		sinks:    sinks,
+		interval: 500 * time.Millisecond,
+		batch:    100,
+	}
+}
+
+func (r *EventRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *EventRelay) RunOnce(ctx context.Context) {
+	for _, sink := range r.sinks {
+		if err := r.relay(ctx, sink); err != nil {
+			log.Printf("events: sink %s: %v", sink.Name(), err)
+		}
+	}
+}
+
+func (r *EventRelay) relay(ctx context.Context, sink EventSink) error {
+	cursor, err := r.store.EventCursor(sink.Name())
+	if err != nil {
+		return err
+	}
+	for {
+		events, err := r.store.EventsAfter(cursor, r.batch)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+		published := cursor
+		for _, e := range events {
+			if err = sink.Publish(ctx, e); err != nil {
+				break
+			}
+			published = e.Seq
+		}
+		if published > cursor {
+			if err := r.store.SetEventCursor(sink.Name(), published); err != nil {
+				return err
+			}
+			cursor = published
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseEventSinks builds sinks from a comma-separated list such as
+// "stdout,file:events.log".
+func parseEventSinks(spec string) ([]EventSink, error) {
+	var sinks []EventSink
+	for _, part := range strings.Split(spec, ",") {
+		switch {
+		case part == "":
+		case part == "stdout":
+			sinks = append(sinks, NewStdoutSink())
+		case strings.HasPrefix(part, "file:"):
+			sink, err := NewFileSink(strings.TrimPrefix(part, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("unknown event sink %s", part)
+		}
+	}
+	return sinks, nil
+}
+
+// handleAccountEvents streams the account's events as server-sent events.
+// Clients that reconnect with Last-Event-ID are first sent what they missed.
+func (s *APIServer) handleAccountEvents(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming is not supported")
+	}
+	last := 0
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if last, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid Last-Event-ID given %s", v)
+		}
+	}
+
+	// Subscribe before catching up so nothing falls between the two.
+	live, cancel := s.tenant(r).events.Subscribe(id)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e *Event) error {
+		if e.Seq <= last || !e.concerns(id) {
+			return nil
+		}
+		// Owners of the other side of a transfer are none of the client's
+		// business.
+		c := *e
+		c.Owners = nil
+		b, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		last = e.Seq
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b)
+		return err
+	}
+
+	if r.Header.Get("Last-Event-ID") != "" {
+		for {
+			missed, err := s.storage(r).EventsAfter(last, 100)
+			if err != nil || len(missed) == 0 {
+				break
+			}
+			progress := last
+			for _, e := range missed {
+				if err := send(e); err != nil {
+					return nil
+				}
+				progress = e.Seq
+			}
+			last = progress
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e, ok := <-live:
+			if !ok {
+				return nil
+			}
+			if err := send(e); err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type flakySink struct {
+	fail bool
+	seen []int
+}
+
+func (s *flakySink) Name() string {
+	return "flaky"
+}
+
+func (s *flakySink) Publish(ctx context.Context, e *Event) error {
+	if s.fail {
+		return errors.New("sink is down")
+	}
+	s.seen = append(s.seen, e.Seq)
+	return nil
+}
+
+func TestRelayPublishesEventsInOrderToEachSink(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 10, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+	store.Transfer(1, 2, 5)
+
+	bus := NewInProcessBus()
+	var types []string
+	bus.Subscribe("gobank.>", func(subject string, data []byte) {
+		e := new(Event)
+		json.Unmarshal(data, e)
+		types = append(types, e.Type)
+	})
+	flaky := &flakySink{fail: true}
+	relay := NewEventRelay(store, NewBusSink("bus", bus, "gobank"), flaky)
+	relay.RunOnce(context.Background())
+
+	want := []string{EventAccountCreated, EventAccountCreated, EventTransferComplete}
+	if len(types) != len(want) {
+		t.Fatalf("expected %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, types)
+		}
+	}
+
+	// A failing sink keeps its place, and the others don't see repeats.
+	flaky.fail = false
+	relay.RunOnce(context.Background())
+	if len(flaky.seen) != 3 || flaky.seen[0] != 1 || flaky.seen[2] != 3 {
+		t.Fatalf("expected the recovered sink to get events 1-3, got %v", flaky.seen)
+	}
+	if len(types) != 3 {
+		t.Fatalf("expected no repeats on the bus, got %v", types)
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		want             bool
+	}{
+		{"gobank.account.created", "gobank.account.created", true},
+		{"gobank.*.created", "gobank.account.created", true},
+		{"gobank.>", "gobank.transfer.completed", true},
+		{"gobank.>", "gobank", false},
+		{"gobank.*", "gobank.account.created", false},
+	}
+	for _, tt := range tests {
+		if got := subjectMatches(tt.pattern, tt.subject); got != tt.want {
+			t.Errorf("subjectMatches(%q, %q): expected %v", tt.pattern, tt.subject, tt.want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig says which browser origins may call the API. The zero value
+// allows none, so cross-origin calls stay blocked until origins are listed.
+type CORSConfig struct {
+	// AllowedOrigins are matched exactly against the Origin header; "*"
+	// allows any origin.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials lets the browser send cookies and Authorization. The
+	// origin is echoed back then, and must be listed: "*" would let any site
+	// make calls as whoever is signed in, so validate refuses it.
+	AllowCredentials bool
+	// MaxAge is how long a browser may cache a preflight answer.
+	MaxAge time.Duration
+}
+
+// defaultCORS is the method and header set the API's routes use.
+var defaultCORS = CORSConfig{
+	AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
+	AllowedHeaders: []string{"Authorization", "Content-Type", "If-Match", "X-Request-ID"},
+	MaxAge:         10 * time.Minute,
+}
+
+// corsExposedHeaders are the response headers browser code may read.
+const corsExposedHeaders = "ETag, Location, X-Request-ID"
+
+// securityHeaders are set on every response.
+var securityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+	"Content-Security-Policy":   "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":           "no-referrer",
+}
+
+// adminCSP is the content security policy of the dashboard, whose pages load
+// their stylesheet from the server and post forms back to it.
+const adminCSP = "default-src 'none'; style-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// notFound and methodNotAllowed answer requests that match no route. The
+// router calls them without its middleware, so they add the security headers
+// themselves.
+var (
+	notFound = withSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusNotFound, ApiError{Error: "no route for " + r.URL.Path})
+	}))
+	methodNotAllowed = withSecurityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusMethodNotAllowed, ApiError{Error: "method not allowed " + r.Method})
+	}))
+)
+
+// withSecurityHeaders adds the hardening headers. The API only serves data,
+// so the content security policy allows nothing to load outside the
+// dashboard.
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range securityHeaders {
+			w.Header().Set(k, v)
+		}
+		if isAdminPath(r.URL.Path) {
+			w.Header().Set("Content-Security-Policy", adminCSP)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *CORSConfig) validate() error {
+	if c.AllowCredentials {
+		for _, o := range c.AllowedOrigins {
+			if o == "*" {
+				return errors.New("cors: credentials can't be allowed from any origin; list the origins instead of *")
+			}
+		}
+	}
+	return nil
+}
+
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		// Should validate have been skipped, "*" still lets no one send
+		// credentials.
+		if (o == "*" && !c.AllowCredentials) || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSConfig) allowsMethod(method string) bool {
+	for _, m := range c.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether every header in a preflight's
+// Access-Control-Request-Headers list is allowed.
+func (c *CORSConfig) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		found := false
+		for _, a := range c.AllowedHeaders {
+			found = found || strings.EqualFold(a, h)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// withCORS answers preflight requests and marks responses to allowed
+// origins. It runs ahead of authentication, since browsers send preflights
+// without credentials.
+func (s *APIServer) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c := &s.cors
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowsOrigin(origin) {
+			if preflight {
+				WriteJSON(w, http.StatusForbidden, ApiError{Error: "origin " + origin + " is not allowed"})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else if c.allowsOrigin("*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !c.allowsMethod(method) {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "method " + method + " is not allowed"})
+			return
+		}
+		if requested := r.Header.Get("Access-Control-Request-Headers"); !c.allowsHeaders(requested) {
+			WriteJSON(w, http.StatusForbidden, ApiError{Error: "headers " + requested + " are not allowed"})
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		if c.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// splitList reads a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
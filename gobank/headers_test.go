@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	server.cors.AllowedOrigins = []string{"https://app.example.com"}
+	token, err := createJWT(Principal{Subject: "alice", Role: RoleCustomer}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/account/1", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		server.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A preflight is answered before authentication.
+	rec := do("OPTIONS", "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "PATCH",
+		"Access-Control-Request-Headers": "authorization, if-match",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("preflight: %d %s", rec.Code, rec.Body)
+	}
+	for k, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, PATCH, DELETE",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := rec.Header().Get(k); got != want {
+			t.Errorf("preflight %s = %q, want %q", k, got, want)
+		}
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"method": {"Access-Control-Request-Method": "PUT"},
+		"header": {"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Debug"},
+	} {
+		if rec := do("OPTIONS", "https://app.example.com", headers); rec.Code != http.StatusForbidden {
+			t.Errorf("preflight with a disallowed %s: %d", name, rec.Code)
+		}
+	}
+	rec = do("OPTIONS", "https://evil.example.com", map[string]string{"Access-Control-Request-Method": "GET"})
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from another origin: %d %v", rec.Code, rec.Header())
+	}
+
+	auth := map[string]string{"Authorization": "Bearer " + token}
+	rec = do("GET", "https://app.example.com", auth)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rec.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("GET from an allowed origin: %d %v", rec.Code, rec.Header())
+	}
+	if rec := do("GET", "https://evil.example.com", auth); rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("GET from another origin allowed")
+	}
+
+	server.cors.AllowedOrigins = []string{"*"}
+	if rec := do("GET", "https://any.example.com", auth); rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("wildcard origin: %v", rec.Header())
+	}
+	// Any site could make calls as whoever is signed in.
+	server.cors.AllowCredentials = true
+	if err := server.cors.validate(); err == nil {
+		t.Error("wildcard origin allowed with credentials")
+	}
+	rec = do("GET", "https://any.example.com", auth)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("wildcard origin with credentials: %v", rec.Header())
+	}
+	server.cors.AllowedOrigins = []string{"https://app.example.com"}
+	rec = do("GET", "https://app.example.com", auth)
+	if err := server.cors.validate(); err != nil || rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("listed origin with credentials: %v %v", err, rec.Header())
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	server := NewAPIServer("", NewMemoryStore(), NewAuditLog())
+	// The router answers an unknown path itself, outside the middleware.
+	for _, path := range []string{"/account/1", "/transfer", "/nowhere"} {
+		rec := httptest.NewRecorder()
+		server.routes().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		for k, want := range securityHeaders {
+			if got := rec.Header().Get(k); got != want {
+				t.Errorf("%s: %s = %q, want %q", path, k, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Histogram records latencies in the layout of an HDR histogram: values are
+// bucketed by power of two, and each bucket is split into enough linear
+// sub-buckets to keep the given number of significant decimal digits. Memory
+// is fixed and recording is a couple of shifts, however wide the range.
+type Histogram struct {
+	subBits  uint
+	subCount int64
+	counts   []int64
+	total    int64
+	min, max int64
+}
+
+// NewHistogram returns a histogram for values from 0 to highest that keeps
+// digits significant digits (1 to 5).
+func NewHistogram(highest int64, digits int) *Histogram {
+	if digits < 1 {
+		digits = 1
+	}
+	if digits > 5 {
+		digits = 5
+	}
+	// Enough sub-buckets to tell apart 2*10^digits values in each bucket.
+	subBits := uint(math.Ceil(math.Log2(2 * math.Pow10(digits))))
+	h := &Histogram{subBits: subBits, subCount: 1 << subBits, min: math.MaxInt64}
+	h.counts = make([]int64, h.index(highest)+1)
+	return h
+}
+
+// index finds the bucket for v. Values below subCount have a bucket each;
+// above that every doubling of range gets subCount/2 buckets.
+func (h *Histogram) index(v int64) int {
+	if v < h.subCount {
+		return int(v)
+	}
+	shift := uint(bits.Len64(uint64(v))) - h.subBits
+	half := h.subCount / 2
+	return int(h.subCount + int64(shift-1)*half + (v>>shift - half))
+}
+
+// highestEquivalent is the largest value that falls in bucket i.
+func (h *Histogram) highestEquivalent(i int) int64 {
+	if int64(i) < h.subCount {
+		return int64(i)
+	}
+	half := h.subCount / 2
+	shift := uint((int64(i)-h.subCount)/half) + 1
+	sub := (int64(i)-h.subCount)%half + half
+	return (sub+1)<<shift - 1
+}
+
+// Record adds a value. Values past the top of the range are clamped to it.
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := h.index(v)
+	if i >= len(h.counts) {
+		i = len(h.counts) - 1
+	}
+	h.counts[i]++
+	h.total++
+	if v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *Histogram) RecordDuration(d time.Duration) {
+	h.Record(int64(d))
+}
+
+// Merge adds every value recorded in o, which must have the same layout.
+func (h *Histogram) Merge(o *Histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+	if o.total > 0 {
+		h.min = min(h.min, o.min)
+		h.max = max(h.max, o.max)
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+func (h *Histogram) Max() int64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.max
+}
+
+// Percentile returns the value below which q percent of recorded values fall,
+// to within the histogram's precision.
+func (h *Histogram) Percentile(q float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	target := int64(math.Ceil(q / 100 * float64(h.total)))
+	if target < 1 {
+		target = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			return min(h.highestEquivalent(i), h.max)
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentilesWithinPrecision(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	h := NewHistogram(int64(time.Minute), 3)
+	var values []int64
+	for i := 0; i < 100_000; i++ {
+		// Log-normal-ish spread from microseconds to seconds.
+		v := int64(float64(time.Microsecond) * (1 + rng.ExpFloat64()*rng.ExpFloat64()*1000))
+		values = append(values, v)
+		h.Record(v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for _, q := range []float64{50, 95, 99, 99.9, 100} {
+		want := values[int(math.Ceil(q/100*float64(len(values))))-1]
+		got := h.Percentile(q)
+		if diff := float64(got-want) / float64(want); diff < 0 || diff > 0.001 {
+			t.Errorf("p%v = %d, want %d to within 0.1%%", q, got, want)
+		}
+	}
+	if h.Count() != int64(len(values)) || h.Max() != values[len(values)-1] {
+		t.Errorf("count %d max %d", h.Count(), h.Max())
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b := NewHistogram(1_000_000, 2), NewHistogram(1_000_000, 2)
+	for v := int64(1); v <= 1000; v++ {
+		a.Record(v)
+		b.Record(v * 1000)
+	}
+	a.Merge(b)
+	if a.Count() != 2000 || a.Max() != 1_000_000 {
+		t.Fatalf("count %d max %d", a.Count(), a.Max())
+	}
+	if p := a.Percentile(50); p < 1000 || p > 1010 {
+		t.Errorf("p50 = %d, want 1000 to within 1%%", p)
+	}
+	// Past the top of the range values are clamped, not dropped.
+	a.Record(5_000_000)
+	if a.Count() != 2001 {
+		t.Errorf("count %d after an out of range value", a.Count())
+	}
+}
+
+func TestLoadTestInProcess(t *testing.T) {
+	token, err := createJWT(Principal{Subject: "loadtest", Role: RoleAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err := newLoadTest(LoadTestConfig{
+		Token:       token,
+		Fund:        1_000,
+		Duration:    200 * time.Millisecond,
+		Rate:        500,
+		Concurrency: 8,
+		Mix:         map[string]int{"create": 1, "read": 2, "transfer": 3},
+		Accounts:    10,
+		Hot:         2,
+		HotRatio:    0.5,
+		Amount:      1,
+		Seed:        1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lt.cleanup()
+	if err := lt.setup(); err != nil {
+		t.Fatal(err)
+	}
+	report := lt.run(context.Background())
+	for _, op := range loadOps {
+		st := report.Ops[op]
+		if st == nil || st.latency.Count() == 0 {
+			t.Fatalf("no %s requests made", op)
+		}
+		if len(st.errors) > 0 {
+			t.Errorf("%s errors: %v", op, st.errors)
+		}
+	}
+}
+
+func TestLoadTestFundsRemoteAccounts(t *testing.T) {
+	store := NewMemoryStore()
+	must(t, store.CreateAccount(&Account{ID: 1, Owner: "treasury", Balance: 1_000, Status: StatusActive}))
+	ts := httptest.NewServer(NewAPIServer("", store, NewAuditLog()).routes())
+	defer ts.Close()
+	token, err := createJWT(Principal{Subject: "loadtest", Role: RoleAdmin}, time.Minute)
+	must(t, err)
+
+	cfg := LoadTestConfig{
+		Target:      ts.URL,
+		Token:       token,
+		Concurrency: 1,
+		Mix:         map[string]int{"transfer": 1},
+		Accounts:    5,
+		Fund:        100,
+	}
+	if _, err := newLoadTest(cfg); err == nil {
+		t.Fatal("transfers on a remote target without funding")
+	}
+	cfg.FundFrom = 1
+	lt, err := newLoadTest(cfg)
+	must(t, err)
+	must(t, lt.setup())
+	for _, id := range lt.ids {
+		if got := balanceOf(t, store, id); got != 100 {
+			t.Fatalf("account %d has %d", id, got)
+		}
+	}
+	if got := balanceOf(t, store, 1); got != 500 {
+		t.Fatalf("funding account has %d", got)
+	}
+}
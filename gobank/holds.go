@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type HoldStatus string
+
+const (
+	HoldPending  HoldStatus = "pending"
+	HoldCaptured HoldStatus = "captured"
+	HoldReleased HoldStatus = "released"
+	HoldExpired  HoldStatus = "expired"
+)
+
+// defaultHoldTTL is how long a hold lasts when the request doesn't say.
+const defaultHoldTTL = 7 * 24 * time.Hour
+
+// Hold is an authorization against an account: it sets money aside for a
+// payment to ToAccount without posting anything to the ledger. A pending hold
+// reduces the account's available balance until it is captured, released or
+// expires.
+type Hold struct {
+	ID          int        `json:"id"`
+	AccountID   int        `json:"accountId"`
+	ToAccount   int        `json:"toAccount"`
+	Amount      int64      `json:"amount"`
+	Description string     `json:"description,omitempty"`
+	Status      HoldStatus `json:"status"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	// Captured is how much was taken when the hold was captured. Whatever is
+	// left over goes back to the available balance.
+	Captured      int64      `json:"captured,omitempty"`
+	TransactionID int        `json:"transactionId,omitempty"`
+	ResolvedAt    *time.Time `json:"resolvedAt,omitempty"`
+}
+
+type PlaceHoldRequest struct {
+	ToAccount   int        `json:"toAccount"`
+	Amount      int64      `json:"amount"`
+	Description string     `json:"description"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+}
+
+type CaptureHoldRequest struct {
+	// Amount is how much to capture. Zero captures the whole hold.
+	Amount int64 `json:"amount"`
+}
+
+func NewHold(accountID int, req *PlaceHoldRequest, now time.Time) (*Hold, error) {
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("hold amount must be positive")
+	}
+	if req.ToAccount == accountID {
+		return nil, fmt.Errorf("cannot hold funds for the same account")
+	}
+	expiresAt := now.Add(defaultHoldTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, fmt.Errorf("expiresAt is in the past")
+		}
+		expiresAt = req.ExpiresAt.UTC()
+	}
+	return &Hold{
+		AccountID:   accountID,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Status:      HoldPending,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   now,
+	}, nil
+}
+
+// HoldExpirer releases pending holds once they pass their expiry.
+type HoldExpirer struct {
+	store    Storage
+	audit    *AuditLog
+	clock    Clock
+	interval time.Duration
+}
+
+func NewHoldExpirer(store Storage, audit *AuditLog, clock Clock) *HoldExpirer {
+	return &HoldExpirer{
+		store:    store,
+		audit:    audit,
+		clock:    clock,
+		interval: time.Minute,
+	}
+}
+
+func (e *HoldExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.RunDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *HoldExpirer) RunDue() {
+	expired, changes, err := e.store.ExpireHolds(e.clock.Now())
+	if err != nil {
+		log.Println("holds:", err)
+		return
+	}
+	if e.audit == nil {
+		return
+	}
+	// Holds on the same account expire in one step, so the account gets one
+	// entry, named after the first of them.
+	for _, h := range expired {
+		ch, ok := changes[h.AccountID]
+		if !ok {
+			continue
+		}
+		delete(changes, h.AccountID)
+		err := e.audit.Append(&AuditEntry{
+			Actor:     "holds",
+			Action:    "hold.expire",
+			AccountID: h.AccountID,
+			Before:    ch.Before,
+			After:     ch.After,
+			RequestID: fmt.Sprintf("hold-%d", h.ID),
+		})
+		if err != nil {
+			log.Println("audit:", err)
+		}
+	}
+}
+
+func (s *APIServer) handleHolds(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		holds, err := s.storage(r).GetHolds(id)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, holds)
+	}
+
+	req := new(PlaceHoldRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	h, err := NewHold(id, req, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	if err := s.tenant(r).checkAmount(h.Amount); err != nil {
+		return err
+	}
+	if err := s.checkPayee(r, h.AccountID, h.ToAccount); err != nil {
+		return err
+	}
+	changes, err := s.storage(r).PlaceHold(h)
+	if err != nil {
+		return err
+	}
+	s.recordAudit(r, "hold.place", id, changes.before(id), changes.after(id))
+	return WriteJSON(w, http.StatusCreated, h)
+}
+
+func (s *APIServer) handleHoldByID(w http.ResponseWriter, r *http.Request) error {
+	h, err := s.holdFor(r)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, h)
+}
+
+func (s *APIServer) handleCaptureHold(w http.ResponseWriter, r *http.Request) error {
+	h, err := s.holdFor(r)
+	if err != nil {
+		return err
+	}
+	req := new(CaptureHoldRequest)
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return err
+		}
+		defer r.Body.Close()
+	}
+	// The payee may have been deleted since the hold was placed.
+	if err := s.checkPayee(r, h.AccountID, h.ToAccount); err != nil {
+		return err
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = h.Amount
+	}
+	e := newTransferEvent(principalFrom(r).Subject, fmt.Sprintf("hold:%d", h.ID), h.AccountID, h.ToAccount, amount)
+	if err := s.runBeforeHooks(r, e); err != nil {
+		return err
+	}
+
+	h, changes, err := s.storage(r).CaptureHold(h.ID, req.Amount, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	s.recordAudit(r, "hold.capture", h.AccountID, changes.before(h.AccountID), changes.after(h.AccountID))
+	s.recordAudit(r, "transfer.credit", h.ToAccount, changes.before(h.ToAccount), changes.after(h.ToAccount))
+	e.TransactionID = h.TransactionID
+	s.runAfterHooks(r, e)
+	return WriteJSON(w, http.StatusOK, h)
+}
+
+func (s *APIServer) handleReleaseHold(w http.ResponseWriter, r *http.Request) error {
+	h, err := s.holdFor(r)
+	if err != nil {
+		return err
+	}
+	h, changes, err := s.storage(r).ReleaseHold(h.ID, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	s.recordAudit(r, "hold.release", h.AccountID, changes.before(h.AccountID), changes.after(h.AccountID))
+	return WriteJSON(w, http.StatusOK, h)
+}
+
+// holdFor loads the hold named in the path, which must be on the account in
+// the path.
+func (s *APIServer) holdFor(r *http.Request) (*Hold, error) {
+	id, err := getID(r)
+	if err != nil {
+		return nil, err
+	}
+	holdID, err := strconv.Atoi(mux.Vars(r)["holdId"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid hold id given %s", mux.Vars(r)["holdId"])
+	}
+	h, err := s.storage(r).GetHold(holdID)
+	if err != nil || h.AccountID != id {
+		return nil, fmt.Errorf("hold %d %w", holdID, ErrNotFound)
+	}
+	return h, nil
+}
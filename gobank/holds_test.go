@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func placeHold(t *testing.T, store Storage, amount int64, now time.Time) *Hold {
+	t.Helper()
+	h, err := NewHold(1, &PlaceHoldRequest{ToAccount: 2, Amount: amount}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PlaceHold(h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func balancesOf(t *testing.T, store Storage, id int) (int64, int64) {
+	t.Helper()
+	acc, err := store.GetAccountByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc.Balance, acc.Available
+}
+
+func TestHoldReducesAvailableBalance(t *testing.T) {
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+
+	h := placeHold(t, store, 70, now)
+	if ledger, available := balancesOf(t, store, 1); ledger != 100 || available != 30 {
+		t.Fatalf("got ledger %d available %d, want 100 and 30", ledger, available)
+	}
+	if _, _, err := store.Transfer(1, 2, 40); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("transfer spent held funds: %v", err)
+	}
+	if _, err := store.PlaceHold(&Hold{AccountID: 1, ToAccount: 2, Amount: 31, Status: HoldPending, ExpiresAt: now.Add(time.Hour)}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("second hold over the available balance: %v", err)
+	}
+
+	if _, _, err := store.ReleaseHold(h.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if ledger, available := balancesOf(t, store, 1); ledger != 100 || available != 100 {
+		t.Fatalf("got ledger %d available %d after release, want 100 and 100", ledger, available)
+	}
+	if _, _, err := store.CaptureHold(h.ID, 0, now); err == nil {
+		t.Fatal("captured a released hold")
+	}
+}
+
+func TestHoldNeedsTheSameCurrency(t *testing.T) {
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Currency: "EUR", Status: StatusActive})
+
+	if _, err := store.PlaceHold(&Hold{AccountID: 1, ToAccount: 2, Amount: 10, Status: HoldPending, ExpiresAt: now.Add(time.Hour)}); err == nil {
+		t.Fatal("placed a hold that could never be captured")
+	}
+	if _, available := balancesOf(t, store, 1); available != 100 {
+		t.Fatalf("available %d, want 100", available)
+	}
+}
+
+func TestPartialCaptureReleasesTheRest(t *testing.T) {
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+
+	h := placeHold(t, store, 80, now)
+	if _, _, err := store.CaptureHold(h.ID, 90, now); err == nil {
+		t.Fatal("captured more than was held")
+	}
+	h, _, err := store.CaptureHold(h.ID, 50, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Status != HoldCaptured || h.Captured != 50 || h.TransactionID == 0 {
+		t.Fatalf("unexpected hold after capture: %+v", h)
+	}
+	if ledger, available := balancesOf(t, store, 1); ledger != 50 || available != 50 {
+		t.Fatalf("got ledger %d available %d, want 50 and 50", ledger, available)
+	}
+	if ledger, _ := balancesOf(t, store, 2); ledger != 50 {
+		t.Fatalf("payee balance %d, want 50", ledger)
+	}
+	txs, _ := store.GetTransactions(1)
+	if len(txs) != 1 || txs[0].Kind != KindCapture || txs[0].HoldID != h.ID {
+		t.Fatalf("unexpected ledger after capture: %+v", txs)
+	}
+}
+
+func TestStaleHoldsExpire(t *testing.T) {
+	now := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: now}
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+	h := placeHold(t, store, 60, now)
+	expirer := NewHoldExpirer(store, nil, clock)
+
+	clock.now = h.ExpiresAt.Add(-time.Second)
+	expirer.RunDue()
+	if _, available := balancesOf(t, store, 1); available != 40 {
+		t.Fatalf("hold expired early, available %d", available)
+	}
+
+	clock.now = h.ExpiresAt
+	expirer.RunDue()
+	h, _ = store.GetHold(h.ID)
+	if h.Status != HoldExpired {
+		t.Fatalf("hold is %s, want expired", h.Status)
+	}
+	if _, available := balancesOf(t, store, 1); available != 100 {
+		t.Fatalf("available %d after expiry, want 100", available)
+	}
+}
@@ -0,0 +1,87 @@
+// Package example has hooks showing what the hook package can do: filling in
+// accounts as they are created, vetoing transfers, and watching operations
+// complete.
+package example
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/cshorten/gobank/hook"
+)
+
+// TitleCaseNames is a before hook for account.create that capitalizes the
+// holder's names, so "ada LOVELACE" is stored as "Ada Lovelace".
+func TitleCaseNames(ctx context.Context, e *hook.Event) error {
+	e.Account.FirstName = titleCase(e.Account.FirstName)
+	e.Account.LastName = titleCase(e.Account.LastName)
+	return nil
+}
+
+func titleCase(s string) string {
+	words := strings.Fields(strings.ToLower(s))
+	for i, w := range words {
+		r := []rune(w)
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+// DefaultProduct is a before hook for account.create that puts accounts
+// opened without a product on the given one.
+func DefaultProduct(product string) hook.Func {
+	return func(ctx context.Context, e *hook.Event) error {
+		if e.Account.Product == "" {
+			e.Account.Product = product
+			e.Labels["example.defaultProduct"] = product
+		}
+		return nil
+	}
+}
+
+// TransferLimit is a before hook for transfer that vetoes any transfer over
+// max.
+func TransferLimit(max int64) hook.Func {
+	return func(ctx context.Context, e *hook.Event) error {
+		if e.Amount > max {
+			return hook.Veto(fmt.Sprintf("transfers are limited to %d", max))
+		}
+		return nil
+	}
+}
+
+// Recorder is an after hook that keeps every event it sees.
+type Recorder struct {
+	mu     sync.Mutex
+	events []hook.Event
+}
+
+func (r *Recorder) Hook(ctx context.Context, e *hook.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, *e)
+	return nil
+}
+
+// Events returns the events recorded so far.
+func (r *Recorder) Events() []hook.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]hook.Event(nil), r.events...)
+}
+
+// Register adds the example hooks to reg: names are title-cased and put on
+// product, transfers over maxTransfer are vetoed, and rec sees every
+// operation that completes.
+func Register(reg *hook.Registry, product string, maxTransfer int64, rec *Recorder) {
+	reg.Register("example.titleCase", hook.CreateAccount, hook.Before, 10, TitleCaseNames)
+	reg.Register("example.defaultProduct", hook.CreateAccount, hook.Before, 20, DefaultProduct(product))
+	reg.Register("example.transferLimit", hook.Transfer, hook.Before, 10, TransferLimit(maxTransfer))
+	for _, op := range []hook.Operation{hook.CreateAccount, hook.Transfer, hook.DeleteAccount} {
+		reg.Register("example.recorder", op, hook.After, 100, rec.Hook)
+	}
+}
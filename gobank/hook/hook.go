@@ -0,0 +1,231 @@
+// Package hook lets code built on gobank run before and after account and
+// transfer operations without changing the server. Before hooks can veto an
+// operation or fill in the account being created; after hooks see what
+// happened.
+//
+// Hooks are added to the server with Register, usually from the init
+// function of a package that the gobank binary imports:
+//
+//	func init() {
+//		hook.Register("mybank.limit", hook.Transfer, hook.Before, 10, limit)
+//	}
+package hook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation names what a hook runs around.
+type Operation string
+
+const (
+	CreateAccount Operation = "account.create"
+	Transfer      Operation = "transfer"
+	// DeleteAccount runs when an account is closed, whether by DELETE or by
+	// the close action.
+	DeleteAccount Operation = "account.delete"
+)
+
+type Phase string
+
+const (
+	Before Phase = "before"
+	After  Phase = "after"
+)
+
+// Account is the part of an account hooks see and, when one is being
+// created, may change.
+type Account struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Owner     string
+	Product   string
+}
+
+// Event is what a hook is called with.
+type Event struct {
+	Operation Operation
+	Phase     Phase
+	// Actor is the subject of the principal making the request.
+	Actor string
+	// Account is the account being created or deleted. Before hooks on
+	// account.create may change its names and product; other changes are
+	// ignored.
+	Account *Account
+	// FromAccount, ToAccount and Amount describe a transfer. TransactionID is
+	// set for after hooks once it has been posted.
+	FromAccount   int
+	ToAccount     int
+	Amount        int64
+	TransactionID int
+	// Source says how a transfer was made: "api", "batch:<id>",
+	// "schedule:<id>", "hold:<id>" for a captured hold, or "review:<id>" for
+	// a held transfer that has been approved. The after hooks of a held
+	// transfer run once it is approved, with a new event.
+	Source string
+	// Labels carry whatever hooks want to pass on to later hooks of the same
+	// operation, including from before hooks to after hooks.
+	Labels map[string]string
+}
+
+func (e *Event) clone() *Event {
+	c := *e
+	if e.Account != nil {
+		a := *e.Account
+		c.Account = &a
+	}
+	c.Labels = make(map[string]string, len(e.Labels))
+	for k, v := range e.Labels {
+		c.Labels[k] = v
+	}
+	return &c
+}
+
+// Func is a hook. The context is cancelled when the hook runs out of time.
+type Func func(ctx context.Context, e *Event) error
+
+// VetoError stops an operation. Before hooks return it, through Veto, to
+// refuse an operation; any other error means the hook itself failed.
+type VetoError struct {
+	Hook   string
+	Reason string
+}
+
+func (e *VetoError) Error() string {
+	return fmt.Sprintf("vetoed by %s: %s", e.Hook, e.Reason)
+}
+
+// Veto refuses the operation for the given reason.
+func Veto(reason string) error {
+	return &VetoError{Reason: reason}
+}
+
+type registration struct {
+	name  string
+	order int
+	f     Func
+}
+
+// Registry holds the hooks for each operation and phase.
+type Registry struct {
+	mu      sync.RWMutex
+	timeout time.Duration
+	hooks   map[Operation]map[Phase][]registration
+}
+
+// NewRegistry returns a registry giving each hook up to timeout to run.
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{timeout: timeout, hooks: map[Operation]map[Phase][]registration{}}
+}
+
+// DefaultTimeout is how long each hook in the default registry gets to run
+// unless the server is configured otherwise.
+const DefaultTimeout = 2 * time.Second
+
+var defaultRegistry = NewRegistry(DefaultTimeout)
+
+// Default returns the registry the gobank server runs.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Register adds a hook to the default registry.
+func Register(name string, op Operation, phase Phase, order int, f Func) {
+	defaultRegistry.Register(name, op, phase, order, f)
+}
+
+// SetTimeout changes how long each hook gets to run.
+func (r *Registry) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timeout = timeout
+}
+
+// Register adds a hook. Hooks run by ascending order, and those with the same
+// order in the order they were registered.
+func (r *Registry) Register(name string, op Operation, phase Phase, order int, f Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hooks[op] == nil {
+		r.hooks[op] = map[Phase][]registration{}
+	}
+	// Run may be iterating over the old slice, so build a new one.
+	hooks := append(append([]registration{}, r.hooks[op][phase]...), registration{name: name, order: order, f: f})
+	sort.SliceStable(hooks, func(i, j int) bool { return hooks[i].order < hooks[j].order })
+	r.hooks[op][phase] = hooks
+}
+
+// Run calls the hooks registered for the event's operation and phase. Before
+// hooks stop at the first one that vetoes or fails, and its error is
+// returned. After hooks all run; their errors are joined.
+func (r *Registry) Run(ctx context.Context, e *Event) error {
+	r.mu.RLock()
+	hooks, timeout := r.hooks[e.Operation][e.Phase], r.timeout
+	r.mu.RUnlock()
+
+	if e.Labels == nil {
+		e.Labels = map[string]string{}
+	}
+	var errs []error
+	for _, h := range hooks {
+		err := call(ctx, h, e, timeout)
+		if err == nil {
+			continue
+		}
+		if e.Phase == Before {
+			return err
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// call runs one hook on a copy of the event, keeping its changes only if it
+// finishes in time without error. A hook that overruns is left to finish in
+// the background.
+func call(ctx context.Context, h registration, e *Event, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	c := e.clone()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				done <- fmt.Errorf("panic: %v", v)
+			}
+		}()
+		done <- h.f(ctx, c)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+	var veto *VetoError
+	if errors.As(err, &veto) {
+		return &VetoError{Hook: h.name, Reason: veto.Reason}
+	}
+	if err != nil {
+		return fmt.Errorf("hook %s: %w", h.name, err)
+	}
+	e.Labels = c.Labels
+	if e.Phase == Before && e.Operation == CreateAccount && e.Account != nil && c.Account != nil {
+		e.Account.FirstName = c.Account.FirstName
+		e.Account.LastName = c.Account.LastName
+		e.Account.Product = c.Account.Product
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOrder(t *testing.T) {
+	reg := NewRegistry(time.Second)
+	var ran []string
+	add := func(name string, order int) {
+		reg.Register(name, Transfer, Before, order, func(ctx context.Context, e *Event) error {
+			ran = append(ran, name)
+			e.Labels["last"] = name
+			return nil
+		})
+	}
+	add("c", 20)
+	add("a", 10)
+	add("d", 20)
+	add("b", 10)
+
+	e := &Event{Operation: Transfer, Phase: Before}
+	if err := reg.Run(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ran, ","); got != "a,b,c,d" {
+		t.Fatalf("ran %s, want a,b,c,d", got)
+	}
+	if e.Labels["last"] != "d" {
+		t.Fatalf("labels %v", e.Labels)
+	}
+}
+
+func TestRunVetoAndFailures(t *testing.T) {
+	reg := NewRegistry(20 * time.Millisecond)
+	reg.Register("rename", CreateAccount, Before, 1, func(ctx context.Context, e *Event) error {
+		e.Account.FirstName = "Ada"
+		return nil
+	})
+	reg.Register("veto", CreateAccount, Before, 2, func(ctx context.Context, e *Event) error {
+		e.Account.LastName = "changed"
+		return Veto("no new accounts")
+	})
+	reg.Register("never", CreateAccount, Before, 3, func(ctx context.Context, e *Event) error {
+		t.Error("ran a hook after a veto")
+		return nil
+	})
+
+	e := &Event{Operation: CreateAccount, Account: &Account{FirstName: "a", LastName: "b"}, Phase: Before}
+	err := reg.Run(context.Background(), e)
+	var veto *VetoError
+	if !errors.As(err, &veto) || veto.Hook != "veto" || veto.Reason != "no new accounts" {
+		t.Fatalf("got %v, want a veto from veto", err)
+	}
+	if e.Account.FirstName != "Ada" || e.Account.LastName != "b" {
+		t.Fatalf("account %+v: want the rename kept and the vetoing hook's change dropped", e.Account)
+	}
+
+	reg.Register("slow", Transfer, After, 1, func(ctx context.Context, e *Event) error {
+		<-ctx.Done()
+		return nil
+	})
+	reg.Register("broken", Transfer, After, 2, func(ctx context.Context, e *Event) error {
+		panic("oops")
+	})
+	ran := false
+	reg.Register("fine", Transfer, After, 3, func(ctx context.Context, e *Event) error {
+		ran = true
+		return nil
+	})
+	err = reg.Run(context.Background(), &Event{Operation: Transfer, Phase: After})
+	if err == nil || !strings.Contains(err.Error(), "hook slow: timed out") || !strings.Contains(err.Error(), "hook broken: panic: oops") {
+		t.Fatalf("got %v, want the timeout and the panic", err)
+	}
+	if !ran {
+		t.Fatal("a failing after hook stopped the rest")
+	}
+}
+
+func TestRegisterAddsToDefault(t *testing.T) {
+	ran := false
+	Register("test.default", DeleteAccount, After, 0, func(ctx context.Context, e *Event) error {
+		ran = true
+		return nil
+	})
+	if err := Default().Run(context.Background(), &Event{Operation: DeleteAccount, Phase: After}); err != nil || !ran {
+		t.Fatalf("default registry ran the hook: %v, %v", ran, err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/cshorten/gobank/hook"
+)
+
+// defaultHookTimeout is how long each hook gets to run.
+const defaultHookTimeout = hook.DefaultTimeout
+
+// useHooks runs the hooks in reg around account operations and around every
+// transfer the tenants' risk engines guard.
+func (s *APIServer) useHooks(reg *hook.Registry) {
+	s.hooks = reg
+	for _, t := range s.tenants.All() {
+		t.risk.hooks = reg
+	}
+}
+
+func hookAccount(a *Account) *hook.Account {
+	return &hook.Account{
+		ID:        a.ID,
+		FirstName: a.FirstName,
+		LastName:  a.LastName,
+		Owner:     a.Owner,
+		Product:   a.Product,
+	}
+}
+
+func newHookEvent(r *http.Request, op hook.Operation) *hook.Event {
+	e := &hook.Event{Operation: op, Phase: hook.Before}
+	if p := principalFrom(r); p != nil {
+		e.Actor = p.Subject
+	}
+	return e
+}
+
+func newTransferEvent(actor, source string, from, to int, amount int64) *hook.Event {
+	return &hook.Event{
+		Operation:   hook.Transfer,
+		Phase:       hook.Before,
+		Actor:       actor,
+		Source:      source,
+		FromAccount: from,
+		ToAccount:   to,
+		Amount:      amount,
+	}
+}
+
+// errHookFailed refuses an operation whose before hook failed or overran,
+// since it can't be known to be safe without it.
+var errHookFailed = errors.New("operation refused: a hook failed")
+
+// beforeHooks runs the before hooks in reg for e, if there are any. It
+// returns a *hook.VetoError when a hook vetoes and errHookFailed when one
+// fails.
+func beforeHooks(ctx context.Context, reg *hook.Registry, e *hook.Event) error {
+	if reg == nil {
+		return nil
+	}
+	e.Phase = hook.Before
+	err := reg.Run(ctx, e)
+	var veto *hook.VetoError
+	if err == nil || errors.As(err, &veto) {
+		return err
+	}
+	log.Printf("hooks: %s: %v", e.Operation, err)
+	return errHookFailed
+}
+
+// afterHooks runs the after hooks in reg for e. The operation has already
+// happened, so failures are only logged.
+func afterHooks(ctx context.Context, reg *hook.Registry, e *hook.Event) {
+	if reg == nil {
+		return
+	}
+	e.Phase = hook.After
+	if err := reg.Run(ctx, e); err != nil {
+		log.Printf("hooks: %s: %v", e.Operation, err)
+	}
+}
+
+// hookStatus gives a before hook's error its status: a veto refuses the
+// request with 422, and a failed hook fails it with 500. Other errors are
+// returned as they are.
+func hookStatus(err error) error {
+	var veto *hook.VetoError
+	switch {
+	case errors.As(err, &veto):
+		return httpError{Status: http.StatusUnprocessableEntity, Msg: err.Error()}
+	case errors.Is(err, errHookFailed):
+		return httpError{Status: http.StatusInternalServerError, Msg: err.Error()}
+	}
+	return err
+}
+
+func (s *APIServer) runBeforeHooks(r *http.Request, e *hook.Event) error {
+	if err := beforeHooks(r.Context(), s.hooks, e); err != nil {
+		return hookStatus(err)
+	}
+	return nil
+}
+
+func (s *APIServer) runAfterHooks(r *http.Request, e *hook.Event) {
+	afterHooks(r.Context(), s.hooks, e)
+}
+
+// createAccount creates the account between the create-account hooks, which
+// may fill in its names and product or refuse it.
+func (s *APIServer) createAccount(r *http.Request, account *Account) error {
+	e := newHookEvent(r, hook.CreateAccount)
+	e.Account = hookAccount(account)
+	if err := s.runBeforeHooks(r, e); err != nil {
+		return err
+	}
+	account.FirstName, account.LastName, account.Product = e.Account.FirstName, e.Account.LastName, e.Account.Product
+	if _, ok := s.products[account.Product]; account.Product != "" && !ok {
+		return fmt.Errorf("unknown product %s", account.Product)
+	}
+	currency, err := s.tenant(r).accountCurrency(account.Currency)
+	if err != nil {
+		return err
+	}
+	account.Currency = currency
+	if err := s.storage(r).CreateAccount(account); err != nil {
+		return err
+	}
+	s.recordAudit(r, "account.create", account.ID, nil, account)
+	e.Account = hookAccount(account)
+	s.runAfterHooks(r, e)
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build examplehooks
+
+package main
+
+import (
+	"github.com/cshorten/gobank/hook"
+	"github.com/cshorten/gobank/hook/example"
+)
+
+// Building with -tags examplehooks runs the example hooks: names are
+// title-cased, new accounts default to savings and transfers over 100000 are
+// vetoed. Hooks of your own are built in the same way, by importing the
+// package that registers them from a file like this one.
+func init() {
+	hook.Register("example.titleCase", hook.CreateAccount, hook.Before, 10, example.TitleCaseNames)
+	hook.Register("example.defaultProduct", hook.CreateAccount, hook.Before, 20, example.DefaultProduct("savings"))
+	hook.Register("example.transferLimit", hook.Transfer, hook.Before, 10, example.TransferLimit(100_000))
+}
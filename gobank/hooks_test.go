@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cshorten/gobank/hook"
+	"github.com/cshorten/gobank/hook/example"
+)
+
+func TestExampleHooks(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	products, err := indexInterestProducts(defaultInterestProducts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.products = products
+	rec := &example.Recorder{}
+	example.Register(server.hooks, "savings", 100, rec)
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+
+	res := customerRequest(t, server, alice, "POST", "/account", `{"firstName":"ada","lastName":"LOVELACE"}`)
+	var account Account
+	json.Unmarshal(res.Body.Bytes(), &account)
+	if res.Code != http.StatusCreated || account.FirstName != "Ada" || account.LastName != "Lovelace" || account.Product != "savings" {
+		t.Fatalf("create: %d %s", res.Code, res.Body)
+	}
+	// Give the account something to send.
+	store.PostInterest(account.ID, "2026-01", 500, time.Now())
+	savePayee(t, store, account.ID, 2)
+
+	transfer := func(amount string) int {
+		body := fmt.Sprintf(`{"fromAccount":%d,"toAccount":2,"amount":%s}`, account.ID, amount)
+		return customerRequest(t, server, alice, "POST", "/transfer", body).Code
+	}
+	if code := transfer("101"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("transfer over the limit: %d", code)
+	}
+	if code := transfer("100"); code != http.StatusOK {
+		t.Fatalf("transfer at the limit: %d", code)
+	}
+
+	events := rec.Events()
+	if len(events) != 2 {
+		t.Fatalf("recorded %d events, want 2: %+v", len(events), events)
+	}
+	if e := events[0]; e.Operation != hook.CreateAccount || e.Account.ID != account.ID || e.Labels["example.defaultProduct"] != "savings" || e.Actor != "alice" {
+		t.Errorf("create event %+v", e)
+	}
+	if e := events[1]; e.Operation != hook.Transfer || e.Amount != 100 || e.TransactionID == 0 {
+		t.Errorf("transfer event %+v", e)
+	}
+}
+
+func TestHookFailureRefusesOperation(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	server.useHooks(hook.NewRegistry(10 * time.Millisecond))
+	server.hooks.Register("stuck", hook.DeleteAccount, hook.Before, 0, func(ctx context.Context, e *hook.Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	res := customerRequest(t, server, Principal{Subject: "alice", Role: RoleCustomer}, "POST", "/account/1/close", "")
+	if res.Code != http.StatusInternalServerError {
+		t.Fatalf("close with a stuck hook: %d %s", res.Code, res.Body)
+	}
+	if acc, _ := store.GetAccountByID(1); acc.Status != StatusActive {
+		t.Fatalf("account closed anyway: %s", acc.Status)
+	}
+}
+
+func TestTransferHooksRunForEveryTransfer(t *testing.T) {
+	store, server, processor := newBatchFixture(t)
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	rec := &example.Recorder{}
+	server.hooks.Register("recorder", hook.Transfer, hook.After, 0, rec.Hook)
+	server.hooks.Register("unlucky", hook.Transfer, hook.Before, 0, func(ctx context.Context, e *hook.Event) error {
+		if e.Amount == 13 {
+			return hook.Veto("unlucky")
+		}
+		return nil
+	})
+	payroll := Principal{Subject: "payroll", Role: RoleCustomer}
+	lastSource := func() string {
+		events := rec.Events()
+		if len(events) == 0 {
+			return ""
+		}
+		e := events[len(events)-1]
+		if e.TransactionID == 0 {
+			t.Errorf("after hook for %s has no transaction", e.Source)
+		}
+		return e.Source
+	}
+
+	_, b := submitBatch(t, server, "/batches", "application/json", `{"mode":"best-effort","transfers":[
+		{"fromAccount":1,"toAccount":2,"amount":5},
+		{"fromAccount":1,"toAccount":3,"amount":13}
+	]}`)
+	processor.RunDue()
+	b, _ = store.GetBatch(b.ID)
+	if b.Items[1].Status != ItemFailed || !strings.Contains(b.Items[1].Error, "unlucky") {
+		t.Fatalf("vetoed batch transfer: %+v", b.Items[1])
+	}
+	if got := lastSource(); got != fmt.Sprintf("batch:%d", b.ID) || len(rec.Events()) != 1 {
+		t.Fatalf("after hooks ran for %s, %d times", got, len(rec.Events()))
+	}
+
+	st, err := NewScheduledTransfer(1, &ScheduleTransferRequest{ToAccount: 2, Amount: 6, StartAt: time.Now()}, time.Now())
+	must(t, err)
+	must(t, store.CreateScheduledTransfer(st))
+	NewScheduler(store, nil, tenant.risk, realClock{}).RunDue()
+	if got := lastSource(); got != fmt.Sprintf("schedule:%d", st.ID) {
+		t.Fatalf("last after hook ran for %s", got)
+	}
+
+	h := placeHold(t, store, 7, time.Now())
+	path := fmt.Sprintf("/account/1/holds/%d/capture", h.ID)
+	if res := customerRequest(t, server, payroll, "POST", path, ""); res.Code != http.StatusOK {
+		t.Fatalf("capture: %d %s", res.Code, res.Body)
+	}
+	if got := lastSource(); got != fmt.Sprintf("hold:%d", h.ID) {
+		t.Fatalf("last after hook ran for %s", got)
+	}
+
+	// A held transfer's after hooks run when it is approved.
+	rules := new(RiskRules)
+	must(t, json.Unmarshal([]byte(`{"dailyLimit": {"amount": 1, "action": "hold"}}`), rules))
+	tenant.risk.SetRules(rules)
+	res := customerRequest(t, server, payroll, "POST", "/transfer", `{"fromAccount":1,"toAccount":2,"amount":8}`)
+	var d RiskDecision
+	json.Unmarshal(res.Body.Bytes(), &d)
+	if res.Code != http.StatusAccepted || len(rec.Events()) != 3 {
+		t.Fatalf("held transfer: %d, %d after hooks", res.Code, len(rec.Events()))
+	}
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+	if res := customerRequest(t, server, admin, "POST", fmt.Sprintf("/reviews/%d/approve", d.ID), ""); res.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", res.Code, res.Body)
+	}
+	if got := lastSource(); got != fmt.Sprintf("review:%d", d.ID) {
+		t.Fatalf("last after hook ran for %s", got)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Interest is accrued in micro-units (millionths of the smallest currency
+// unit) and only rounded when it is posted to the ledger. Whatever rounding
+// leaves over is carried into the next posting.
+const microsPerUnit = 1_000_000
+
+// bankAccountID is the ledger counterparty for money the bank itself pays,
+// such as interest. The store gives out account IDs after it, so no account
+// can have it.
+const bankAccountID = 0
+
+type RoundingMode string
+
+const (
+	RoundHalfEven RoundingMode = "half-even"
+	RoundHalfUp   RoundingMode = "half-up"
+	RoundDown     RoundingMode = "down"
+)
+
+// round converts micro-units to whole units.
+func (m RoundingMode) round(micros int64) int64 {
+	if micros < 0 {
+		return -m.round(-micros)
+	}
+	q, r := micros/microsPerUnit, micros%microsPerUnit
+	switch m {
+	case RoundDown:
+		return q
+	case RoundHalfUp:
+		if r >= microsPerUnit/2 {
+			q++
+		}
+	default:
+		if r > microsPerUnit/2 || (r == microsPerUnit/2 && q%2 == 1) {
+			q++
+		}
+	}
+	return q
+}
+
+type InterestProduct struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// RateBps is the annual rate in basis points.
+	RateBps int64 `json:"rateBps"`
+	// DayCount is the number of days the annual rate is spread over.
+	DayCount   int64        `json:"dayCount"`
+	Rounding   RoundingMode `json:"rounding"`
+	MinBalance int64        `json:"minBalance"`
+}
+
+var defaultInterestProducts = []*InterestProduct{
+	{ID: "checking", Name: "Checking", RateBps: 0, DayCount: 365, Rounding: RoundHalfEven},
+	{ID: "savings", Name: "Savings", RateBps: 200, DayCount: 365, Rounding: RoundHalfEven},
+}
+
+func (p *InterestProduct) validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("interest product needs an id")
+	}
+	if p.RateBps < 0 {
+		return fmt.Errorf("interest product %s has a negative rate", p.ID)
+	}
+	if p.DayCount != 360 && p.DayCount != 365 {
+		return fmt.Errorf("interest product %s has day count %d, want 360 or 365", p.ID, p.DayCount)
+	}
+	switch p.Rounding {
+	case RoundHalfEven, RoundHalfUp, RoundDown:
+	default:
+		return fmt.Errorf("interest product %s has unknown rounding %s", p.ID, p.Rounding)
+	}
+	return nil
+}
+
+// DailyAccrual returns the interest, in micro-units, earned in one day on an
+// end-of-day balance. Fractions of a micro-unit are truncated.
+func (p *InterestProduct) DailyAccrual(balance int64) int64 {
+	if balance <= 0 || balance < p.MinBalance || p.RateBps == 0 {
+		return 0
+	}
+	n := new(big.Int).Mul(big.NewInt(balance), big.NewInt(p.RateBps))
+	n.Mul(n, big.NewInt(microsPerUnit))
+	n.Quo(n, big.NewInt(10_000*p.DayCount))
+	return n.Int64()
+}
+
+// LoadInterestProducts reads a JSON list of products from path.
+func LoadInterestProducts(path string) (map[string]*InterestProduct, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*InterestProduct
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	return indexInterestProducts(list)
+}
+
+func indexInterestProducts(list []*InterestProduct) (map[string]*InterestProduct, error) {
+	products := make(map[string]*InterestProduct, len(list))
+	for _, p := range list {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		products[p.ID] = p
+	}
+	return products, nil
+}
+
+// InterestState tracks interest an account has earned but not yet been paid.
+type InterestState struct {
+	AccruedMicros int64 `json:"accruedMicros"`
+	// AccruedThrough is the last day interest was accrued for.
+	AccruedThrough *time.Time `json:"accruedThrough,omitempty"`
+	// LastPosted is the last month, as YYYY-MM, interest was paid for.
+	LastPosted string `json:"lastPosted,omitempty"`
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// InterestEngine accrues interest for every account with an interest product
+// once a day, on the balance at the end of that day, and pays the month's
+// interest into the account on the first day of the next month.
+type InterestEngine struct {
+	store    Storage
+	audit    *AuditLog
+	products map[string]*InterestProduct
+	clock    Clock
+	interval time.Duration
+	// tracer, if set, traces each run.
+	tracer trace.Tracer
+}
+
+func NewInterestEngine(store Storage, audit *AuditLog, products map[string]*InterestProduct, clock Clock) *InterestEngine {
+	return &InterestEngine{
+		store:    store,
+		audit:    audit,
+		products: products,
+		clock:    clock,
+		interval: time.Hour,
+	}
+}
+
+func (e *InterestEngine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.RunDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue catches every account up to the start of today.
+func (e *InterestEngine) RunDue() {
+	ctx, span := startWork(e.tracer, "interest.run", trace.SpanKindInternal)
+	defer span.End()
+
+	accounts, err := e.store.GetAccounts()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		log.Println("interest:", err)
+		return
+	}
+	today := startOfDay(e.clock.Now())
+	for _, acc := range accounts {
+		p, ok := e.products[acc.Product]
+		if !ok {
+			continue
+		}
+		// Frozen and closed accounts neither earn nor are paid interest until
+		// they are active again, when they are caught up.
+		if acc.Status != StatusActive || acc.ErasedAt != nil {
+			continue
+		}
+		if err := e.catchUp(ctx, acc, p, today); err != nil && !errors.Is(err, ErrInterestStale) {
+			log.Printf("interest: account %d: %v", acc.ID, err)
+		}
+	}
+}
+
+func (e *InterestEngine) catchUp(ctx context.Context, acc *Account, p *InterestProduct, today time.Time) (err error) {
+	ctx, span := startChild(ctx, "interest.catchUp", attribute.Int("gobank.account.id", acc.ID))
+	defer endSpan(span, &err)
+	store := traced(ctx, e.store)
+
+	state, err := store.GetInterestState(acc.ID)
+	if err != nil {
+		return err
+	}
+	day := startOfDay(acc.CreatedAt)
+	if state.AccruedThrough != nil {
+		day = state.AccruedThrough.AddDate(0, 0, 1)
+	}
+	if day.After(today) {
+		return nil
+	}
+
+	// The balance is worked out once, for the first day, and then carried
+	// forward through the account's transactions rather than worked out
+	// afresh from the whole ledger for each day.
+	balance, err := store.BalanceAt(acc.ID, day)
+	if err != nil {
+		return err
+	}
+	txs, err := store.GetTransactions(acc.ID)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.Before(txs[j].CreatedAt) })
+	for len(txs) > 0 && txs[0].CreatedAt.Before(day) {
+		txs = txs[1:]
+	}
+
+	for ; !day.After(today); day = day.AddDate(0, 0, 1) {
+		if day.Day() == 1 {
+			period := day.AddDate(0, 0, -1).Format("2006-01")
+			if period > state.LastPosted {
+				tx, err := e.post(store, acc.ID, p, period, day)
+				if err != nil {
+					return err
+				}
+				// The payment is dated day but was made after the
+				// transactions were read, so it is added on here.
+				if tx != nil {
+					balance += tx.Amount
+				}
+			}
+		}
+		if day.Equal(today) {
+			break
+		}
+		next := day.AddDate(0, 0, 1)
+		for len(txs) > 0 && txs[0].CreatedAt.Before(next) {
+			balance += ledgerDelta(txs[0], acc.ID)
+			txs = txs[1:]
+		}
+		if err := store.AccrueInterest(acc.ID, day, p.DailyAccrual(balance)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ledgerDelta is how much tx changed the balance of the account.
+func ledgerDelta(tx *Transaction, accountID int) int64 {
+	var delta int64
+	if tx.FromAccount == accountID {
+		delta -= tx.Amount
+	}
+	if tx.ToAccount == accountID {
+		delta += tx.Amount
+	}
+	return delta
+}
+
+// post pays out the interest for period. The ledger entry is dated on the
+// first of the following month, however late the engine gets to it, so the
+// balances later days accrue on include it.
+func (e *InterestEngine) post(store Storage, accountID int, p *InterestProduct, period string, on time.Time) (*Transaction, error) {
+	state, err := store.GetInterestState(accountID)
+	if err != nil {
+		return nil, err
+	}
+	amount := p.Rounding.round(state.AccruedMicros)
+	tx, changes, err := store.PostInterest(accountID, period, amount, on)
+	if err != nil || tx == nil || e.audit == nil {
+		return tx, err
+	}
+
+	err = e.audit.Append(&AuditEntry{
+		Actor:     "interest",
+		Action:    "interest.post",
+		AccountID: accountID,
+		Before:    changes.before(accountID),
+		After:     changes.after(accountID),
+		RequestID: fmt.Sprintf("interest-%d-%s", accountID, period),
+	})
+	if err != nil {
+		log.Println("audit:", err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundingModes(t *testing.T) {
+	tests := []struct {
+		mode   RoundingMode
+		micros int64
+		want   int64
+	}{
+		{RoundHalfEven, 2_500_000, 2},
+		{RoundHalfEven, 3_500_000, 4},
+		{RoundHalfEven, 2_500_001, 3},
+		{RoundHalfEven, -2_500_000, -2},
+		{RoundHalfUp, 2_500_000, 3},
+		{RoundHalfUp, 2_499_999, 2},
+		{RoundDown, 2_999_999, 2},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.round(tt.micros); got != tt.want {
+			t.Errorf("%s.round(%d): expected %d, got %d", tt.mode, tt.micros, tt.want, got)
+		}
+	}
+}
+
+func TestInterestAccruesDailyAndPostsMonthly(t *testing.T) {
+	products, err := indexInterestProducts(defaultInterestProducts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	// 365000 at 2% over 365 days earns exactly 20 a day.
+	store.CreateAccount(&Account{ID: 1, Product: "savings", Balance: 365_000, Status: StatusActive, CreatedAt: created})
+
+	clock := &fakeClock{now: time.Date(2026, 2, 1, 10, 0, 0, 0, time.UTC)}
+	engine := NewInterestEngine(store, nil, products, clock)
+	engine.RunDue()
+	engine.RunDue()
+
+	if got := balanceOf(t, store, 1); got != 365_000+31*20 {
+		t.Fatalf("expected January's interest to be posted once, balance %d", got)
+	}
+	state, _ := store.GetInterestState(1)
+	if state.AccruedMicros != 0 || state.LastPosted != "2026-01" {
+		t.Fatalf("unexpected interest state %+v", state)
+	}
+
+	st, err := BuildStatement(store, 1, "2026-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.OpeningBalance != 365_000 || st.ClosingBalance != 365_620 || st.InterestPaid != 620 {
+		t.Fatalf("unexpected statement %+v", st)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := st.WriteCSV(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Interest,6.20,3656.20") {
+		t.Fatalf("csv statement is missing the interest line:\n%s", buf)
+	}
+}
+
+func TestInterestOnlyForActiveAccounts(t *testing.T) {
+	products, err := indexInterestProducts(defaultInterestProducts)
+	must(t, err)
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	must(t, store.CreateAccount(&Account{ID: 1, Product: "savings", Balance: 365_000, Status: StatusActive, CreatedAt: created}))
+	must(t, store.CreateAccount(&Account{ID: 2, Product: "checking", Balance: 365_000, Status: StatusActive, CreatedAt: created}))
+	must(t, store.CreateAccount(&Account{ID: 3, Product: "savings", Balance: 365_000, Status: StatusFrozen, CreatedAt: created}))
+	must(t, store.CreateAccount(&Account{ID: 4, Product: "savings", Status: StatusClosed, CreatedAt: created}))
+	unnumbered := &Account{Product: "savings", Status: StatusActive}
+	must(t, store.CreateAccount(unnumbered))
+	if unnumbered.ID == bankAccountID {
+		t.Fatal("opened an account under the bank's own ID")
+	}
+
+	// Account 1's balance doubles halfway through January.
+	if _, _, err := store.Transfer(2, 1, 365_000); err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	store.transactions[len(store.transactions)-1].CreatedAt = time.Date(2026, 1, 16, 12, 0, 0, 0, time.UTC)
+	store.mu.Unlock()
+
+	clock := &fakeClock{now: time.Date(2026, 2, 1, 10, 0, 0, 0, time.UTC)}
+	engine := NewInterestEngine(store, nil, products, clock)
+	engine.RunDue()
+
+	if got := balanceOf(t, store, 1); got != 730_000+15*20+16*40 {
+		t.Fatalf("account 1 has %d", got)
+	}
+	if got := balanceOf(t, store, 3); got != 365_000 {
+		t.Fatalf("frozen account was paid interest: %d", got)
+	}
+	if got := balanceOf(t, store, 4); got != 0 {
+		t.Fatalf("closed account was paid interest: %d", got)
+	}
+
+	// Once unfrozen, the account is caught up.
+	_, err = store.SetAccountStatus(3, StatusFrozen, StatusActive, 0)
+	must(t, err)
+	engine.RunDue()
+	if got := balanceOf(t, store, 3); got != 365_000+31*20 {
+		t.Fatalf("unfrozen account has %d", got)
+	}
+}
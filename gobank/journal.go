@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A store kept on disk is a snapshot of everything at path and, next to it,
+// a journal of the changes since. Each change appends one line to the
+// journal holding the records it touched: an account, a transaction, a
+// counter. Opening the store replays the journal over the snapshot. Once the
+// journal has grown bigger than the snapshot, or data has been erased, the
+// two are folded into a new snapshot and the journal starts again.
+//
+// Records are keyed by section and ID for maps ("accounts/12"), section and
+// position for lists ("transactions#3") and section alone for counters
+// ("nextPayeeId"). A record written as null has been removed.
+
+// minCompactSize is how big the journal may get before it is worth
+// compacting, however small the snapshot.
+const minCompactSize = 1 << 20
+
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// save appends the records the last change touched to the journal. If they
+// can't be written, the change is undone by loading the store again from
+// disk, so the caller's error leaves the store as a restart would find it.
+// Callers hold s.mu.
+func (s *MemoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return s.rollback(err)
+	}
+	recs, err := splitRecords(b)
+	if err != nil {
+		return s.rollback(err)
+	}
+	changed := map[string]json.RawMessage{}
+	for k, v := range recs {
+		if s.written[k] != sha256.Sum256(v) {
+			changed[k] = v
+		}
+	}
+	for k := range s.written {
+		if _, ok := recs[k]; !ok {
+			changed[k] = json.RawMessage("null")
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	line, err := json.Marshal(changed)
+	if err != nil {
+		return s.rollback(err)
+	}
+	line = append(line, '\n')
+	if _, err := s.journal.Write(line); err != nil {
+		return s.rollback(err)
+	}
+	if err := s.journal.Sync(); err != nil {
+		return s.rollback(err)
+	}
+	s.journalSize += int64(len(line))
+	for k, v := range changed {
+		if recs[k] == nil {
+			delete(s.written, k)
+		} else {
+			s.written[k] = sha256.Sum256(v)
+		}
+	}
+
+	if s.journalSize > minCompactSize && s.journalSize > s.snapshotSize {
+		// The change is safely in the journal, so a failed compaction
+		// only means the journal goes on growing until the next one.
+		if err := s.compact(); err != nil {
+			log.Printf("store: compacting %s: %v", s.path, err)
+		}
+	}
+	return nil
+}
+
+// rollback undoes a change that couldn't be saved by loading the store from
+// disk again, and returns err. Callers hold s.mu.
+func (s *MemoryStore) rollback(err error) error {
+	// Drop whatever part of the change made it into the journal.
+	if terr := os.Truncate(journalPath(s.path), s.journalSize); terr != nil {
+		return errors.Join(err, fmt.Errorf("undoing the change: %w", terr))
+	}
+	before := make([]int, 0, len(s.accounts))
+	for id := range s.accounts {
+		before = append(before, id)
+	}
+	if _, lerr := s.load(); lerr != nil {
+		return errors.Join(err, fmt.Errorf("undoing the change: %w", lerr))
+	}
+	// The change may have touched any account, and those it created are
+	// gone again.
+	for _, id := range before {
+		for _, hook := range s.changeHooks {
+			hook(id)
+		}
+	}
+	return err
+}
+
+// checkpoint records the store as it is, so a change made in several steps
+// can be undone with revert if a later step fails. Callers hold s.mu.
+func (s *MemoryStore) checkpoint() ([]byte, error) {
+	return json.Marshal(s.snapshot())
+}
+
+// revert puts the store back as it was at a checkpoint. Nothing since has
+// been saved, so the store is left as a restart would find it. Callers hold
+// s.mu.
+func (s *MemoryStore) revert(checkpoint []byte) error {
+	snap := storeSnapshot{}
+	if err := json.Unmarshal(checkpoint, &snap); err != nil {
+		return err
+	}
+	before := make([]int, 0, len(s.accounts))
+	for id := range s.accounts {
+		before = append(before, id)
+	}
+	s.restore(snap)
+	for _, id := range before {
+		for _, hook := range s.changeHooks {
+			hook(id)
+		}
+	}
+	return nil
+}
+
+// compact writes the whole store as a new snapshot, in a temporary file
+// renamed into place so a crash leaves either the old snapshot or the new
+// one, and then empties the journal. A crash before the journal is emptied
+// only means it is replayed over a snapshot that already has its changes.
+// Callers hold s.mu.
+func (s *MemoryStore) compact() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".gobank-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.snapshotSize = int64(len(b))
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	s.journalSize = 0
+	recs, err := splitRecords(b)
+	if err != nil {
+		return err
+	}
+	s.remember(recs)
+	return nil
+}
+
+// load replaces the store's data with the snapshot and journal on disk, and
+// reports whether any account had to be given a number. Callers hold s.mu or
+// have the store to themselves.
+func (s *MemoryStore) load() (bool, error) {
+	recs := map[string]json.RawMessage{}
+	b, err := os.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return false, err
+	default:
+		if recs, err = splitRecords(b); err != nil {
+			return false, fmt.Errorf("loading %s: %w", s.path, err)
+		}
+	}
+	s.snapshotSize = int64(len(b))
+
+	if s.journalSize, err = replayJournal(journalPath(s.path), recs); err != nil {
+		return false, err
+	}
+	b, err = joinRecords(recs)
+	if err != nil {
+		return false, fmt.Errorf("loading %s: %w", s.path, err)
+	}
+	snap := storeSnapshot{}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return false, fmt.Errorf("loading %s: %w", s.path, err)
+	}
+	s.remember(recs)
+	return s.restore(snap), nil
+}
+
+// remember notes recs as written. Callers hold s.mu.
+func (s *MemoryStore) remember(recs map[string]json.RawMessage) {
+	s.written = make(map[string][sha256.Size]byte, len(recs))
+	for k, v := range recs {
+		s.written[k] = sha256.Sum256(v)
+	}
+}
+
+// replayJournal applies the changes in the journal at path to recs and
+// returns how much of the journal it used. A last line without its newline
+// was cut short by a crash before its change was saved, and is left out.
+func replayJournal(path string, recs map[string]json.RawMessage) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		changed := map[string]json.RawMessage{}
+		if err := json.Unmarshal(line, &changed); err != nil {
+			return 0, fmt.Errorf("loading %s line %d: %w", path, n, err)
+		}
+		for k, v := range changed {
+			if bytes.Equal(v, []byte("null")) {
+				delete(recs, k)
+			} else {
+				recs[k] = v
+			}
+		}
+		size += int64(len(line))
+	}
+}
+
+// splitRecords breaks an encoded snapshot into its records.
+func splitRecords(b []byte) (map[string]json.RawMessage, error) {
+	sections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &sections); err != nil {
+		return nil, err
+	}
+	recs := map[string]json.RawMessage{}
+	for name, raw := range sections {
+		switch {
+		case bytes.HasPrefix(raw, []byte("{")):
+			m := map[string]json.RawMessage{}
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return nil, err
+			}
+			for k, v := range m {
+				recs[name+"/"+k] = v
+			}
+		case bytes.HasPrefix(raw, []byte("[")):
+			var list []json.RawMessage
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return nil, err
+			}
+			for i, v := range list {
+				recs[name+"#"+strconv.Itoa(i)] = v
+			}
+		case !bytes.Equal(raw, []byte("null")):
+			recs[name] = raw
+		}
+	}
+	return recs, nil
+}
+
+// joinRecords puts records back together into an encoded snapshot.
+func joinRecords(recs map[string]json.RawMessage) ([]byte, error) {
+	sections := map[string]json.RawMessage{}
+	maps := map[string]map[string]json.RawMessage{}
+	lists := map[string]map[int]json.RawMessage{}
+	for k, v := range recs {
+		if name, key, ok := strings.Cut(k, "/"); ok {
+			if maps[name] == nil {
+				maps[name] = map[string]json.RawMessage{}
+			}
+			maps[name][key] = v
+			continue
+		}
+		if name, pos, ok := strings.Cut(k, "#"); ok {
+			i, err := strconv.Atoi(pos)
+			if err != nil {
+				return nil, fmt.Errorf("bad record %s", k)
+			}
+			if lists[name] == nil {
+				lists[name] = map[int]json.RawMessage{}
+			}
+			lists[name][i] = v
+			continue
+		}
+		sections[k] = v
+	}
+	for name, m := range maps {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		sections[name] = b
+	}
+	for name, items := range lists {
+		list := make([]json.RawMessage, len(items))
+		for i, v := range items {
+			if i < 0 || i >= len(list) {
+				return nil, fmt.Errorf("%s has a gap at %d", name, i)
+			}
+			list[i] = v
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		sections[name] = b
+	}
+	return json.Marshal(sections)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Balance: 100, Status: StatusActive}))
+	must(t, store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive}))
+	_, _, err = store.Transfer(1, 2, 30)
+	must(t, err)
+	customers, _ := store.GetCustomers("alice")
+	keep := &Payee{CustomerID: customers[0].ID, Nickname: "bob", AccountNumber: firstAccountNumber + 1, Name: "Bob"}
+	gone := &Payee{CustomerID: customers[0].ID, Nickname: "old", AccountNumber: 12345678, Name: "Carol"}
+	must(t, store.CreatePayee(keep))
+	must(t, store.CreatePayee(gone))
+	must(t, store.DeletePayee(gone.ID))
+
+	// Changes are appended, not written out in full each time.
+	snapshot, _ := os.ReadFile(path)
+	if journal, _ := os.ReadFile(journalPath(path)); len(journal) == 0 || bytes.Contains(snapshot, []byte("Lovelace")) {
+		t.Fatalf("snapshot %q, journal %q", snapshot, journal)
+	}
+
+	check := func(s *MemoryStore) {
+		t.Helper()
+		if got := balanceOf(t, s, 1); got != 70 {
+			t.Fatalf("account 1 has %d", got)
+		}
+		if got := balanceOf(t, s, 2); got != 30 {
+			t.Fatalf("account 2 has %d", got)
+		}
+		if txs, _ := s.GetTransactions(1); len(txs) != 1 {
+			t.Fatalf("%d transactions", len(txs))
+		}
+		if _, err := s.GetPayee(gone.ID); err == nil {
+			t.Fatal("deleted payee is back")
+		}
+		if p, err := s.GetPayee(keep.ID); err != nil || p.Nickname != "bob" {
+			t.Fatalf("payee %+v %v", p, err)
+		}
+	}
+	reopened, err := OpenMemoryStore(path)
+	must(t, err)
+	check(reopened)
+
+	// Opening folds the journal into the snapshot.
+	if journal, _ := os.ReadFile(journalPath(path)); len(journal) != 0 {
+		t.Fatalf("journal after reopening: %q", journal)
+	}
+	must(t, reopened.CreateAccount(&Account{ID: 3, Owner: "carol", Status: StatusActive}))
+	again, err := OpenMemoryStore(path)
+	must(t, err)
+	check(again)
+	if acc, err := again.GetAccountByID(3); err != nil || acc.Number != firstAccountNumber+2 {
+		t.Fatalf("account 3: %+v %v", acc, err)
+	}
+}
+
+func TestStoreDropsChangeCutShortByACrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive}))
+
+	f, err := os.OpenFile(journalPath(path), os.O_WRONLY|os.O_APPEND, 0)
+	must(t, err)
+	f.WriteString(`{"accounts/1":{"id":1,"bal`)
+	f.Close()
+
+	reopened, err := OpenMemoryStore(path)
+	must(t, err)
+	if got := balanceOf(t, reopened, 1); got != 100 {
+		t.Fatalf("account 1 has %d", got)
+	}
+}
+
+func TestStoreUndoesChangeItCannotSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive}))
+	must(t, store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive}))
+	var changed []int
+	store.OnAccountChange(func(id int) { changed = append(changed, id) })
+
+	// Writes to the journal fail once it is closed.
+	store.journal.Close()
+	if _, _, err := store.Transfer(1, 2, 30); err == nil {
+		t.Fatal("transfer reported as saved")
+	}
+	if got := balanceOf(t, store, 1); got != 100 {
+		t.Fatalf("account 1 has %d after a failed save", got)
+	}
+	if txs, _ := store.GetTransactions(1); len(txs) != 0 {
+		t.Fatalf("%d transactions after a failed save", len(txs))
+	}
+	if err := store.CreateAccount(&Account{ID: 3, Owner: "carol", Status: StatusActive}); err == nil {
+		t.Fatal("account reported as saved")
+	}
+	if _, err := store.GetAccountByID(3); err == nil {
+		t.Fatal("unsaved account is still there")
+	}
+	// Caches are told to forget what they read of the change.
+	if len(changed) == 0 {
+		t.Fatal("no change hooks ran for the undone change")
+	}
+}
+
+func TestErasureIsCompactedOutOfTheJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Status: StatusActive}))
+	_, err = store.SetAccountStatus(1, "", StatusClosed, 0)
+	must(t, err)
+	_, err = store.EraseAccount(1, "Erased", "Erased", time.Now())
+	must(t, err)
+
+	for _, file := range []string{path, journalPath(path)} {
+		if b, _ := os.ReadFile(file); bytes.Contains(b, []byte("Lovelace")) {
+			t.Errorf("%s still has the erased name", file)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadOps are the requests a load test can make.
+var loadOps = []string{"create", "read", "transfer"}
+
+// LoadTestConfig describes a load test workload.
+type LoadTestConfig struct {
+	// Target is the base URL of the server. Empty starts a server in-process
+	// over a fresh memory store.
+	Target string
+	Token  string
+	// FundFrom is an account on the target that pays Fund into each test
+	// account before the run, so transfers have money to move. The
+	// in-process server has one made for it.
+	FundFrom int
+	Fund     int64
+	Duration time.Duration
+	// Rate is the number of requests a second to start, whatever the
+	// server's response time. Zero runs Concurrency workers back to back.
+	Rate        float64
+	Concurrency int
+	// Mix weights each operation, such as {"read": 5, "transfer": 4}.
+	Mix      map[string]int
+	Accounts int
+	// Hot accounts take HotRatio of the transfers, to show contention.
+	Hot      int
+	HotRatio float64
+	Amount   int64
+	Seed     int64
+}
+
+type loadStats struct {
+	latency *Histogram
+	ok      int64
+	errors  map[string]int64
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{latency: NewHistogram(int64(time.Minute), 3), errors: map[string]int64{}}
+}
+
+// LoadTestReport holds the results of a run, by operation.
+type LoadTestReport struct {
+	Elapsed time.Duration
+	Ops     map[string]*loadStats
+}
+
+// loadTest runs a configured workload against a server.
+type loadTest struct {
+	cfg     LoadTestConfig
+	client  *http.Client
+	ids     []int
+	ops     []string
+	cleanup func()
+}
+
+func newLoadTest(cfg LoadTestConfig) (*loadTest, error) {
+	lt := &loadTest{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}, cleanup: func() {}}
+	for _, op := range loadOps {
+		for i := 0; i < cfg.Mix[op]; i++ {
+			lt.ops = append(lt.ops, op)
+		}
+	}
+	if len(lt.ops) == 0 {
+		return nil, fmt.Errorf("workload mix has no operations")
+	}
+	if cfg.Accounts < 2 {
+		return nil, fmt.Errorf("need at least 2 accounts")
+	}
+	if cfg.Hot > cfg.Accounts {
+		return nil, fmt.Errorf("more hot accounts than accounts")
+	}
+	if cfg.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1")
+	}
+	if cfg.Target != "" && cfg.Mix["transfer"] > 0 && cfg.FundFrom == 0 {
+		return nil, fmt.Errorf("transfers on a remote target need an account to fund the test accounts from")
+	}
+	return lt, nil
+}
+
+// setup starts the in-process server if there is no target, and creates and
+// funds the accounts the workload uses.
+func (lt *loadTest) setup() error {
+	if lt.cfg.Target == "" {
+		// The in-process bank has no money but what it is started with, all
+		// of it in one account for setup to share out.
+		store := NewMemoryStore()
+		bank := &Account{Owner: "loadtest", Balance: lt.cfg.Fund * int64(lt.cfg.Accounts), Status: StatusActive, CreatedAt: time.Now().UTC()}
+		if err := store.CreateAccount(bank); err != nil {
+			return err
+		}
+		lt.cfg.FundFrom = bank.ID
+		server := NewAPIServer("", store, NewAuditLog())
+		ts := httptest.NewServer(server.routes())
+		lt.cfg.Target = ts.URL
+		lt.cleanup = ts.Close
+	}
+	for i := 0; i < lt.cfg.Accounts; i++ {
+		acc := new(Account)
+		status, err := lt.do("POST", "/account", CreateAccountRequest{FirstName: "Load", LastName: strconv.Itoa(i)}, acc)
+		if err != nil {
+			return fmt.Errorf("creating accounts: %w", err)
+		}
+		if status != http.StatusCreated {
+			return fmt.Errorf("creating accounts: got status %d", status)
+		}
+		lt.ids = append(lt.ids, acc.ID)
+	}
+	if lt.cfg.FundFrom == 0 || lt.cfg.Fund == 0 {
+		return nil
+	}
+	for _, id := range lt.ids {
+		status, err := lt.do("POST", "/transfer", TransferRequest{FromAccount: lt.cfg.FundFrom, ToAccount: id, Amount: lt.cfg.Fund}, nil)
+		if err != nil {
+			return fmt.Errorf("funding accounts: %w", err)
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("funding account %d from %d: got status %d", id, lt.cfg.FundFrom, status)
+		}
+	}
+	return nil
+}
+
+// do sends one request and decodes a JSON response into out, if given.
+func (lt *loadTest) do(method, path string, body, out any) (int, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, lt.cfg.Target+path, r)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+lt.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lt.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode/100 == 2 {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, err
+}
+
+// pick returns two different accounts for a transfer, both hot or both cold.
+func (lt *loadTest) pick(rng *rand.Rand) (int, int) {
+	pool := lt.ids
+	if lt.cfg.Hot >= 2 && rng.Float64() < lt.cfg.HotRatio {
+		pool = lt.ids[:lt.cfg.Hot]
+	} else if len(lt.ids)-lt.cfg.Hot >= 2 {
+		pool = lt.ids[lt.cfg.Hot:]
+	}
+	from := rng.Intn(len(pool))
+	to := rng.Intn(len(pool) - 1)
+	if to >= from {
+		to++
+	}
+	return pool[from], pool[to]
+}
+
+// request runs one randomly chosen operation and returns its name and error
+// class, which is empty on success.
+func (lt *loadTest) request(rng *rand.Rand) (string, string) {
+	op := lt.ops[rng.Intn(len(lt.ops))]
+	var status int
+	var err error
+	switch op {
+	case "create":
+		status, err = lt.do("POST", "/account", CreateAccountRequest{FirstName: "Load", LastName: "Test"}, nil)
+	case "read":
+		status, err = lt.do("GET", fmt.Sprintf("/account/%d", lt.ids[rng.Intn(len(lt.ids))]), nil, nil)
+	case "transfer":
+		from, to := lt.pick(rng)
+		status, err = lt.do("POST", "/transfer", TransferRequest{FromAccount: from, ToAccount: to, Amount: lt.cfg.Amount}, nil)
+	}
+	switch {
+	case err != nil:
+		return op, "transport"
+	case status/100 != 2:
+		return op, strconv.Itoa(status)
+	}
+	return op, ""
+}
+
+// run drives the workload until the duration is up. In rate mode latency is
+// measured from when each request was due to start rather than when a worker
+// got to it, so a slow server can't hide its queueing (coordinated omission).
+func (lt *loadTest) run(ctx context.Context) *LoadTestReport {
+	ctx, cancel := context.WithTimeout(ctx, lt.cfg.Duration)
+	defer cancel()
+
+	due := make(chan time.Time, lt.cfg.Concurrency*4)
+	if lt.cfg.Rate > 0 {
+		go func() {
+			defer close(due)
+			interval := time.Duration(float64(time.Second) / lt.cfg.Rate)
+			start := time.Now()
+			for i := 0; ; i++ {
+				at := start.Add(time.Duration(i) * interval)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(at)):
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case due <- at:
+				}
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	report := &LoadTestReport{Ops: map[string]*loadStats{}}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < lt.cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			local := map[string]*loadStats{}
+			for {
+				var began time.Time
+				if lt.cfg.Rate > 0 {
+					at, ok := <-due
+					if !ok {
+						break
+					}
+					began = at
+				} else {
+					if ctx.Err() != nil {
+						break
+					}
+					began = time.Now()
+				}
+				op, class := lt.request(rng)
+				st, ok := local[op]
+				if !ok {
+					st = newLoadStats()
+					local[op] = st
+				}
+				st.latency.RecordDuration(time.Since(began))
+				if class == "" {
+					st.ok++
+				} else {
+					st.errors[class]++
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for op, st := range local {
+				total, ok := report.Ops[op]
+				if !ok {
+					total = newLoadStats()
+					report.Ops[op] = total
+				}
+				total.latency.Merge(st.latency)
+				total.ok += st.ok
+				for class, n := range st.errors {
+					total.errors[class] += n
+				}
+			}
+		}(lt.cfg.Seed + int64(w))
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	return report
+}
+
+// Write prints the report as a table, one row per operation and a total.
+func (r *LoadTestReport) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\treq/s\terrors\terror %\tp50\tp95\tp99\tmax\t")
+	all := newLoadStats()
+	line := func(name string, st *loadStats) {
+		n := st.latency.Count()
+		var errs int64
+		for _, c := range st.errors {
+			errs += c
+		}
+		pct := 0.0
+		if n > 0 {
+			pct = 100 * float64(errs) / float64(n)
+		}
+		ms := func(v int64) string {
+			return fmt.Sprintf("%.2fms", float64(v)/float64(time.Millisecond))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\t%.2f\t%s\t%s\t%s\t%s\t\n", name, n, float64(n)/r.Elapsed.Seconds(), errs, pct,
+			ms(st.latency.Percentile(50)), ms(st.latency.Percentile(95)), ms(st.latency.Percentile(99)), ms(st.latency.Max()))
+	}
+	for _, op := range loadOps {
+		st, ok := r.Ops[op]
+		if !ok {
+			continue
+		}
+		line(op, st)
+		all.latency.Merge(st.latency)
+		all.ok += st.ok
+		for class, n := range st.errors {
+			all.errors[class] += n
+		}
+	}
+	line("total", all)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(all.errors) > 0 {
+		classes := make([]string, 0, len(all.errors))
+		for class := range all.errors {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		fmt.Fprint(w, "\nerrors:")
+		for _, class := range classes {
+			fmt.Fprintf(w, " %s=%d", class, all.errors[class])
+		}
+		fmt.Fprintln(w)
+	}
+	_, err := fmt.Fprintf(w, "\n%s elapsed\n", r.Elapsed.Round(time.Millisecond))
+	return err
+}
+
+// parseMix reads weights such as "create=1,read=5,transfer=4".
+func parseMix(spec string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, part := range strings.Split(spec, ",") {
+		op, weight, ok := strings.Cut(part, "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid mix entry %s", part)
+		}
+		known := false
+		for _, o := range loadOps {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation %s in mix", op)
+		}
+		mix[op] = n
+	}
+	return mix, nil
+}
+
+// runLoadTest implements `gobank loadtest`, which drives a workload at a
+// server and reports throughput, errors and latency percentiles.
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	target := fs.String("target", "", "base URL of the server to test; empty tests an in-process server")
+	token := fs.String("token", "", "bearer token for the target; defaults to an admin token signed with JWT_SECRET")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run")
+	rate := fs.Float64("rate", 0, "requests a second to start; 0 runs the workers back to back")
+	concurrency := fs.Int("concurrency", 16, "number of workers")
+	mix := fs.String("mix", "create=1,read=5,transfer=4", "relative weight of each operation")
+	accounts := fs.Int("accounts", 100, "accounts to create before the run")
+	hot := fs.Int("hot", 5, "accounts that take most of the transfers")
+	hotRatio := fs.Float64("hot-ratio", 0.8, "fraction of transfers between hot accounts")
+	amount := fs.Int64("amount", 1, "amount of each transfer")
+	fundFrom := fs.Int("fund-from", 0, "account on the target to fund the test accounts from; needed for transfers on a remote target")
+	fund := fs.Int64("fund", 1_000_000, "amount to put in each test account")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	dev := fs.Bool("dev", false, "use the public development keys if JWT_SECRET or PII_KEY isn't set")
+	fs.Parse(args)
+
+	weights, err := parseMix(*mix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The in-process server checks tokens too.
+	if *token == "" || *target == "" {
+		if err := configureJWTSecret(*dev); err != nil {
+			log.Fatal("loadtest: ", err)
+		}
+	}
+	// It also audits, which encrypts names.
+	if *target == "" {
+		if err := configurePIIKey(*dev); err != nil {
+			log.Fatal("loadtest: ", err)
+		}
+	}
+	if *token == "" {
+		if *token, err = createJWT(Principal{Subject: "loadtest", Role: RoleAdmin}, *duration+time.Hour); err != nil {
+			log.Fatal(err)
+		}
+	}
+	lt, err := newLoadTest(LoadTestConfig{
+		Target:      strings.TrimSuffix(*target, "/"),
+		Token:       *token,
+		FundFrom:    *fundFrom,
+		Fund:        *fund,
+		Duration:    *duration,
+		Rate:        *rate,
+		Concurrency: *concurrency,
+		Mix:         weights,
+		Accounts:    *accounts,
+		Hot:         *hot,
+		HotRatio:    *hotRatio,
+		Amount:      *amount,
+		Seed:        *seed,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lt.cleanup()
+	if err := lt.setup(); err != nil {
+		log.Fatal(err)
+	}
+	report := lt.run(context.Background())
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
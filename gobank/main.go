@@ -1,6 +1,196 @@
 package main
 
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cshorten/gobank/hook"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
 func main() {
-	server := NewAPIServer(":3000")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-audit":
+			runVerifyAudit(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "dev-certs":
+			runDevCerts(os.Args[2:])
+			return
+		case "loadtest":
+			runLoadTest(os.Args[2:])
+			return
+		}
+	}
+
+	listenAddr := flag.String("listen", ":3000", "address to serve the API on")
+	auditPath := flag.String("audit-log", "audit.log", "file the audit trail is appended to")
+	dataPath := flag.String("data", "gobank.json", "file accounts and the ledger are kept in")
+	eventSinks := flag.String("event-sinks", "", "comma-separated sinks domain events are relayed to: stdout, file:<path>")
+	riskPath := flag.String("risk-rules", "", "JSON file of fraud and velocity rules, reloaded when it changes")
+	productsPath := flag.String("interest-products", "", "JSON file of interest products, replacing the defaults")
+	corsOrigins := flag.String("cors-origins", "", "comma-separated origins browsers may call the API from, or * for any")
+	corsMethods := flag.String("cors-methods", strings.Join(defaultCORS.AllowedMethods, ","), "comma-separated methods allowed cross-origin")
+	corsHeaders := flag.String("cors-headers", strings.Join(defaultCORS.AllowedHeaders, ","), "comma-separated request headers allowed cross-origin")
+	corsCredentials := flag.Bool("cors-credentials", false, "allow cross-origin requests with credentials")
+	corsMaxAge := flag.Duration("cors-max-age", defaultCORS.MaxAge, "how long browsers may cache a preflight answer")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve HTTPS with, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	clientAuth := flag.String("tls-client-auth", "none", "client certificates: none, optional or require")
+	clientCA := flag.String("tls-client-ca", "", "PEM bundle of CAs client certificates must chain to, reloaded when it changes")
+	clientPrincipals := flag.String("tls-client-principals", "", "JSON file mapping client certificate common names to the principals they authenticate as")
+	traceExporter := flag.String("trace-exporter", "", "where to write traces: stdout or otlp-file:<path>; empty disables tracing")
+	traceSample := flag.Float64("trace-sample", 1, "fraction of new traces to record; traces continued from a caller follow its sampling decision")
+	cacheSize := flag.Int("account-cache-size", 10000, "accounts kept in the read cache; 0 turns the cache off")
+	cacheTTL := flag.Duration("account-cache-ttl", 30*time.Second, "how long an account stays in the read cache")
+	hookTimeout := flag.Duration("hook-timeout", defaultHookTimeout, "how long each operation hook gets to run")
+	coolingOff := flag.Duration("payee-cooling-off", defaultPayeeCoolingOff, "how long a new payee waits before it can be paid")
+	tenantsPath := flag.String("tenants", "", "JSON file of the banks to host; without it one bank is served from -data, -audit-log and -risk-rules")
+	secureCookies := flag.Bool("secure-cookies", false, "mark dashboard cookies Secure even when serving plain HTTP, as behind a proxy that terminates TLS")
+	dev := flag.Bool("dev", false, "development mode: allow the public development keys when JWT_SECRET or PII_KEY isn't set")
+	flag.Parse()
+
+	if err := configureJWTSecret(*dev); err != nil {
+		log.Fatal(err)
+	}
+	if err := configurePIIKey(*dev); err != nil {
+		log.Fatal(err)
+	}
+
+	cfgs := []TenantConfig{{ID: defaultTenantID, Data: *dataPath, AuditLog: *auditPath, RiskRules: *riskPath}}
+	if *tenantsPath != "" {
+		var err error
+		if cfgs, err = LoadTenantConfigs(*tenantsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	products, err := indexInterestProducts(defaultInterestProducts)
+	if *productsPath != "" {
+		products, err = LoadInterestProducts(*productsPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sinks, err := parseEventSinks(*eventSinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	spans, err := parseSpanExporter(*traceExporter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var list []*Tenant
+	for _, cfg := range cfgs {
+		audit, err := OpenAuditLog(cfg.AuditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store, err := OpenMemoryStore(cfg.Data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t := NewTenant(cfg, store, audit, realClock{})
+		if *cacheSize > 0 {
+			t.cache = NewAccountCache(store, NewLRUCache(*cacheSize, realClock{}), *cacheTTL)
+		}
+		list = append(list, t)
+	}
+	tenants, err := NewTenants(list...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewMultiTenantAPIServer(*listenAddr, tenants)
+	var tracer trace.Tracer
+	if spans != nil {
+		provider := newTracerProvider(*traceSample, sdktrace.NewBatchSpanProcessor(spans))
+		tracer = provider.Tracer(tracerName)
+	}
+	server.tracer = tracer
+	server.products = products
+	server.payeeCoolingOff = *coolingOff
+	server.secureCookies = *secureCookies
+	// Hooks are registered with the hook package by whatever is built in;
+	// see hooks_example.go.
+	hook.Default().SetTimeout(*hookTimeout)
+	server.useHooks(hook.Default())
+	server.cors = CORSConfig{
+		AllowedOrigins:   splitList(*corsOrigins),
+		AllowedMethods:   splitList(*corsMethods),
+		AllowedHeaders:   splitList(*corsHeaders),
+		AllowCredentials: *corsCredentials,
+		MaxAge:           *corsMaxAge,
+	}
+	if err := server.cors.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *tlsCert != "" {
+		certs, err := NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var cas *CAReloader
+		if *clientCA != "" {
+			if cas, err = NewCAReloader(*clientCA); err != nil {
+				log.Fatal(err)
+			}
+			go cas.Watch(context.Background(), 5*time.Second)
+		}
+		if server.tls, err = newTLSConfig(certs, ClientAuthMode(*clientAuth), cas); err != nil {
+			log.Fatal(err)
+		}
+		go certs.Watch(context.Background(), 5*time.Second)
+	}
+	if *clientPrincipals != "" {
+		if server.tls == nil || server.tls.ClientAuth == tls.NoClientCert {
+			log.Fatal("-tls-client-principals needs -tls-client-auth optional or require")
+		}
+		if server.clientPrincipals, err = LoadClientPrincipals(*clientPrincipals); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Each tenant gets its own workers, so none of them ever sees another
+	// tenant's store.
+	for _, t := range tenants.All() {
+		if t.RiskRules != "" {
+			go t.risk.WatchRules(context.Background(), t.RiskRules, 5*time.Second)
+		}
+		scheduler := NewScheduler(t.store, t.audit, t.risk, realClock{})
+		scheduler.tracer = tracer
+		go scheduler.Run(context.Background())
+		interest := NewInterestEngine(t.store, t.audit, products, realClock{})
+		interest.tracer = tracer
+		go interest.Run(context.Background())
+		batches := NewBatchProcessor(t.store, t.audit, t.risk, realClock{})
+		batches.tracer = tracer
+		go batches.Run(context.Background())
+		holds := NewHoldExpirer(t.store, t.audit, realClock{})
+		go holds.Run(context.Background())
+		webhooks := NewWebhookDispatcher(t.store, realClock{})
+		webhooks.tracer = tracer
+		go webhooks.Run(context.Background())
+		var tenantSinks []EventSink
+		for _, sink := range sinks {
+			if *tenantsPath != "" {
+				sink = tenantSink{EventSink: sink, tenant: t.ID}
+			}
+			tenantSinks = append(tenantSinks, sink)
+		}
+		relay := NewEventRelay(t.store, append(tenantSinks, t.events)...)
+		go relay.Run(context.Background())
+	}
 	server.Run()
 }
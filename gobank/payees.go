@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultPayeeCoolingOff is how long a new payee has to wait before it can be
+// paid, giving the customer time to notice a payee they didn't add.
+const defaultPayeeCoolingOff = 24 * time.Hour
+
+// Each principal may check a burst of payee names, then one more every
+// nameCheckInterval, so account holders' names can't be guessed at scale.
+const (
+	nameCheckBurst    = 10
+	nameCheckInterval = 6 * time.Minute
+)
+
+// NameMatch is the outcome of checking a name against an account holder, as
+// in confirmation of payee.
+type NameMatch string
+
+const (
+	NameMatched NameMatch = "match"
+	NameClose   NameMatch = "close"
+	NameNoMatch NameMatch = "no-match"
+)
+
+// Payee is an account a customer has saved to pay by its number.
+type Payee struct {
+	ID            int    `json:"id"`
+	CustomerID    int    `json:"customerId"`
+	Nickname      string `json:"nickname"`
+	AccountNumber int64  `json:"accountNumber"`
+	// Name is the holder's name as the customer gave it, and NameMatch how
+	// well it matched the account when the payee was saved.
+	Name      string    `json:"name"`
+	NameMatch NameMatch `json:"nameMatch"`
+	// ActiveFrom is when the cooling-off period ends and the payee can be
+	// paid.
+	ActiveFrom time.Time `json:"activeFrom"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type CreatePayeeRequest struct {
+	Nickname      string `json:"nickname"`
+	AccountNumber int64  `json:"accountNumber"`
+	Name          string `json:"name"`
+	// Proceed saves the payee even though the name isn't an exact match.
+	Proceed bool `json:"proceed,omitempty"`
+}
+
+type ConfirmPayeeRequest struct {
+	AccountNumber int64  `json:"accountNumber"`
+	Name          string `json:"name"`
+}
+
+// ConfirmPayeeResult never gives the holder's name back, even on a close
+// match, and an account number no one holds is simply no match.
+type ConfirmPayeeResult struct {
+	Result NameMatch `json:"result"`
+}
+
+// nameTokens lowercases a name and splits it into words, dropping
+// punctuation so "O'Brien-Smith" and "obrien smith" compare equal.
+func nameTokens(name string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '-' || unicode.IsSpace(r):
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+// levenshtein counts the single-character edits between a and b.
+func levenshtein(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	prev := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ar); i++ {
+		cur := make([]int, len(br)+1)
+		cur[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(br)]
+}
+
+// typos is how many edits a name of n characters may be off by and still be
+// a close match.
+func typos(n int) int {
+	if n < 10 {
+		return 1
+	}
+	return 2
+}
+
+// matchName checks the name a customer gave for a payee against the account
+// holder's. Names that differ only in case, spacing or punctuation match.
+// A typo or two, an initial for the first name, or the names the other way
+// round are close. Anything else doesn't match.
+func matchName(given, firstName, lastName string) NameMatch {
+	got := nameTokens(given)
+	want := nameTokens(firstName + " " + lastName)
+	if len(got) == 0 || len(want) == 0 {
+		return NameNoMatch
+	}
+	g, w := strings.Join(got, " "), strings.Join(want, " ")
+	if g == w {
+		return NameMatched
+	}
+	if levenshtein(g, w) <= typos(len(w)) {
+		return NameClose
+	}
+	if len(got) == 2 && len(want) == 2 && got[0] == want[1] && got[1] == want[0] {
+		return NameClose
+	}
+	gotFirst, gotLast := got[0], got[len(got)-1]
+	wantFirst, wantLast := want[0], want[len(want)-1]
+	if len(got) > 1 && levenshtein(gotLast, wantLast) <= typos(len(wantLast))-1 {
+		initial := len([]rune(gotFirst)) == 1 && strings.HasPrefix(wantFirst, gotFirst)
+		if initial || levenshtein(gotFirst, wantFirst) <= typos(len(wantFirst))-1 {
+			return NameClose
+		}
+	}
+	return NameNoMatch
+}
+
+// confirmPayee checks a name against the legal name of the customer who
+// holds the account with the given number, along with the account if there
+// is one. An account number no one holds, or whose holder has been erased,
+// matches no name, so the result doesn't tell whether the number is in use.
+func confirmPayee(store Storage, number int64, name string) (NameMatch, *Account) {
+	acc, err := store.GetAccountByNumber(number)
+	if err != nil {
+		return NameNoMatch, nil
+	}
+	c, err := store.GetCustomer(acc.CustomerID)
+	if err != nil || acc.ErasedAt != nil {
+		return NameNoMatch, acc
+	}
+	return matchName(name, c.FirstName, c.LastName), acc
+}
+
+// limitNameChecks counts a name check against the caller's allowance, which
+// is shared between confirming and saving payees.
+func (s *APIServer) limitNameChecks(w http.ResponseWriter, r *http.Request) error {
+	key := s.tenant(r).ID + "/" + principalFrom(r).Subject
+	wait, ok := s.nameChecks.Allow(key, s.clock.Now())
+	if ok {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	return httpError{Status: http.StatusTooManyRequests, Msg: "too many payee name checks; try again later"}
+}
+
+func (s *APIServer) handleConfirmPayee(w http.ResponseWriter, r *http.Request) error {
+	req := new(ConfirmPayeeRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if err := s.limitNameChecks(w, r); err != nil {
+		return err
+	}
+	result, _ := confirmPayee(s.storage(r), req.AccountNumber, req.Name)
+	return WriteJSON(w, http.StatusOK, &ConfirmPayeeResult{Result: result})
+}
+
+func (s *APIServer) handlePayees(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		customer, err := s.customerFor(r, PermReadCustomer)
+		if err != nil {
+			return err
+		}
+		payees, err := s.storage(r).GetPayees(customer.ID)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, payees)
+	}
+
+	customer, err := s.customerFor(r, PermManagePayees)
+	if err != nil {
+		return err
+	}
+	req := new(CreatePayeeRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if req.Nickname == "" {
+		return fmt.Errorf("nickname is required")
+	}
+	if err := s.limitNameChecks(w, r); err != nil {
+		return err
+	}
+	result, acc := confirmPayee(s.storage(r), req.AccountNumber, req.Name)
+	if acc != nil && acc.CustomerID == customer.ID {
+		return fmt.Errorf("account number %d is the customer's own account", req.AccountNumber)
+	}
+	if !req.Proceed {
+		switch result {
+		case NameClose:
+			return httpError{Status: http.StatusUnprocessableEntity, Msg: "name is close to the holder's but not the same; check it, or set proceed to save it anyway"}
+		case NameNoMatch:
+			return httpError{Status: http.StatusUnprocessableEntity, Msg: "name does not match the holder's; set proceed to save it anyway"}
+		}
+	}
+
+	now := s.clock.Now().UTC()
+	payee := &Payee{
+		CustomerID:    customer.ID,
+		Nickname:      req.Nickname,
+		AccountNumber: req.AccountNumber,
+		Name:          req.Name,
+		NameMatch:     result,
+		ActiveFrom:    now.Add(s.payeeCoolingOff),
+		CreatedAt:     now,
+	}
+	if err := s.storage(r).CreatePayee(payee); err != nil {
+		return err
+	}
+	s.recordCustomerAudit(r, "payee.create", customer.ID)
+	return WriteJSON(w, http.StatusCreated, payee)
+}
+
+func (s *APIServer) handlePayeeByID(w http.ResponseWriter, r *http.Request) error {
+	perm := PermReadCustomer
+	if r.Method == "DELETE" {
+		perm = PermManagePayees
+	}
+	customer, err := s.customerFor(r, perm)
+	if err != nil {
+		return err
+	}
+	idStr := mux.Vars(r)["payeeId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return fmt.Errorf("invalid payee id given %s", idStr)
+	}
+	payee, err := s.storage(r).GetPayee(id)
+	if err != nil || payee.CustomerID != customer.ID {
+		return fmt.Errorf("payee %d %w", id, ErrNotFound)
+	}
+	if r.Method == "DELETE" {
+		if err := s.storage(r).DeletePayee(id); err != nil {
+			return err
+		}
+		s.recordCustomerAudit(r, "payee.delete", customer.ID)
+	}
+	return WriteJSON(w, http.StatusOK, payee)
+}
+
+// payeeAccount finds the account a transfer from the given account to an
+// account number goes to, and checks the caller may pay it. A number no one
+// holds is refused just as one the caller hasn't saved, so the answer doesn't
+// tell whether the number is in use.
+func (s *APIServer) payeeAccount(r *http.Request, from int, number int64) (int, error) {
+	to, err := s.storage(r).GetAccountByNumber(number)
+	if errors.Is(err, ErrNotFound) {
+		return 0, notSavedPayee(number)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := s.checkPayee(r, from, to.ID); err != nil {
+		return 0, err
+	}
+	return to.ID, nil
+}
+
+// checkPayee checks that money may go from one account to another, however
+// the transfer names it: straight away, on a schedule, in a batch or by
+// capturing a hold. Other customers' accounts must be saved payees past their
+// cooling-off period; the customer's own accounts needn't be. Staff who may
+// transfer from any account aren't held to the customer's payees.
+func (s *APIServer) checkPayee(r *http.Request, from, to int) error {
+	_, err := s.payeeFor(r, from, to)
+	return err
+}
+
+// payeeFor is checkPayee, returning the saved payee that lets the money go,
+// or nil if the transfer needs none.
+func (s *APIServer) payeeFor(r *http.Request, from, to int) (*Payee, error) {
+	if p := principalFrom(r); p != nil && rolePermissions[p.Role][PermTransfer] == scopeAny {
+		return nil, nil
+	}
+	store := s.storage(r)
+	fromAcc, err := store.GetAccountByID(from)
+	if err != nil {
+		return nil, err
+	}
+	toAcc, err := store.GetAccountByID(to)
+	if err != nil {
+		return nil, err
+	}
+	if fromAcc.CustomerID != 0 && toAcc.CustomerID == fromAcc.CustomerID {
+		return nil, nil
+	}
+	payees, err := store.GetPayees(fromAcc.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range payees {
+		if p.AccountNumber != toAcc.Number {
+			continue
+		}
+		if now := s.clock.Now(); now.Before(p.ActiveFrom) {
+			return nil, httpError{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("payee %d can't be paid until %s", p.ID, p.ActiveFrom.Format(time.RFC3339))}
+		}
+		return p, nil
+	}
+	return nil, notSavedPayee(toAcc.Number)
+}
+
+func notSavedPayee(number int64) error {
+	return httpError{Status: http.StatusUnprocessableEntity, Msg: fmt.Sprintf("account number %d is not a saved payee", number)}
+}
+
+// checkSavedPayee checks, as a transfer set up earlier is made, that the
+// payee it was set up to pay is still saved and still pays account to.
+// Transfers that needed no payee pass.
+func checkSavedPayee(store Storage, payeeID, to int) error {
+	if payeeID == 0 {
+		return nil
+	}
+	p, err := store.GetPayee(payeeID)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("payee %d has been removed", payeeID)
+	}
+	if err != nil {
+		return err
+	}
+	acc, err := store.GetAccountByID(to)
+	if err != nil {
+		return err
+	}
+	if p.AccountNumber != acc.Number {
+		return fmt.Errorf("payee %d no longer pays account %d", payeeID, to)
+	}
+	return nil
+}
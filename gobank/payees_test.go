@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		given string
+		want  NameMatch
+	}{
+		{"Ada Lovelace", NameMatched},
+		{"  ada LOVELACE ", NameMatched},
+		{"Ada Love-lace", NameClose},
+		{"Ada Lovelance", NameClose},
+		{"A Lovelace", NameClose},
+		{"A. Lovelace", NameClose},
+		{"Lovelace Ada", NameClose},
+		{"Ada King", NameNoMatch},
+		{"Charles Babbage", NameNoMatch},
+		{"Lovelace", NameNoMatch},
+		{"", NameNoMatch},
+	}
+	for _, tt := range tests {
+		if got := matchName(tt.given, "Ada", "Lovelace"); got != tt.want {
+			t.Errorf("matchName(%q) = %s, want %s", tt.given, got, tt.want)
+		}
+	}
+}
+
+func TestPayeeTransfers(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Number: 1001, Owner: "alice", Balance: 1000, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Number: 1002, Owner: "alice", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 3, Number: 2001, FirstName: "Bob", LastName: "Brown", Owner: "bob", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+	server.clock = clock
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+	transfer := func(number int64) *http.Response {
+		body := fmt.Sprintf(`{"fromAccount":1,"toAccountNumber":%d,"amount":10}`, number)
+		return customerRequest(t, server, alice, "POST", "/transfer", body).Result()
+	}
+
+	if res := transfer(1002); res.StatusCode != http.StatusOK {
+		t.Fatalf("transfer to own account: %d", res.StatusCode)
+	}
+	// A number no one holds gets the same answer as one alice hasn't saved.
+	unsaved, _ := io.ReadAll(transfer(2001).Body)
+	unused, _ := io.ReadAll(transfer(9999).Body)
+	if want := `{"Error":"account number 2001 is not a saved payee"}`; strings.TrimSpace(string(unsaved)) != want {
+		t.Fatalf("transfer to an unsaved payee: %s", unsaved)
+	}
+	if want := `{"Error":"account number 9999 is not a saved payee"}`; strings.TrimSpace(string(unused)) != want {
+		t.Fatalf("transfer to an unused number: %s", unused)
+	}
+	// Naming the account by ID, or paying it later, is no way round it.
+	for _, req := range []struct{ path, body string }{
+		{"/transfer", `{"fromAccount":1,"toAccount":3,"amount":10}`},
+		{"/account/1/schedules", `{"toAccount":3,"amount":10,"startAt":"2026-03-02T09:00:00Z"}`},
+		{"/account/1/holds", `{"toAccount":3,"amount":10}`},
+		{"/batches", `{"transfers":[{"fromAccount":1,"toAccount":3,"amount":10}]}`},
+	} {
+		if rec := customerRequest(t, server, alice, "POST", req.path, req.body); rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("POST %s to an unsaved payee: %d %s", req.path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := customerRequest(t, server, alice, "POST", "/confirm-payee", `{"accountNumber":2001,"name":"Bob Browne"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"result":"close"}` {
+		t.Fatalf("confirm: %d %s", rec.Code, rec.Body)
+	}
+	if rec := customerRequest(t, server, alice, "POST", "/customers/1/payees", `{"nickname":"Bob","accountNumber":2001,"name":"Bob Browne"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("saved a close match without proceed: %d %s", rec.Code, rec.Body)
+	}
+	rec = customerRequest(t, server, alice, "POST", "/customers/1/payees", `{"nickname":"Bob","accountNumber":2001,"name":"Bob Brown"}`)
+	var payee Payee
+	json.Unmarshal(rec.Body.Bytes(), &payee)
+	if rec.Code != http.StatusCreated || payee.NameMatch != NameMatched || !payee.ActiveFrom.Equal(clock.now.Add(defaultPayeeCoolingOff)) {
+		t.Fatalf("save payee: %d %s", rec.Code, rec.Body)
+	}
+
+	if res := transfer(2001); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("paid a payee during cooling-off: %d", res.StatusCode)
+	}
+	clock.now = payee.ActiveFrom
+	if res := transfer(2001); res.StatusCode != http.StatusOK {
+		t.Fatalf("transfer after cooling-off: %d", res.StatusCode)
+	}
+	if got := balanceOf(t, store, 3); got != 10 {
+		t.Fatalf("payee balance %d, want 10", got)
+	}
+
+	carol := Principal{Subject: "carol", Role: RoleCustomer}
+	if rec := customerRequest(t, server, carol, "GET", "/customers/1/payees", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("carol listed alice's payees: %d", rec.Code)
+	}
+	if rec := customerRequest(t, server, alice, "DELETE", fmt.Sprintf("/customers/1/payees/%d", payee.ID), ""); rec.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body)
+	}
+	if res := transfer(2001); res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("paid a deleted payee: %d", res.StatusCode)
+	}
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	for _, action := range []string{"payee.create", "payee.delete"} {
+		if got := tenant.audit.Query(AuditQuery{Action: action}); len(got) != 1 || got[0].Actor != "alice" || got[0].Subject != customerSubject(1) {
+			t.Errorf("%s audited as %+v", action, got)
+		}
+	}
+}
+
+// savePayee saves the account to as a payee of the holder of account from,
+// already past its cooling-off period.
+func savePayee(t *testing.T, store Storage, from, to int) {
+	t.Helper()
+	fromAcc, err := store.GetAccountByID(from)
+	must(t, err)
+	toAcc, err := store.GetAccountByID(to)
+	must(t, err)
+	must(t, store.CreatePayee(&Payee{
+		CustomerID:    fromAcc.CustomerID,
+		Nickname:      fmt.Sprintf("account %d", to),
+		AccountNumber: toAcc.Number,
+		Name:          toAcc.FirstName + " " + toAcc.LastName,
+		NameMatch:     NameMatched,
+	}))
+}
+
+func TestConfirmPayeeGivesNothingAway(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Number: 1001, Owner: "alice", Status: StatusActive})
+	bob := &Customer{Owner: "bob", FirstName: "Bob", LastName: "Brown", KYCStatus: KYCVerified}
+	must(t, store.CreateCustomer(bob))
+	store.CreateAccount(&Account{ID: 2, Number: 2001, FirstName: "Alice", LastName: "Smith", Owner: "bob", CustomerID: bob.ID, Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+	server.clock = clock
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+	confirm := func(number int64, name string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"accountNumber":%d,"name":%q}`, number, name)
+		return customerRequest(t, server, alice, "POST", "/confirm-payee", body)
+	}
+
+	// Only the customer's legal name counts, not what is on the account.
+	if rec := confirm(2001, "Alice Smith"); !strings.Contains(rec.Body.String(), `"no-match"`) {
+		t.Fatalf("matched the account's names: %s", rec.Body)
+	}
+	if rec := confirm(2001, "Bob Brown"); !strings.Contains(rec.Body.String(), `"match"`) {
+		t.Fatalf("didn't match the customer's name: %s", rec.Body)
+	}
+	noMatch, unknown := confirm(2001, "Carl Green"), confirm(9999, "Carl Green")
+	if noMatch.Code != unknown.Code || noMatch.Body.String() != unknown.Body.String() {
+		t.Fatalf("an unknown number answers %d %s, no match %d %s", unknown.Code, unknown.Body, noMatch.Code, noMatch.Body)
+	}
+
+	for i := 4; i < nameCheckBurst; i++ {
+		confirm(2001, "Bob Brown")
+	}
+	rec := confirm(2001, "Bob Brown")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("check over the limit: %d %v", rec.Code, rec.Header())
+	}
+	// Saving a payee checks the name too, so it draws on the same allowance.
+	if rec := customerRequest(t, server, alice, "POST", "/customers/1/payees", `{"nickname":"Bob","accountNumber":2001,"name":"Bob Brown"}`); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("save payee over the limit: %d", rec.Code)
+	}
+	clock.now = clock.now.Add(nameCheckInterval)
+	if rec := confirm(2001, "Bob Brown"); rec.Code != http.StatusOK {
+		t.Fatalf("check once the limit allows: %d", rec.Code)
+	}
+}
+
+func TestAccountNumbers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	store, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive}))
+	must(t, store.CreateAccount(&Account{ID: 2, Owner: "bob", Number: firstAccountNumber + 1, Status: StatusActive}))
+	must(t, store.CreateAccount(&Account{ID: 3, Owner: "carol", Status: StatusActive}))
+	if err := store.CreateAccount(&Account{ID: 4, Owner: "dave", Number: firstAccountNumber + 1}); err == nil {
+		t.Fatal("created an account with a number that is taken")
+	}
+	want := map[int]int64{1: firstAccountNumber, 2: firstAccountNumber + 1, 3: firstAccountNumber + 2}
+	for id, number := range want {
+		acc, err := store.GetAccountByNumber(number)
+		if err != nil || acc.ID != id {
+			t.Fatalf("account number %d: %+v %v", number, acc, err)
+		}
+	}
+	if _, err := store.GetAccountByNumber(0); err == nil {
+		t.Fatal("found an account by number 0")
+	}
+
+	reopened, err := OpenMemoryStore(path)
+	must(t, err)
+	must(t, reopened.CreateAccount(&Account{ID: 5, Owner: "erin", Status: StatusActive}))
+	if acc, _ := reopened.GetAccountByID(5); acc.Number != firstAccountNumber+3 {
+		t.Fatalf("number after a restart %d", acc.Number)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// devPIIKey protects personal data in development when PII_KEY isn't set.
+// It is public, so data protected with it is only as safe as the files are.
+const devPIIKey = "gobank-dev-pii-key"
+
+// piiKey wraps the per-subject data keys, set by configurePIIKey.
+var piiKey []byte
+
+// configurePIIKey reads the key that wraps data keys from PII_KEY. Without
+// it, only dev mode may fall back to the public development key.
+func configurePIIKey(dev bool) error {
+	key := os.Getenv("PII_KEY")
+	if key == "" {
+		if !dev {
+			return errors.New("PII_KEY is not set; set it, or pass -dev to protect personal data with the public development key")
+		}
+		log.Println("privacy: PII_KEY is not set; protecting personal data with the public development key")
+		key = devPIIKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	piiKey = sum[:]
+	return nil
+}
+
+func wrappingKey() []byte {
+	if piiKey == nil {
+		panic("privacy: the PII key has not been configured")
+	}
+	return piiKey
+}
+
+// newPseudonym returns a stand-in last name for an erased holder. It is
+// random, so nothing left on the record leads back to who it replaced.
+func newPseudonym() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "erased-" + hex.EncodeToString(b), nil
+}
+
+// Personal data is kept out of long-lived records, such as the audit log,
+// by encrypting it under a data key of its own for each data subject: the
+// customer, or an account that has none. Erasing the subject deletes the
+// key, which leaves the record intact but the data unreadable.
+
+func customerSubject(id int) string { return "customer/" + strconv.Itoa(id) }
+
+func accountSubject(id int) string { return "account/" + strconv.Itoa(id) }
+
+// subjectOf returns whose personal data an account carries.
+func subjectOf(acc *Account) string {
+	if acc.CustomerID != 0 {
+		return customerSubject(acc.CustomerID)
+	}
+	return accountSubject(acc.ID)
+}
+
+// subjectKeys is where data keys are kept, wrapped under the PII key.
+type subjectKeys interface {
+	SubjectKey(subject string) ([]byte, error)
+	PutSubjectKey(subject string, key []byte) ([]byte, error)
+}
+
+// dataKey returns the subject's data key, making one if it has none and
+// create is set.
+func dataKey(keys subjectKeys, subject string, create bool) ([]byte, error) {
+	wrapped, err := keys.SubjectKey(subject)
+	if err != nil && create {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if wrapped, err = seal(wrappingKey(), key); err != nil {
+			return nil, err
+		}
+		wrapped, err = keys.PutSubjectKey(subject, wrapped)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unseal(wrappingKey(), wrapped)
+}
+
+// seal encrypts plaintext with AES-GCM under key, prefixed with its nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AccountExport describes what an export contains. It is the manifest.json
+// of the archive.
+type AccountExport struct {
+	AccountID  int       `json:"accountId"`
+	ExportedAt time.Time `json:"exportedAt"`
+	ExportedBy string    `json:"exportedBy"`
+	Files      []string  `json:"files"`
+}
+
+// buildAccountExport writes everything held about an account as a zip of
+// JSON files: the profile and its customer, ledger entries, holds, scheduled
+// transfers, payees, batches, risk decisions, events, webhook deliveries and
+// audit trail.
+func (s *APIServer) buildAccountExport(r *http.Request, id int) ([]byte, error) {
+	store := s.storage(r)
+	account, err := store.GetAccountByID(id)
+	if err != nil {
+		return nil, err
+	}
+	transactions, err := store.GetTransactions(id)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := store.GetHolds(id)
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := store.GetScheduledTransfers(id)
+	if err != nil {
+		return nil, err
+	}
+	var customer *Customer
+	payees := []*Payee{}
+	if account.CustomerID != 0 {
+		if customer, err = store.GetCustomer(account.CustomerID); err != nil {
+			return nil, err
+		}
+		if payees, err = store.GetPayees(account.CustomerID); err != nil {
+			return nil, err
+		}
+	}
+	batches, err := store.GetAccountBatches(id)
+	if err != nil {
+		return nil, err
+	}
+	decisions, err := store.GetAccountRiskDecisions(id)
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := store.GetAccountWebhookDeliveries(id)
+	if err != nil {
+		return nil, err
+	}
+	all, err := store.EventsAfter(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	events := []*Event{}
+	for _, e := range all {
+		if e.concerns(id) {
+			events = append(events, e)
+		}
+	}
+
+	files := []struct {
+		name string
+		v    any
+	}{
+		{"account.json", account},
+		{"customer.json", customer},
+		{"transactions.json", transactions},
+		{"holds.json", holds},
+		{"scheduled-transfers.json", schedules},
+		{"payees.json", payees},
+		{"batches.json", batches},
+		{"risk-decisions.json", decisions},
+		{"events.json", events},
+		{"webhook-deliveries.json", deliveries},
+		{"audit.json", s.tenant(r).audit.Query(AuditQuery{AccountID: id})},
+	}
+	now := s.clock.Now().UTC()
+	manifest := &AccountExport{AccountID: id, ExportedAt: now, ExportedBy: principalFrom(r).Subject}
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f.name)
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	write := func(name string, v any) error {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if err := write("manifest.json", manifest); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := write(f.name, f.v); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handleExportAccount sends the account's data as a zip archive. The export
+// is audited like a change, since it hands personal data out.
+func (s *APIServer) handleExportAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	archive, err := s.buildAccountExport(r, id)
+	if err != nil {
+		return err
+	}
+	s.recordAudit(r, "account.export", id, nil, nil)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"account-%d-export.zip\"", id))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(archive)
+	return err
+}
+
+// handleEraseAccount pseudonymizes the holder of a closed account: their
+// customer record and every one of their accounts, which must all be closed.
+// Balances and the ledger stay intact so the books still add up. The audit
+// log keeps its entries, which are hash-chained and retained as a financial
+// record; the names in them were encrypted under the holder's data keys,
+// which the erasure deletes.
+func (s *APIServer) handleEraseAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	name, err := newPseudonym()
+	if err != nil {
+		return err
+	}
+	erased, err := s.storage(r).EraseAccount(id, "erased", name, s.clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	for _, acc := range erased {
+		s.recordAudit(r, "account.erase", acc.ID, nil, acc)
+	}
+	return WriteJSON(w, http.StatusOK, erased[0])
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func privacyRequest(t *testing.T, server *APIServer, p Principal, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := createJWT(p, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestExportAccount(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateWebhook(&Webhook{Owner: "alice", URL: "http://example.com", Events: []string{EventAccountCreated}, Secret: "s"})
+	store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	store.Transfer(1, 2, 40)
+	savePayee(t, store, 1, 2)
+	store.CreateBatch(&Batch{Owner: "alice", Items: []*BatchItem{{FromAccount: 1, ToAccount: 2, Amount: 1}}})
+	store.CreateBatch(&Batch{Owner: "bob", Items: []*BatchItem{{FromAccount: 2, ToAccount: 1, Amount: 1}}})
+	store.RecordRiskDecision(&RiskDecision{FromAccount: 1, ToAccount: 2, Amount: 40, Outcome: RiskAllow})
+	store.RecordRiskDecision(&RiskDecision{FromAccount: 2, ToAccount: 1, Amount: 1, Outcome: RiskAllow})
+	audit := NewAuditLog()
+	audit.Append(&AuditEntry{Actor: "alice", Action: "transfer.debit", AccountID: 1})
+	audit.Append(&AuditEntry{Actor: "bob", Action: "transfer.debit", AccountID: 2})
+	server := NewAPIServer("", store, audit)
+
+	rec := privacyRequest(t, server, Principal{Subject: "alice", Role: RoleCustomer}, "GET", "/account/1/export")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export: %d %s", rec.Code, rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+
+	var manifest AccountExport
+	json.Unmarshal(files["manifest.json"], &manifest)
+	if manifest.AccountID != 1 || manifest.ExportedBy != "alice" || len(manifest.Files) != len(files)-1 {
+		t.Fatalf("manifest %+v for files %d", manifest, len(files))
+	}
+	var account Account
+	json.Unmarshal(files["account.json"], &account)
+	if account.FirstName != "Ada" || account.Balance != 60 {
+		t.Errorf("account.json %+v", account)
+	}
+	var txs []Transaction
+	json.Unmarshal(files["transactions.json"], &txs)
+	if len(txs) != 1 || txs[0].Amount != 40 {
+		t.Errorf("transactions.json %+v", txs)
+	}
+	var customer Customer
+	json.Unmarshal(files["customer.json"], &customer)
+	if customer.ID != account.CustomerID || customer.LastName != "Lovelace" {
+		t.Errorf("customer.json %+v", customer)
+	}
+	for name, want := range map[string]int{"payees.json": 1, "batches.json": 1, "risk-decisions.json": 1, "webhook-deliveries.json": 1} {
+		var got []json.RawMessage
+		if err := json.Unmarshal(files[name], &got); err != nil || len(got) != want {
+			t.Errorf("%s has %d entries, want %d: %s", name, len(got), want, files[name])
+		}
+	}
+	var entries []AuditEntry
+	json.Unmarshal(files["audit.json"], &entries)
+	if len(entries) != 1 || entries[0].Actor != "alice" {
+		t.Errorf("audit.json has another account's entries: %+v", entries)
+	}
+
+	if got := audit.Query(AuditQuery{AccountID: 1, Action: "account.export"}); len(got) != 1 || got[0].Actor != "alice" {
+		t.Fatalf("export not audited: %+v", got)
+	}
+}
+
+func TestEraseAccount(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateWebhook(&Webhook{Owner: "alice", URL: "http://example.com", Events: []string{EventAccountCreated}, Secret: "s"})
+	store.CreateAccount(&Account{ID: 1, FirstName: "Ada", LastName: "Lovelace", Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, FirstName: "Bob", Owner: "bob", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 3, Owner: "alice", Status: StatusActive})
+	email := "ada@example.com"
+	store.PatchCustomer(1, &CustomerPatch{Email: &email}, 0, time.Now())
+	store.Transfer(1, 2, 100)
+	audit := NewAuditLog()
+	server := NewAPIServer("", store, audit)
+	admin := Principal{Subject: "root", Role: RoleAdmin}
+
+	// Names go into the audit log encrypted under the customer's data key.
+	before, _ := store.GetAccountByID(1)
+	must(t, audit.Append(&AuditEntry{Actor: "root", Action: "account.update", AccountID: 1, After: before}))
+	if stored := audit.entries[0]; strings.Contains(string(stored.raw), "Lovelace") || stored.Subject != customerSubject(before.CustomerID) {
+		t.Fatalf("audit entry stored the name in the clear: %s", stored.raw)
+	}
+	if got := audit.Query(AuditQuery{Action: "account.update"}); got[0].After.LastName != "Lovelace" {
+		t.Fatalf("audit entry reads back as %+v", got[0].After)
+	}
+
+	if rec := privacyRequest(t, server, admin, "POST", "/account/1/erase"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("erased an open account: %d", rec.Code)
+	}
+	if _, err := store.SetAccountStatus(1, "", StatusClosed, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Alice's other account carries her names too.
+	if rec := privacyRequest(t, server, admin, "POST", "/account/1/erase"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("erased while the customer has an open account: %d", rec.Code)
+	}
+	if _, err := store.SetAccountStatus(3, "", StatusClosed, 0); err != nil {
+		t.Fatal(err)
+	}
+	rec := privacyRequest(t, server, admin, "POST", "/account/1/erase")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("erase: %d %s", rec.Code, rec.Body)
+	}
+
+	acc, _ := store.GetAccountByID(1)
+	pseudonym := acc.LastName
+	if acc.FirstName != "erased" || !strings.HasPrefix(pseudonym, "erased-") || acc.ErasedAt == nil {
+		t.Fatalf("account after erasure %+v", acc)
+	}
+	customer, _ := store.GetCustomer(acc.CustomerID)
+	if customer.LastName != pseudonym || customer.Email != "" || customer.ErasedAt == nil {
+		t.Fatalf("customer after erasure %+v", customer)
+	}
+	if sibling, _ := store.GetAccountByID(3); sibling.LastName != pseudonym || sibling.ErasedAt == nil {
+		t.Fatalf("customer's other account after erasure %+v", sibling)
+	}
+	// The ledger still adds up.
+	other, _ := store.GetAccountByID(2)
+	if txs, _ := store.GetTransactions(1); len(txs) != 1 || acc.Balance+other.Balance != 100 {
+		t.Fatalf("ledger changed: %+v", txs)
+	}
+
+	events, _ := store.EventsAfter(0, 0)
+	for _, e := range events {
+		if strings.Contains(string(e.Data), "Lovelace") {
+			t.Errorf("%s event still names the holder: %s", e.Type, e.Data)
+		}
+	}
+	if last := events[len(events)-1]; last.Type != EventAccountErased {
+		t.Errorf("last event is %s", last.Type)
+	}
+	deliveries, _ := store.GetWebhookDeliveries(1)
+	if len(deliveries) != 2 {
+		t.Fatalf("%d webhook deliveries, want 2", len(deliveries))
+	}
+	for _, d := range deliveries {
+		if strings.Contains(string(d.Payload), "Lovelace") || !strings.Contains(string(d.Payload), pseudonym) {
+			t.Errorf("webhook delivery not scrubbed: %s", d.Payload)
+		}
+	}
+
+	// The earlier entry still verifies, but its names can't be read.
+	if err := verifyAuditChain(audit.entries); err != nil {
+		t.Fatal(err)
+	}
+	if got := audit.Query(AuditQuery{Action: "account.update"}); got[0].After.FirstName != "" || got[0].After.LastName != "" {
+		t.Fatalf("erased names still read back as %+v", got[0].After)
+	}
+	// Each account the erasure covered is audited, the one asked for first.
+	entries := audit.Query(AuditQuery{Action: "account.erase"})
+	if len(entries) != 2 {
+		t.Fatalf("%d erasure audit entries, want 2", len(entries))
+	}
+	for i, id := range []int{1, 3} {
+		if e := entries[i]; e.AccountID != id || e.Before != nil || e.After.ID != id || e.After.LastName != pseudonym {
+			t.Fatalf("erasure audit entry %d: %+v", i, e)
+		}
+	}
+	if _, err := store.SetAccountStatus(1, "", StatusActive, 0); err == nil {
+		t.Error("reopened an erased account")
+	}
+	if rec := privacyRequest(t, server, admin, "POST", "/account/1/erase"); rec.Code != http.StatusBadRequest {
+		t.Errorf("erased twice: %d", rec.Code)
+	}
+}
+
+func TestPIIKeyIsRequired(t *testing.T) {
+	defer func(key []byte) { piiKey = key }(piiKey)
+
+	t.Setenv("PII_KEY", "")
+	if err := configurePIIKey(false); err == nil {
+		t.Fatal("started without a key")
+	}
+	t.Setenv("PII_KEY", "correct horse battery staple")
+	must(t, configurePIIKey(false))
+	sealed, err := seal(wrappingKey(), []byte("Lovelace"))
+	must(t, err)
+	if name, err := unseal(wrappingKey(), sealed); err != nil || string(name) != "Lovelace" {
+		t.Fatalf("unsealed %q, %v", name, err)
+	}
+}
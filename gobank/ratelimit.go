@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateBuckets is how many keys a rateLimiter tracks before it forgets
+// those that have filled up again.
+const maxRateBuckets = 10_000
+
+// rateLimiter lets each key make a burst of calls, then one more every
+// interval.
+type rateLimiter struct {
+	burst    int
+	interval time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+func newRateLimiter(burst int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{burst: burst, interval: interval, buckets: map[string]*rateBucket{}}
+}
+
+// Allow takes a call from key's allowance. If there is none left it reports
+// how long until there is.
+func (l *rateLimiter) Allow(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.sweep(now)
+		}
+		b = &rateBucket{tokens: float64(l.burst), at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.at = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) * float64(l.interval)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+func (l *rateLimiter) refill(b *rateBucket, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.at))/float64(l.interval)
+	return min(tokens, float64(l.burst))
+}
+
+// sweep forgets keys whose allowance is full again, since they behave just
+// like keys never seen. Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleSupport  Role = "support"
+	RoleAdmin    Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+type Permission string
+
+const (
+	PermCreateAccount  Permission = "account:create"
+	PermReadAccount    Permission = "account:read"
+	PermUpdateAccount  Permission = "account:update"
+	PermCloseAccount   Permission = "account:close"
+	PermFreezeAccount  Permission = "account:freeze"
+	PermReopenAccount  Permission = "account:reopen"
+	PermExportAccount  Permission = "account:export"
+	PermEraseAccount   Permission = "account:erase"
+	PermTransfer       Permission = "transfer:create"
+	PermCreateCustomer Permission = "customer:create"
+	PermReadCustomer   Permission = "customer:read"
+	PermUpdateCustomer Permission = "customer:update"
+	PermVerifyCustomer Permission = "customer:verify"
+	PermManagePayees   Permission = "payee:manage"
+	PermReadAudit      Permission = "audit:read"
+	PermReadReviews    Permission = "review:read"
+	PermResolveReviews Permission = "review:resolve"
+	PermReadMetrics    Permission = "metrics:read"
+	PermUseDashboard   Permission = "dashboard:use"
+	// PermManageWebhooks is scoped to the caller's own webhooks rather than to
+	// accounts.
+	PermManageWebhooks Permission = "webhook:manage"
+)
+
+// scope says which accounts a granted permission covers.
+type scope int
+
+const (
+	scopeOwn scope = iota + 1
+	scopeAny
+)
+
+// rolePermissions is the permission matrix. A permission missing for a role
+// is denied.
+var rolePermissions = map[Role]map[Permission]scope{
+	RoleCustomer: {
+		PermCreateAccount:  scopeOwn,
+		PermReadAccount:    scopeOwn,
+		PermUpdateAccount:  scopeOwn,
+		PermCloseAccount:   scopeOwn,
+		PermExportAccount:  scopeOwn,
+		PermTransfer:       scopeOwn,
+		PermCreateCustomer: scopeOwn,
+		PermReadCustomer:   scopeOwn,
+		PermUpdateCustomer: scopeOwn,
+		PermManagePayees:   scopeOwn,
+		PermManageWebhooks: scopeOwn,
+	},
+	RoleSupport: {
+		PermReadAccount:  scopeAny,
+		PermReadCustomer: scopeAny,
+		PermReadReviews:  scopeAny,
+		PermUseDashboard: scopeAny,
+	},
+	RoleAdmin: {
+		PermCreateAccount:  scopeAny,
+		PermReadAccount:    scopeAny,
+		PermUpdateAccount:  scopeAny,
+		PermCloseAccount:   scopeAny,
+		PermFreezeAccount:  scopeAny,
+		PermReopenAccount:  scopeAny,
+		PermExportAccount:  scopeAny,
+		PermEraseAccount:   scopeAny,
+		PermTransfer:       scopeAny,
+		PermCreateCustomer: scopeAny,
+		PermReadCustomer:   scopeAny,
+		PermUpdateCustomer: scopeAny,
+		PermVerifyCustomer: scopeAny,
+		PermManagePayees:   scopeAny,
+		PermReadAudit:      scopeAny,
+		PermReadReviews:    scopeAny,
+		PermResolveReviews: scopeAny,
+		PermManageWebhooks: scopeAny,
+		PermReadMetrics:    scopeAny,
+		PermUseDashboard:   scopeAny,
+	},
+}
+
+// routePermissions maps the HTTP methods a route accepts to the permission
+// each one needs.
+type routePermissions map[string]Permission
+
+func denied(r *http.Request, status int, reason string) error {
+	subject, role := "anonymous", Role("")
+	if p := principalFrom(r); p != nil {
+		subject, role = p.Subject, p.Role
+	}
+	log.Printf("access denied: %s %s principal=%s role=%s: %s", r.Method, r.URL.Path, subject, role, reason)
+	return httpError{Status: status, Msg: reason}
+}
+
+// authorize wraps f so it only runs when the caller's role grants the
+// permission for the request method. Routes with an {id} are also checked for
+// ownership when the role only covers its own accounts.
+func (s *APIServer) authorize(perms routePermissions, f apiFunc) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		perm, ok := perms[r.Method]
+		if !ok {
+			return errMethodNotAllowed(r)
+		}
+		if _, ok := mux.Vars(r)["id"]; !ok {
+			if err := checkPermission(r, perm); err != nil {
+				return err
+			}
+			return f(w, r)
+		}
+		id, err := getID(r)
+		if err != nil {
+			return err
+		}
+		if err := s.authorizeAccount(r, perm, id); err != nil {
+			return err
+		}
+		return f(w, r)
+	}
+}
+
+func checkPermission(r *http.Request, perm Permission) error {
+	p := principalFrom(r)
+	if p == nil {
+		return denied(r, http.StatusUnauthorized, "authentication required")
+	}
+	if _, ok := rolePermissions[p.Role][perm]; !ok {
+		return denied(r, http.StatusForbidden, fmt.Sprintf("role %s lacks %s", p.Role, perm))
+	}
+	return nil
+}
+
+// authorizeAccount checks that the caller may use perm on the given account.
+// Handlers call it directly for accounts named in the request body.
+func (s *APIServer) authorizeAccount(r *http.Request, perm Permission, accountID int) error {
+	if err := checkPermission(r, perm); err != nil {
+		return err
+	}
+	p := principalFrom(r)
+	if rolePermissions[p.Role][perm] == scopeAny {
+		return nil
+	}
+	acc, err := s.storage(r).GetAccountByID(accountID)
+	if err != nil || acc.Owner != p.Subject {
+		return denied(r, http.StatusForbidden, fmt.Sprintf("account %d is not owned by %s", accountID, p.Subject))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutePermissions(t *testing.T) {
+	principals := map[string]*Principal{
+		"anonymous": nil,
+		"owner":     {Subject: "alice", Role: RoleCustomer},
+		"other":     {Subject: "carol", Role: RoleCustomer},
+		"support":   {Subject: "sam", Role: RoleSupport},
+		"admin":     {Subject: "root", Role: RoleAdmin},
+	}
+
+	routes := []struct {
+		method  string
+		path    string
+		body    string
+		allowed []string
+	}{
+		{"POST", "/account", `{"firstName":"a","lastName":"b"}`, []string{"owner", "other", "admin"}},
+		{"GET", "/accounts", "", []string{"owner", "other", "support", "admin"}},
+		{"GET", "/account/1", "", []string{"owner", "support", "admin"}},
+		{"PATCH", "/account/1", `{"product":null}`, []string{"owner", "admin"}},
+		{"DELETE", "/account/1", "", []string{"owner", "admin"}},
+		{"POST", "/account/1/freeze", "", []string{"admin"}},
+		{"POST", "/account/1/unfreeze", "", []string{"admin"}},
+		{"POST", "/account/1/close", "", []string{"owner", "admin"}},
+		{"POST", "/account/1/reopen", "", []string{"admin"}},
+		{"GET", "/account/1/transactions", "", []string{"owner", "support", "admin"}},
+		{"GET", "/account/1/events", "", []string{"owner", "support", "admin"}},
+		{"GET", "/account/1/statements/2026-01", "", []string{"owner", "support", "admin"}},
+		{"GET", "/account/1/export", "", []string{"owner", "admin"}},
+		{"POST", "/account/1/erase", "", []string{"admin"}},
+		{"GET", "/account/1/schedules", "", []string{"owner", "support", "admin"}},
+		{"POST", "/account/1/schedules", `{"toAccount":2,"amount":1}`, []string{"owner", "admin"}},
+		{"GET", "/account/1/schedules/1", "", []string{"owner", "support", "admin"}},
+		{"DELETE", "/account/1/schedules/1", "", []string{"owner", "admin"}},
+		{"GET", "/account/1/holds", "", []string{"owner", "support", "admin"}},
+		{"POST", "/account/1/holds", `{"toAccount":2,"amount":1}`, []string{"owner", "admin"}},
+		{"GET", "/account/1/holds/1", "", []string{"owner", "support", "admin"}},
+		{"POST", "/account/1/holds/1/capture", "", []string{"owner", "admin"}},
+		{"POST", "/account/1/holds/1/release", "", []string{"owner", "admin"}},
+		{"GET", "/customers", "", []string{"owner", "other", "support", "admin"}},
+		{"POST", "/customers", `{"firstName":"a","lastName":"b"}`, []string{"owner", "other", "admin"}},
+		{"GET", "/customers/1", "", []string{"owner", "support", "admin"}},
+		{"PATCH", "/customers/1", `{"phone":"555"}`, []string{"owner", "admin"}},
+		{"GET", "/customers/1/accounts", "", []string{"owner", "support", "admin"}},
+		{"POST", "/customers/1/accounts", `{"product":"savings"}`, []string{"owner", "admin"}},
+		{"GET", "/customers/1/payees", "", []string{"owner", "support", "admin"}},
+		{"POST", "/customers/1/payees", `{"nickname":"b","accountNumber":2,"name":"x"}`, []string{"owner", "admin"}},
+		{"GET", "/customers/1/payees/1", "", []string{"owner", "support", "admin"}},
+		{"DELETE", "/customers/1/payees/1", "", []string{"owner", "admin"}},
+		{"POST", "/confirm-payee", `{"accountNumber":2,"name":"x"}`, []string{"owner", "other", "admin"}},
+		{"POST", "/transfer", `{"fromAccount":1,"toAccount":2,"amount":1}`, []string{"owner", "admin"}},
+		{"POST", "/batches", `{"transfers":[{"fromAccount":1,"toAccount":2,"amount":1}]}`, []string{"owner", "admin"}},
+		{"GET", "/batches/1", "", []string{"owner", "other", "admin"}},
+		{"GET", "/audit", "", []string{"admin"}},
+		{"GET", "/debug/vars", "", []string{"admin"}},
+		{"GET", "/reviews", "", []string{"support", "admin"}},
+		{"POST", "/reviews/1/approve", "", []string{"admin"}},
+		{"POST", "/reviews/1/reject", "", []string{"admin"}},
+		{"GET", "/webhooks", "", []string{"owner", "other", "admin"}},
+		{"POST", "/webhooks", `{"url":"http://example.com","events":["account.created"]}`, []string{"owner", "other", "admin"}},
+		{"GET", "/webhooks/1", "", []string{"owner", "other", "admin"}},
+		{"DELETE", "/webhooks/1", "", []string{"owner", "other", "admin"}},
+		{"GET", "/webhooks/1/deliveries", "", []string{"owner", "other", "admin"}},
+	}
+
+	for _, rt := range routes {
+		for name, p := range principals {
+			t.Run(rt.method+" "+rt.path+" as "+name, func(t *testing.T) {
+				store := NewMemoryStore()
+				store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 10, Status: StatusActive})
+				store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+				server := NewAPIServer("", store, NewAuditLog())
+
+				// Streaming routes run until the client goes away.
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				req := httptest.NewRequest(rt.method, rt.path, strings.NewReader(rt.body)).WithContext(ctx)
+				if p != nil {
+					token, err := createJWT(*p, time.Minute)
+					if err != nil {
+						t.Fatal(err)
+					}
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				rec := httptest.NewRecorder()
+				server.routes().ServeHTTP(rec, req)
+
+				want := http.StatusForbidden
+				if p == nil {
+					want = http.StatusUnauthorized
+				}
+				for _, a := range rt.allowed {
+					if a == name {
+						want = 0
+					}
+				}
+				denied := rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden
+				switch {
+				case want == 0 && denied:
+					t.Errorf("expected access, got %d: %s", rec.Code, rec.Body)
+				case want != 0 && rec.Code != want:
+					t.Errorf("expected %d, got %d: %s", want, rec.Code, rec.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestJWTSecretIsRequired(t *testing.T) {
+	defer func(key []byte) { jwtKey = key }(jwtKey)
+
+	t.Setenv("JWT_SECRET", "")
+	if err := configureJWTSecret(false); err == nil {
+		t.Fatal("started without a secret")
+	}
+	must(t, configureJWTSecret(true))
+	if string(jwtSecret()) != devJWTSecret {
+		t.Fatalf("dev mode signs with %q", jwtSecret())
+	}
+	t.Setenv("JWT_SECRET", "correct horse battery staple")
+	must(t, configureJWTSecret(false))
+	if string(jwtSecret()) != "correct horse battery staple" {
+		t.Fatalf("signs with %q", jwtSecret())
+	}
+}
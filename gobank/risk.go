@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cshorten/gobank/hook"
+	"github.com/gorilla/mux"
+)
+
+type RiskOutcome string
+
+// Outcomes are ordered by severity; a transfer gets the most severe outcome
+// of the rules it trips.
+const (
+	RiskAllow RiskOutcome = "allow"
+	RiskHold  RiskOutcome = "hold"
+	RiskDeny  RiskOutcome = "deny"
+)
+
+var riskSeverity = map[RiskOutcome]int{RiskAllow: 0, RiskHold: 1, RiskDeny: 2}
+
+type ReviewStatus string
+
+const (
+	ReviewPending  ReviewStatus = "pending"
+	ReviewApproved ReviewStatus = "approved"
+	ReviewRejected ReviewStatus = "rejected"
+)
+
+// duration reads a time.Duration from a string such as "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// RiskRules is the rule file. Every rule is optional.
+type RiskRules struct {
+	DailyLimit *struct {
+		Amount int64 `json:"amount"`
+		// Accounts overrides the limit for particular accounts.
+		Accounts map[int]int64 `json:"accounts"`
+		Action   RiskOutcome   `json:"action"`
+	} `json:"dailyLimit"`
+	Velocity *struct {
+		Count  int         `json:"count"`
+		Window duration    `json:"window"`
+		Action RiskOutcome `json:"action"`
+	} `json:"velocity"`
+	NewPayee *struct {
+		Amount int64       `json:"amount"`
+		Action RiskOutcome `json:"action"`
+	} `json:"newPayee"`
+	Blocklist *struct {
+		Accounts []int       `json:"accounts"`
+		Action   RiskOutcome `json:"action"`
+	} `json:"blocklist"`
+}
+
+func LoadRiskRules(path string) (*RiskRules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := new(RiskRules)
+	if err := json.Unmarshal(b, rules); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	actions := []*RiskOutcome{}
+	if rules.DailyLimit != nil {
+		actions = append(actions, &rules.DailyLimit.Action)
+	}
+	if rules.Velocity != nil {
+		actions = append(actions, &rules.Velocity.Action)
+	}
+	if rules.NewPayee != nil {
+		actions = append(actions, &rules.NewPayee.Action)
+	}
+	if rules.Blocklist != nil {
+		actions = append(actions, &rules.Blocklist.Action)
+	}
+	for _, a := range actions {
+		if *a == "" {
+			*a = RiskHold
+		}
+		if _, ok := riskSeverity[*a]; !ok {
+			return nil, fmt.Errorf("loading %s: unknown action %s", path, *a)
+		}
+	}
+	return rules, nil
+}
+
+// RiskDecision is the recorded outcome of checking a transfer. Held transfers
+// wait in the review queue until someone approves or rejects them.
+type RiskDecision struct {
+	ID            int          `json:"id"`
+	FromAccount   int          `json:"fromAccount"`
+	ToAccount     int          `json:"toAccount"`
+	Amount        int64        `json:"amount"`
+	Source        string       `json:"source"`
+	Outcome       RiskOutcome  `json:"outcome"`
+	Reasons       []string     `json:"reasons"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	Review        ReviewStatus `json:"review,omitempty"`
+	ReviewedBy    string       `json:"reviewedBy,omitempty"`
+	ReviewedAt    *time.Time   `json:"reviewedAt,omitempty"`
+	TransactionID int          `json:"transactionId,omitempty"`
+	// Error is why an allowed transfer then failed to be made.
+	Error string `json:"error,omitempty"`
+}
+
+func (d *RiskDecision) trip(outcome RiskOutcome, reason string) {
+	d.Reasons = append(d.Reasons, reason)
+	if riskSeverity[outcome] > riskSeverity[d.Outcome] {
+		d.Outcome = outcome
+	}
+}
+
+// RiskEngine checks transfers against the current rules before they are
+// made. The rules only look at what the source account has sent, so checking
+// and making a transfer happen under that account's lock: concurrent
+// transfers from one account can't slip past a limit together, and transfers
+// from different accounts don't wait for each other.
+type RiskEngine struct {
+	locks accountLocks
+	store Storage
+	clock Clock
+	// hooks are run around every transfer the engine guards, which is every
+	// transfer made through the API, a batch or a schedule.
+	hooks *hook.Registry
+
+	rulesMu sync.RWMutex
+	rules   *RiskRules
+}
+
+func NewRiskEngine(store Storage, clock Clock) *RiskEngine {
+	return &RiskEngine{store: store, clock: clock, rules: new(RiskRules)}
+}
+
+func (e *RiskEngine) SetRules(rules *RiskRules) {
+	e.rulesMu.Lock()
+	defer e.rulesMu.Unlock()
+	e.rules = rules
+}
+
+func (e *RiskEngine) currentRules() *RiskRules {
+	e.rulesMu.RLock()
+	defer e.rulesMu.RUnlock()
+	return e.rules
+}
+
+// WatchRules reloads the rule file whenever it changes. A file that doesn't
+// parse is logged and the previous rules stay in force.
+func (e *RiskEngine) WatchRules(ctx context.Context, path string, interval time.Duration) {
+	var modTime time.Time
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if fi, err := os.Stat(path); err != nil {
+			log.Println("risk:", err)
+		} else if !fi.ModTime().Equal(modTime) {
+			modTime = fi.ModTime()
+			if rules, err := LoadRiskRules(path); err != nil {
+				log.Println("risk:", err)
+			} else {
+				e.SetRules(rules)
+				log.Println("risk: loaded rules from", path)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Guard runs the before transfer hooks, checks the transfer, records the
+// decision and, if it is allowed, runs exec to make the transfer and then the
+// after hooks. actor is who asked for the transfer.
+func (e *RiskEngine) Guard(ctx context.Context, actor string, from, to int, amount int64, source string, exec func() (*Transaction, error)) (*RiskDecision, *Transaction, error) {
+	ev := newTransferEvent(actor, source, from, to, amount)
+	if err := beforeHooks(ctx, e.hooks, ev); err != nil {
+		return nil, nil, err
+	}
+	d, tx, err := e.guard(from, to, amount, source, exec)
+	if tx != nil {
+		ev.TransactionID = tx.ID
+		afterHooks(ctx, e.hooks, ev)
+	}
+	return d, tx, err
+}
+
+func (e *RiskEngine) guard(from, to int, amount int64, source string, exec func() (*Transaction, error)) (*RiskDecision, *Transaction, error) {
+	defer e.locks.lock(from)()
+
+	d, err := e.evaluate(from, to, amount, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Source = source
+	if d.Outcome == RiskHold {
+		d.Review = ReviewPending
+	}
+
+	var tx *Transaction
+	if d.Outcome == RiskAllow {
+		if tx, err = exec(); err != nil {
+			return nil, nil, e.recordFailure(err, d)
+		}
+		d.TransactionID = tx.ID
+	}
+	if err := e.store.RecordRiskDecision(d); err != nil {
+		return nil, nil, err
+	}
+	return d, tx, nil
+}
+
+// recordFailure records allowed decisions whose transfer failed, with the
+// failure, and returns it.
+func (e *RiskEngine) recordFailure(err error, decisions ...*RiskDecision) error {
+	for _, d := range decisions {
+		if d == nil {
+			continue
+		}
+		d.Error = err.Error()
+		if rerr := e.store.RecordRiskDecision(d); rerr != nil {
+			return fmt.Errorf("%w (recording the risk decision: %v)", err, rerr)
+		}
+	}
+	return err
+}
+
+// GuardAll checks the pending transfers in an all-or-nothing batch and runs
+// exec only if none of them trips a rule. exec returns the transaction each
+// transfer was posted as, by index. Each transfer is checked as though the
+// ones before it in the batch had been made.
+//
+// A decision is recorded for every pending transfer and returned by index.
+// Nothing is queued for review, since a held transfer couldn't be approved
+// on its own.
+//
+// The transfer hooks run around each pending transfer. If a before hook
+// refuses one, nothing is checked or made and a *BatchItemError says which.
+func (e *RiskEngine) GuardAll(ctx context.Context, actor string, items []*BatchItem, source string, exec func() ([]int, error)) ([]*RiskDecision, error) {
+	events := make([]*hook.Event, len(items))
+	for i, item := range items {
+		if item.Status != ItemPending {
+			continue
+		}
+		events[i] = newTransferEvent(actor, source, item.FromAccount, item.ToAccount, item.Amount)
+		if err := beforeHooks(ctx, e.hooks, events[i]); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+	}
+	decisions, err := e.guardAll(items, source, exec)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range decisions {
+		if d != nil && d.TransactionID != 0 {
+			events[i].TransactionID = d.TransactionID
+			afterHooks(ctx, e.hooks, events[i])
+		}
+	}
+	return decisions, nil
+}
+
+// BatchItemError is the error of one transfer in a batch.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("transfer %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RiskEngine) guardAll(items []*BatchItem, source string, exec func() ([]int, error)) ([]*RiskDecision, error) {
+	var sources []int
+	for _, item := range items {
+		if item.Status == ItemPending {
+			sources = append(sources, item.FromAccount)
+		}
+	}
+	defer e.locks.lock(sources...)()
+
+	decisions := make([]*RiskDecision, len(items))
+	earlier := map[int]*riskTally{}
+	tripped := false
+	for i, item := range items {
+		if item.Status != ItemPending {
+			continue
+		}
+		tally := earlier[item.FromAccount]
+		if tally == nil {
+			tally = &riskTally{paid: map[int]bool{}}
+			earlier[item.FromAccount] = tally
+		}
+		d, err := e.evaluate(item.FromAccount, item.ToAccount, item.Amount, tally)
+		if err != nil {
+			return nil, err
+		}
+		d.Source = source
+		decisions[i] = d
+		tally.add(item.ToAccount, item.Amount)
+		tripped = tripped || d.Outcome != RiskAllow
+	}
+	if !tripped {
+		txIDs, err := exec()
+		if err != nil {
+			return nil, e.recordFailure(err, decisions...)
+		}
+		for i, d := range decisions {
+			if d != nil && i < len(txIDs) {
+				d.TransactionID = txIDs[i]
+			}
+		}
+	}
+	for _, d := range decisions {
+		if d == nil {
+			continue
+		}
+		if err := e.store.RecordRiskDecision(d); err != nil {
+			return nil, err
+		}
+	}
+	return decisions, nil
+}
+
+// accountLocks holds a lock for each account that is in use. A lock is
+// dropped once nobody holds it or waits for it, so the map only ever has the
+// accounts being worked on. The zero value is ready to use.
+type accountLocks struct {
+	mu    sync.Mutex
+	locks map[int]*accountLock
+}
+
+type accountLock struct {
+	sync.Mutex
+	// refs counts the holder and those waiting, guarded by accountLocks.mu.
+	refs int
+}
+
+// lock locks each of the accounts ids, and returns a func that unlocks them.
+// They are locked in order, so two callers locking some of the same accounts
+// can't each end up waiting for the other.
+func (l *accountLocks) lock(ids ...int) (unlock func()) {
+	ids = append([]int(nil), ids...)
+	sort.Ints(ids)
+	held := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = map[int]*accountLock{}
+		}
+		al := l.locks[id]
+		if al == nil {
+			al = &accountLock{}
+			l.locks[id] = al
+		}
+		al.refs++
+		l.mu.Unlock()
+
+		al.Lock()
+		held = append(held, id)
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, id := range held {
+			al := l.locks[id]
+			al.Unlock()
+			if al.refs--; al.refs == 0 {
+				delete(l.locks, id)
+			}
+		}
+	}
+}
+
+// riskTally is what transfers earlier in a batch have sent from an account.
+// They aren't on the ledger yet when the batch is checked.
+type riskTally struct {
+	sent  int64
+	count int
+	paid  map[int]bool
+}
+
+func (t *riskTally) add(to int, amount int64) {
+	t.sent += amount
+	t.count++
+	t.paid[to] = true
+}
+
+// evaluate checks a transfer against the rules. earlier, if not nil, adds
+// transfers not yet on the ledger to the account's history.
+func (e *RiskEngine) evaluate(from, to int, amount int64, earlier *riskTally) (*RiskDecision, error) {
+	now := e.clock.Now()
+	d := &RiskDecision{
+		FromAccount: from,
+		ToAccount:   to,
+		Amount:      amount,
+		Outcome:     RiskAllow,
+		Reasons:     []string{},
+		CreatedAt:   now,
+	}
+	rules := e.currentRules()
+
+	if bl := rules.Blocklist; bl != nil {
+		for _, id := range bl.Accounts {
+			if id == from || id == to {
+				d.trip(bl.Action, fmt.Sprintf("account %d is blocklisted", id))
+			}
+		}
+	}
+	if rules.DailyLimit == nil && rules.Velocity == nil && rules.NewPayee == nil {
+		return d, nil
+	}
+
+	txs, err := e.store.GetTransactions(from)
+	if err != nil {
+		return nil, err
+	}
+	var sentToday int64
+	recent, paidBefore := 0, false
+	if earlier != nil {
+		sentToday, recent, paidBefore = earlier.sent, earlier.count, earlier.paid[to]
+	}
+	today := startOfDay(now)
+	for _, tx := range txs {
+		// Captured holds are money sent like any transfer; only interest
+		// comes from elsewhere.
+		if tx.Kind == KindInterest || tx.FromAccount != from {
+			continue
+		}
+		if !tx.CreatedAt.Before(today) {
+			sentToday += tx.Amount
+		}
+		if v := rules.Velocity; v != nil && tx.CreatedAt.After(now.Add(-time.Duration(v.Window))) {
+			recent++
+		}
+		if tx.ToAccount == to {
+			paidBefore = true
+		}
+	}
+
+	if dl := rules.DailyLimit; dl != nil {
+		// Pending holds are money already promised, so they count against
+		// the limit until they are captured or given back.
+		holds, err := e.store.GetHolds(from)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range holds {
+			if h.Status == HoldPending && h.ExpiresAt.After(now) {
+				sentToday += h.Amount
+			}
+		}
+		limit := dl.Amount
+		if l, ok := dl.Accounts[from]; ok {
+			limit = l
+		}
+		if sentToday+amount > limit {
+			d.trip(dl.Action, fmt.Sprintf("daily limit of %d exceeded", limit))
+		}
+	}
+	if v := rules.Velocity; v != nil && recent+1 > v.Count {
+		d.trip(v.Action, fmt.Sprintf("more than %d transfers in %s", v.Count, time.Duration(v.Window)))
+	}
+	// Moving money between a customer's own accounts pays no one new.
+	if np := rules.NewPayee; np != nil && !paidBefore && amount > np.Amount && !e.sameCustomer(from, to) {
+		d.trip(np.Action, fmt.Sprintf("first transfer to %d is over %d", to, np.Amount))
+	}
+	return d, nil
+}
+
+// sameCustomer reports whether both accounts belong to the same customer.
+func (e *RiskEngine) sameCustomer(from, to int) bool {
+	a, err := e.store.GetAccountByID(from)
+	if err != nil || a.CustomerID == 0 {
+		return false
+	}
+	b, err := e.store.GetAccountByID(to)
+	return err == nil && b.CustomerID == a.CustomerID
+}
+
+func (s *APIServer) handleGetReviews(w http.ResponseWriter, r *http.Request) error {
+	status := ReviewStatus(r.URL.Query().Get("status"))
+	if status == "" {
+		status = ReviewPending
+	}
+	decisions, err := s.storage(r).GetRiskDecisions(status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, decisions)
+}
+
+func (s *APIServer) handleApproveReview(w http.ResponseWriter, r *http.Request) error {
+	return s.resolveReview(w, r, ReviewApproved)
+}
+
+func (s *APIServer) handleRejectReview(w http.ResponseWriter, r *http.Request) error {
+	return s.resolveReview(w, r, ReviewRejected)
+}
+
+// resolveReview approves or rejects a held transfer. Approving makes the
+// transfer without checking the rules again.
+func (s *APIServer) resolveReview(w http.ResponseWriter, r *http.Request, status ReviewStatus) error {
+	idStr := mux.Vars(r)["reviewId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return fmt.Errorf("invalid review id given %s", idStr)
+	}
+	d, err := s.resolveRiskReview(r, id, status)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, d)
+}
+
+// resolveRiskReview records the caller's verdict on a held transfer and
+// audits it, along with the transfer if one was made.
+func (s *APIServer) resolveRiskReview(r *http.Request, id int, status ReviewStatus) (*RiskDecision, error) {
+	d, changes, err := s.storage(r).ResolveRiskDecision(id, status, principalFrom(r).Subject, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit(r, "review."+string(status), d.FromAccount, nil, nil)
+	if d.TransactionID != 0 {
+		s.recordAudit(r, "transfer.debit", d.FromAccount, changes.before(d.FromAccount), changes.after(d.FromAccount))
+		s.recordAudit(r, "transfer.credit", d.ToAccount, changes.before(d.ToAccount), changes.after(d.ToAccount))
+		// The before hooks ran when the transfer was asked for.
+		e := newTransferEvent(principalFrom(r).Subject, fmt.Sprintf("review:%d", d.ID), d.FromAccount, d.ToAccount, d.Amount)
+		e.TransactionID = d.TransactionID
+		s.runAfterHooks(r, e)
+	}
+	return d, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRiskFixture(t *testing.T, rules string) (*MemoryStore, *RiskEngine) {
+	t.Helper()
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Balance: 1000, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 3, Status: StatusActive})
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRiskRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewRiskEngine(store, realClock{})
+	engine.SetRules(loaded)
+	return store, engine
+}
+
+func guardTransfer(t *testing.T, store Storage, engine *RiskEngine, from, to int, amount int64) *RiskDecision {
+	t.Helper()
+	d, _, err := engine.Guard(context.Background(), "test", from, to, amount, "test", func() (*Transaction, error) {
+		tx, _, err := store.Transfer(from, to, amount)
+		return tx, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRiskRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		amounts []int64
+		want    []RiskOutcome
+	}{
+		{
+			name:    "daily limit",
+			rules:   `{"dailyLimit": {"amount": 100, "action": "deny"}}`,
+			amounts: []int64{60, 40, 1},
+			want:    []RiskOutcome{RiskAllow, RiskAllow, RiskDeny},
+		},
+		{
+			name:    "daily limit override",
+			rules:   `{"dailyLimit": {"amount": 100, "accounts": {"1": 500}}}`,
+			amounts: []int64{300, 300},
+			want:    []RiskOutcome{RiskAllow, RiskHold},
+		},
+		{
+			name:    "velocity",
+			rules:   `{"velocity": {"count": 2, "window": "10m"}}`,
+			amounts: []int64{1, 1, 1},
+			want:    []RiskOutcome{RiskAllow, RiskAllow, RiskHold},
+		},
+		{
+			name:    "new payee",
+			rules:   `{"newPayee": {"amount": 50}}`,
+			amounts: []int64{80, 10, 80},
+			want:    []RiskOutcome{RiskHold, RiskAllow, RiskAllow},
+		},
+		{
+			name:    "blocklist",
+			rules:   `{"blocklist": {"accounts": [2], "action": "deny"}}`,
+			amounts: []int64{1},
+			want:    []RiskOutcome{RiskDeny},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, engine := newRiskFixture(t, tt.rules)
+			for i, amount := range tt.amounts {
+				d := guardTransfer(t, store, engine, 1, 2, amount)
+				if d.Outcome != tt.want[i] {
+					t.Fatalf("transfer %d of %d: outcome %s, want %s (%v)", i, amount, d.Outcome, tt.want[i], d.Reasons)
+				}
+			}
+		})
+	}
+}
+
+func TestCardHoldsCountTowardsLimits(t *testing.T) {
+	now := time.Now().UTC()
+	store, engine := newRiskFixture(t, `{"dailyLimit": {"amount": 100, "action": "deny"}, "velocity": {"count": 2, "window": "10m"}}`)
+
+	h := placeHold(t, store, 70, now)
+	if d := guardTransfer(t, store, engine, 1, 3, 40); d.Outcome != RiskDeny {
+		t.Fatalf("pending hold not counted against the daily limit: %s %v", d.Outcome, d.Reasons)
+	}
+	if _, _, err := store.CaptureHold(h.ID, 0, now); err != nil {
+		t.Fatal(err)
+	}
+	if d := guardTransfer(t, store, engine, 1, 3, 40); d.Outcome != RiskDeny {
+		t.Fatalf("capture not counted against the daily limit: %s %v", d.Outcome, d.Reasons)
+	}
+	if d := guardTransfer(t, store, engine, 1, 3, 30); d.Outcome != RiskAllow {
+		t.Fatalf("transfer within the limit: %s %v", d.Outcome, d.Reasons)
+	}
+	// The capture and the transfer make two in the window.
+	d := guardTransfer(t, store, engine, 1, 3, 1)
+	if len(d.Reasons) != 2 || !strings.HasPrefix(d.Reasons[1], "more than 2 transfers") {
+		t.Fatalf("capture not counted towards velocity: %v", d.Reasons)
+	}
+}
+
+func TestRiskChecksOnlyWaitForTheSameAccount(t *testing.T) {
+	store, engine := newRiskFixture(t, `{"dailyLimit": {"amount": 100, "action": "deny"}}`)
+	store.CreateAccount(&Account{ID: 4, Balance: 1000, Status: StatusActive})
+	guard := func(from, to int, amount int64, making func()) <-chan *RiskDecision {
+		out := make(chan *RiskDecision, 1)
+		go func() {
+			d, _, err := engine.Guard(context.Background(), "test", from, to, amount, "test", func() (*Transaction, error) {
+				if making != nil {
+					making()
+				}
+				tx, _, err := store.Transfer(from, to, amount)
+				return tx, err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			out <- d
+		}()
+		return out
+	}
+
+	// A transfer out of account 1 is held up while it is being made.
+	inside, release := make(chan struct{}), make(chan struct{})
+	first := guard(1, 2, 60, func() {
+		close(inside)
+		<-release
+	})
+	<-inside
+
+	select {
+	case <-guard(4, 3, 10, nil):
+	case <-time.After(5 * time.Second):
+		t.Fatal("a transfer out of another account waited for it")
+	}
+	second := guard(1, 3, 60, nil)
+	select {
+	case <-second:
+		t.Fatal("a transfer out of the same account didn't wait for it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if d := <-first; d.Outcome != RiskAllow {
+		t.Fatalf("first transfer %s %v", d.Outcome, d.Reasons)
+	}
+	// The second was checked with the first already made.
+	if d := <-second; d.Outcome != RiskDeny {
+		t.Fatalf("second transfer %s %v", d.Outcome, d.Reasons)
+	}
+	if n := len(engine.locks.locks); n != 0 {
+		t.Fatalf("%d account locks left behind", n)
+	}
+}
+
+func TestHeldTransferRunsWhenApproved(t *testing.T) {
+	store, engine := newRiskFixture(t, `{"newPayee": {"amount": 50}}`)
+
+	d := guardTransfer(t, store, engine, 1, 3, 200)
+	if d.Outcome != RiskHold || d.Review != ReviewPending {
+		t.Fatalf("got %s/%s, want a pending hold", d.Outcome, d.Review)
+	}
+	if got := balanceOf(t, store, 3); got != 0 {
+		t.Fatalf("held transfer moved money, balance %d", got)
+	}
+	pending, _ := store.GetRiskDecisions(ReviewPending)
+	if len(pending) != 1 || pending[0].ID != d.ID {
+		t.Fatalf("review queue holds %v, want decision %d", pending, d.ID)
+	}
+
+	resolved, _, err := store.ResolveRiskDecision(d.ID, ReviewApproved, "root", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.TransactionID == 0 {
+		t.Fatal("approval did not record the transaction")
+	}
+	if got := balanceOf(t, store, 3); got != 200 {
+		t.Fatalf("balance after approval %d, want 200", got)
+	}
+	if _, _, err := store.ResolveRiskDecision(d.ID, ReviewApproved, "root", time.Now()); err == nil {
+		t.Fatal("approved the same transfer twice")
+	}
+	if got := balanceOf(t, store, 3); got != 200 {
+		t.Fatalf("balance after second approval %d, want 200", got)
+	}
+}
+
+func TestRiskRecordsAllowedTransferThatFails(t *testing.T) {
+	store, engine := newRiskFixture(t, `{}`)
+	_, _, err := engine.Guard(context.Background(), "test", 1, 2, 5000, "test", func() (*Transaction, error) {
+		tx, _, err := store.Transfer(1, 2, 5000)
+		return tx, err
+	})
+	if err == nil {
+		t.Fatal("overdrawing transfer went through")
+	}
+	decisions, _ := store.GetAccountRiskDecisions(1)
+	if len(decisions) != 1 || decisions[0].Outcome != RiskAllow || decisions[0].Error != err.Error() || decisions[0].TransactionID != 0 {
+		t.Fatalf("decisions %+v, want the allowed transfer with its failure", decisions)
+	}
+}
+
+func TestRiskRulesReload(t *testing.T) {
+	store, engine := newRiskFixture(t, `{}`)
+	if d := guardTransfer(t, store, engine, 1, 2, 10); d.Outcome != RiskAllow {
+		t.Fatalf("outcome %s with no rules", d.Outcome)
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"blocklist": {"accounts": [2], "action": "deny"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.WatchRules(ctx, path, 10*time.Millisecond)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if engine.currentRules().Blocklist != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := guardTransfer(t, store, engine, 1, 2, 10); d.Outcome != RiskDeny {
+		t.Fatalf("outcome %s after reload, want deny", d.Outcome)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Frequency string
+
+const (
+	FrequencyOnce    Frequency = "once"
+	FrequencyDaily   Frequency = "daily"
+	FrequencyWeekly  Frequency = "weekly"
+	FrequencyMonthly Frequency = "monthly"
+)
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	ScheduleCompleted ScheduleStatus = "completed"
+	ScheduleFailed    ScheduleStatus = "failed"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+)
+
+// maxScheduleFailures caps how many failures are kept on a schedule.
+const maxScheduleFailures = 20
+
+type ScheduleFailure struct {
+	At         time.Time `json:"at"`
+	Occurrence int       `json:"occurrence"`
+	Error      string    `json:"error"`
+}
+
+// ScheduledTransfer is a future-dated or recurring transfer. Occurrence counts
+// the runs that have been posted or given up on, and NextRun is when the
+// current one is due.
+type ScheduledTransfer struct {
+	ID          int               `json:"id"`
+	FromAccount int               `json:"fromAccount"`
+	ToAccount   int               `json:"toAccount"`
+	Amount      int64             `json:"amount"`
+	Frequency   Frequency         `json:"frequency"`
+	StartAt     time.Time         `json:"startAt"`
+	EndDate     *time.Time        `json:"endDate,omitempty"`
+	Status      ScheduleStatus    `json:"status"`
+	NextRun     time.Time         `json:"nextRun"`
+	Occurrence  int               `json:"occurrence"`
+	Attempts    int               `json:"attempts"`
+	RetryAt     *time.Time        `json:"retryAt,omitempty"`
+	LastRun     *time.Time        `json:"lastRun,omitempty"`
+	Failures    []ScheduleFailure `json:"failures"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	// PayeeID is the saved payee the schedule pays, if it needed one. Each
+	// transfer checks it is still saved.
+	PayeeID int `json:"payeeId,omitempty"`
+	// Traceparent is the trace context of the request that made the
+	// schedule.
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+type ScheduleTransferRequest struct {
+	ToAccount int        `json:"toAccount"`
+	Amount    int64      `json:"amount"`
+	Frequency Frequency  `json:"frequency"`
+	StartAt   time.Time  `json:"startAt"`
+	EndDate   *time.Time `json:"endDate,omitempty"`
+}
+
+func NewScheduledTransfer(from int, req *ScheduleTransferRequest, now time.Time) (*ScheduledTransfer, error) {
+	freq := req.Frequency
+	if freq == "" {
+		freq = FrequencyOnce
+	}
+	switch freq {
+	case FrequencyOnce, FrequencyDaily, FrequencyWeekly, FrequencyMonthly:
+	default:
+		return nil, fmt.Errorf("unknown frequency %s", freq)
+	}
+	if req.Amount <= 0 {
+		return nil, fmt.Errorf("transfer amount must be positive")
+	}
+	if req.StartAt.IsZero() {
+		return nil, fmt.Errorf("startAt is required")
+	}
+	if req.StartAt.Before(now.Add(-time.Minute)) {
+		return nil, fmt.Errorf("startAt is in the past")
+	}
+	if req.EndDate != nil {
+		if freq == FrequencyOnce {
+			return nil, fmt.Errorf("endDate only applies to recurring transfers")
+		}
+		if req.EndDate.Before(req.StartAt) {
+			return nil, fmt.Errorf("endDate is before startAt")
+		}
+	}
+
+	return &ScheduledTransfer{
+		FromAccount: from,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Frequency:   freq,
+		StartAt:     req.StartAt.UTC(),
+		EndDate:     req.EndDate,
+		Status:      ScheduleActive,
+		NextRun:     req.StartAt.UTC(),
+		Failures:    []ScheduleFailure{},
+		CreatedAt:   now,
+	}, nil
+}
+
+func (st *ScheduledTransfer) clone() *ScheduledTransfer {
+	c := *st
+	c.Failures = append([]ScheduleFailure{}, st.Failures...)
+	return &c
+}
+
+// dueAt is when the scheduler should next try the schedule.
+func (st *ScheduledTransfer) dueAt() time.Time {
+	if st.RetryAt != nil {
+		return *st.RetryAt
+	}
+	return st.NextRun
+}
+
+// occurrenceTime returns when run n of the schedule is due. Monthly runs keep
+// to the start day, falling back to the last day of shorter months.
+func (st *ScheduledTransfer) occurrenceTime(n int) time.Time {
+	switch st.Frequency {
+	case FrequencyDaily:
+		return st.StartAt.AddDate(0, 0, n)
+	case FrequencyWeekly:
+		return st.StartAt.AddDate(0, 0, 7*n)
+	case FrequencyMonthly:
+		y, m, d := st.StartAt.Date()
+		first := time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+		if last := first.AddDate(0, 1, -1).Day(); d > last {
+			d = last
+		}
+		return time.Date(first.Year(), first.Month(), d,
+			st.StartAt.Hour(), st.StartAt.Minute(), st.StartAt.Second(), st.StartAt.Nanosecond(), time.UTC)
+	}
+	return st.StartAt
+}
+
+// advance moves the schedule on to its next run, completing it once there
+// are none left.
+func (st *ScheduledTransfer) advance() {
+	st.Occurrence++
+	st.Attempts = 0
+	st.RetryAt = nil
+	if st.Frequency == FrequencyOnce {
+		st.Status = ScheduleCompleted
+		return
+	}
+	st.NextRun = st.occurrenceTime(st.Occurrence)
+	if st.EndDate != nil && st.NextRun.After(*st.EndDate) {
+		st.Status = ScheduleCompleted
+	}
+}
+
+func (st *ScheduledTransfer) recordFailure(f ScheduleFailure, retryAt *time.Time) {
+	f.Occurrence = st.Occurrence
+	st.Failures = append(st.Failures, f)
+	if n := len(st.Failures); n > maxScheduleFailures {
+		st.Failures = st.Failures[n-maxScheduleFailures:]
+	}
+	st.Attempts++
+
+	switch {
+	case retryAt != nil:
+		st.RetryAt = retryAt
+	case st.Frequency == FrequencyOnce:
+		st.Status = ScheduleFailed
+		st.RetryAt = nil
+	default:
+		st.advance()
+	}
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// Scheduler posts scheduled transfers as they fall due. Failures that may
+// clear up on their own, like a lack of funds, are retried with a doubling
+// delay; other failures give up on the occurrence straight away.
+type Scheduler struct {
+	store       Storage
+	audit       *AuditLog
+	risk        *RiskEngine
+	clock       Clock
+	interval    time.Duration
+	maxAttempts int
+	retryDelay  time.Duration
+	// tracer, if set, traces each transfer, linked to the request that
+	// scheduled it.
+	tracer trace.Tracer
+}
+
+func NewScheduler(store Storage, audit *AuditLog, risk *RiskEngine, clock Clock) *Scheduler {
+	return &Scheduler{
+		store:       store,
+		audit:       audit,
+		risk:        risk,
+		clock:       clock,
+		interval:    time.Minute,
+		maxAttempts: 3,
+		retryDelay:  5 * time.Minute,
+	}
+}
+
+// Run checks for due transfers every interval until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.RunDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue makes one attempt at every schedule that is due now.
+func (s *Scheduler) RunDue() {
+	now := s.clock.Now()
+	due, err := s.store.DueScheduledTransfers(now)
+	if err != nil {
+		log.Println("scheduler:", err)
+		return
+	}
+	for _, st := range due {
+		s.execute(st, now)
+	}
+}
+
+func (s *Scheduler) execute(st *ScheduledTransfer, now time.Time) {
+	ctx, span := startWork(s.tracer, "scheduler.execute", trace.SpanKindInternal, st.Traceparent)
+	span.SetAttributes(attribute.Int("gobank.schedule.id", st.ID), attribute.Int("gobank.schedule.occurrence", st.Occurrence))
+	defer span.End()
+	store := traced(ctx, s.store)
+
+	var changes Changes
+	exec := func() (tx *Transaction, err error) {
+		tx, changes, err = store.ExecuteScheduledTransfer(st.ID, st.Occurrence, now)
+		return tx, err
+	}
+	// The payee may have been removed since the schedule was set up.
+	err := checkSavedPayee(store, st.PayeeID, st.ToAccount)
+	if err == nil && s.risk == nil {
+		_, err = exec()
+	} else if err == nil {
+		// A transfer the rules hold or deny is given up on here; held ones can
+		// still be approved from the review queue.
+		var d *RiskDecision
+		d, _, err = s.risk.Guard(ctx, "scheduler", st.FromAccount, st.ToAccount, st.Amount, fmt.Sprintf("schedule:%d", st.ID), exec)
+		if err == nil && d.Outcome != RiskAllow {
+			err = fmt.Errorf("transfer %s by risk rules (decision %d): %s", d.Outcome, d.ID, strings.Join(d.Reasons, "; "))
+		}
+	}
+	if errors.Is(err, ErrScheduleStale) {
+		return
+	}
+	if err == nil {
+		s.recordAudit(st, "transfer.debit", st.FromAccount, changes.before(st.FromAccount), changes.after(st.FromAccount))
+		s.recordAudit(st, "transfer.credit", st.ToAccount, changes.before(st.ToAccount), changes.after(st.ToAccount))
+		return
+	}
+
+	span.SetStatus(codes.Error, err.Error())
+	log.Printf("scheduler: transfer %d occurrence %d failed: %v", st.ID, st.Occurrence, err)
+	var retryAt *time.Time
+	if isTransient(err) && st.Attempts+1 < s.maxAttempts {
+		t := now.Add(s.retryDelay << st.Attempts)
+		retryAt = &t
+	}
+	f := ScheduleFailure{At: now, Error: err.Error()}
+	if err := store.RecordScheduledTransferFailure(st.ID, st.Occurrence, f, retryAt); err != nil && !errors.Is(err, ErrScheduleStale) {
+		log.Println("scheduler:", err)
+	}
+}
+
+func (s *Scheduler) recordAudit(st *ScheduledTransfer, action string, accountID int, before, after *Account) {
+	if s.audit == nil {
+		return
+	}
+	err := s.audit.Append(&AuditEntry{
+		Actor:     "scheduler",
+		Action:    action,
+		AccountID: accountID,
+		Before:    before,
+		After:     after,
+		RequestID: fmt.Sprintf("schedule-%d-%d", st.ID, st.Occurrence),
+	})
+	if err != nil {
+		log.Println("audit:", err)
+	}
+}
+
+func isTransient(err error) bool {
+	return errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrAccountFrozen)
+}
+
+func (s *APIServer) handleSchedules(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		schedules, err := s.storage(r).GetScheduledTransfers(id)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, schedules)
+	}
+
+	req := new(ScheduleTransferRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	st, err := NewScheduledTransfer(id, req, s.clock.Now())
+	if err != nil {
+		return err
+	}
+	if err := s.tenant(r).checkAmount(st.Amount); err != nil {
+		return err
+	}
+	payee, err := s.payeeFor(r, st.FromAccount, st.ToAccount)
+	if err != nil {
+		return err
+	}
+	if payee != nil {
+		st.PayeeID = payee.ID
+	}
+	if err := s.storage(r).CreateScheduledTransfer(st); err != nil {
+		return err
+	}
+	s.recordAudit(r, "schedule.create", st.FromAccount, nil, nil)
+	return WriteJSON(w, http.StatusCreated, st)
+}
+
+func (s *APIServer) handleScheduleByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	scheduleID, err := strconv.Atoi(mux.Vars(r)["scheduleId"])
+	if err != nil {
+		return fmt.Errorf("invalid schedule id given %s", mux.Vars(r)["scheduleId"])
+	}
+	st, err := s.storage(r).GetScheduledTransfer(scheduleID)
+	if err != nil || st.FromAccount != id {
+		return fmt.Errorf("scheduled transfer %d %w", scheduleID, ErrNotFound)
+	}
+
+	if r.Method == "DELETE" {
+		if st, err = s.storage(r).CancelScheduledTransfer(scheduleID); err != nil {
+			return err
+		}
+		s.recordAudit(r, "schedule.cancel", st.FromAccount, nil, nil)
+	}
+	return WriteJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newScheduleFixture(t *testing.T, store *MemoryStore, balance int64, req *ScheduleTransferRequest, now time.Time) *ScheduledTransfer {
+	t.Helper()
+	store.CreateAccount(&Account{ID: 1, Balance: balance, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Status: StatusActive})
+	st, err := NewScheduledTransfer(1, req, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateScheduledTransfer(st); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func balanceOf(t *testing.T, store Storage, id int) int64 {
+	t.Helper()
+	acc, err := store.GetAccountByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc.Balance
+}
+
+func TestSchedulerRunsRecurringTransferOncePerOccurrence(t *testing.T) {
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(-time.Hour)}
+	store := NewMemoryStore()
+	end := start.AddDate(0, 0, 2)
+	st := newScheduleFixture(t, store, 100, &ScheduleTransferRequest{
+		ToAccount: 2, Amount: 10, Frequency: FrequencyDaily, StartAt: start, EndDate: &end,
+	}, clock.now)
+	scheduler := NewScheduler(store, nil, nil, clock)
+
+	scheduler.RunDue()
+	if got := balanceOf(t, store, 2); got != 0 {
+		t.Fatalf("transfer ran before it was due, balance %d", got)
+	}
+
+	for day := 0; day < 5; day++ {
+		clock.now = start.AddDate(0, 0, day)
+		scheduler.RunDue()
+		scheduler.RunDue()
+	}
+	if got := balanceOf(t, store, 2); got != 30 {
+		t.Fatalf("expected 3 runs totalling 30, got %d", got)
+	}
+	st, _ = store.GetScheduledTransfer(st.ID)
+	if st.Status != ScheduleCompleted {
+		t.Fatalf("expected schedule to complete after its end date, got %s", st.Status)
+	}
+}
+
+func TestSchedulerRetriesTransientFailures(t *testing.T) {
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	store := NewMemoryStore()
+	st := newScheduleFixture(t, store, 0, &ScheduleTransferRequest{
+		ToAccount: 2, Amount: 10, StartAt: start,
+	}, clock.now)
+	scheduler := NewScheduler(store, nil, nil, clock)
+
+	scheduler.RunDue()
+	st, _ = store.GetScheduledTransfer(st.ID)
+	if st.Status != ScheduleActive || st.RetryAt == nil || len(st.Failures) != 1 {
+		t.Fatalf("expected a recorded failure and a retry, got %+v", st)
+	}
+
+	store.mu.Lock()
+	store.accounts[1].Balance = 10
+	store.mu.Unlock()
+	clock.now = *st.RetryAt
+	scheduler.RunDue()
+
+	st, _ = store.GetScheduledTransfer(st.ID)
+	if st.Status != ScheduleCompleted {
+		t.Fatalf("expected retry to complete the transfer, got %s", st.Status)
+	}
+	if got := balanceOf(t, store, 2); got != 10 {
+		t.Fatalf("expected balance 10, got %d", got)
+	}
+}
+
+func TestSchedulerGivesUpAfterMaxAttempts(t *testing.T) {
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	store := NewMemoryStore()
+	st := newScheduleFixture(t, store, 0, &ScheduleTransferRequest{
+		ToAccount: 2, Amount: 10, StartAt: start,
+	}, clock.now)
+	scheduler := NewScheduler(store, nil, nil, clock)
+
+	for i := 0; i < scheduler.maxAttempts; i++ {
+		scheduler.RunDue()
+		st, _ = store.GetScheduledTransfer(st.ID)
+		if st.RetryAt != nil {
+			clock.now = *st.RetryAt
+		}
+	}
+	if st.Status != ScheduleFailed || len(st.Failures) != scheduler.maxAttempts {
+		t.Fatalf("expected schedule to fail after %d attempts, got %+v", scheduler.maxAttempts, st)
+	}
+}
+
+func TestSchedulerStopsPayingRemovedPayee(t *testing.T) {
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	savePayee(t, store, 1, 2)
+	st, err := NewScheduledTransfer(1, &ScheduleTransferRequest{ToAccount: 2, Amount: 10, StartAt: start}, clock.now)
+	must(t, err)
+	st.PayeeID = 1
+	must(t, store.CreateScheduledTransfer(st))
+	must(t, store.DeletePayee(1))
+
+	NewScheduler(store, nil, nil, clock).RunDue()
+	st, _ = store.GetScheduledTransfer(st.ID)
+	if len(st.Failures) != 1 || !strings.Contains(st.Failures[0].Error, "payee 1 has been removed") {
+		t.Fatalf("expected the removed payee to be recorded as a failure, got %+v", st)
+	}
+	if got := balanceOf(t, store, 2); got != 0 {
+		t.Fatalf("removed payee was paid %d", got)
+	}
+}
+
+func TestSchedulesAreAudited(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "alice", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	alice := Principal{Subject: "alice", Role: RoleCustomer}
+
+	startAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if rec := customerRequest(t, server, alice, "POST", "/account/1/schedules", `{"toAccount":2,"amount":10,"startAt":"`+startAt+`"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	if rec := customerRequest(t, server, alice, "DELETE", "/account/1/schedules/1", ""); rec.Code != http.StatusOK {
+		t.Fatalf("cancel: %d %s", rec.Code, rec.Body)
+	}
+	tenant, _ := server.tenants.Get(defaultTenantID)
+	for _, action := range []string{"schedule.create", "schedule.cancel"} {
+		if got := tenant.audit.Query(AuditQuery{AccountID: 1, Action: action}); len(got) != 1 || got[0].Actor != "alice" {
+			t.Errorf("%s audited as %+v", action, got)
+		}
+	}
+}
+
+func TestScheduledTransferSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobank.json")
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+
+	store, err := OpenMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newScheduleFixture(t, store, 100, &ScheduleTransferRequest{
+		ToAccount: 2, Amount: 10, Frequency: FrequencyWeekly, StartAt: start,
+	}, clock.now)
+	NewScheduler(store, nil, nil, clock).RunDue()
+
+	restarted, err := OpenMemoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewScheduler(restarted, nil, nil, clock).RunDue()
+	if got := balanceOf(t, restarted, 2); got != 10 {
+		t.Fatalf("expected the occurrence to run once across restarts, balance %d", got)
+	}
+}
+
+func TestMonthlyOccurrencesClampToMonthEnd(t *testing.T) {
+	st := &ScheduledTransfer{
+		Frequency: FrequencyMonthly,
+		StartAt:   time.Date(2026, 1, 31, 9, 0, 0, 0, time.UTC),
+	}
+	want := []time.Time{
+		time.Date(2026, 1, 31, 9, 0, 0, 0, time.UTC),
+		time.Date(2026, 2, 28, 9, 0, 0, 0, time.UTC),
+		time.Date(2026, 3, 31, 9, 0, 0, 0, time.UTC),
+		time.Date(2026, 4, 30, 9, 0, 0, 0, time.UTC),
+	}
+	for n, w := range want {
+		if got := st.occurrenceTime(n); !got.Equal(w) {
+			t.Errorf("occurrence %d: expected %s, got %s", n, w, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type StatementLine struct {
+	Date          time.Time `json:"date"`
+	TransactionID int       `json:"transactionId"`
+	Description   string    `json:"description"`
+	// Amount is positive for money in and negative for money out.
+	Amount  int64 `json:"amount"`
+	Balance int64 `json:"balance"`
+}
+
+// Statement covers one calendar month of an account, in UTC.
+type Statement struct {
+	AccountID      int             `json:"accountId"`
+	AccountNumber  int64           `json:"accountNumber"`
+	Name           string          `json:"name"`
+	Period         string          `json:"period"`
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	OpeningBalance int64           `json:"openingBalance"`
+	ClosingBalance int64           `json:"closingBalance"`
+	InterestPaid   int64           `json:"interestPaid"`
+	Lines          []StatementLine `json:"lines"`
+}
+
+func BuildStatement(store Storage, accountID int, period string) (*Statement, error) {
+	from, err := time.Parse("2006-01", period)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period given %s", period)
+	}
+	to := from.AddDate(0, 1, 0)
+
+	acc, err := store.GetAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	opening, err := store.BalanceAt(accountID, from)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := store.GetTransactions(accountID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].CreatedAt.Before(txs[j].CreatedAt) })
+
+	st := &Statement{
+		AccountID:      acc.ID,
+		AccountNumber:  acc.Number,
+		Name:           acc.FirstName + " " + acc.LastName,
+		Period:         period,
+		From:           from,
+		To:             to,
+		OpeningBalance: opening,
+		Lines:          []StatementLine{},
+	}
+	balance := opening
+	for _, tx := range txs {
+		if tx.CreatedAt.Before(from) || !tx.CreatedAt.Before(to) {
+			continue
+		}
+		line := statementLine(tx, accountID)
+		if tx.Kind == KindInterest {
+			st.InterestPaid += tx.Amount
+		}
+		balance += line.Amount
+		line.Balance = balance
+		st.Lines = append(st.Lines, line)
+	}
+	st.ClosingBalance = balance
+	return st, nil
+}
+
+// statementLine describes tx as seen from the account, without a running
+// balance.
+func statementLine(tx *Transaction, accountID int) StatementLine {
+	line := StatementLine{Date: tx.CreatedAt, TransactionID: tx.ID, Amount: tx.Amount}
+	switch {
+	case tx.Kind == KindInterest:
+		line.Description = "Interest"
+	case tx.ToAccount == accountID:
+		line.Description = fmt.Sprintf("Transfer from %d", tx.FromAccount)
+	default:
+		line.Description = fmt.Sprintf("Transfer to %d", tx.ToAccount)
+		line.Amount = -tx.Amount
+	}
+	return line
+}
+
+// formatAmount renders an amount in minor units with two decimal places.
+func formatAmount(v int64) string {
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/100, v%100)
+}
+
+func (st *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "transaction", "description", "amount", "balance"})
+	cw.Write([]string{st.From.Format(time.DateOnly), "", "Opening balance", "", formatAmount(st.OpeningBalance)})
+	for _, l := range st.Lines {
+		cw.Write([]string{
+			l.Date.Format(time.RFC3339),
+			strconv.Itoa(l.TransactionID),
+			l.Description,
+			formatAmount(l.Amount),
+			formatAmount(l.Balance),
+		})
+	}
+	cw.Write([]string{st.To.AddDate(0, 0, -1).Format(time.DateOnly), "", "Closing balance", "", formatAmount(st.ClosingBalance)})
+	cw.Flush()
+	return cw.Error()
+}
+
+func (st *Statement) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Statement for %s, account %d (%d)\n", st.Name, st.AccountNumber, st.AccountID)
+	fmt.Fprintf(w, "Period %s to %s\n\n", st.From.Format(time.DateOnly), st.To.AddDate(0, 0, -1).Format(time.DateOnly))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Date\tDescription\tAmount\tBalance\t")
+	fmt.Fprintf(tw, "%s\tOpening balance\t\t%s\t\n", st.From.Format(time.DateOnly), formatAmount(st.OpeningBalance))
+	for _, l := range st.Lines {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", l.Date.Format(time.DateOnly), l.Description, formatAmount(l.Amount), formatAmount(l.Balance))
+	}
+	fmt.Fprintf(tw, "%s\tClosing balance\t\t%s\t\n", st.To.AddDate(0, 0, -1).Format(time.DateOnly), formatAmount(st.ClosingBalance))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nInterest paid: %s\n", formatAmount(st.InterestPaid))
+	return err
+}
+
+// statementFormat picks json, csv or text from the format query parameter,
+// falling back to the Accept header.
+func statementFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "text/plain"):
+		return "text"
+	}
+	return "json"
+}
+
+func (s *APIServer) handleGetStatement(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	period := mux.Vars(r)["period"]
+	st, err := BuildStatement(s.storage(r), id, period)
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("statement-%d-%s", id, period)
+	switch statementFormat(r) {
+	case "json":
+		return WriteJSON(w, http.StatusOK, st)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".csv"))
+		return st.WriteCSV(w)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".txt"))
+		return st.WriteText(w)
+	}
+	return fmt.Errorf("unknown statement format %s", statementFormat(r))
+}
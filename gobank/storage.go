@@ -0,0 +1,2040 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is wrapped by the errors for records that don't exist.
+	ErrNotFound          = errors.New("not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrAccountFrozen     = errors.New("account frozen")
+	ErrScheduleStale     = errors.New("scheduled transfer has already moved on")
+	ErrInterestStale     = errors.New("interest has already been applied")
+	ErrVersionConflict   = errors.New("version conflict")
+	ErrCustomerRejected  = errors.New("customer failed identity checks")
+)
+
+type Storage interface {
+	// CreateAccount fails if the account's number is taken.
+	CreateAccount(*Account) error
+	GetAccountByID(int) (*Account, error)
+	GetAccountByNumber(int64) (*Account, error)
+	GetAccounts() ([]*Account, error)
+	// ListAccounts returns one page of the accounts matching q.
+	ListAccounts(q *AccountQuery) (*AccountPage, error)
+	// SetAccountStatus and PatchAccount only change the account if it is
+	// still at version ifVersion. Zero skips the check. SetAccountStatus
+	// also only moves an account that is in status from, if one is given.
+	SetAccountStatus(id int, from, to AccountStatus, ifVersion int) (*AccountChange, error)
+	PatchAccount(id int, p *AccountPatch, ifVersion int) (*AccountChange, error)
+	// EraseAccount erases the holder of a closed account: their customer's
+	// names and contact details, and the names on every one of their
+	// accounts and in the events and webhook deliveries about them, are
+	// replaced with the given pseudonyms. All of the customer's accounts must
+	// be closed. Balances and the ledger are left as they are. The data keys
+	// of the customer and of the accounts are deleted. It returns every
+	// account it erased, the given one first.
+	EraseAccount(id int, firstName, lastName string, now time.Time) ([]*Account, error)
+	// SubjectKey returns the data key kept for a data subject, as stored.
+	// PutSubjectKey stores key for a subject that has none and returns the
+	// key the subject ends up with.
+	SubjectKey(subject string) ([]byte, error)
+	PutSubjectKey(subject string, key []byte) ([]byte, error)
+	// OnAccountChange registers f to be called with the ID of every account
+	// that changes. f runs with the store locked and must not call back into
+	// it.
+	OnAccountChange(f func(id int))
+	Transfer(from, to int, amount int64) (*Transaction, Changes, error)
+	GetTransactions(accountID int) ([]*Transaction, error)
+
+	// CreateCustomer fails if the owner is already a customer.
+	CreateCustomer(*Customer) error
+	GetCustomer(int) (*Customer, error)
+	// GetCustomers lists the customer that is owner, or every customer when
+	// owner is empty.
+	GetCustomers(owner string) ([]*Customer, error)
+	// PatchCustomer only changes the customer if it is still at version
+	// ifVersion. New names are copied onto the customer's accounts, which
+	// only ever carry their customer's names, and the accounts renamed are
+	// returned as changes.
+	PatchCustomer(id int, p *CustomerPatch, ifVersion int, now time.Time) (*Customer, Changes, error)
+	// CreatePayee fails if the customer already has a payee with the same
+	// account number.
+	CreatePayee(*Payee) error
+	GetPayee(int) (*Payee, error)
+	GetPayees(customerID int) ([]*Payee, error)
+	DeletePayee(int) error
+
+	CreateScheduledTransfer(*ScheduledTransfer) error
+	GetScheduledTransfer(int) (*ScheduledTransfer, error)
+	GetScheduledTransfers(accountID int) ([]*ScheduledTransfer, error)
+	CancelScheduledTransfer(int) (*ScheduledTransfer, error)
+	DueScheduledTransfers(now time.Time) ([]*ScheduledTransfer, error)
+	// ExecuteScheduledTransfer posts the given occurrence of a schedule and
+	// advances it in one step, so an occurrence is never posted twice.
+	ExecuteScheduledTransfer(id, occurrence int, now time.Time) (*Transaction, Changes, error)
+	// RecordScheduledTransferFailure notes a failed occurrence. A nil retryAt
+	// gives up on the occurrence.
+	RecordScheduledTransferFailure(id, occurrence int, f ScheduleFailure, retryAt *time.Time) error
+
+	// BalanceAt returns what the account's balance was just before t.
+	BalanceAt(accountID int, t time.Time) (int64, error)
+	GetInterestState(accountID int) (*InterestState, error)
+	// AccrueInterest adds a day's interest. Days must be accrued in order.
+	AccrueInterest(accountID int, day time.Time, micros int64) error
+	// PostInterest pays amount into the account for the month period, once.
+	// No transaction is posted when amount is zero.
+	PostInterest(accountID int, period string, amount int64, now time.Time) (*Transaction, Changes, error)
+
+	CreateWebhook(*Webhook) error
+	GetWebhook(int) (*Webhook, error)
+	// GetWebhooks lists the webhooks registered by owner, or every webhook
+	// when owner is empty.
+	GetWebhooks(owner string) ([]*Webhook, error)
+	DeleteWebhook(int) error
+	DueWebhookDeliveries(now time.Time) ([]*WebhookDelivery, error)
+	GetWebhookDeliveries(webhookID int) ([]*WebhookDelivery, error)
+	// GetAccountWebhookDeliveries lists the deliveries of events about the
+	// account.
+	GetAccountWebhookDeliveries(accountID int) ([]*WebhookDelivery, error)
+	// RecordWebhookAttempt notes an attempt at a delivery. A nil retryAt
+	// finishes the delivery.
+	RecordWebhookAttempt(deliveryID int, a DeliveryAttempt, retryAt *time.Time) error
+
+	// EventsAfter returns up to limit events with a sequence number above seq,
+	// in order. A limit of zero means no limit.
+	EventsAfter(seq, limit int) ([]*Event, error)
+	EventCursor(name string) (int, error)
+	SetEventCursor(name string, seq int) error
+
+	RecordRiskDecision(*RiskDecision) error
+	GetRiskDecision(int) (*RiskDecision, error)
+	// GetRiskDecisions lists held transfers with the given review status.
+	GetRiskDecisions(ReviewStatus) ([]*RiskDecision, error)
+	// GetAccountRiskDecisions lists the decisions on transfers out of the
+	// account.
+	GetAccountRiskDecisions(accountID int) ([]*RiskDecision, error)
+	// ResolveRiskDecision approves or rejects a held transfer. Approving makes
+	// the transfer in the same step.
+	ResolveRiskDecision(id int, status ReviewStatus, reviewer string, now time.Time) (*RiskDecision, Changes, error)
+
+	// PlaceHold sets the hold's amount aside from the account's available
+	// balance.
+	PlaceHold(*Hold) (Changes, error)
+	GetHold(int) (*Hold, error)
+	GetHolds(accountID int) ([]*Hold, error)
+	// CaptureHold posts amount of a pending hold, or all of it when amount is
+	// zero, and releases the rest.
+	CaptureHold(id int, amount int64, now time.Time) (*Hold, Changes, error)
+	ReleaseHold(id int, now time.Time) (*Hold, Changes, error)
+	// ExpireHolds releases every pending hold that has expired by now and
+	// returns them.
+	ExpireHolds(now time.Time) ([]*Hold, Changes, error)
+
+	CreateBatch(*Batch) error
+	GetBatch(int) (*Batch, error)
+	// PendingBatches lists batches that haven't finished, oldest first.
+	PendingBatches() ([]*Batch, error)
+	// GetAccountBatches lists the batches with a transfer out of the account.
+	GetAccountBatches(accountID int) ([]*Batch, error)
+	// ExecuteBatch posts every pending transfer in the batch in one step. If
+	// any of them would fail, none are posted and the failing one is marked.
+	ExecuteBatch(id int, now time.Time) (Changes, error)
+	// ExecuteBatchItem posts one pending transfer of a batch and marks it
+	// succeeded in the same step.
+	ExecuteBatchItem(id, index int, now time.Time) (*Transaction, Changes, error)
+	// RecordBatchItemResult sets the result of a pending transfer in a batch.
+	RecordBatchItemResult(id, index int, status BatchItemStatus, msg string) error
+	// FinishBatch settles the status of a batch whose transfers have all been
+	// tried.
+	FinishBatch(id int, now time.Time) (*Batch, error)
+}
+
+// AccountChange is an account just before and just after an operation changed
+// it. Both are read in the same step as the change, so nothing else can land
+// in between.
+type AccountChange struct {
+	Before, After *Account
+}
+
+// Changes are the accounts an operation changed, by ID. Operations that
+// move money or rename accounts return them for the audit trail.
+type Changes map[int]*AccountChange
+
+// Merge folds later changes into c, keeping the earliest before and the
+// latest after of each account.
+func (c Changes) Merge(later Changes) {
+	for id, ch := range later {
+		if first, ok := c[id]; ok {
+			first.After = ch.After
+		} else {
+			c[id] = &AccountChange{Before: ch.Before, After: ch.After}
+		}
+	}
+}
+
+// ids lists the accounts changed, in order.
+func (c Changes) ids() []int {
+	ids := make([]int, 0, len(c))
+	for id := range c {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// before and after return the account as the operation found and left it,
+// or nil if the operation didn't change it.
+func (c Changes) before(id int) *Account {
+	if ch, ok := c[id]; ok {
+		return ch.Before
+	}
+	return nil
+}
+
+func (c Changes) after(id int) *Account {
+	if ch, ok := c[id]; ok {
+		return ch.After
+	}
+	return nil
+}
+
+// MemoryStore keeps accounts and the ledger in memory. Accounts handed out
+// are copies, so callers can't mutate the store without going through it.
+//
+// A store opened with OpenMemoryStore also writes every change to disk
+// before it returns, to be loaded again on the next start; see journal.go.
+type MemoryStore struct {
+	*memoryState
+	// trace is the traceparent of the span the store is used under, if it is
+	// a view returned by withTrace. Webhook deliveries, scheduled transfers
+	// and batches created through it keep it, so the work they lead to later
+	// can be linked back to the request that asked for it.
+	trace string
+}
+
+// memoryState is what a MemoryStore holds, shared with its views.
+type memoryState struct {
+	mu   sync.Mutex
+	path string
+	// journal is the file changes are appended to, and journalSize and
+	// snapshotSize how much the journal and the snapshot it follows hold.
+	journal      *os.File
+	journalSize  int64
+	snapshotSize int64
+	// written is the hash of each record as last written, to tell which
+	// records a change touched.
+	written  map[string][sha256.Size]byte
+	accounts map[int]*Account
+	// nextID is the next account ID to give out.
+	nextID int
+	// byNumber indexes accounts by their number, and nextNumber is the next
+	// one to give out.
+	byNumber       map[int64]int
+	nextNumber     int64
+	transactions   []*Transaction
+	customers      map[int]*Customer
+	nextCustomerID int
+	payees         map[int]*Payee
+	nextPayeeID    int
+	schedules      map[int]*ScheduledTransfer
+	nextScheduleID int
+	interest       map[int]*InterestState
+	webhooks       map[int]*Webhook
+	nextWebhookID  int
+	deliveries     []*WebhookDelivery
+	events         []*Event
+	eventCursors   map[string]int
+	riskDecisions  []*RiskDecision
+	holds          []*Hold
+	batches        []*Batch
+	// subjectKeys are the data keys the audit log encrypts personal data
+	// with, by data subject.
+	subjectKeys map[string][]byte
+	// held is the total of each account's pending holds.
+	held map[int]int64
+	// changeHooks are called with the ID of each account that changes.
+	changeHooks []func(id int)
+}
+
+// storeSnapshot is the on-disk form of a MemoryStore.
+type storeSnapshot struct {
+	Accounts       map[int]*Account           `json:"accounts"`
+	Transactions   []*Transaction             `json:"transactions"`
+	Customers      map[int]*Customer          `json:"customers"`
+	NextCustomerID int                        `json:"nextCustomerId"`
+	Payees         map[int]*Payee             `json:"payees"`
+	NextPayeeID    int                        `json:"nextPayeeId"`
+	Schedules      map[int]*ScheduledTransfer `json:"schedules"`
+	NextScheduleID int                        `json:"nextScheduleId"`
+	Interest       map[int]*InterestState     `json:"interest"`
+	Webhooks       map[int]*Webhook           `json:"webhooks"`
+	NextWebhookID  int                        `json:"nextWebhookId"`
+	Deliveries     []*WebhookDelivery         `json:"deliveries"`
+	Events         []*Event                   `json:"events"`
+	EventCursors   map[string]int             `json:"eventCursors"`
+	RiskDecisions  []*RiskDecision            `json:"riskDecisions"`
+	Holds          []*Hold                    `json:"holds"`
+	Batches        []*Batch                   `json:"batches"`
+	SubjectKeys    map[string][]byte          `json:"subjectKeys"`
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{memoryState: &memoryState{
+		accounts:     make(map[int]*Account),
+		nextID:       bankAccountID + 1,
+		byNumber:     make(map[int64]int),
+		nextNumber:   firstAccountNumber,
+		customers:    make(map[int]*Customer),
+		payees:       make(map[int]*Payee),
+		schedules:    make(map[int]*ScheduledTransfer),
+		interest:     make(map[int]*InterestState),
+		webhooks:     make(map[int]*Webhook),
+		eventCursors: make(map[string]int),
+		subjectKeys:  make(map[string][]byte),
+		held:         make(map[int]int64),
+	}}
+}
+
+// withTrace returns a view of the store whose deliveries, scheduled transfers
+// and batches are linked to the span with the given traceparent.
+func (s *MemoryStore) withTrace(traceparent string) Storage {
+	return &MemoryStore{memoryState: s.memoryState, trace: traceparent}
+}
+
+// OpenMemoryStore loads the store kept at path, if there is one, and keeps
+// it up to date from then on.
+func OpenMemoryStore(path string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	s.path = path
+	numbered, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if s.journal, err = os.OpenFile(journalPath(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	migrated := s.migrateCustomers()
+	if s.syncCustomerNames() || migrated || numbered {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	// Start from a snapshot of everything, which also drops the end of a
+	// journal cut short by a crash.
+	if s.journalSize > 0 {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// restore replaces the store's data with the snapshot's, and reports whether
+// any account had to be given a number. Callers hold s.mu or have the store
+// to themselves.
+func (s *MemoryStore) restore(snap storeSnapshot) bool {
+	fresh := NewMemoryStore()
+	s.accounts = fresh.accounts
+	s.nextID = fresh.nextID
+	s.byNumber = fresh.byNumber
+	s.nextNumber = fresh.nextNumber
+	s.customers = fresh.customers
+	s.payees = fresh.payees
+	s.schedules = fresh.schedules
+	s.interest = fresh.interest
+	s.webhooks = fresh.webhooks
+	s.eventCursors = fresh.eventCursors
+	s.subjectKeys = fresh.subjectKeys
+	s.held = fresh.held
+	if snap.Accounts != nil {
+		s.accounts = snap.Accounts
+	}
+	if snap.Customers != nil {
+		s.customers = snap.Customers
+	}
+	if snap.Payees != nil {
+		s.payees = snap.Payees
+	}
+	if snap.Schedules != nil {
+		s.schedules = snap.Schedules
+	}
+	if snap.Interest != nil {
+		s.interest = snap.Interest
+	}
+	if snap.Webhooks != nil {
+		s.webhooks = snap.Webhooks
+	}
+	if snap.EventCursors != nil {
+		s.eventCursors = snap.EventCursors
+	}
+	if snap.SubjectKeys != nil {
+		s.subjectKeys = snap.SubjectKeys
+	}
+	s.transactions = snap.Transactions
+	s.nextCustomerID = snap.NextCustomerID
+	s.nextPayeeID = snap.NextPayeeID
+	s.nextScheduleID = snap.NextScheduleID
+	s.nextWebhookID = snap.NextWebhookID
+	s.deliveries = snap.Deliveries
+	s.events = snap.Events
+	s.riskDecisions = snap.RiskDecisions
+	s.holds = snap.Holds
+	s.batches = snap.Batches
+	for _, h := range s.holds {
+		if h.Status == HoldPending {
+			s.held[h.AccountID] += h.Amount
+		}
+	}
+	// Snapshots from before holds and versions existed have neither an
+	// available balance nor a version.
+	for _, acc := range s.accounts {
+		s.syncAvailable(acc)
+		if acc.Version == 0 {
+			acc.Version = 1
+		}
+	}
+	return s.indexNumbers()
+}
+
+// indexNumbers builds the index of account numbers, giving a number to any
+// account from a snapshot that doesn't have one, or whose number another
+// account already has. It reports whether any account was numbered. Callers
+// hold s.mu or have the store to themselves.
+func (s *MemoryStore) indexNumbers() bool {
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, acc := range s.accounts {
+		accounts = append(accounts, acc)
+		if acc.Number >= s.nextNumber {
+			s.nextNumber = acc.Number + 1
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	numbered := false
+	for _, acc := range accounts {
+		if _, taken := s.byNumber[acc.Number]; acc.Number <= 0 || taken {
+			acc.Number = s.allocateNumber()
+			numbered = true
+		}
+		s.byNumber[acc.Number] = acc.ID
+	}
+	return numbered
+}
+
+// allocateID gives out the next unused account ID, which is never the bank's
+// own. Callers hold s.mu.
+func (s *MemoryStore) allocateID() int {
+	for {
+		id := s.nextID
+		s.nextID++
+		if _, taken := s.accounts[id]; !taken {
+			return id
+		}
+	}
+}
+
+// allocateNumber gives out the next unused account number. Callers hold s.mu.
+func (s *MemoryStore) allocateNumber() int64 {
+	for {
+		n := s.nextNumber
+		s.nextNumber++
+		if _, taken := s.byNumber[n]; !taken {
+			return n
+		}
+	}
+}
+
+// migrateCustomers gives accounts from snapshots that predate customers to a
+// customer for their owner, made from the owner's oldest account. It reports
+// whether any account was moved. Callers hold s.mu or have the store to
+// themselves.
+func (s *MemoryStore) migrateCustomers() bool {
+	legacy := []*Account{}
+	for _, acc := range s.accounts {
+		if acc.CustomerID == 0 && acc.Owner != "" {
+			legacy = append(legacy, acc)
+		}
+	}
+	sort.Slice(legacy, func(i, j int) bool {
+		a, b := legacy[i], legacy[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.ID < b.ID
+	})
+	for _, acc := range legacy {
+		acc.CustomerID = s.customerOf(acc).ID
+	}
+	return len(legacy) > 0
+}
+
+// syncCustomerNames puts each customer's names back on their accounts where
+// they were edited on the account alone, as they could be before customers
+// were the only place names are kept. It reports whether any account changed.
+// Callers hold s.mu or have the store to themselves.
+func (s *MemoryStore) syncCustomerNames() bool {
+	synced := false
+	for _, acc := range s.accounts {
+		c, ok := s.customers[acc.CustomerID]
+		if !ok || acc.ErasedAt != nil {
+			continue
+		}
+		if acc.FirstName != c.FirstName || acc.LastName != c.LastName {
+			acc.FirstName, acc.LastName = c.FirstName, c.LastName
+			acc.Version++
+			synced = true
+		}
+	}
+	return synced
+}
+
+// customerOf returns the customer that owns acc, creating one from the
+// account's names if the owner isn't a customer yet. Callers hold s.mu.
+func (s *MemoryStore) customerOf(acc *Account) *Customer {
+	if c := s.customerByOwner(acc.Owner); c != nil {
+		return c
+	}
+	s.nextCustomerID++
+	c := &Customer{
+		ID:        s.nextCustomerID,
+		Owner:     acc.Owner,
+		FirstName: acc.FirstName,
+		LastName:  acc.LastName,
+		KYCStatus: KYCPending,
+		Version:   1,
+		CreatedAt: acc.CreatedAt,
+		UpdatedAt: acc.CreatedAt,
+	}
+	s.customers[c.ID] = c
+	return c
+}
+
+// customerByOwner finds the customer that is owner. Callers hold s.mu.
+func (s *MemoryStore) customerByOwner(owner string) *Customer {
+	for _, c := range s.customers {
+		if c.Owner == owner {
+			return c
+		}
+	}
+	return nil
+}
+
+// snapshot gathers the store's data for saving. The caller holds s.mu.
+func (s *MemoryStore) snapshot() storeSnapshot {
+	return storeSnapshot{
+		Accounts:       s.accounts,
+		Transactions:   s.transactions,
+		Customers:      s.customers,
+		NextCustomerID: s.nextCustomerID,
+		Payees:         s.payees,
+		NextPayeeID:    s.nextPayeeID,
+		Schedules:      s.schedules,
+		NextScheduleID: s.nextScheduleID,
+		Interest:       s.interest,
+		Webhooks:       s.webhooks,
+		NextWebhookID:  s.nextWebhookID,
+		Deliveries:     s.deliveries,
+		Events:         s.events,
+		EventCursors:   s.eventCursors,
+		RiskDecisions:  s.riskDecisions,
+		Holds:          s.holds,
+		Batches:        s.batches,
+		SubjectKeys:    s.subjectKeys,
+	}
+}
+
+func (s *MemoryStore) CreateAccount(acc *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Accounts get their ID from the store unless they bring one of their
+	// own, as imported ones do.
+	switch {
+	case acc.ID == 0:
+		acc.ID = s.allocateID()
+	case acc.ID < 0:
+		return fmt.Errorf("invalid account id %d", acc.ID)
+	default:
+		if _, ok := s.accounts[acc.ID]; ok {
+			return fmt.Errorf("account %d already exists", acc.ID)
+		}
+	}
+	// Accounts are numbered by the store unless they bring a number of their
+	// own, as imported ones do.
+	switch {
+	case acc.Number == 0:
+		acc.Number = s.allocateNumber()
+	case acc.Number < 0:
+		return fmt.Errorf("invalid account number %d", acc.Number)
+	default:
+		if _, taken := s.byNumber[acc.Number]; taken {
+			return fmt.Errorf("account number %d is taken", acc.Number)
+		}
+		if acc.Number >= s.nextNumber {
+			s.nextNumber = acc.Number + 1
+		}
+	}
+	var c *Customer
+	switch {
+	case acc.CustomerID != 0:
+		var ok bool
+		if c, ok = s.customers[acc.CustomerID]; !ok {
+			return fmt.Errorf("customer %d %w", acc.CustomerID, ErrNotFound)
+		}
+		if c.Owner != acc.Owner {
+			return fmt.Errorf("account owner %s is not customer %d", acc.Owner, c.ID)
+		}
+	case acc.Owner != "":
+		c = s.customerOf(acc)
+		acc.CustomerID = c.ID
+	}
+	// The account is in its customer's name, whatever it was opened with.
+	if c != nil {
+		if c.ErasedAt != nil {
+			return fmt.Errorf("customer %d has been erased", c.ID)
+		}
+		if c.KYCStatus == KYCRejected {
+			return fmt.Errorf("%w: customer %d", ErrCustomerRejected, c.ID)
+		}
+		acc.FirstName, acc.LastName = c.FirstName, c.LastName
+	}
+	acc.Version = 1
+	acc.Available = acc.Balance
+	a := *acc
+	s.accounts[acc.ID] = &a
+	s.byNumber[a.Number] = a.ID
+	if err := s.appendEvent(EventAccountCreated, &a, a.CreatedAt, &a); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *MemoryStore) GetAccountByID(id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", id, ErrNotFound)
+	}
+	a := *acc
+	return &a, nil
+}
+
+func (s *MemoryStore) GetAccountByNumber(number int64) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, err := s.accountByNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	a := *acc
+	return &a, nil
+}
+
+// accountByNumber finds an account by its number. Callers hold s.mu.
+func (s *MemoryStore) accountByNumber(number int64) (*Account, error) {
+	if id, ok := s.byNumber[number]; ok {
+		return s.accounts[id], nil
+	}
+	return nil, fmt.Errorf("account number %d %w", number, ErrNotFound)
+}
+
+func (s *MemoryStore) GetAccounts() ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, acc := range s.accounts {
+		a := *acc
+		accounts = append(accounts, &a)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts, nil
+}
+
+// ListAccounts filters in one pass and only sorts what matched. There is no
+// index to seek to the cursor, so each page costs a scan of every account.
+func (s *MemoryStore) ListAccounts(q *AccountQuery) (*AccountPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var after *Account
+	if q.After != nil {
+		after = q.After.account()
+	}
+	total := 0
+	matched := []*Account{}
+	for _, acc := range s.accounts {
+		if !q.matches(acc) {
+			continue
+		}
+		total++
+		if after == nil || q.compare(acc, after) > 0 {
+			matched = append(matched, acc)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return q.compare(matched[i], matched[j]) < 0 })
+
+	page := &AccountPage{Accounts: []*Account{}}
+	for i, acc := range matched {
+		if i == q.Limit {
+			page.NextCursor = newAccountCursor(q, page.Accounts[i-1]).Encode()
+			break
+		}
+		a := *acc
+		page.Accounts = append(page.Accounts, &a)
+	}
+	if q.IncludeTotal {
+		page.Total = &total
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) CreateCustomer(c *Customer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing := s.customerByOwner(c.Owner); existing != nil {
+		return fmt.Errorf("%s is already customer %d", c.Owner, existing.ID)
+	}
+	s.nextCustomerID++
+	c.ID = s.nextCustomerID
+	c.Version = 1
+	cust := *c
+	s.customers[c.ID] = &cust
+	return s.save()
+}
+
+func (s *MemoryStore) GetCustomer(id int) (*Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.customers[id]
+	if !ok {
+		return nil, fmt.Errorf("customer %d %w", id, ErrNotFound)
+	}
+	cust := *c
+	return &cust, nil
+}
+
+func (s *MemoryStore) GetCustomers(owner string) ([]*Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	customers := []*Customer{}
+	for _, c := range s.customers {
+		if owner == "" || c.Owner == owner {
+			cust := *c
+			customers = append(customers, &cust)
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool { return customers[i].ID < customers[j].ID })
+	return customers, nil
+}
+
+func (s *MemoryStore) PatchCustomer(id int, p *CustomerPatch, ifVersion int, now time.Time) (*Customer, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.customers[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("customer %d %w", id, ErrNotFound)
+	}
+	if ifVersion != 0 && c.Version != ifVersion {
+		return nil, nil, fmt.Errorf("%w: customer %d is at version %d", ErrVersionConflict, id, c.Version)
+	}
+	if c.ErasedAt != nil {
+		return nil, nil, fmt.Errorf("customer %d has been erased", id)
+	}
+	p.apply(c)
+	c.Version++
+	c.UpdatedAt = now
+	changes := Changes{}
+	if p.renames() {
+		for _, acc := range s.accountsOf(id) {
+			s.note(changes, acc.ID)
+			acc.FirstName, acc.LastName = c.FirstName, c.LastName
+			s.touch(acc)
+			a := *acc
+			if err := s.appendEvent(EventAccountUpdated, &a, now, &a); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	cust := *c
+	return &cust, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) CreatePayee(p *Payee) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.customers[p.CustomerID]; !ok {
+		return fmt.Errorf("customer %d %w", p.CustomerID, ErrNotFound)
+	}
+	for _, existing := range s.payees {
+		if existing.CustomerID == p.CustomerID && existing.AccountNumber == p.AccountNumber {
+			return fmt.Errorf("account number %d is already payee %d", p.AccountNumber, existing.ID)
+		}
+	}
+	s.nextPayeeID++
+	p.ID = s.nextPayeeID
+	payee := *p
+	s.payees[p.ID] = &payee
+	return s.save()
+}
+
+func (s *MemoryStore) GetPayee(id int) (*Payee, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payees[id]
+	if !ok {
+		return nil, fmt.Errorf("payee %d %w", id, ErrNotFound)
+	}
+	payee := *p
+	return &payee, nil
+}
+
+func (s *MemoryStore) GetPayees(customerID int) ([]*Payee, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payees := []*Payee{}
+	for _, p := range s.payees {
+		if p.CustomerID == customerID {
+			payee := *p
+			payees = append(payees, &payee)
+		}
+	}
+	sort.Slice(payees, func(i, j int) bool { return payees[i].ID < payees[j].ID })
+	return payees, nil
+}
+
+func (s *MemoryStore) DeletePayee(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.payees[id]; !ok {
+		return fmt.Errorf("payee %d %w", id, ErrNotFound)
+	}
+	delete(s.payees, id)
+	return s.save()
+}
+
+func (s *MemoryStore) SetAccountStatus(id int, from, to AccountStatus, ifVersion int) (*AccountChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, err := s.accountAt(id, ifVersion)
+	if err != nil {
+		return nil, err
+	}
+	if from != "" && acc.Status != from {
+		return nil, fmt.Errorf("account %d is %s, not %s", id, acc.Status, from)
+	}
+	before := *acc
+	if err := acc.Transition(to); err != nil {
+		return nil, err
+	}
+	s.touch(acc)
+	a := *acc
+	if err := s.appendEvent(statusEvents[to], &a, time.Now().UTC(), &a); err != nil {
+		return nil, err
+	}
+	return &AccountChange{Before: &before, After: &a}, s.save()
+}
+
+func (s *MemoryStore) PatchAccount(id int, p *AccountPatch, ifVersion int) (*AccountChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, err := s.accountAt(id, ifVersion)
+	if err != nil {
+		return nil, err
+	}
+	if acc.ErasedAt != nil {
+		return nil, fmt.Errorf("account %d has been erased", id)
+	}
+	before := *acc
+	p.apply(acc)
+	s.touch(acc)
+	a := *acc
+	if err := s.appendEvent(EventAccountUpdated, &a, time.Now().UTC(), &a); err != nil {
+		return nil, err
+	}
+	return &AccountChange{Before: &before, After: &a}, s.save()
+}
+
+// accountAt returns the account if it is still at version ifVersion, or at
+// any version when ifVersion is zero. Callers hold s.mu.
+func (s *MemoryStore) accountAt(id, ifVersion int) (*Account, error) {
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", id, ErrNotFound)
+	}
+	if ifVersion != 0 && acc.Version != ifVersion {
+		return nil, fmt.Errorf("%w: account %d is at version %d", ErrVersionConflict, id, acc.Version)
+	}
+	return acc, nil
+}
+
+func (s *MemoryStore) Transfer(from, to int, amount int64) (*Transaction, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := Changes{}
+	s.note(changes, from, to)
+	tx, err := s.transfer(from, to, amount, time.Now().UTC())
+	if err != nil {
+		return nil, nil, err
+	}
+	t := *tx
+	return &t, s.settle(changes), s.save()
+}
+
+// sameCurrency checks that money can move between two accounts, which it
+// only can if they hold the same currency.
+func sameCurrency(src, dst *Account) error {
+	if src.Currency != dst.Currency {
+		return fmt.Errorf("cannot transfer from %s to %s", src.Currency, dst.Currency)
+	}
+	return nil
+}
+
+// transfer moves money between two accounts and posts it to the ledger.
+// Callers hold s.mu.
+func (s *MemoryStore) transfer(from, to int, amount int64, now time.Time) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("transfer amount must be positive")
+	}
+	if from == to {
+		return nil, fmt.Errorf("cannot transfer to the same account")
+	}
+	src, ok := s.accounts[from]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", from, ErrNotFound)
+	}
+	dst, ok := s.accounts[to]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", to, ErrNotFound)
+	}
+	for _, acc := range []*Account{src, dst} {
+		if acc.Status == StatusFrozen {
+			return nil, fmt.Errorf("%w: %d", ErrAccountFrozen, acc.ID)
+		}
+		if acc.Status != StatusActive {
+			return nil, fmt.Errorf("account %d is %s", acc.ID, acc.Status)
+		}
+	}
+	if err := sameCurrency(src, dst); err != nil {
+		return nil, err
+	}
+	if err := s.checkCustomer(src); err != nil {
+		return nil, err
+	}
+	if src.Balance-s.held[from] < amount {
+		return nil, fmt.Errorf("%w in account %d", ErrInsufficientFunds, from)
+	}
+
+	src.Balance -= amount
+	dst.Balance += amount
+	s.touch(src)
+	s.touch(dst)
+	tx := &Transaction{
+		ID:          len(s.transactions) + 1,
+		Kind:        KindTransfer,
+		FromAccount: from,
+		ToAccount:   to,
+		Amount:      amount,
+		CreatedAt:   now,
+	}
+	s.transactions = append(s.transactions, tx)
+	if err := s.appendEvent(EventTransferComplete, tx, now, src, dst); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *MemoryStore) GetTransactions(accountID int) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	txs := []*Transaction{}
+	for _, tx := range s.transactions {
+		if tx.FromAccount == accountID || tx.ToAccount == accountID {
+			t := *tx
+			txs = append(txs, &t)
+		}
+	}
+	return txs, nil
+}
+
+func (s *MemoryStore) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range []int{st.FromAccount, st.ToAccount} {
+		if _, ok := s.accounts[id]; !ok {
+			return fmt.Errorf("account %d %w", id, ErrNotFound)
+		}
+	}
+	s.nextScheduleID++
+	st.ID = s.nextScheduleID
+	st.Traceparent = s.trace
+	s.schedules[st.ID] = st.clone()
+	return s.save()
+}
+
+func (s *MemoryStore) GetScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.schedules[id]
+	if !ok {
+		return nil, fmt.Errorf("scheduled transfer %d %w", id, ErrNotFound)
+	}
+	return st.clone(), nil
+}
+
+func (s *MemoryStore) GetScheduledTransfers(accountID int) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	schedules := []*ScheduledTransfer{}
+	for id := 1; id <= s.nextScheduleID; id++ {
+		if st, ok := s.schedules[id]; ok && st.FromAccount == accountID {
+			schedules = append(schedules, st.clone())
+		}
+	}
+	return schedules, nil
+}
+
+func (s *MemoryStore) CancelScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.schedules[id]
+	if !ok {
+		return nil, fmt.Errorf("scheduled transfer %d %w", id, ErrNotFound)
+	}
+	if st.Status != ScheduleActive {
+		return nil, fmt.Errorf("scheduled transfer %d is %s", id, st.Status)
+	}
+	st.Status = ScheduleCancelled
+	st.RetryAt = nil
+	return st.clone(), s.save()
+}
+
+func (s *MemoryStore) DueScheduledTransfers(now time.Time) ([]*ScheduledTransfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*ScheduledTransfer{}
+	for id := 1; id <= s.nextScheduleID; id++ {
+		if st, ok := s.schedules[id]; ok && st.Status == ScheduleActive && !st.dueAt().After(now) {
+			due = append(due, st.clone())
+		}
+	}
+	return due, nil
+}
+
+func (s *MemoryStore) ExecuteScheduledTransfer(id, occurrence int, now time.Time) (*Transaction, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.schedules[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("scheduled transfer %d %w", id, ErrNotFound)
+	}
+	if st.Status != ScheduleActive || st.Occurrence != occurrence {
+		return nil, nil, ErrScheduleStale
+	}
+	changes := Changes{}
+	s.note(changes, st.FromAccount, st.ToAccount)
+	tx, err := s.transfer(st.FromAccount, st.ToAccount, st.Amount, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	st.LastRun = &now
+	st.advance()
+
+	t := *tx
+	return &t, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) RecordScheduledTransferFailure(id, occurrence int, f ScheduleFailure, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.schedules[id]
+	if !ok {
+		return fmt.Errorf("scheduled transfer %d %w", id, ErrNotFound)
+	}
+	if st.Status != ScheduleActive || st.Occurrence != occurrence {
+		return ErrScheduleStale
+	}
+	st.recordFailure(f, retryAt)
+	return s.save()
+}
+
+func (s *MemoryStore) BalanceAt(accountID int, t time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[accountID]
+	if !ok {
+		return 0, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	balance := acc.Balance
+	for i := len(s.transactions) - 1; i >= 0; i-- {
+		tx := s.transactions[i]
+		if tx.CreatedAt.Before(t) {
+			continue
+		}
+		if tx.FromAccount == accountID {
+			balance += tx.Amount
+		}
+		if tx.ToAccount == accountID {
+			balance -= tx.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (s *MemoryStore) GetInterestState(accountID int) (*InterestState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	state := InterestState{}
+	if st, ok := s.interest[accountID]; ok {
+		state = *st
+	}
+	return &state, nil
+}
+
+func (s *MemoryStore) AccrueInterest(accountID int, day time.Time, micros int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	state, ok := s.interest[accountID]
+	if !ok {
+		state = &InterestState{}
+		s.interest[accountID] = state
+	}
+	if state.AccruedThrough != nil && !day.Equal(state.AccruedThrough.AddDate(0, 0, 1)) {
+		return ErrInterestStale
+	}
+	state.AccruedMicros += micros
+	state.AccruedThrough = &day
+	return s.save()
+}
+
+func (s *MemoryStore) PostInterest(accountID int, period string, amount int64, now time.Time) (*Transaction, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[accountID]
+	if !ok {
+		return nil, nil, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	if acc.Status != StatusActive || acc.ErasedAt != nil {
+		return nil, nil, fmt.Errorf("account %d is %s", accountID, acc.Status)
+	}
+	state, ok := s.interest[accountID]
+	if !ok {
+		state = &InterestState{}
+		s.interest[accountID] = state
+	}
+	if period <= state.LastPosted {
+		return nil, nil, ErrInterestStale
+	}
+	state.LastPosted = period
+	if amount == 0 {
+		return nil, Changes{}, s.save()
+	}
+
+	changes := Changes{}
+	s.note(changes, accountID)
+	state.AccruedMicros -= amount * microsPerUnit
+	acc.Balance += amount
+	s.touch(acc)
+	tx := &Transaction{
+		ID:          len(s.transactions) + 1,
+		Kind:        KindInterest,
+		FromAccount: bankAccountID,
+		ToAccount:   accountID,
+		Amount:      amount,
+		CreatedAt:   now,
+	}
+	s.transactions = append(s.transactions, tx)
+	if err := s.appendEvent(EventInterestPosted, tx, now, acc); err != nil {
+		return nil, nil, err
+	}
+
+	t := *tx
+	return &t, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) CreateWebhook(wh *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextWebhookID++
+	wh.ID = s.nextWebhookID
+	w := *wh
+	s.webhooks[wh.ID] = &w
+	return s.save()
+}
+
+func (s *MemoryStore) GetWebhook(id int) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wh, ok := s.webhooks[id]
+	if !ok {
+		return nil, fmt.Errorf("webhook %d %w", id, ErrNotFound)
+	}
+	w := *wh
+	return &w, nil
+}
+
+func (s *MemoryStore) GetWebhooks(owner string) ([]*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks := []*Webhook{}
+	for id := 1; id <= s.nextWebhookID; id++ {
+		if wh, ok := s.webhooks[id]; ok && (owner == "" || wh.Owner == owner) {
+			w := *wh
+			webhooks = append(webhooks, &w)
+		}
+	}
+	return webhooks, nil
+}
+
+func (s *MemoryStore) DeleteWebhook(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[id]; !ok {
+		return fmt.Errorf("webhook %d %w", id, ErrNotFound)
+	}
+	delete(s.webhooks, id)
+	for _, d := range s.deliveries {
+		if d.WebhookID == id && d.Status == DeliveryPending {
+			d.Status = DeliveryFailed
+		}
+	}
+	return s.save()
+}
+
+func (s *MemoryStore) DueWebhookDeliveries(now time.Time) ([]*WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d.clone())
+		}
+	}
+	return due, nil
+}
+
+func (s *MemoryStore) GetWebhookDeliveries(webhookID int) ([]*WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := []*WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, d.clone())
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) GetAccountWebhookDeliveries(accountID int) ([]*WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	about := map[string]bool{}
+	for _, e := range s.events {
+		if e.concerns(accountID) {
+			about[e.ID] = true
+		}
+	}
+	deliveries := []*WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if about[d.EventID] {
+			deliveries = append(deliveries, d.clone())
+		}
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) RecordWebhookAttempt(deliveryID int, a DeliveryAttempt, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if deliveryID < 1 || deliveryID > len(s.deliveries) {
+		return fmt.Errorf("webhook delivery %d %w", deliveryID, ErrNotFound)
+	}
+	d := s.deliveries[deliveryID-1]
+	if d.Status != DeliveryPending {
+		return fmt.Errorf("webhook delivery %d is %s", deliveryID, d.Status)
+	}
+	d.Attempts = append(d.Attempts, a)
+	switch {
+	case a.StatusCode/100 == 2:
+		d.Status = DeliveryDelivered
+	case retryAt != nil:
+		d.NextAttemptAt = *retryAt
+	default:
+		d.Status = DeliveryFailed
+	}
+	return s.save()
+}
+
+// appendEvent records a domain event along with the change that raised it,
+// and queues it for every webhook that wants it. Callers hold s.mu.
+func (s *MemoryStore) appendEvent(typ string, data any, now time.Time, accounts ...*Account) error {
+	e, err := newEvent(typ, data, now, accounts...)
+	if err != nil {
+		return err
+	}
+	e.Seq = len(s.events) + 1
+	s.events = append(s.events, e)
+
+	for id := 1; id <= s.nextWebhookID; id++ {
+		wh, ok := s.webhooks[id]
+		if !ok || !wh.wants(e) {
+			continue
+		}
+		d, err := newWebhookDelivery(wh, e)
+		if err != nil {
+			return err
+		}
+		d.ID = len(s.deliveries) + 1
+		d.Traceparent = s.trace
+		s.deliveries = append(s.deliveries, d)
+	}
+	return nil
+}
+
+func (s *MemoryStore) EventsAfter(seq, limit int) ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq < 0 {
+		seq = 0
+	}
+	if seq > len(s.events) {
+		seq = len(s.events)
+	}
+	events := s.events[seq:]
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return append([]*Event{}, events...), nil
+}
+
+func (s *MemoryStore) EventCursor(name string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.eventCursors[name], nil
+}
+
+func (s *MemoryStore) SetEventCursor(name string, seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.eventCursors[name] = seq
+	return s.save()
+}
+
+func (s *MemoryStore) RecordRiskDecision(d *RiskDecision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d.ID = len(s.riskDecisions) + 1
+	c := *d
+	c.Reasons = append([]string{}, d.Reasons...)
+	s.riskDecisions = append(s.riskDecisions, &c)
+	return s.save()
+}
+
+func (s *MemoryStore) GetRiskDecision(id int) (*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.riskDecisions) {
+		return nil, fmt.Errorf("risk decision %d %w", id, ErrNotFound)
+	}
+	d := *s.riskDecisions[id-1]
+	return &d, nil
+}
+
+func (s *MemoryStore) GetRiskDecisions(status ReviewStatus) ([]*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decisions := []*RiskDecision{}
+	for _, d := range s.riskDecisions {
+		if d.Review == status {
+			c := *d
+			decisions = append(decisions, &c)
+		}
+	}
+	return decisions, nil
+}
+
+func (s *MemoryStore) GetAccountRiskDecisions(accountID int) ([]*RiskDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	decisions := []*RiskDecision{}
+	for _, d := range s.riskDecisions {
+		if d.FromAccount == accountID {
+			c := *d
+			decisions = append(decisions, &c)
+		}
+	}
+	return decisions, nil
+}
+
+func (s *MemoryStore) ResolveRiskDecision(id int, status ReviewStatus, reviewer string, now time.Time) (*RiskDecision, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.riskDecisions) {
+		return nil, nil, fmt.Errorf("risk decision %d %w", id, ErrNotFound)
+	}
+	d := s.riskDecisions[id-1]
+	if d.Review != ReviewPending {
+		return nil, nil, fmt.Errorf("transfer %d is not awaiting review", id)
+	}
+	changes := Changes{}
+	if status == ReviewApproved {
+		s.note(changes, d.FromAccount, d.ToAccount)
+		tx, err := s.transfer(d.FromAccount, d.ToAccount, d.Amount, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.TransactionID = tx.ID
+	}
+	d.Review = status
+	d.ReviewedBy = reviewer
+	d.ReviewedAt = &now
+
+	c := *d
+	return &c, s.settle(changes), s.save()
+}
+
+// note copies the accounts into c as they are before a change, unless c
+// already has them. Callers hold s.mu.
+func (s *MemoryStore) note(c Changes, ids ...int) {
+	for _, id := range ids {
+		acc, ok := s.accounts[id]
+		if _, seen := c[id]; seen || !ok {
+			continue
+		}
+		a := *acc
+		c[id] = &AccountChange{Before: &a}
+	}
+}
+
+// settle copies the noted accounts into c as they are after the change, and
+// drops any the change left alone. Callers hold s.mu.
+func (s *MemoryStore) settle(c Changes) Changes {
+	for id, ch := range c {
+		acc := s.accounts[id]
+		if acc.Version == ch.Before.Version {
+			delete(c, id)
+			continue
+		}
+		a := *acc
+		ch.After = &a
+	}
+	return c
+}
+
+// checkCustomer refuses to let money leave an account whose customer failed
+// identity checks. Callers hold s.mu.
+func (s *MemoryStore) checkCustomer(acc *Account) error {
+	if c, ok := s.customers[acc.CustomerID]; ok && c.KYCStatus == KYCRejected {
+		return fmt.Errorf("%w: account %d belongs to customer %d", ErrCustomerRejected, acc.ID, c.ID)
+	}
+	return nil
+}
+
+// touch notes a change to the account, moving its version on. Callers hold
+// s.mu.
+func (s *MemoryStore) touch(acc *Account) {
+	s.syncAvailable(acc)
+	acc.Version++
+	for _, f := range s.changeHooks {
+		f(acc.ID)
+	}
+}
+
+func (s *MemoryStore) OnAccountChange(f func(id int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changeHooks = append(s.changeHooks, f)
+}
+
+// syncAvailable works out the account's available balance after a change to
+// its balance or holds. Callers hold s.mu.
+func (s *MemoryStore) syncAvailable(acc *Account) {
+	acc.Available = acc.Balance - s.held[acc.ID]
+}
+
+func (s *MemoryStore) PlaceHold(h *Hold) (Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[h.AccountID]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", h.AccountID, ErrNotFound)
+	}
+	dst, ok := s.accounts[h.ToAccount]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", h.ToAccount, ErrNotFound)
+	}
+	if acc.Status == StatusFrozen {
+		return nil, fmt.Errorf("%w: %d", ErrAccountFrozen, acc.ID)
+	}
+	if acc.Status != StatusActive {
+		return nil, fmt.Errorf("account %d is %s", acc.ID, acc.Status)
+	}
+	// A hold that couldn't be captured would only tie the money up.
+	if err := sameCurrency(acc, dst); err != nil {
+		return nil, err
+	}
+	if err := s.checkCustomer(acc); err != nil {
+		return nil, err
+	}
+	if acc.Balance-s.held[acc.ID] < h.Amount {
+		return nil, fmt.Errorf("%w in account %d", ErrInsufficientFunds, acc.ID)
+	}
+
+	changes := Changes{}
+	s.note(changes, acc.ID)
+	h.ID = len(s.holds) + 1
+	c := *h
+	s.holds = append(s.holds, &c)
+	s.held[acc.ID] += h.Amount
+	s.touch(acc)
+	if err := s.appendEvent(EventHoldPlaced, &c, h.CreatedAt, acc, dst); err != nil {
+		return nil, err
+	}
+	return s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) GetHold(id int) (*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.holds) {
+		return nil, fmt.Errorf("hold %d %w", id, ErrNotFound)
+	}
+	h := *s.holds[id-1]
+	return &h, nil
+}
+
+func (s *MemoryStore) GetHolds(accountID int) ([]*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return nil, fmt.Errorf("account %d %w", accountID, ErrNotFound)
+	}
+	holds := []*Hold{}
+	for _, h := range s.holds {
+		if h.AccountID == accountID {
+			c := *h
+			holds = append(holds, &c)
+		}
+	}
+	return holds, nil
+}
+
+func (s *MemoryStore) CaptureHold(id int, amount int64, now time.Time) (*Hold, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.pendingHold(id, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amount == 0 {
+		amount = h.Amount
+	}
+	if amount < 0 || amount > h.Amount {
+		return nil, nil, fmt.Errorf("capture amount must be between 1 and %d", h.Amount)
+	}
+
+	changes := Changes{}
+	s.note(changes, h.AccountID, h.ToAccount)
+	// The hold comes off first so the capture can spend what it set aside.
+	s.held[h.AccountID] -= h.Amount
+	s.syncAvailable(s.accounts[h.AccountID])
+	tx, err := s.transfer(h.AccountID, h.ToAccount, amount, now)
+	if err != nil {
+		s.held[h.AccountID] += h.Amount
+		s.syncAvailable(s.accounts[h.AccountID])
+		return nil, nil, err
+	}
+	tx.Kind = KindCapture
+	tx.HoldID = h.ID
+
+	h.Status = HoldCaptured
+	h.Captured = amount
+	h.TransactionID = tx.ID
+	h.ResolvedAt = &now
+	if err := s.appendEvent(EventHoldCaptured, h, now, s.accounts[h.AccountID], s.accounts[h.ToAccount]); err != nil {
+		return nil, nil, err
+	}
+	c := *h
+	return &c, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) ReleaseHold(id int, now time.Time) (*Hold, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.pendingHold(id, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes := Changes{}
+	s.note(changes, h.AccountID)
+	if err := s.endHold(h, HoldReleased, EventHoldReleased, now); err != nil {
+		return nil, nil, err
+	}
+	c := *h
+	return &c, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) ExpireHolds(now time.Time) ([]*Hold, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := []*Hold{}
+	changes := Changes{}
+	for _, h := range s.holds {
+		if h.Status != HoldPending || h.ExpiresAt.After(now) {
+			continue
+		}
+		s.note(changes, h.AccountID)
+		if err := s.endHold(h, HoldExpired, EventHoldExpired, now); err != nil {
+			return nil, nil, err
+		}
+		c := *h
+		expired = append(expired, &c)
+	}
+	if len(expired) == 0 {
+		return expired, changes, nil
+	}
+	return expired, s.settle(changes), s.save()
+}
+
+// pendingHold returns the hold if it can still be captured or released.
+// Callers hold s.mu.
+func (s *MemoryStore) pendingHold(id int, now time.Time) (*Hold, error) {
+	if id < 1 || id > len(s.holds) {
+		return nil, fmt.Errorf("hold %d %w", id, ErrNotFound)
+	}
+	h := s.holds[id-1]
+	if h.Status == HoldPending && !h.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("hold %d has expired", id)
+	}
+	if h.Status != HoldPending {
+		return nil, fmt.Errorf("hold %d is %s", id, h.Status)
+	}
+	return h, nil
+}
+
+// endHold gives a pending hold's amount back to the account without posting
+// anything. Callers hold s.mu.
+func (s *MemoryStore) endHold(h *Hold, status HoldStatus, event string, now time.Time) error {
+	acc := s.accounts[h.AccountID]
+	s.held[h.AccountID] -= h.Amount
+	s.touch(acc)
+	h.Status = status
+	h.ResolvedAt = &now
+	return s.appendEvent(event, h, now, acc)
+}
+
+func (s *MemoryStore) CreateBatch(b *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b.ID = len(s.batches) + 1
+	b.Traceparent = s.trace
+	s.batches = append(s.batches, b.clone())
+	return s.save()
+}
+
+func (s *MemoryStore) GetBatch(id int) (*Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id < 1 || id > len(s.batches) {
+		return nil, fmt.Errorf("batch %d %w", id, ErrNotFound)
+	}
+	return s.batches[id-1].clone(), nil
+}
+
+func (s *MemoryStore) PendingBatches() ([]*Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := []*Batch{}
+	for _, b := range s.batches {
+		if b.Status == BatchPending || b.Status == BatchRunning {
+			pending = append(pending, b.clone())
+		}
+	}
+	return pending, nil
+}
+
+func (s *MemoryStore) GetAccountBatches(accountID int) ([]*Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batches := []*Batch{}
+	for _, b := range s.batches {
+		for _, item := range b.Items {
+			if item.FromAccount == accountID {
+				batches = append(batches, b.clone())
+				break
+			}
+		}
+	}
+	return batches, nil
+}
+
+func (s *MemoryStore) ExecuteBatch(id int, now time.Time) (Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.runningBatch(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Try the whole batch against scratch balances first, so a failure
+	// leaves nothing behind to undo.
+	balances := map[int]int64{}
+	for _, item := range b.Items {
+		if item.Status != ItemPending {
+			continue
+		}
+		if err := s.checkTransfer(item.FromAccount, item.ToAccount, item.Amount, balances); err != nil {
+			item.Status, item.Error = ItemFailed, err.Error()
+			return Changes{}, s.save()
+		}
+	}
+	// Should a transfer still fail, those before it are undone and the
+	// batch fails on it, as it would have in the check.
+	checkpoint, err := s.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	changes := Changes{}
+	for i, item := range b.Items {
+		if item.Status != ItemPending {
+			continue
+		}
+		s.note(changes, item.FromAccount, item.ToAccount)
+		tx, err := s.transfer(item.FromAccount, item.ToAccount, item.Amount, now)
+		if err != nil {
+			if rerr := s.revert(checkpoint); rerr != nil {
+				return nil, errors.Join(err, fmt.Errorf("undoing the batch: %w", rerr))
+			}
+			b, rerr := s.runningBatch(id)
+			if rerr != nil {
+				return nil, rerr
+			}
+			b.Items[i].Status, b.Items[i].Error = ItemFailed, err.Error()
+			return Changes{}, s.save()
+		}
+		item.Status, item.TransactionID = ItemSucceeded, tx.ID
+	}
+	return s.settle(changes), s.save()
+}
+
+// checkTransfer checks a transfer could be made given the balances changed
+// by earlier transfers in the same batch, and applies it to balances.
+// Callers hold s.mu.
+func (s *MemoryStore) checkTransfer(from, to int, amount int64, balances map[int]int64) error {
+	for _, id := range []int{from, to} {
+		acc, ok := s.accounts[id]
+		if !ok {
+			return fmt.Errorf("account %d %w", id, ErrNotFound)
+		}
+		if acc.Status == StatusFrozen {
+			return fmt.Errorf("%w: %d", ErrAccountFrozen, id)
+		}
+		if acc.Status != StatusActive {
+			return fmt.Errorf("account %d is %s", id, acc.Status)
+		}
+		if _, ok := balances[id]; !ok {
+			balances[id] = acc.Balance - s.held[id]
+		}
+	}
+	if err := sameCurrency(s.accounts[from], s.accounts[to]); err != nil {
+		return err
+	}
+	if err := s.checkCustomer(s.accounts[from]); err != nil {
+		return err
+	}
+	if balances[from] < amount {
+		return fmt.Errorf("%w in account %d", ErrInsufficientFunds, from)
+	}
+	balances[from] -= amount
+	balances[to] += amount
+	return nil
+}
+
+func (s *MemoryStore) ExecuteBatchItem(id, index int, now time.Time) (*Transaction, Changes, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, err := s.pendingBatchItem(id, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes := Changes{}
+	s.note(changes, item.FromAccount, item.ToAccount)
+	tx, err := s.transfer(item.FromAccount, item.ToAccount, item.Amount, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	item.Status, item.TransactionID = ItemSucceeded, tx.ID
+
+	t := *tx
+	return &t, s.settle(changes), s.save()
+}
+
+func (s *MemoryStore) RecordBatchItemResult(id, index int, status BatchItemStatus, msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, err := s.pendingBatchItem(id, index)
+	if err != nil {
+		return err
+	}
+	item.Status, item.Error = status, msg
+	return s.save()
+}
+
+func (s *MemoryStore) FinishBatch(id int, now time.Time) (*Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.runningBatch(id)
+	if err != nil {
+		return nil, err
+	}
+	b.finish(now)
+	return b.clone(), s.save()
+}
+
+// runningBatch returns the batch if it hasn't finished, marking it running.
+// Callers hold s.mu.
+func (s *MemoryStore) runningBatch(id int) (*Batch, error) {
+	if id < 1 || id > len(s.batches) {
+		return nil, fmt.Errorf("batch %d %w", id, ErrNotFound)
+	}
+	b := s.batches[id-1]
+	if b.Status != BatchPending && b.Status != BatchRunning {
+		return nil, fmt.Errorf("batch %d is %s", id, b.Status)
+	}
+	b.Status = BatchRunning
+	return b, nil
+}
+
+// pendingBatchItem returns a transfer in a batch that has no result yet.
+// Callers hold s.mu.
+func (s *MemoryStore) pendingBatchItem(id, index int) (*BatchItem, error) {
+	b, err := s.runningBatch(id)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(b.Items) {
+		return nil, fmt.Errorf("batch %d has no transfer %d", id, index)
+	}
+	item := b.Items[index]
+	if item.Status != ItemPending {
+		return nil, fmt.Errorf("transfer %d of batch %d is %s", index, id, item.Status)
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) EraseAccount(id int, firstName, lastName string, now time.Time) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, fmt.Errorf("account %d %w", id, ErrNotFound)
+	}
+	if acc.ErasedAt != nil {
+		return nil, fmt.Errorf("account %d has already been erased", id)
+	}
+	if acc.Status != StatusClosed {
+		return nil, fmt.Errorf("account %d must be closed before it is erased", id)
+	}
+	// Names live on the customer, so erasing one account erases the customer
+	// and every account that carries their names.
+	accounts := []*Account{acc}
+	if c, ok := s.customers[acc.CustomerID]; ok {
+		accounts = accounts[:0]
+		for _, other := range s.accountsOf(c.ID) {
+			if other.Status != StatusClosed {
+				return nil, fmt.Errorf("account %d of customer %d must be closed before account %d is erased", other.ID, c.ID, id)
+			}
+			if other.ErasedAt == nil {
+				accounts = append(accounts, other)
+			}
+		}
+		c.FirstName, c.LastName = firstName, lastName
+		c.Email, c.Phone = "", ""
+		c.ErasedAt = &now
+		c.Version++
+		c.UpdatedAt = now
+		delete(s.subjectKeys, customerSubject(c.ID))
+	}
+
+	erased := make([]*Account, 0, len(accounts))
+	for _, other := range accounts {
+		a, err := s.eraseAccount(other, firstName, lastName, now)
+		if err != nil {
+			return nil, err
+		}
+		if a.ID == id {
+			erased = append([]*Account{a}, erased...)
+		} else {
+			erased = append(erased, a)
+		}
+	}
+	// The journal still has the names from before, so it is folded into a
+	// new snapshot rather than appended to.
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return erased, s.compact()
+}
+
+func (s *MemoryStore) SubjectKey(subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.subjectKeys[subject]
+	if !ok {
+		return nil, fmt.Errorf("no key for %s", subject)
+	}
+	return append([]byte(nil), key...), nil
+}
+
+func (s *MemoryStore) PutSubjectKey(subject string, key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.subjectKeys[subject]; ok {
+		return append([]byte(nil), existing...), nil
+	}
+	s.subjectKeys[subject] = append([]byte(nil), key...)
+	return key, s.save()
+}
+
+// accountsOf returns the customer's accounts in ID order. Callers hold s.mu.
+func (s *MemoryStore) accountsOf(customerID int) []*Account {
+	var accounts []*Account
+	for _, acc := range s.accounts {
+		if acc.CustomerID == customerID {
+			accounts = append(accounts, acc)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts
+}
+
+// eraseAccount puts the pseudonyms on acc and on the events and deliveries
+// about it, and records its erasure. Callers hold s.mu and save afterwards.
+func (s *MemoryStore) eraseAccount(acc *Account, firstName, lastName string, now time.Time) (*Account, error) {
+	id := acc.ID
+	acc.FirstName, acc.LastName = firstName, lastName
+	acc.ErasedAt = &now
+	s.touch(acc)
+	delete(s.subjectKeys, accountSubject(id))
+
+	// Earlier events carry snapshots of the account. Events are shared with
+	// readers, so changed ones are replaced rather than edited.
+	scrubbed := map[string]*Event{}
+	for i, e := range s.events {
+		if !strings.HasPrefix(e.Type, "account.") || !e.concerns(id) {
+			continue
+		}
+		var snap Account
+		if err := json.Unmarshal(e.Data, &snap); err != nil || snap.ID != id {
+			continue
+		}
+		snap.FirstName, snap.LastName = firstName, lastName
+		b, err := json.Marshal(&snap)
+		if err != nil {
+			return nil, err
+		}
+		c := *e
+		c.Data = b
+		s.events[i] = &c
+		scrubbed[c.ID] = &c
+	}
+	for i, d := range s.deliveries {
+		e, ok := scrubbed[d.EventID]
+		if !ok {
+			continue
+		}
+		payload, err := eventPayload(e)
+		if err != nil {
+			return nil, err
+		}
+		c := d.clone()
+		c.Payload = payload
+		s.deliveries[i] = c
+	}
+
+	a := *acc
+	if err := s.appendEvent(EventAccountErased, &a, now, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
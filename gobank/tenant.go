@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultTenantID is the tenant of a single-bank deployment, and of tokens
+// and certificates that don't name a tenant.
+const defaultTenantID = "default"
+
+// TenantConfig describes one bank hosted on the deployment.
+type TenantConfig struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Hosts are the host names requests for the tenant arrive on.
+	Hosts []string `json:"hosts,omitempty"`
+	// Currencies are those accounts may be opened in; the first is the
+	// default. Without any, accounts have no currency.
+	Currencies []string `json:"currencies,omitempty"`
+	// MaxTransfer caps the amount of any one transfer, scheduled transfer,
+	// batch item or hold. Zero means no cap.
+	MaxTransfer int64 `json:"maxTransfer,omitempty"`
+	// Data, AuditLog and RiskRules are the tenant's files.
+	Data      string `json:"data,omitempty"`
+	AuditLog  string `json:"auditLog,omitempty"`
+	RiskRules string `json:"riskRules,omitempty"`
+}
+
+// Tenant is a bank with its own store, audit log, risk engine and event
+// broker. Tenants share nothing but the process, so a request can only reach
+// the data of the tenant it was resolved to.
+//
+// Isolation comes from each tenant having a Storage of its own rather than
+// from a tenant key on every record and query: a store only ever holds one
+// bank's data, so no query against it can return another's, and nothing in
+// the Storage interface has to be trusted to filter. What has to hold instead
+// is that the store is picked from the request's tenant, which tenant does
+// without a fallback, and that no two tenants are given the same store or
+// files, which NewTenants checks.
+type Tenant struct {
+	TenantConfig
+	store  Storage
+	audit  *AuditLog
+	risk   *RiskEngine
+	events *EventBroker
+	// cache, if set, serves account reads.
+	cache *AccountCache
+}
+
+func NewTenant(cfg TenantConfig, store Storage, audit *AuditLog, clock Clock) *Tenant {
+	// The tenant's audit log keeps its data keys with the rest of the
+	// tenant's data.
+	audit.keys = store
+	return &Tenant{
+		TenantConfig: cfg,
+		store:        store,
+		audit:        audit,
+		risk:         NewRiskEngine(store, clock),
+		events:       NewEventBroker(),
+	}
+}
+
+// accountCurrency picks the currency of a new account: the one asked for if
+// the tenant offers it, or the tenant's default.
+func (t *Tenant) accountCurrency(currency string) (string, error) {
+	if currency == "" && len(t.Currencies) > 0 {
+		return t.Currencies[0], nil
+	}
+	for _, c := range t.Currencies {
+		if c == currency {
+			return c, nil
+		}
+	}
+	if currency == "" {
+		return "", nil
+	}
+	return "", fmt.Errorf("currency %s is not offered", currency)
+}
+
+// checkAmount applies the tenant's cap on the amount of a payment.
+func (t *Tenant) checkAmount(amount int64) error {
+	if t.MaxTransfer > 0 && amount > t.MaxTransfer {
+		return fmt.Errorf("amount %d is over the limit of %d", amount, t.MaxTransfer)
+	}
+	return nil
+}
+
+// Tenants are the banks a deployment hosts, found by ID or host name.
+type Tenants struct {
+	byID   map[string]*Tenant
+	byHost map[string]*Tenant
+}
+
+func NewTenants(tenants ...*Tenant) (*Tenants, error) {
+	ts := &Tenants{byID: map[string]*Tenant{}, byHost: map[string]*Tenant{}}
+	for _, t := range tenants {
+		if t.ID == "" {
+			return nil, fmt.Errorf("tenant has no id")
+		}
+		if _, ok := ts.byID[t.ID]; ok {
+			return nil, fmt.Errorf("tenant %s is configured twice", t.ID)
+		}
+		for _, other := range ts.byID {
+			if other.store == t.store {
+				return nil, fmt.Errorf("tenants %s and %s share a store", other.ID, t.ID)
+			}
+			if t.Data != "" && other.Data == t.Data {
+				return nil, fmt.Errorf("tenants %s and %s share the data file %s", other.ID, t.ID, t.Data)
+			}
+			if t.AuditLog != "" && other.AuditLog == t.AuditLog {
+				return nil, fmt.Errorf("tenants %s and %s share the audit log %s", other.ID, t.ID, t.AuditLog)
+			}
+		}
+		ts.byID[t.ID] = t
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := ts.byHost[h]; ok {
+				return nil, fmt.Errorf("host %s is used by tenants %s and %s", h, other.ID, t.ID)
+			}
+			ts.byHost[h] = t
+		}
+	}
+	return ts, nil
+}
+
+func (ts *Tenants) Get(id string) (*Tenant, bool) {
+	t, ok := ts.byID[id]
+	return t, ok
+}
+
+// All lists the tenants by ID.
+func (ts *Tenants) All() []*Tenant {
+	all := make([]*Tenant, 0, len(ts.byID))
+	for _, t := range ts.byID {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+// LoadTenantConfigs reads a JSON list of tenants from path. Tenants without
+// files of their own get ones named after them.
+func LoadTenantConfigs(path string) ([]TenantConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []TenantConfig
+	if err := json.Unmarshal(b, &cfgs); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	for i := range cfgs {
+		c := &cfgs[i]
+		if c.Data == "" {
+			c.Data = "gobank-" + c.ID + ".json"
+		}
+		if c.AuditLog == "" {
+			c.AuditLog = "audit-" + c.ID + ".log"
+		}
+	}
+	return cfgs, nil
+}
+
+// withTenant resolves the tenant of a request from the tenant claim of its
+// principal or, for anonymous requests, its host. A principal belongs to one
+// tenant only, the default one if its credentials don't say, so it is refused
+// on any other tenant's host.
+func (s *APIServer) withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = strings.ToLower(h)
+		}
+		t, byHost := s.tenants.byHost[host]
+		if p := principalFrom(r); p != nil {
+			id := p.Tenant
+			if id == "" {
+				id = defaultTenantID
+			}
+			claimed, ok := s.tenants.Get(id)
+			if !ok || (byHost && claimed != t) {
+				denied(r, http.StatusForbidden, fmt.Sprintf("principal of tenant %s used on %s", id, host))
+				WriteJSON(w, http.StatusForbidden, ApiError{Error: "credentials are not valid for this bank"})
+				return
+			}
+			t, byHost = claimed, true
+		}
+		if !byHost {
+			t, byHost = s.tenants.Get(defaultTenantID)
+		}
+		if !byHost {
+			WriteJSON(w, http.StatusNotFound, ApiError{Error: fmt.Sprintf("no bank at %s", host)})
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("gobank.tenant.id", t.ID))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, t)))
+	})
+}
+
+// tenantSink tags the events it passes on with the tenant they came from, so
+// a sink shared by tenants can tell them apart.
+type tenantSink struct {
+	EventSink
+	tenant string
+}
+
+func (s tenantSink) Publish(ctx context.Context, e *Event) error {
+	tagged := *e
+	tagged.Tenant = s.tenant
+	return s.EventSink.Publish(ctx, &tagged)
+}
+
+// tenant returns the tenant the request was resolved to. Every route is
+// behind withTenant, so a request without one is a routing bug; it panics
+// rather than guess a tenant and hand out another bank's data.
+func (s *APIServer) tenant(r *http.Request) *Tenant {
+	t, ok := r.Context().Value(tenantKey).(*Tenant)
+	if !ok {
+		panic(fmt.Sprintf("%s %s was not resolved to a tenant", r.Method, r.URL.Path))
+	}
+	return t
+}
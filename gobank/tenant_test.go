@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTenantServer hosts two banks: a, with one account of alice's, and b,
+// seeded like the end-to-end tests with the same IDs and more besides.
+func newTenantServer(t *testing.T) (*APIServer, *MemoryStore, *MemoryStore) {
+	t.Helper()
+	storeA := NewMemoryStore()
+	must(t, storeA.CreateAccount(&Account{ID: 1, FirstName: "Alan", LastName: "Turing", Owner: "alice", Number: 111, Currency: "GBP", Status: StatusActive}))
+	_, storeB := newE2EServer(t)
+	customers, err := storeB.GetCustomers("alice")
+	must(t, err)
+	must(t, storeB.CreatePayee(&Payee{CustomerID: customers[0].ID, Nickname: "Zanzibar", AccountNumber: 333, Name: "Ada Savings", CreatedAt: e2eNow}))
+
+	tenants, err := NewTenants(
+		NewTenant(TenantConfig{ID: "a", Hosts: []string{"a.bank.test"}, Currencies: []string{"GBP", "EUR"}, MaxTransfer: 100}, storeA, NewAuditLog(), realClock{}),
+		NewTenant(TenantConfig{ID: "b", Hosts: []string{"b.bank.test"}}, storeB, NewAuditLog(), realClock{}),
+	)
+	must(t, err)
+	server := NewMultiTenantAPIServer("", tenants)
+	server.products, err = indexInterestProducts(defaultInterestProducts)
+	must(t, err)
+	return server, storeA, storeB
+}
+
+func TestNoCrossTenantReads(t *testing.T) {
+	server, _, _ := newTenantServer(t)
+	adminA := Principal{Subject: "root", Role: RoleAdmin, Tenant: "a"}
+	adminB := Principal{Subject: "root", Role: RoleAdmin, Tenant: "b"}
+
+	// Leave something of b's in its audit trail.
+	if res := customerRequest(t, server, adminB, "POST", "http://b.bank.test/account/2/freeze", ""); res.Code != http.StatusOK {
+		t.Fatalf("freeze in b: %d %s", res.Code, res.Body)
+	}
+
+	// Only b has any of these.
+	markers := []string{"Lovelace", "Hopper", "Savings", "Zanzibar", "hooks.example.com"}
+	vars := regexp.MustCompile(`{[^}]+}`)
+	token, err := createJWT(adminA, time.Minute)
+	must(t, err)
+	err = server.routes().(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := vars.ReplaceAllStringFunc(tmpl, func(v string) string {
+			if v == "{period}" {
+				return "2026-03"
+			}
+			return "1"
+		})
+		// The event stream only ends when the client goes away.
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest("GET", "http://a.bank.test"+path, nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		for _, m := range markers {
+			if strings.Contains(res.Body.String(), m) {
+				t.Errorf("GET %s on a shows b's %s: %s", path, m, res.Body)
+			}
+		}
+		return nil
+	})
+	must(t, err)
+
+	// Sanity check that b's data is there to be leaked.
+	if res := customerRequest(t, server, adminB, "GET", "http://b.bank.test/account/1", ""); !strings.Contains(res.Body.String(), "Lovelace") {
+		t.Fatalf("account 1 in b: %d %s", res.Code, res.Body)
+	}
+}
+
+func TestNoCrossTenantWrites(t *testing.T) {
+	server, storeA, storeB := newTenantServer(t)
+	adminA := Principal{Subject: "root", Role: RoleAdmin, Tenant: "a"}
+	dump := func(s *MemoryStore) string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		b, err := json.Marshal(s.snapshot())
+		must(t, err)
+		return string(b)
+	}
+	tenantB, _ := server.tenants.Get("b")
+	beforeA, beforeB := dump(storeA), dump(storeB)
+	auditB := len(tenantB.audit.Query(AuditQuery{}))
+
+	// Bodies that would change b if they reached it. Account 2 is only in b.
+	bodies := map[string]string{
+		"/account":                         `{"firstName":"Grace","lastName":"Hopper"}`,
+		"/account/{id}":                    `{"product":null}`,
+		"/account/{id}/schedules":          `{"toAccount":1,"amount":1}`,
+		"/account/{id}/holds":              `{"toAccount":1,"amount":1}`,
+		"/customers":                       `{"firstName":"Grace","lastName":"Hopper"}`,
+		"/customers/{customerId}":          `{"phone":"555"}`,
+		"/customers/{customerId}/accounts": `{"product":"savings"}`,
+		"/customers/{customerId}/payees":   `{"nickname":"b","accountNumber":333,"name":"Ada Savings"}`,
+		"/transfer":                        `{"fromAccount":2,"toAccount":1,"amount":1}`,
+		"/batches":                         `{"transfers":[{"fromAccount":2,"toAccount":1,"amount":1}]}`,
+	}
+	vars := regexp.MustCompile(`{[^}]+}`)
+	err := server.routes().(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := vars.ReplaceAllStringFunc(tmpl, func(v string) string {
+			if v == "{id}" {
+				return "2"
+			}
+			return "1"
+		})
+		for _, method := range []string{"POST", "PATCH", "DELETE"} {
+			customerRequest(t, server, adminA, method, "http://a.bank.test"+path, bodies[tmpl])
+		}
+		return nil
+	})
+	must(t, err)
+
+	if dump(storeB) != beforeB {
+		t.Error("writes on a changed b's store")
+	}
+	if n := len(tenantB.audit.Query(AuditQuery{})); n != auditB {
+		t.Errorf("writes on a added %d entries to b's audit log", n-auditB)
+	}
+	// Sanity check that the writes went somewhere.
+	if dump(storeA) == beforeA {
+		t.Fatal("no write changed a either")
+	}
+}
+
+func TestTenantsAreKeptApart(t *testing.T) {
+	store := NewMemoryStore()
+	_, err := NewTenants(
+		NewTenant(TenantConfig{ID: "a"}, store, NewAuditLog(), realClock{}),
+		NewTenant(TenantConfig{ID: "b"}, store, NewAuditLog(), realClock{}),
+	)
+	if err == nil {
+		t.Fatal("two tenants share a store")
+	}
+	_, err = NewTenants(
+		NewTenant(TenantConfig{ID: "a", Data: "bank.json"}, NewMemoryStore(), NewAuditLog(), realClock{}),
+		NewTenant(TenantConfig{ID: "b", Data: "bank.json"}, NewMemoryStore(), NewAuditLog(), realClock{}),
+	)
+	if err == nil {
+		t.Fatal("two tenants share a data file")
+	}
+
+	// A request that skipped tenant resolution gets nobody's data.
+	server := NewAPIServer("", store, NewAuditLog())
+	defer func() {
+		if recover() == nil {
+			t.Fatal("request without a tenant was served")
+		}
+	}()
+	server.tenant(httptest.NewRequest("GET", "/account/1", nil))
+}
+
+func TestTenantResolution(t *testing.T) {
+	server, _, _ := newTenantServer(t)
+
+	tests := []struct {
+		name   string
+		p      Principal
+		url    string
+		status int
+	}{
+		{"own host", Principal{Subject: "alice", Role: RoleCustomer, Tenant: "a"}, "http://a.bank.test/account/1", http.StatusOK},
+		{"other tenant's host", Principal{Subject: "alice", Role: RoleCustomer, Tenant: "b"}, "http://a.bank.test/account/1", http.StatusForbidden},
+		{"no tenant claim", Principal{Subject: "alice", Role: RoleCustomer}, "http://a.bank.test/account/1", http.StatusForbidden},
+		{"unknown tenant", Principal{Subject: "alice", Role: RoleCustomer, Tenant: "c"}, "http://a.bank.test/account/1", http.StatusForbidden},
+		{"claim on an unknown host", Principal{Subject: "alice", Role: RoleCustomer, Tenant: "b"}, "http://localhost/account/1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := customerRequest(t, server, tt.p, "GET", tt.url, ""); res.Code != tt.status {
+				t.Fatalf("got %d, want %d: %s", res.Code, tt.status, res.Body)
+			}
+		})
+	}
+
+	// Without a default bank, anonymous requests need a known host.
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost/account/1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("anonymous on an unknown host: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTenantCurrenciesAndLimits(t *testing.T) {
+	server, storeA, _ := newTenantServer(t)
+	alice := Principal{Subject: "alice", Role: RoleCustomer, Tenant: "a"}
+	open := func(currency string) (*Account, int) {
+		body := fmt.Sprintf(`{"firstName":"Alan","lastName":"Turing","currency":%q}`, currency)
+		res := customerRequest(t, server, alice, "POST", "http://a.bank.test/account", body)
+		account := new(Account)
+		json.Unmarshal(res.Body.Bytes(), account)
+		return account, res.Code
+	}
+	if acc, code := open(""); code != http.StatusCreated || acc.Currency != "GBP" {
+		t.Fatalf("default currency: %d %+v", code, acc)
+	}
+	if _, code := open("USD"); code != http.StatusBadRequest {
+		t.Fatalf("currency not offered: %d", code)
+	}
+	euros, code := open("EUR")
+	if code != http.StatusCreated || euros.Currency != "EUR" {
+		t.Fatalf("EUR account: %d %+v", code, euros)
+	}
+	storeA.PostInterest(1, "2026-01", 500, time.Now())
+
+	transfer := func(to int, amount int64) int {
+		body := fmt.Sprintf(`{"fromAccount":1,"toAccount":%d,"amount":%d}`, to, amount)
+		return customerRequest(t, server, alice, "POST", "http://a.bank.test/transfer", body).Code
+	}
+	if code := transfer(euros.ID, 10); code != http.StatusBadRequest {
+		t.Fatalf("transfer across currencies: %d", code)
+	}
+	pounds, _ := open("GBP")
+	if code := transfer(pounds.ID, 101); code != http.StatusBadRequest {
+		t.Fatalf("transfer over the limit: %d", code)
+	}
+	if code := transfer(pounds.ID, 100); code != http.StatusOK {
+		t.Fatalf("transfer at the limit: %d", code)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ClientAuthMode says whether callers must present a client certificate.
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone ignores client certificates.
+	ClientAuthNone ClientAuthMode = "none"
+	// ClientAuthOptional verifies a certificate when one is sent, so service
+	// callers can use one while browsers keep using tokens.
+	ClientAuthOptional ClientAuthMode = "optional"
+	// ClientAuthRequire refuses connections without a valid certificate.
+	ClientAuthRequire ClientAuthMode = "require"
+)
+
+// CertReloader serves a certificate and key from files, picking up new ones
+// when the files change so certificates can be rotated without a restart.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate, failing if it can't be read.
+func NewCertReloader(certPath, keyPath string) (*CertReloader, error) {
+	c := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again if either has changed, reporting whether it
+// did. A pair that doesn't load leaves the current certificate in place.
+func (c *CertReloader) Reload() (bool, error) {
+	var modTime time.Time
+	for _, path := range []string{c.certPath, c.keyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return true, nil
+}
+
+// Watch reloads the certificate whenever its files change.
+func (c *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	watchReload(ctx, interval, c.Reload, "certificate from "+c.certPath)
+}
+
+// watchReload calls reload every interval until ctx is done, logging what
+// it loaded.
+func watchReload(ctx context.Context, interval time.Duration, reload func() (bool, error), what string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if ok, err := reload(); err != nil {
+			log.Println("tls:", err)
+		} else if ok {
+			log.Println("tls: loaded", what)
+		}
+	}
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// CAReloader serves a bundle of CA certificates from a file, picking up a
+// new bundle when the file changes so client CAs can be rotated without a
+// restart.
+type CAReloader struct {
+	path string
+
+	mu      sync.RWMutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// NewCAReloader loads the bundle, failing if it can't be read.
+func NewCAReloader(path string) (*CAReloader, error) {
+	c := &CAReloader{path: path}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the file again if it has changed, reporting whether it did. A
+// bundle without certificates leaves the current one in place.
+func (c *CAReloader) Reload() (bool, error) {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	unchanged := c.pool != nil && fi.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return false, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return false, fmt.Errorf("no certificates found in %s", c.path)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pool = pool
+	c.modTime = fi.ModTime()
+	return true, nil
+}
+
+// Watch reloads the bundle whenever its file changes.
+func (c *CAReloader) Watch(ctx context.Context, interval time.Duration) {
+	watchReload(ctx, interval, c.Reload, "client CAs from "+c.path)
+}
+
+func (c *CAReloader) Pool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pool
+}
+
+// newTLSConfig serves the reloader's certificate and, unless mode is none,
+// verifies client certificates against the CAs in clientCAs. Each handshake
+// uses the CAs loaded at the time.
+func newTLSConfig(certs *CertReloader, mode ClientAuthMode, clientCAs *CAReloader) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	switch mode {
+	case ClientAuthNone, "":
+		// A client CA here means the operator expects certificates to be
+		// checked, so it isn't quietly ignored.
+		if clientCAs != nil {
+			return nil, fmt.Errorf("a client CA needs client auth optional or require, not none")
+		}
+		return cfg, nil
+	case ClientAuthOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %s", mode)
+	}
+	if clientCAs == nil {
+		return nil, fmt.Errorf("client auth %s needs a client CA", mode)
+	}
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := cfg.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = clientCAs.Pool()
+		return c, nil
+	}
+	return cfg, nil
+}
+
+// LoadClientPrincipals reads a JSON list of principals from path, keyed by
+// the common name of the client certificate each one authenticates. The role
+// and tenant come from this list, never from the certificate, so a
+// certificate the CA issued for one purpose can't claim another.
+func LoadClientPrincipals(path string) (map[string]Principal, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Principal
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+	principals := make(map[string]Principal, len(list))
+	for _, p := range list {
+		if p.Subject == "" {
+			return nil, fmt.Errorf("loading %s: principal without a subject", path)
+		}
+		if !p.Role.Valid() {
+			return nil, fmt.Errorf("loading %s: %s has unknown role %s", path, p.Subject, p.Role)
+		}
+		if _, ok := principals[p.Subject]; ok {
+			return nil, fmt.Errorf("loading %s: %s is listed twice", path, p.Subject)
+		}
+		principals[p.Subject] = p
+	}
+	return principals, nil
+}
+
+// certPrincipal maps a verified client certificate to the principal the
+// server's configuration gives its common name. Certificates it doesn't list
+// don't authenticate anyone.
+func (s *APIServer) certPrincipal(r *http.Request) *Principal {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	p, ok := s.clientPrincipals[cn]
+	if cn == "" || !ok {
+		return nil
+	}
+	return &p
+}
+
+// devCA is a certificate authority for local testing.
+type devCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newDevCA() (*devCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gobank dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &devCA{cert: cert, key: key}, nil
+}
+
+// issue signs a leaf certificate for tmpl and returns it and its key, both
+// PEM encoded.
+func (ca *devCA) issue(tmpl *x509.Certificate) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().AddDate(0, 3, 0)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+func encodeKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeDevCerts creates a CA, a server certificate for hosts and a client
+// certificate for the given principal in dir, along with a clients.json that
+// maps the client certificate to the principal.
+func writeDevCerts(dir string, hosts []string, client Principal) error {
+	ca, err := newDevCA()
+	if err != nil {
+		return err
+	}
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, h)
+		}
+	}
+	serverCert, serverKey, err := ca.issue(server)
+	if err != nil {
+		return err
+	}
+	clientCert, clientKey, err := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: client.Subject},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+	caKey, err := encodeKeyPEM(ca.key)
+	if err != nil {
+		return err
+	}
+	principals, err := json.MarshalIndent([]Principal{client}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for name, b := range map[string][]byte{
+		"ca.pem":         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}),
+		"ca-key.pem":     caKey,
+		"server.pem":     serverCert,
+		"server-key.pem": serverKey,
+		"client.pem":     clientCert,
+		"client-key.pem": clientKey,
+		"clients.json":   principals,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDevCerts implements `gobank dev-certs`, which writes a throwaway CA and
+// certificates for trying out TLS and mutual TLS locally.
+func runDevCerts(args []string) {
+	fs := flag.NewFlagSet("dev-certs", flag.ExitOnError)
+	dir := fs.String("dir", "certs", "directory to write the certificates to")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated names and addresses the server certificate is for")
+	sub := fs.String("client-sub", "service", "subject of the client certificate")
+	role := fs.String("client-role", "admin", "role of the client certificate")
+	fs.Parse(args)
+
+	if !Role(*role).Valid() {
+		log.Fatalf("dev-certs: unknown role %s", *role)
+	}
+	if len(splitList(*hosts)) == 0 {
+		log.Fatal("dev-certs: -hosts is required")
+	}
+	if err := writeDevCerts(*dir, splitList(*hosts), Principal{Subject: *sub, Role: Role(*role)}); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("wrote CA, server and client certificates and clients.json to", *dir)
+}
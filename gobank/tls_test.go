@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTLSServer serves the API over TLS with certificates from dir.
+func startTLSServer(t *testing.T, server *APIServer, dir string, mode ClientAuthMode) (string, *CertReloader, *CAReloader) {
+	t.Helper()
+	certs, err := NewCertReloader(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cas *CAReloader
+	if mode != ClientAuthNone {
+		if cas, err = NewCAReloader(filepath.Join(dir, "ca.pem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := newTLSConfig(certs, mode, cas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: server.routes(), TLSConfig: cfg}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + ln.Addr().String(), certs, cas
+}
+
+// tlsClient trusts the CAs in dirs and presents the client certificate from
+// the first one, if withCert is set.
+func tlsClient(t *testing.T, withCert bool, dirs ...string) *http.Client {
+	t.Helper()
+	cfg := &tls.Config{RootCAs: x509.NewCertPool()}
+	for _, dir := range dirs {
+		b, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.RootCAs.AppendCertsFromPEM(b)
+	}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dirs[0], "client.pem"), filepath.Join(dirs[0], "client-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+}
+
+func TestMutualTLSMapsCertificateToPrincipal(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeDevCerts(dir, []string{"127.0.0.1"}, Principal{Subject: "ledger-sync", Role: RoleSupport}); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	principals, err := LoadClientPrincipals(filepath.Join(dir, "clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.clientPrincipals = principals
+	url, _, _ := startTLSServer(t, server, dir, ClientAuthRequire)
+
+	client := tlsClient(t, true, dir)
+	resp, err := client.Get(url + "/account/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET as support over mTLS: %d", resp.StatusCode)
+	}
+	resp, err = client.Post(url+"/transfer", "application/json", strings.NewReader(`{"fromAccount":1,"toAccount":2,"amount":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("transfer as support over mTLS: %d", resp.StatusCode)
+	}
+
+	if _, err := tlsClient(t, false, dir).Get(url + "/account/1"); err == nil {
+		t.Fatal("connected without a client certificate")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, next := t.TempDir(), t.TempDir()
+	for _, d := range []string{dir, next} {
+		if err := writeDevCerts(d, []string{"127.0.0.1"}, Principal{Subject: "svc", Role: RoleAdmin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url, certs, _ := startTLSServer(t, NewAPIServer("", NewMemoryStore(), NewAuditLog()), dir, ClientAuthNone)
+	servedBy := func() string {
+		t.Helper()
+		// A fresh client, so the connection and its handshake are new.
+		resp, err := tlsClient(t, false, dir, next).Get(url + "/account/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Issuer.CommonName + " " + resp.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+
+	before := servedBy()
+	if ok, err := certs.Reload(); ok || err != nil {
+		t.Fatalf("reloaded unchanged files: %v %v", ok, err)
+	}
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{"server.pem", "server-key.pem"} {
+		b, err := os.ReadFile(filepath.Join(next, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, later, later)
+	}
+	if ok, err := certs.Reload(); !ok || err != nil {
+		t.Fatalf("didn't reload changed files: %v %v", ok, err)
+	}
+	if after := servedBy(); after == before {
+		t.Fatalf("still serving %s", before)
+	}
+}
+
+func TestCertificateRoleComesFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := writeDevCerts(dir, []string{"127.0.0.1"}, Principal{Subject: "ledger-sync", Role: RoleSupport}); err != nil {
+		t.Fatal(err)
+	}
+	// Any certificate the CA issues can say what it likes in its OU.
+	caCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &devCA{cert: caCert.Leaf, key: caCert.PrivateKey.(*ecdsa.PrivateKey)}
+	if ca.cert == nil {
+		if ca.cert, err = x509.ParseCertificate(caCert.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, key, err := ca.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "intruder", OrganizationalUnit: []string{string(RoleAdmin)}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "client.pem"), cert, 0o600)
+	os.WriteFile(filepath.Join(dir, "client-key.pem"), key, 0o600)
+
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	if server.clientPrincipals, err = LoadClientPrincipals(filepath.Join(dir, "clients.json")); err != nil {
+		t.Fatal(err)
+	}
+	url, _, _ := startTLSServer(t, server, dir, ClientAuthOptional)
+
+	resp, err := tlsClient(t, true, dir).Get(url + "/account/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("GET with an unlisted certificate: %d", resp.StatusCode)
+	}
+}
+
+func TestClientCAReload(t *testing.T) {
+	dir, next := t.TempDir(), t.TempDir()
+	for _, d := range []string{dir, next} {
+		if err := writeDevCerts(d, []string{"127.0.0.1"}, Principal{Subject: "svc", Role: RoleAdmin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	url, certs, cas := startTLSServer(t, NewAPIServer("", NewMemoryStore(), NewAuditLog()), dir, ClientAuthRequire)
+	if _, err := newTLSConfig(certs, ClientAuthNone, cas); err == nil {
+		t.Fatal("client CA accepted with client auth none")
+	}
+
+	// The client's certificate is from next, and it trusts dir's server.
+	client := tlsClient(t, true, next, dir)
+	if _, err := client.Get(url + "/account/1"); err == nil {
+		t.Fatal("connected with a certificate from an unknown CA")
+	}
+
+	b, err := os.ReadFile(filepath.Join(next, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if ok, err := cas.Reload(); !ok || err != nil {
+		t.Fatalf("didn't reload the changed CA: %v %v", ok, err)
+	}
+	resp, err := client.Get(url + "/account/1")
+	if err != nil {
+		t.Fatalf("rejected after the CA was rotated: %v", err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Tracing is done with the OpenTelemetry SDK. Requests continue the
+// caller's W3C trace context, and whether a trace is recorded is decided at
+// its root: a trace the caller didn't sample isn't recorded here either.
+//
+// Work done later on a request's behalf, such as webhook deliveries,
+// scheduled transfers and batches, is traced as a trace of its own with a
+// link back to the request, so a slow delivery doesn't stretch the
+// request's trace out over hours of retries.
+
+// tracerName is the instrumentation scope gobank's spans are recorded under.
+const tracerName = "github.com/cshorten/gobank"
+
+// propagator reads and writes traceparent headers.
+var propagator = propagation.TraceContext{}
+
+// newTracerProvider returns a provider that hands the spans it records to
+// processor. New traces are sampled at ratio; traces continued from a
+// caller keep the caller's decision.
+func newTracerProvider(ratio float64, processor sdktrace.SpanProcessor) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "gobank"))),
+	)
+}
+
+// traceparentOf encodes sc as a traceparent header, or "" if sc is invalid.
+func traceparentOf(sc trace.SpanContext) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+	return carrier.Get("traceparent")
+}
+
+// spanContextOf decodes a traceparent header. The result is invalid if h is.
+func spanContextOf(h string) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": h})
+	return trace.SpanContextFromContext(ctx)
+}
+
+// startWork begins the root span of a piece of background work, linked to
+// the spans, given as traceparents, of the requests that asked for it. A nil
+// tracer traces nothing.
+func startWork(tracer trace.Tracer, name string, kind trace.SpanKind, traceparents ...string) (context.Context, trace.Span) {
+	if tracer == nil {
+		tracer = noop.NewTracerProvider().Tracer(tracerName)
+	}
+	var links []trace.Link
+	for _, h := range traceparents {
+		if sc := spanContextOf(h); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+	return tracer.Start(context.Background(), name, trace.WithNewRoot(), trace.WithSpanKind(kind), trace.WithLinks(links...))
+}
+
+// startChild begins an internal span under the one in ctx. Without a
+// recording span in ctx it records nothing.
+func startChild(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if *err is set. It is meant to be
+// deferred with a pointer to a named error result.
+func endSpan(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// statusRecorder remembers the status a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withTracing wraps each request in a server span named after its route,
+// continuing the caller's trace when it sends a traceparent header. The span
+// context is returned in a traceparent response header.
+func (s *APIServer) withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := r.URL.Path
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+		attrs := []attribute.KeyValue{
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		}
+		if id, err := strconv.Atoi(mux.Vars(r)["id"]); err == nil {
+			attrs = append(attrs, attribute.Int("gobank.account.id", id))
+		}
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+		propagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+		span.End()
+	})
+}
+
+// OTLPFileExporter appends spans to a file in the OTLP JSON encoding, one
+// ExportTraceServiceRequest per batch, as the OpenTelemetry Collector's file
+// exporter writes them.
+type OTLPFileExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewOTLPFileExporter(path string) (*OTLPFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPFileExporter{w: f}, nil
+}
+
+// otlpValue is an OTLP AnyValue. 64-bit integers are strings in OTLP JSON.
+func otlpValue(v attribute.Value) map[string]any {
+	switch v.Type() {
+	case attribute.BOOL:
+		return map[string]any{"boolValue": v.AsBool()}
+	case attribute.INT64:
+		return map[string]any{"intValue": strconv.FormatInt(v.AsInt64(), 10)}
+	case attribute.FLOAT64:
+		return map[string]any{"doubleValue": v.AsFloat64()}
+	}
+	return map[string]any{"stringValue": v.Emit()}
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []map[string]any {
+	out := []map[string]any{}
+	for _, kv := range attrs {
+		out = append(out, map[string]any{"key": string(kv.Key), "value": otlpValue(kv.Value)})
+	}
+	return out
+}
+
+func otlpSpan(s sdktrace.ReadOnlySpan) map[string]any {
+	sc := s.SpanContext()
+	span := map[string]any{
+		"traceId":           sc.TraceID().String(),
+		"spanId":            sc.SpanID().String(),
+		"name":              s.Name(),
+		"kind":              int(s.SpanKind()),
+		"startTimeUnixNano": strconv.FormatInt(s.StartTime().UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.Attributes()),
+		"status":            map[string]any{},
+	}
+	if s.Parent().IsValid() {
+		span["parentSpanId"] = s.Parent().SpanID().String()
+	}
+	links := []map[string]any{}
+	for _, l := range s.Links() {
+		links = append(links, map[string]any{
+			"traceId":    l.SpanContext.TraceID().String(),
+			"spanId":     l.SpanContext.SpanID().String(),
+			"attributes": otlpAttributes(l.Attributes),
+		})
+	}
+	span["links"] = links
+	// OTLP's status codes are 1 for ok and 2 for error.
+	switch s.Status().Code {
+	case codes.Ok:
+		span["status"] = map[string]any{"code": 1}
+	case codes.Error:
+		span["status"] = map[string]any{"code": 2, "message": s.Status().Description}
+	}
+	return span
+}
+
+func (e *OTLPFileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	// Spans are grouped by the scope that recorded them. A provider has one
+	// resource, so the first span's stands for all of them.
+	var scopes []string
+	byScope := map[string][]any{}
+	for _, s := range spans {
+		name := s.InstrumentationScope().Name
+		if _, ok := byScope[name]; !ok {
+			scopes = append(scopes, name)
+		}
+		byScope[name] = append(byScope[name], otlpSpan(s))
+	}
+	scopeSpans := []any{}
+	for _, name := range scopes {
+		scopeSpans = append(scopeSpans, map[string]any{
+			"scope": map[string]any{"name": name},
+			"spans": byScope[name],
+		})
+	}
+	b, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(spans[0].Resource().Attributes()),
+			},
+			"scopeSpans": scopeSpans,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *OTLPFileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// parseSpanExporter reads the -trace-exporter flag: stdout or
+// otlp-file:<path>. Empty turns tracing off.
+func parseSpanExporter(spec string) (sdktrace.SpanExporter, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case strings.HasPrefix(spec, "otlp-file:"):
+		return NewOTLPFileExporter(strings.TrimPrefix(spec, "otlp-file:"))
+	}
+	return nil, fmt.Errorf("unknown trace exporter %s", spec)
+}
+
+// tracedStore is the view of the store a request or a piece of background
+// work has, and records a child span for each call. Calls that post to the ledger or move available funds are named
+// ledger.*, the rest storage.*. Methods neither handlers nor workers use
+// pass through untraced.
+type tracedStore struct {
+	Storage
+	ctx context.Context
+}
+
+// storage returns the store for a request, traced if the request is.
+func (s *APIServer) storage(r *http.Request) Storage {
+	return traced(r.Context(), s.tenant(r).store)
+}
+
+// traced returns store as seen from the span in ctx: calls record child
+// spans, and the deliveries, schedules and batches they create are linked
+// back to the span. Without a recording span, store is returned as it is.
+func traced(ctx context.Context, store Storage) Storage {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return store
+	}
+	if ts, ok := store.(interface{ withTrace(string) Storage }); ok {
+		store = ts.withTrace(traceparentOf(span.SpanContext()))
+	}
+	return tracedStore{Storage: store, ctx: ctx}
+}
+
+func (t tracedStore) span(name string, accountIDs ...int) trace.Span {
+	var attrs []attribute.KeyValue
+	for i, id := range accountIDs {
+		key := "gobank.account.id"
+		if len(accountIDs) == 2 {
+			key = [2]string{"gobank.from_account.id", "gobank.to_account.id"}[i]
+		}
+		attrs = append(attrs, attribute.Int(key, id))
+	}
+	_, span := startChild(t.ctx, name, attrs...)
+	return span
+}
+
+func (t tracedStore) CreateAccount(acc *Account) (err error) {
+	defer endSpan(t.span("storage.CreateAccount"), &err)
+	return t.Storage.CreateAccount(acc)
+}
+
+func (t tracedStore) GetAccountByID(id int) (_ *Account, err error) {
+	defer endSpan(t.span("storage.GetAccountByID", id), &err)
+	return t.Storage.GetAccountByID(id)
+}
+
+func (t tracedStore) ListAccounts(q *AccountQuery) (_ *AccountPage, err error) {
+	defer endSpan(t.span("storage.ListAccounts"), &err)
+	return t.Storage.ListAccounts(q)
+}
+
+func (t tracedStore) SetAccountStatus(id int, from, to AccountStatus, ifVersion int) (_ *AccountChange, err error) {
+	defer endSpan(t.span("storage.SetAccountStatus", id), &err)
+	return t.Storage.SetAccountStatus(id, from, to, ifVersion)
+}
+
+func (t tracedStore) PatchAccount(id int, p *AccountPatch, ifVersion int) (_ *AccountChange, err error) {
+	defer endSpan(t.span("storage.PatchAccount", id), &err)
+	return t.Storage.PatchAccount(id, p, ifVersion)
+}
+
+func (t tracedStore) Transfer(from, to int, amount int64) (tx *Transaction, _ Changes, err error) {
+	span := t.span("ledger.Transfer", from, to)
+	span.SetAttributes(attribute.Int64("gobank.amount", amount))
+	defer endSpan(span, &err)
+	return t.Storage.Transfer(from, to, amount)
+}
+
+func (t tracedStore) GetTransactions(accountID int) (_ []*Transaction, err error) {
+	defer endSpan(t.span("storage.GetTransactions", accountID), &err)
+	return t.Storage.GetTransactions(accountID)
+}
+
+func (t tracedStore) CreateCustomer(c *Customer) (err error) {
+	defer endSpan(t.span("storage.CreateCustomer"), &err)
+	return t.Storage.CreateCustomer(c)
+}
+
+func (t tracedStore) GetCustomer(id int) (_ *Customer, err error) {
+	defer endSpan(t.span("storage.GetCustomer"), &err)
+	return t.Storage.GetCustomer(id)
+}
+
+func (t tracedStore) GetCustomers(owner string) (_ []*Customer, err error) {
+	defer endSpan(t.span("storage.GetCustomers"), &err)
+	return t.Storage.GetCustomers(owner)
+}
+
+func (t tracedStore) PatchCustomer(id int, p *CustomerPatch, ifVersion int, now time.Time) (_ *Customer, _ Changes, err error) {
+	defer endSpan(t.span("storage.PatchCustomer"), &err)
+	return t.Storage.PatchCustomer(id, p, ifVersion, now)
+}
+
+func (t tracedStore) GetAccountByNumber(number int64) (_ *Account, err error) {
+	defer endSpan(t.span("storage.GetAccountByNumber"), &err)
+	return t.Storage.GetAccountByNumber(number)
+}
+
+func (t tracedStore) CreatePayee(p *Payee) (err error) {
+	defer endSpan(t.span("storage.CreatePayee"), &err)
+	return t.Storage.CreatePayee(p)
+}
+
+func (t tracedStore) GetPayee(id int) (_ *Payee, err error) {
+	defer endSpan(t.span("storage.GetPayee"), &err)
+	return t.Storage.GetPayee(id)
+}
+
+func (t tracedStore) GetPayees(customerID int) (_ []*Payee, err error) {
+	defer endSpan(t.span("storage.GetPayees"), &err)
+	return t.Storage.GetPayees(customerID)
+}
+
+func (t tracedStore) DeletePayee(id int) (err error) {
+	defer endSpan(t.span("storage.DeletePayee"), &err)
+	return t.Storage.DeletePayee(id)
+}
+
+func (t tracedStore) CreateScheduledTransfer(st *ScheduledTransfer) (err error) {
+	defer endSpan(t.span("storage.CreateScheduledTransfer", st.FromAccount, st.ToAccount), &err)
+	return t.Storage.CreateScheduledTransfer(st)
+}
+
+func (t tracedStore) GetScheduledTransfer(id int) (_ *ScheduledTransfer, err error) {
+	defer endSpan(t.span("storage.GetScheduledTransfer"), &err)
+	return t.Storage.GetScheduledTransfer(id)
+}
+
+func (t tracedStore) GetScheduledTransfers(accountID int) (_ []*ScheduledTransfer, err error) {
+	defer endSpan(t.span("storage.GetScheduledTransfers", accountID), &err)
+	return t.Storage.GetScheduledTransfers(accountID)
+}
+
+func (t tracedStore) CancelScheduledTransfer(id int) (_ *ScheduledTransfer, err error) {
+	defer endSpan(t.span("storage.CancelScheduledTransfer"), &err)
+	return t.Storage.CancelScheduledTransfer(id)
+}
+
+func (t tracedStore) CreateWebhook(wh *Webhook) (err error) {
+	defer endSpan(t.span("storage.CreateWebhook"), &err)
+	return t.Storage.CreateWebhook(wh)
+}
+
+func (t tracedStore) GetWebhook(id int) (_ *Webhook, err error) {
+	defer endSpan(t.span("storage.GetWebhook"), &err)
+	return t.Storage.GetWebhook(id)
+}
+
+func (t tracedStore) GetWebhooks(owner string) (_ []*Webhook, err error) {
+	defer endSpan(t.span("storage.GetWebhooks"), &err)
+	return t.Storage.GetWebhooks(owner)
+}
+
+func (t tracedStore) DeleteWebhook(id int) (err error) {
+	defer endSpan(t.span("storage.DeleteWebhook"), &err)
+	return t.Storage.DeleteWebhook(id)
+}
+
+func (t tracedStore) GetWebhookDeliveries(webhookID int) (_ []*WebhookDelivery, err error) {
+	defer endSpan(t.span("storage.GetWebhookDeliveries"), &err)
+	return t.Storage.GetWebhookDeliveries(webhookID)
+}
+
+func (t tracedStore) EventsAfter(seq, limit int) (_ []*Event, err error) {
+	defer endSpan(t.span("storage.EventsAfter"), &err)
+	return t.Storage.EventsAfter(seq, limit)
+}
+
+func (t tracedStore) GetRiskDecision(id int) (_ *RiskDecision, err error) {
+	defer endSpan(t.span("storage.GetRiskDecision"), &err)
+	return t.Storage.GetRiskDecision(id)
+}
+
+func (t tracedStore) GetRiskDecisions(status ReviewStatus) (_ []*RiskDecision, err error) {
+	defer endSpan(t.span("storage.GetRiskDecisions"), &err)
+	return t.Storage.GetRiskDecisions(status)
+}
+
+func (t tracedStore) ResolveRiskDecision(id int, status ReviewStatus, reviewer string, now time.Time) (_ *RiskDecision, _ Changes, err error) {
+	span := t.span("ledger.ResolveRiskDecision")
+	span.SetAttributes(attribute.String("gobank.review.status", string(status)))
+	defer endSpan(span, &err)
+	return t.Storage.ResolveRiskDecision(id, status, reviewer, now)
+}
+
+func (t tracedStore) PlaceHold(h *Hold) (_ Changes, err error) {
+	span := t.span("ledger.PlaceHold", h.AccountID)
+	span.SetAttributes(attribute.Int64("gobank.amount", h.Amount))
+	defer endSpan(span, &err)
+	return t.Storage.PlaceHold(h)
+}
+
+func (t tracedStore) GetHold(id int) (_ *Hold, err error) {
+	defer endSpan(t.span("storage.GetHold"), &err)
+	return t.Storage.GetHold(id)
+}
+
+func (t tracedStore) GetHolds(accountID int) (_ []*Hold, err error) {
+	defer endSpan(t.span("storage.GetHolds", accountID), &err)
+	return t.Storage.GetHolds(accountID)
+}
+
+func (t tracedStore) CaptureHold(id int, amount int64, now time.Time) (_ *Hold, _ Changes, err error) {
+	span := t.span("ledger.CaptureHold")
+	span.SetAttributes(attribute.Int64("gobank.amount", amount))
+	defer endSpan(span, &err)
+	return t.Storage.CaptureHold(id, amount, now)
+}
+
+func (t tracedStore) ReleaseHold(id int, now time.Time) (_ *Hold, _ Changes, err error) {
+	defer endSpan(t.span("ledger.ReleaseHold"), &err)
+	return t.Storage.ReleaseHold(id, now)
+}
+
+func (t tracedStore) CreateBatch(b *Batch) (err error) {
+	defer endSpan(t.span("storage.CreateBatch"), &err)
+	return t.Storage.CreateBatch(b)
+}
+
+func (t tracedStore) GetBatch(id int) (_ *Batch, err error) {
+	defer endSpan(t.span("storage.GetBatch"), &err)
+	return t.Storage.GetBatch(id)
+}
+
+func (t tracedStore) EraseAccount(id int, firstName, lastName string, now time.Time) (_ []*Account, err error) {
+	defer endSpan(t.span("storage.EraseAccount", id), &err)
+	return t.Storage.EraseAccount(id, firstName, lastName, now)
+}
+
+func (t tracedStore) ExecuteScheduledTransfer(id, occurrence int, now time.Time) (_ *Transaction, _ Changes, err error) {
+	defer endSpan(t.span("ledger.ExecuteScheduledTransfer"), &err)
+	return t.Storage.ExecuteScheduledTransfer(id, occurrence, now)
+}
+
+func (t tracedStore) RecordScheduledTransferFailure(id, occurrence int, f ScheduleFailure, retryAt *time.Time) (err error) {
+	defer endSpan(t.span("storage.RecordScheduledTransferFailure"), &err)
+	return t.Storage.RecordScheduledTransferFailure(id, occurrence, f, retryAt)
+}
+
+func (t tracedStore) BalanceAt(accountID int, at time.Time) (_ int64, err error) {
+	defer endSpan(t.span("storage.BalanceAt", accountID), &err)
+	return t.Storage.BalanceAt(accountID, at)
+}
+
+func (t tracedStore) GetInterestState(accountID int) (_ *InterestState, err error) {
+	defer endSpan(t.span("storage.GetInterestState", accountID), &err)
+	return t.Storage.GetInterestState(accountID)
+}
+
+func (t tracedStore) PostInterest(accountID int, period string, amount int64, now time.Time) (_ *Transaction, _ Changes, err error) {
+	span := t.span("ledger.PostInterest", accountID)
+	span.SetAttributes(attribute.Int64("gobank.amount", amount))
+	defer endSpan(span, &err)
+	return t.Storage.PostInterest(accountID, period, amount, now)
+}
+
+func (t tracedStore) ExecuteBatch(id int, now time.Time) (_ Changes, err error) {
+	defer endSpan(t.span("ledger.ExecuteBatch"), &err)
+	return t.Storage.ExecuteBatch(id, now)
+}
+
+func (t tracedStore) ExecuteBatchItem(id, index int, now time.Time) (_ *Transaction, _ Changes, err error) {
+	defer endSpan(t.span("ledger.ExecuteBatchItem"), &err)
+	return t.Storage.ExecuteBatchItem(id, index, now)
+}
+
+func (t tracedStore) RecordBatchItemResult(id, index int, status BatchItemStatus, msg string) (err error) {
+	defer endSpan(t.span("storage.RecordBatchItemResult"), &err)
+	return t.Storage.RecordBatchItemResult(id, index, status, msg)
+}
+
+func (t tracedStore) FinishBatch(id int, now time.Time) (_ *Batch, err error) {
+	defer endSpan(t.span("storage.FinishBatch"), &err)
+	return t.Storage.FinishBatch(id, now)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestTracer returns a tracer that samples new traces at ratio and keeps
+// the spans it records.
+func newTestTracer(ratio float64) (trace.Tracer, *tracetest.SpanRecorder) {
+	rec := tracetest.NewSpanRecorder()
+	return newTracerProvider(ratio, rec).Tracer(tracerName), rec
+}
+
+func named(rec *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	var out []sdktrace.ReadOnlySpan
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func attrs(s sdktrace.ReadOnlySpan) map[string]any {
+	m := map[string]any{}
+	for _, kv := range s.Attributes() {
+		m[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return m
+}
+
+func linkedTo(s sdktrace.ReadOnlySpan, sc trace.SpanContext) bool {
+	for _, l := range s.Links() {
+		if l.SpanContext.TraceID() == sc.TraceID() && l.SpanContext.SpanID() == sc.SpanID() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc := spanContextOf(valid)
+	if !sc.IsValid() || !sc.IsSampled() || traceparentOf(sc) != valid {
+		t.Fatalf("parsed %+v", sc)
+	}
+	for _, h := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		if spanContextOf(h).IsValid() {
+			t.Errorf("accepted %q", h)
+		}
+	}
+}
+
+func TestTransferIsTracedThroughStorage(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	savePayee(t, store, 1, 2)
+	server := NewAPIServer("", store, NewAuditLog())
+	var spans *tracetest.SpanRecorder
+	server.tracer, spans = newTestTracer(1)
+	token, err := createJWT(Principal{Subject: "alice", Role: RoleCustomer}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(`{"fromAccount":1,"toAccount":2,"amount":40}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("traceparent", parent)
+	rec := httptest.NewRecorder()
+	server.routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("transfer: %d %s", rec.Code, rec.Body)
+	}
+
+	servers := named(spans, "POST /transfer")
+	if len(servers) != 1 {
+		t.Fatalf("%d server spans", len(servers))
+	}
+	root := servers[0]
+	if root.SpanKind() != trace.SpanKindServer || root.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("server span didn't continue the caller's trace: %+v", root)
+	}
+	if a := attrs(root); a["http.route"] != "/transfer" || a["http.response.status_code"] != int64(http.StatusOK) {
+		t.Errorf("server span attributes %v", a)
+	}
+	if got, want := rec.Header().Get("traceparent"), traceparentOf(root.SpanContext()); got != want {
+		t.Errorf("response traceparent %q, want %q", got, want)
+	}
+
+	ledger := named(spans, "ledger.Transfer")
+	if len(ledger) != 1 || ledger[0].Parent().SpanID() != root.SpanContext().SpanID() || ledger[0].SpanContext().TraceID() != root.SpanContext().TraceID() {
+		t.Fatalf("ledger span isn't a child of the request: %+v", ledger)
+	}
+	if a := attrs(ledger[0]); a["gobank.from_account.id"] != int64(1) || a["gobank.to_account.id"] != int64(2) || a["gobank.amount"] != int64(40) {
+		t.Errorf("ledger span attributes %v", a)
+	}
+	if reads := named(spans, "storage.GetAccountByID"); len(reads) == 0 || reads[0].Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Errorf("storage reads not traced under the request: %+v", reads)
+	}
+
+	// A failing storage call marks its span.
+	req = httptest.NewRequest("GET", "/account/9", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	server.routes().ServeHTTP(httptest.NewRecorder(), req)
+	reads := named(spans, "storage.GetAccountByID")
+	if last := reads[len(reads)-1]; last.Status().Code != codes.Error || attrs(last)["gobank.account.id"] != int64(9) {
+		t.Errorf("failed read span %+v", last)
+	}
+}
+
+func TestTracesFollowTheSamplingDecision(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	server := NewAPIServer("", store, NewAuditLog())
+	var spans *tracetest.SpanRecorder
+	server.tracer, spans = newTestTracer(1)
+	token, err := createJWT(Principal{Subject: "alice", Role: RoleCustomer}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(traceparent string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/account/1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if traceparent != "" {
+			req.Header.Set("traceparent", traceparent)
+		}
+		rec := httptest.NewRecorder()
+		server.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The caller didn't sample the trace, so nothing is recorded, but the
+	// trace still goes on.
+	rec := get("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if n := len(spans.Ended()); n != 0 {
+		t.Fatalf("recorded %d spans of an unsampled trace", n)
+	}
+	sc := spanContextOf(rec.Header().Get("traceparent"))
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.IsSampled() {
+		t.Fatalf("response traceparent %q", rec.Header().Get("traceparent"))
+	}
+
+	get("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if len(named(spans, "GET /account/{id}")) != 1 {
+		t.Fatalf("sampled trace not recorded: %d spans", len(spans.Ended()))
+	}
+
+	// New traces are sampled at the configured ratio.
+	server.tracer, spans = newTestTracer(0)
+	get("")
+	if n := len(spans.Ended()); n != 0 {
+		t.Fatalf("recorded %d spans at a ratio of 0", n)
+	}
+}
+
+func TestWebhookDeliveryIsLinkedToTheRequest(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	store := NewMemoryStore()
+	store.CreateWebhook(&Webhook{Owner: "alice", URL: srv.URL, Events: []string{EventAccountFrozen}, Secret: "s"})
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	tracer, spans := newTestTracer(1)
+	ctx, request := tracer.Start(context.Background(), "POST /account/{id}/freeze", trace.WithSpanKind(trace.SpanKindServer))
+	if _, err := traced(ctx, store).SetAccountStatus(1, StatusActive, StatusFrozen, 0); err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+
+	d := NewWebhookDispatcher(store, realClock{})
+	d.client = srv.Client()
+	d.tracer = tracer
+	d.RunDue()
+
+	sent := named(spans, "webhook.deliver")
+	if len(sent) != 1 || sent[0].SpanKind() != trace.SpanKindClient {
+		t.Fatalf("delivery spans %+v", sent)
+	}
+	if !linkedTo(sent[0], request.SpanContext()) || sent[0].SpanContext().TraceID() == request.SpanContext().TraceID() {
+		t.Fatalf("delivery span isn't a trace of its own linked to the request: %+v", sent[0])
+	}
+	if want := traceparentOf(sent[0].SpanContext()); got != want {
+		t.Fatalf("receiver got traceparent %q, want %q", got, want)
+	}
+}
+
+func TestWorkersAreTraced(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: now}
+	store := NewMemoryStore()
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Balance: 100, Status: StatusActive, Product: "savings", CreatedAt: now.AddDate(0, 0, -2)})
+	store.CreateAccount(&Account{ID: 2, Owner: "bob", Status: StatusActive})
+	tracer, spans := newTestTracer(1)
+
+	ctx, request := tracer.Start(context.Background(), "POST /account/{id}/schedules")
+	st, err := NewScheduledTransfer(1, &ScheduleTransferRequest{ToAccount: 2, Amount: 10, StartAt: now}, now)
+	must(t, err)
+	must(t, traced(ctx, store).CreateScheduledTransfer(st))
+	b := &Batch{Owner: "alice", Mode: BatchBestEffort, Status: BatchPending, Items: []*BatchItem{{FromAccount: 1, ToAccount: 2, Amount: 5, Status: ItemPending}}, CreatedAt: now}
+	must(t, traced(ctx, store).CreateBatch(b))
+	request.End()
+
+	scheduler := NewScheduler(store, nil, nil, clock)
+	scheduler.tracer = tracer
+	scheduler.RunDue()
+	batches := NewBatchProcessor(store, nil, nil, clock)
+	batches.tracer = tracer
+	batches.RunDue()
+	interest := NewInterestEngine(store, nil, map[string]*InterestProduct{"savings": defaultInterestProducts[1]}, clock)
+	interest.tracer = tracer
+	interest.RunDue()
+
+	for _, work := range []struct{ root, child string }{
+		{"scheduler.execute", "ledger.ExecuteScheduledTransfer"},
+		{"batch.process", "ledger.ExecuteBatchItem"},
+	} {
+		roots, children := named(spans, work.root), named(spans, work.child)
+		if len(roots) != 1 || !linkedTo(roots[0], request.SpanContext()) {
+			t.Fatalf("%s spans %+v", work.root, roots)
+		}
+		if len(children) != 1 || children[0].Parent().SpanID() != roots[0].SpanContext().SpanID() {
+			t.Fatalf("%s spans %+v", work.child, children)
+		}
+	}
+	runs, catchUps := named(spans, "interest.run"), named(spans, "interest.catchUp")
+	if len(runs) != 1 || len(catchUps) != 1 || catchUps[0].Parent().SpanID() != runs[0].SpanContext().SpanID() {
+		t.Fatalf("interest spans %+v %+v", runs, catchUps)
+	}
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := &OTLPFileExporter{w: buf}
+	sc := spanContextOf("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	start := time.Now()
+	span := tracetest.SpanStub{
+		Name:        "ledger.Transfer",
+		SpanContext: sc,
+		SpanKind:    trace.SpanKindInternal,
+		StartTime:   start,
+		EndTime:     start.Add(time.Millisecond),
+		Attributes:  []attribute.KeyValue{attribute.Int64("gobank.amount", 40)},
+		Status:      sdktrace.Status{Code: codes.Error, Description: "insufficient funds"},
+	}.Snapshot()
+	if err := e.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{span}); err != nil {
+		t.Fatal(err)
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string `json:"traceId"`
+					Name       string `json:"name"`
+					Kind       int    `json:"kind"`
+					Attributes []struct {
+						Key   string         `json:"key"`
+						Value map[string]any `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.TraceID != sc.TraceID().String() || got.Name != "ledger.Transfer" || got.Kind != 1 || got.Status.Code != 2 {
+		t.Fatalf("exported %+v", got)
+	}
+	if a := got.Attributes[0]; a.Key != "gobank.amount" || a.Value["intValue"] != "40" {
+		t.Fatalf("attribute %+v", a)
+	}
+}
@@ -1,20 +1,130 @@
 package main
 
-import "math/rand"
+import (
+	"fmt"
+	"time"
+)
+
+type AccountStatus string
+
+const (
+	StatusActive AccountStatus = "active"
+	StatusFrozen AccountStatus = "frozen"
+	StatusClosed AccountStatus = "closed"
+)
+
+// accountTransitions lists the statuses an account may move to from each
+// status. Closed accounts can only be reopened.
+var accountTransitions = map[AccountStatus][]AccountStatus{
+	StatusActive: {StatusFrozen, StatusClosed},
+	StatusFrozen: {StatusActive, StatusClosed},
+	StatusClosed: {StatusActive},
+}
+
+// firstAccountNumber is the first account number the store gives out.
+const firstAccountNumber = 10_000_000
 
 type Account struct {
 	ID        int    `json:"id"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
-	Number    int64  `json:"number"`
-	Balance   int64  `json:"balance"`
+	Owner     string `json:"owner"`
+	// CustomerID is the customer the account belongs to.
+	CustomerID int    `json:"customerId,omitempty"`
+	Product    string `json:"product,omitempty"`
+	// Currency is empty for banks that don't deal in more than one.
+	Currency string `json:"currency,omitempty"`
+	// Number is what the account is paid by. The store gives one out when
+	// an account is created without one.
+	Number int64 `json:"number"`
+	// Balance is the ledger balance: everything posted to the account.
+	// Available is what can still be spent once pending holds are taken off.
+	Balance   int64         `json:"balance"`
+	Available int64         `json:"available"`
+	Status    AccountStatus `json:"status"`
+	// Version goes up by one with every change to the account.
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ClosedAt  *time.Time `json:"closedAt,omitempty"`
+	// ErasedAt is set once the holder's personal data has been erased.
+	ErasedAt *time.Time `json:"erasedAt,omitempty"`
 }
 
-func NewAccount(firstName, lastName string) *Account {
+func NewAccount(firstName, lastName, owner string) *Account {
 	return &Account{
-		ID:        rand.Intn(100_000),
 		FirstName: firstName,
 		LastName:  lastName,
-		Number:    int64(rand.Intn(1_000_000)),
+		Owner:     owner,
+		Status:    StatusActive,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Transition moves the account to the given status if the move is allowed.
+// An account can only be closed once its balance is zero, and an erased
+// account stays closed.
+func (a *Account) Transition(to AccountStatus) error {
+	if a.ErasedAt != nil {
+		return fmt.Errorf("account %d has been erased", a.ID)
+	}
+	allowed := false
+	for _, s := range accountTransitions[a.Status] {
+		if s == to {
+			allowed = true
+			break
+		}
 	}
+	if !allowed {
+		return fmt.Errorf("account %d cannot go from %s to %s", a.ID, a.Status, to)
+	}
+	if to == StatusClosed && a.Balance != 0 {
+		return fmt.Errorf("account %d has a non-zero balance of %d", a.ID, a.Balance)
+	}
+
+	a.Status = to
+	if to == StatusClosed {
+		now := time.Now().UTC()
+		a.ClosedAt = &now
+	} else {
+		a.ClosedAt = nil
+	}
+	return nil
+}
+
+type CreateAccountRequest struct {
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	// Owner is only honoured for roles that may act on any account; everyone
+	// else owns the accounts they create.
+	Owner    string `json:"owner,omitempty"`
+	Product  string `json:"product,omitempty"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// TransferRequest names the account paid either by ID or by its number.
+type TransferRequest struct {
+	FromAccount     int   `json:"fromAccount"`
+	ToAccount       int   `json:"toAccount,omitempty"`
+	ToAccountNumber int64 `json:"toAccountNumber,omitempty"`
+	Amount          int64 `json:"amount"`
+}
+
+type TransactionKind string
+
+const (
+	KindTransfer TransactionKind = "transfer"
+	KindInterest TransactionKind = "interest"
+	KindCapture  TransactionKind = "capture"
+)
+
+// Transaction is a posted movement of money between two accounts. Transactions
+// are never removed, so closed accounts keep their history.
+type Transaction struct {
+	ID          int             `json:"id"`
+	Kind        TransactionKind `json:"kind"`
+	FromAccount int             `json:"fromAccount"`
+	ToAccount   int             `json:"toAccount"`
+	Amount      int64           `json:"amount"`
+	HoldID      int             `json:"holdId,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
 }
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type Webhook struct {
+	ID    int    `json:"id"`
+	Owner string `json:"owner"`
+	URL   string `json:"url"`
+	// AllAccounts subscribes to events on every account rather than just the
+	// owner's. Only roles that can see any account may set it.
+	AllAccounts bool     `json:"allAccounts,omitempty"`
+	Events      []string `json:"events"`
+	// Secret signs deliveries. It is only shown when the webhook is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type CreateWebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	AllAccounts bool     `json:"allAccounts"`
+}
+
+func (wh *Webhook) wants(e *Event) bool {
+	subscribed := false
+	for _, t := range wh.Events {
+		if t == e.Type {
+			subscribed = true
+			break
+		}
+	}
+	if !subscribed {
+		return false
+	}
+	if wh.AllAccounts {
+		return true
+	}
+	for _, owner := range e.Owners {
+		if owner == wh.Owner {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// DeliveryAttempt records how an attempt went. Only the status code is kept
+// of the response, so a webhook can't be used to read what an endpoint
+// returns.
+type DeliveryAttempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// WebhookDelivery is the outbox entry for sending one event to one webhook.
+type WebhookDelivery struct {
+	ID            int               `json:"id"`
+	WebhookID     int               `json:"webhookId"`
+	EventID       string            `json:"eventId"`
+	EventType     string            `json:"eventType"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        DeliveryStatus    `json:"status"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+	NextAttemptAt time.Time         `json:"nextAttemptAt"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	// Traceparent is the trace context of the request the event happened in.
+	Traceparent string `json:"traceparent,omitempty"`
+}
+
+// eventPayload is the body a webhook receives for an event.
+func eventPayload(e *Event) (json.RawMessage, error) {
+	return json.Marshal(struct {
+		ID        string          `json:"id"`
+		Type      string          `json:"type"`
+		CreatedAt time.Time       `json:"createdAt"`
+		Data      json.RawMessage `json:"data"`
+	}{e.ID, e.Type, e.CreatedAt, e.Data})
+}
+
+func newWebhookDelivery(wh *Webhook, e *Event) (*WebhookDelivery, error) {
+	payload, err := eventPayload(e)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookDelivery{
+		WebhookID:     wh.ID,
+		EventID:       e.ID,
+		EventType:     e.Type,
+		Payload:       payload,
+		Status:        DeliveryPending,
+		Attempts:      []DeliveryAttempt{},
+		NextAttemptAt: e.CreatedAt,
+		CreatedAt:     e.CreatedAt,
+	}, nil
+}
+
+func (d *WebhookDelivery) clone() *WebhookDelivery {
+	c := *d
+	c.Attempts = append([]DeliveryAttempt{}, d.Attempts...)
+	return &c
+}
+
+// signPayload returns the X-Gobank-Signature header for a delivery: an
+// HMAC-SHA256 over the timestamp and body, so receivers can reject replays.
+func signPayload(secret string, ts int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(payload)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// reservedPrefixes are ranges webhooks may not reach that netip doesn't
+// already classify as private, loopback or link-local.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// publicAddr reports whether a webhook may be delivered to ip: anything but
+// the bank's own machine and networks.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range reservedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns a client that will only connect to public
+// addresses. The check is made on the address actually dialled, after DNS,
+// so a name can't be pointed at an internal one between checks. Redirects
+// aren't followed and proxies aren't used, since both would dial somewhere
+// else.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(ap.Addr()) {
+				return fmt.Errorf("webhook address %s is not public", ap.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebhookDispatcher sends pending deliveries from the outbox. A delivery that
+// doesn't get a 2xx response is retried with exponential backoff until it
+// runs out of attempts.
+//
+// Each webhook's deliveries are sent in order, but webhooks are sent to in
+// parallel, so a slow endpoint only holds up its own deliveries.
+type WebhookDispatcher struct {
+	store       Storage
+	client      *http.Client
+	clock       Clock
+	interval    time.Duration
+	maxAttempts int
+	backoff     time.Duration
+	// tracer, if set, traces each delivery, linked to the request the event
+	// happened in, and passes the trace on to the receiver in a traceparent
+	// header.
+	tracer trace.Tracer
+
+	mu sync.Mutex
+	// busy holds the webhooks that are being sent to.
+	busy map[int]bool
+}
+
+func NewWebhookDispatcher(store Storage, clock Clock) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:       store,
+		client:      newWebhookClient(10 * time.Second),
+		clock:       clock,
+		interval:    5 * time.Second,
+		maxAttempts: 8,
+		backoff:     30 * time.Second,
+		busy:        map[int]bool{},
+	}
+}
+
+// Run starts sending due deliveries every interval without waiting for the
+// last round to finish. Webhooks still being sent to are left out of a round.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.start()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue sends every due delivery and waits for them all.
+func (d *WebhookDispatcher) RunDue() {
+	d.start().Wait()
+}
+
+// start sends each idle webhook's due deliveries on a goroutine of its own.
+func (d *WebhookDispatcher) start() *sync.WaitGroup {
+	// d.mu is held from reading what is due, so a webhook that finishes in
+	// the meantime can't have its last deliveries sent again.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var wg sync.WaitGroup
+	due, err := d.store.DueWebhookDeliveries(d.clock.Now())
+	if err != nil {
+		log.Println("webhooks:", err)
+		return &wg
+	}
+	byWebhook := map[int][]*WebhookDelivery{}
+	var order []int
+	for _, delivery := range due {
+		if byWebhook[delivery.WebhookID] == nil {
+			order = append(order, delivery.WebhookID)
+		}
+		byWebhook[delivery.WebhookID] = append(byWebhook[delivery.WebhookID], delivery)
+	}
+
+	for _, id := range order {
+		if d.busy[id] {
+			continue
+		}
+		d.busy[id] = true
+		wg.Add(1)
+		go func(id int, deliveries []*WebhookDelivery) {
+			defer wg.Done()
+			d.deliver(id, deliveries)
+			d.mu.Lock()
+			delete(d.busy, id)
+			d.mu.Unlock()
+		}(id, byWebhook[id])
+	}
+	return &wg
+}
+
+// deliver sends one webhook's due deliveries in order.
+func (d *WebhookDispatcher) deliver(webhookID int, deliveries []*WebhookDelivery) {
+	wh, err := d.store.GetWebhook(webhookID)
+	if err != nil {
+		log.Println("webhooks:", err)
+		return
+	}
+	for _, delivery := range deliveries {
+		attempt := d.send(wh, delivery)
+
+		var next *time.Time
+		if attempt.StatusCode/100 != 2 && len(delivery.Attempts)+1 < d.maxAttempts {
+			t := attempt.At.Add(d.backoff << len(delivery.Attempts))
+			next = &t
+		}
+		if err := d.store.RecordWebhookAttempt(delivery.ID, attempt, next); err != nil {
+			log.Println("webhooks:", err)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) send(wh *Webhook, delivery *WebhookDelivery) (attempt DeliveryAttempt) {
+	now := d.clock.Now()
+	attempt = DeliveryAttempt{At: now}
+
+	ctx, span := startWork(d.tracer, "webhook.deliver", trace.SpanKindClient, delivery.Traceparent)
+	span.SetAttributes(
+		attribute.Int("gobank.webhook.id", wh.ID),
+		attribute.Int("gobank.delivery.id", delivery.ID),
+		attribute.String("gobank.event.type", delivery.EventType),
+	)
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", attempt.StatusCode))
+		if attempt.Error != "" {
+			span.SetStatus(codes.Error, attempt.Error)
+		} else if attempt.StatusCode/100 != 2 {
+			span.SetStatus(codes.Error, http.StatusText(attempt.StatusCode))
+		}
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gobank-Event", delivery.EventType)
+	req.Header.Set("X-Gobank-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Gobank-Signature", signPayload(wh.Secret, now.Unix(), delivery.Payload))
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	// The body is read so the connection can be reused, but not kept.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+	attempt.StatusCode = resp.StatusCode
+	return attempt
+}
+
+func (s *APIServer) handleWebhooks(w http.ResponseWriter, r *http.Request) error {
+	p := principalFrom(r)
+	if r.Method == "GET" {
+		owner := p.Subject
+		if rolePermissions[p.Role][PermManageWebhooks] == scopeAny {
+			owner = r.URL.Query().Get("owner")
+		}
+		webhooks, err := s.storage(r).GetWebhooks(owner)
+		if err != nil {
+			return err
+		}
+		for _, wh := range webhooks {
+			wh.Secret = ""
+		}
+		return WriteJSON(w, http.StatusOK, webhooks)
+	}
+
+	req := new(CreateWebhookRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid webhook url %s", req.URL)
+	}
+	// Names are checked when they are dialled, since what they resolve to
+	// can change; addresses and localhost can be turned away now.
+	if ip, err := netip.ParseAddr(u.Hostname()); (err == nil && !publicAddr(ip)) || u.Hostname() == "localhost" {
+		return fmt.Errorf("webhook url %s is not a public address", req.URL)
+	}
+	if len(req.Events) == 0 {
+		return fmt.Errorf("webhook must subscribe to at least one event")
+	}
+	for _, t := range req.Events {
+		if !eventTypes[t] {
+			return fmt.Errorf("unknown event type %s", t)
+		}
+	}
+	if req.AllAccounts && rolePermissions[p.Role][PermManageWebhooks] != scopeAny {
+		return denied(r, http.StatusForbidden, fmt.Sprintf("role %s cannot subscribe to all accounts", p.Role))
+	}
+
+	wh := &Webhook{
+		Owner:       p.Subject,
+		URL:         req.URL,
+		AllAccounts: req.AllAccounts,
+		Events:      req.Events,
+		Secret:      randomHex(32),
+		CreatedAt:   s.clock.Now(),
+	}
+	if err := s.storage(r).CreateWebhook(wh); err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusCreated, wh)
+}
+
+func (s *APIServer) handleWebhookByID(w http.ResponseWriter, r *http.Request) error {
+	wh, err := s.webhookFor(r)
+	if err != nil {
+		return err
+	}
+	if r.Method == "DELETE" {
+		if err := s.storage(r).DeleteWebhook(wh.ID); err != nil {
+			return err
+		}
+	}
+	wh.Secret = ""
+	return WriteJSON(w, http.StatusOK, wh)
+}
+
+func (s *APIServer) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) error {
+	wh, err := s.webhookFor(r)
+	if err != nil {
+		return err
+	}
+	deliveries, err := s.storage(r).GetWebhookDeliveries(wh.ID)
+	if err != nil {
+		return err
+	}
+	return WriteJSON(w, http.StatusOK, deliveries)
+}
+
+// webhookFor loads the webhook named in the path, hiding webhooks the caller
+// doesn't own.
+func (s *APIServer) webhookFor(r *http.Request) (*Webhook, error) {
+	idStr := mux.Vars(r)["webhookId"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook id given %s", idStr)
+	}
+	wh, err := s.storage(r).GetWebhook(id)
+	p := principalFrom(r)
+	if err != nil || (wh.Owner != p.Subject && rolePermissions[p.Role][PermManageWebhooks] != scopeAny) {
+		return nil, fmt.Errorf("webhook %d %w", id, ErrNotFound)
+	}
+	return wh, nil
+}
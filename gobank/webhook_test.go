@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveryIsSignedAndRetried(t *testing.T) {
+	var calls int
+	var gotSig, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		gotSig, gotBody = r.Header.Get("X-Gobank-Signature"), string(b)
+	}))
+	defer srv.Close()
+
+	store := NewMemoryStore()
+	wh := &Webhook{Owner: "alice", URL: srv.URL, Events: []string{EventAccountFrozen}, Secret: "s3cret"}
+	store.CreateWebhook(wh)
+	other := &Webhook{Owner: "bob", URL: srv.URL, Events: []string{EventAccountFrozen}, Secret: "x"}
+	store.CreateWebhook(other)
+
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store.SetAccountStatus(1, "", StatusFrozen, 0)
+
+	clock := &fakeClock{now: time.Now().UTC()}
+	d := NewWebhookDispatcher(store, clock)
+	d.client = srv.Client()
+	d.RunDue()
+
+	deliveries, _ := store.GetWebhookDeliveries(wh.ID)
+	if len(deliveries) != 1 || deliveries[0].Status != DeliveryPending || len(deliveries[0].Attempts) != 1 {
+		t.Fatalf("expected one pending delivery after a failed attempt, got %+v", deliveries)
+	}
+	if others, _ := store.GetWebhookDeliveries(other.ID); len(others) != 0 {
+		t.Fatalf("webhook for another owner received %d deliveries", len(others))
+	}
+
+	clock.now = deliveries[0].NextAttemptAt
+	d.RunDue()
+
+	deliveries, _ = store.GetWebhookDeliveries(wh.ID)
+	if deliveries[0].Status != DeliveryDelivered {
+		t.Fatalf("expected retry to deliver, got %s", deliveries[0].Status)
+	}
+	if want := signPayload("s3cret", clock.now.Unix(), []byte(gotBody)); gotSig != want {
+		t.Fatalf("expected signature %s, got %s", want, gotSig)
+	}
+}
+
+func TestWebhooksOnlyReachPublicAddresses(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::1":   true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"fe80::1":              false,
+		"fd00::1":              false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.216.34": true,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, public)
+		}
+	}
+
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		io.WriteString(w, "internal secrets")
+	}))
+	defer srv.Close()
+
+	store := NewMemoryStore()
+	wh := &Webhook{Owner: "alice", URL: srv.URL, Events: []string{EventAccountFrozen}}
+	store.CreateWebhook(wh)
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store.SetAccountStatus(1, "", StatusFrozen, 0)
+
+	NewWebhookDispatcher(store, &fakeClock{now: time.Now().UTC()}).RunDue()
+	deliveries, _ := store.GetWebhookDeliveries(wh.ID)
+	if called || len(deliveries[0].Attempts) != 1 || !strings.Contains(deliveries[0].Attempts[0].Error, "not public") {
+		t.Fatalf("delivered to a loopback address: %+v", deliveries[0].Attempts)
+	}
+
+	server := NewAPIServer("", store, NewAuditLog())
+	for _, url := range []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://[::1]/hook", "http://169.254.169.254/latest"} {
+		body := `{"url":"` + url + `","events":["account.frozen"]}`
+		if rec := customerRequest(t, server, *e2ePrincipals["alice"], "POST", "/webhooks", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("registered %s: %d %s", url, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSlowWebhookDoesNotHoldUpOthers(t *testing.T) {
+	fastCalled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-fastCalled:
+		case <-time.After(5 * time.Second):
+			t.Error("the fast webhook waited for the slow one")
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastCalled)
+	}))
+	defer fast.Close()
+
+	store := NewMemoryStore()
+	for _, url := range []string{slow.URL, fast.URL} {
+		store.CreateWebhook(&Webhook{Owner: "alice", URL: url, Events: []string{EventAccountFrozen}})
+	}
+	store.CreateAccount(&Account{ID: 1, Owner: "alice", Status: StatusActive})
+	store.SetAccountStatus(1, "", StatusFrozen, 0)
+
+	d := NewWebhookDispatcher(store, &fakeClock{now: time.Now().UTC()})
+	d.client = &http.Client{}
+	d.RunDue()
+	for id := 1; id <= 2; id++ {
+		if deliveries, _ := store.GetWebhookDeliveries(id); deliveries[0].Status != DeliveryDelivered {
+			t.Fatalf("webhook %d: %+v", id, deliveries[0])
+		}
+	}
+}